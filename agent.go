@@ -1,5 +1,7 @@
 package agent
 
+import "context"
+
 type Agent interface {
 	Answer(query string) (string, error)
 	SetOnReActInitCallback(callback func(string, []Action))
@@ -7,3 +9,29 @@ type Agent interface {
 	SetOnBeginStreamAnswerCallback(callback func())
 	SetOnStreamAnswerChunkCallback(callback func(string))
 }
+
+// An agent whose conversation history can be saved and later restored.
+type StatefulAgent interface {
+	Agent
+	// Get the tasks the agent has completed so far, oldest first.
+	History() []CompletedTask
+	// Replace the tasks the agent remembers, such as with a history that was saved earlier.
+	SetHistory([]CompletedTask)
+}
+
+// An agent whose answers can be cancelled.
+type ContextAgent interface {
+	Agent
+	// Answer the query, giving up as soon as possible once the context is cancelled.
+	// If the answer is cancelled, the error wraps the error of the context.
+	AnswerContext(ctx context.Context, query string) (string, error)
+}
+
+// Answer the query with the agent, cancelling the answer with the context if the agent is a ContextAgent.
+// Other agents cannot be cancelled, so the context is ignored.
+func AnswerWithContext(ctx context.Context, a Agent, query string) (string, error) {
+	if ca, ok := a.(ContextAgent); ok {
+		return ca.AnswerContext(ctx, query)
+	}
+	return a.Answer(query)
+}
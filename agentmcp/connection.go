@@ -0,0 +1,313 @@
+package agentmcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/JoshPattman/agent"
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// The progress of a running MCP tool call, as reported by the server.
+type ToolProgress struct {
+	ToolName string
+	Progress float64
+	// The total amount of progress that will be made, or 0 if unknown.
+	Total   float64
+	Message string
+}
+
+// The method of progress notifications, which mcp-go has no constant for.
+const methodNotificationProgress = "notifications/progress"
+
+type connectionParams struct {
+	healthCheckInterval time.Duration
+	minBackoff          time.Duration
+	maxBackoff          time.Duration
+	onProgress          func(ToolProgress)
+	onStatusChange      func(connected bool, err error)
+}
+
+type ConnectionOpt func(*connectionParams)
+
+// Set how often the server is pinged to check the connection is still alive (default 30s).
+// A zero interval disables health checks.
+func WithHealthCheckInterval(interval time.Duration) ConnectionOpt {
+	return func(cp *connectionParams) {
+		cp.healthCheckInterval = interval
+	}
+}
+
+// Set the delay before the first reconnect attempt, which doubles with each failed attempt up to max (default 1s to 1m).
+func WithReconnectBackoff(min, max time.Duration) ConnectionOpt {
+	return func(cp *connectionParams) {
+		cp.minBackoff = min
+		cp.maxBackoff = max
+	}
+}
+
+// Set a callback to receive progress notifications for tool calls.
+func WithProgressCallback(callback func(ToolProgress)) ConnectionOpt {
+	return func(cp *connectionParams) {
+		cp.onProgress = callback
+	}
+}
+
+// Set a callback which is called when the connection is lost (with the reason) or re-established.
+func WithStatusCallback(callback func(connected bool, err error)) ConnectionOpt {
+	return func(cp *connectionParams) {
+		cp.onStatusChange = callback
+	}
+}
+
+// A connection to an MCP server which reconnects when the connection is lost,
+// and keeps its tools up to date when the server reports that they have changed.
+// It implements agent.ToolProvider, so agents using it see the current tools of the server.
+type Connection struct {
+	connect func(opts ...ClientOpt) (*client.Client, error)
+	params  connectionParams
+	hooks   *toolHooks
+
+	lock         sync.RWMutex
+	client       *client.Client
+	lastErr      error
+	reconnecting bool
+	tools        []agent.Tool
+
+	progressLock   sync.Mutex
+	progressTokens map[string]string
+	nextToken      int
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Connect to an MCP server using the connect function, which must create and initialise a new client with the given options each time it is called
+// (such as a call to CreateClient or CreateStdioClient), so that the connection can handle notifications from the server as soon as it is initialised.
+// The same function is used to reconnect if the connection is lost.
+func NewConnection(connect func(opts ...ClientOpt) (*client.Client, error), opts ...ConnectionOpt) (*Connection, error) {
+	params := connectionParams{
+		healthCheckInterval: 30 * time.Second,
+		minBackoff:          time.Second,
+		maxBackoff:          time.Minute,
+	}
+	for _, o := range opts {
+		o(&params)
+	}
+	c := &Connection{
+		connect:        connect,
+		params:         params,
+		progressTokens: make(map[string]string),
+		closed:         make(chan struct{}),
+	}
+	c.hooks = &toolHooks{
+		getClient:     c.Client,
+		onCallFailed:  c.onCallFailed,
+		beginProgress: c.beginProgress,
+	}
+	cl, err := connect(withNotificationHandler(c.handleNotification))
+	if err != nil {
+		return nil, err
+	}
+	c.setClient(cl)
+	err = c.RefreshTools()
+	if err != nil {
+		cl.Close()
+		return nil, err
+	}
+	if params.healthCheckInterval > 0 {
+		go c.healthCheckLoop()
+	}
+	return c, nil
+}
+
+// Get the current client, or an error if the server is currently disconnected.
+func (c *Connection) Client() (*client.Client, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.client == nil {
+		return nil, fmt.Errorf("mcp server is disconnected, reconnecting (last error: %w)", c.lastErr)
+	}
+	return c.client, nil
+}
+
+// Tools implements agent.ToolProvider.
+func (c *Connection) Tools() []agent.Tool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	tools := make([]agent.Tool, len(c.tools))
+	copy(tools, c.tools)
+	return tools
+}
+
+// Create tools to list and read the server's resources and fetch its prompts, which keep working after a reconnect.
+// See CreateResourceAndPromptToolsFromMCP.
+func (c *Connection) ResourceAndPromptTools(prefix string) []agent.Tool {
+	cl, err := c.Client()
+	if err != nil {
+		return nil
+	}
+	return resourceAndPromptTools(cl.GetServerCapabilities(), c.Client, prefix)
+}
+
+// Fetch the list of tools from the server again.
+// This happens automatically when the server notifies that its tools have changed, and after reconnecting.
+func (c *Connection) RefreshTools() error {
+	tools, err := listTools(c.hooks)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.tools = tools
+	c.lock.Unlock()
+	return nil
+}
+
+// Close the connection, stopping any reconnect attempts.
+func (c *Connection) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.client != nil {
+			err = c.client.Close()
+			c.client = nil
+		}
+	})
+	return err
+}
+
+// Use the client, unless the connection has been closed, in which case the client must be closed by the caller.
+// The check is made under the lock so that Close cannot miss the client.
+func (c *Connection) setClient(cl *client.Client) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	c.client = cl
+	c.lastErr = nil
+	c.reconnecting = false
+	return true
+}
+
+func (c *Connection) handleNotification(notification mcp.JSONRPCNotification) {
+	switch notification.Method {
+	case mcp.MethodNotificationToolsListChanged:
+		// Notifications are handled on the transport's goroutine, so do not block it.
+		go c.RefreshTools()
+	case methodNotificationProgress:
+		if c.params.onProgress == nil {
+			return
+		}
+		fields := notification.Params.AdditionalFields
+		c.progressLock.Lock()
+		toolName, ok := c.progressTokens[fmt.Sprint(fields["progressToken"])]
+		c.progressLock.Unlock()
+		if !ok {
+			return
+		}
+		progress := ToolProgress{ToolName: toolName}
+		progress.Progress, _ = fields["progress"].(float64)
+		progress.Total, _ = fields["total"].(float64)
+		progress.Message, _ = fields["message"].(string)
+		c.params.onProgress(progress)
+	}
+}
+
+func (c *Connection) beginProgress(toolName string) (mcp.ProgressToken, func()) {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+	c.nextToken++
+	token := fmt.Sprintf("agent-%d", c.nextToken)
+	c.progressTokens[token] = toolName
+	return token, func() {
+		c.progressLock.Lock()
+		defer c.progressLock.Unlock()
+		delete(c.progressTokens, token)
+	}
+}
+
+// A call failing may be because the connection was lost, or just because the call was bad, so check with a ping.
+func (c *Connection) onCallFailed(error) {
+	go c.checkHealth()
+}
+
+func (c *Connection) healthCheckLoop() {
+	ticker := time.NewTicker(c.params.healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.checkHealth()
+		}
+	}
+}
+
+func (c *Connection) checkHealth() {
+	cl, err := c.Client()
+	if err != nil {
+		// Already disconnected, so a reconnect is in progress.
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = cl.Ping(ctx)
+	if err != nil {
+		c.disconnected(cl, err)
+	}
+}
+
+// Mark the client as broken and start reconnecting, unless this has already happened.
+func (c *Connection) disconnected(cl *client.Client, err error) {
+	c.lock.Lock()
+	if c.client != cl || c.reconnecting {
+		c.lock.Unlock()
+		return
+	}
+	c.client = nil
+	c.lastErr = err
+	c.reconnecting = true
+	c.lock.Unlock()
+	cl.Close()
+	if c.params.onStatusChange != nil {
+		c.params.onStatusChange(false, err)
+	}
+	go c.reconnectLoop()
+}
+
+func (c *Connection) reconnectLoop() {
+	backoff := c.params.minBackoff
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(backoff):
+		}
+		cl, err := c.connect(withNotificationHandler(c.handleNotification))
+		if err == nil {
+			if !c.setClient(cl) {
+				cl.Close()
+				return
+			}
+			err = c.RefreshTools()
+			if c.params.onStatusChange != nil {
+				c.params.onStatusChange(true, err)
+			}
+			return
+		}
+		c.lock.Lock()
+		c.lastErr = errors.Join(errors.New("failed to reconnect"), err)
+		c.lock.Unlock()
+		backoff = min(backoff*2, c.params.maxBackoff)
+	}
+}
@@ -4,11 +4,12 @@ go 1.23.1
 
 require (
 	github.com/JoshPattman/agent v0.0.2
-	github.com/mark3labs/mcp-go v0.41.1
+	github.com/JoshPattman/jpf v0.8.2
+	github.com/mark3labs/mcp-go v0.43.2
+	github.com/yosida95/uritemplate/v3 v3.0.2
 )
 
 require (
-	github.com/JoshPattman/jpf v0.8.2 // indirect
 	github.com/bahlo/generic-list-go v0.2.0 // indirect
 	github.com/buger/jsonparser v1.1.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
@@ -17,6 +18,5 @@ require (
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/spf13/cast v1.7.1 // indirect
 	github.com/wk8/go-ordered-map/v2 v2.1.8 // indirect
-	github.com/yosida95/uritemplate/v3 v3.0.2 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
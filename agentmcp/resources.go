@@ -0,0 +1,381 @@
+package agentmcp
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/JoshPattman/agent"
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// Create tools which allow an agent to list and read the resources of the MCP server, and to fetch its prompts.
+// Tools are only created for the features that the server advertises.
+// Each tool name is prefixed with the prefix (such as the server name), so that multiple servers can be used by one agent.
+func CreateResourceAndPromptToolsFromMCP(client *client.Client, prefix string) []agent.Tool {
+	return resourceAndPromptTools(client.GetServerCapabilities(), staticClient(client), prefix)
+}
+
+func resourceAndPromptTools(caps mcp.ServerCapabilities, getClient func() (*client.Client, error), prefix string) []agent.Tool {
+	tools := make([]agent.Tool, 0)
+	if caps.Resources != nil {
+		tools = append(tools, &listResourcesTool{getClient, prefix}, &readResourceTool{getClient, prefix})
+	}
+	if caps.Prompts != nil {
+		tools = append(tools, &listPromptsTool{getClient, prefix}, &getPromptTool{getClient, prefix})
+	}
+	return tools
+}
+
+// Read a resource from the MCP server, returning its text.
+// An error is returned if the resource has no text content.
+func ReadResourceText(client *client.Client, uri string) (string, error) {
+	res, err := client.ReadResource(context.Background(), mcp.ReadResourceRequest{
+		Params: mcp.ReadResourceParams{URI: uri},
+	})
+	if err != nil {
+		return "", err
+	}
+	texts := make([]string, 0)
+	for _, c := range res.Contents {
+		if c, ok := c.(mcp.TextResourceContents); ok {
+			texts = append(texts, c.Text)
+		}
+	}
+	if len(texts) == 0 {
+		return "", fmt.Errorf("resource '%s' has no text content", uri)
+	}
+	return strings.Join(texts, "\n\n"), nil
+}
+
+type listResourcesTool struct {
+	getClient func() (*client.Client, error)
+	prefix    string
+}
+
+// Name implements agent.Tool.
+func (t *listResourcesTool) Name() string {
+	return t.prefix + "_list_resources"
+}
+
+// Description implements agent.Tool.
+func (t *listResourcesTool) Description() []string {
+	return []string{
+		fmt.Sprintf("List the resources (such as files or documents) that can be read from the '%s' MCP server.", t.prefix),
+		"Also lists resource templates, which describe families of resources that are read by filling in the template variables.",
+		"Takes no arguments.",
+	}
+}
+
+// Call implements agent.Tool.
+func (t *listResourcesTool) Call(map[string]any) (string, error) {
+	client, err := t.getClient()
+	if err != nil {
+		return "", err
+	}
+	ctx := context.Background()
+	resources, err := listAllResources(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	// Templates are optional, so a server that cannot list them is treated as having none
+	templates, err := listAllResourceTemplates(ctx, client)
+	if err != nil {
+		templates = nil
+	}
+	lines := make([]string, 0)
+	if len(resources) == 0 {
+		lines = append(lines, "There are no resources.")
+	} else {
+		lines = append(lines, "Resources:")
+		for _, r := range resources {
+			lines = append(lines, fmt.Sprintf(" - `%s` %s", r.URI, describeNamed(r.Name, r.MIMEType, r.Description)))
+		}
+	}
+	if len(templates) > 0 {
+		lines = append(lines, "Resource templates:")
+		for _, r := range templates {
+			var raw string
+			if r.URITemplate != nil && r.URITemplate.Template != nil {
+				raw = r.URITemplate.Raw()
+			}
+			lines = append(lines, fmt.Sprintf(" - `%s` %s", raw, describeNamed(r.Name, r.MIMEType, r.Description)))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// List the resources on every page the server returns.
+func listAllResources(ctx context.Context, c *client.Client) ([]mcp.Resource, error) {
+	request := mcp.ListResourcesRequest{}
+	resources := make([]mcp.Resource, 0)
+	for {
+		page, err := c.ListResourcesByPage(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, page.Resources...)
+		if page.NextCursor == "" || page.NextCursor == request.Params.Cursor {
+			return resources, nil
+		}
+		request.Params.Cursor = page.NextCursor
+	}
+}
+
+// List the resource templates on every page the server returns.
+func listAllResourceTemplates(ctx context.Context, c *client.Client) ([]mcp.ResourceTemplate, error) {
+	request := mcp.ListResourceTemplatesRequest{}
+	templates := make([]mcp.ResourceTemplate, 0)
+	for {
+		page, err := c.ListResourceTemplatesByPage(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, page.ResourceTemplates...)
+		if page.NextCursor == "" || page.NextCursor == request.Params.Cursor {
+			return templates, nil
+		}
+		request.Params.Cursor = page.NextCursor
+	}
+}
+
+func describeNamed(name, mimeType, description string) string {
+	s := name
+	if mimeType != "" {
+		s += fmt.Sprintf(" (%s)", mimeType)
+	}
+	if description != "" {
+		s += ": " + description
+	}
+	return s
+}
+
+type readResourceTool struct {
+	getClient func() (*client.Client, error)
+	prefix    string
+}
+
+// Name implements agent.Tool.
+func (t *readResourceTool) Name() string {
+	return t.prefix + "_read_resource"
+}
+
+// Description implements agent.Tool.
+func (t *readResourceTool) Description() []string {
+	return []string{
+		fmt.Sprintf("Read a resource from the '%s' MCP server.", t.prefix),
+		"Either pass 'uri' (string), the uri of a listed resource,",
+		"or pass 'uri_template' (string), a listed resource template, and 'variables' (object of strings), the values of the template variables.",
+	}
+}
+
+// Call implements agent.Tool.
+func (t *readResourceTool) Call(args map[string]any) (string, error) {
+	res, err := t.CallRich(args)
+	if err != nil {
+		return "", err
+	}
+	return res.TextWithFallback(), nil
+}
+
+// CallRich implements agent.RichTool.
+func (t *readResourceTool) CallRich(args map[string]any) (agent.ToolResult, error) {
+	uri, err := resourceURIFromArgs(args)
+	if err != nil {
+		return agent.ToolResult{}, err
+	}
+	client, err := t.getClient()
+	if err != nil {
+		return agent.ToolResult{}, err
+	}
+	res, err := client.ReadResource(context.Background(), mcp.ReadResourceRequest{
+		Params: mcp.ReadResourceParams{URI: uri},
+	})
+	if err != nil {
+		return agent.ToolResult{}, err
+	}
+	var result agent.ToolResult
+	texts := make([]string, 0)
+	for _, c := range res.Contents {
+		switch c := c.(type) {
+		case mcp.TextResourceContents:
+			texts = append(texts, c.Text)
+		case mcp.BlobResourceContents:
+			if strings.HasPrefix(c.MIMEType, "image/") {
+				data, err := base64.StdEncoding.DecodeString(c.Blob)
+				if err != nil {
+					return agent.ToolResult{}, fmt.Errorf("resource contained an invalid image: %w", err)
+				}
+				result.Images = append(result.Images, agent.Image{MIMEType: c.MIMEType, Data: data})
+			} else {
+				result.Resources = append(result.Resources, agent.ResourceReference{
+					URI:         c.URI,
+					MIMEType:    c.MIMEType,
+					Description: "binary content that cannot be shown",
+				})
+			}
+		}
+	}
+	result.Text = strings.Join(texts, "\n\n")
+	return result, nil
+}
+
+func resourceURIFromArgs(args map[string]any) (string, error) {
+	if uriAny, ok := args["uri"]; ok {
+		uri, ok := uriAny.(string)
+		if !ok {
+			return "", errors.New("uri must be a string")
+		}
+		return uri, nil
+	}
+	tplAny, ok := args["uri_template"]
+	if !ok {
+		return "", errors.New("must specify either 'uri' or 'uri_template'")
+	}
+	tplRaw, ok := tplAny.(string)
+	if !ok {
+		return "", errors.New("uri_template must be a string")
+	}
+	tpl, err := uritemplate.New(tplRaw)
+	if err != nil {
+		return "", fmt.Errorf("invalid uri_template: %w", err)
+	}
+	vars := uritemplate.Values{}
+	if varsAny, ok := args["variables"]; ok {
+		varsMap, ok := varsAny.(map[string]any)
+		if !ok {
+			return "", errors.New("variables must be an object")
+		}
+		for k, v := range varsMap {
+			vars.Set(k, uritemplate.String(fmt.Sprint(v)))
+		}
+	}
+	return tpl.Expand(vars)
+}
+
+type listPromptsTool struct {
+	getClient func() (*client.Client, error)
+	prefix    string
+}
+
+// Name implements agent.Tool.
+func (t *listPromptsTool) Name() string {
+	return t.prefix + "_list_prompts"
+}
+
+// Description implements agent.Tool.
+func (t *listPromptsTool) Description() []string {
+	return []string{
+		fmt.Sprintf("List the prompts (reusable instructions or templates) provided by the '%s' MCP server.", t.prefix),
+		"Takes no arguments.",
+	}
+}
+
+// Call implements agent.Tool.
+func (t *listPromptsTool) Call(map[string]any) (string, error) {
+	client, err := t.getClient()
+	if err != nil {
+		return "", err
+	}
+	res, err := client.ListPrompts(context.Background(), mcp.ListPromptsRequest{})
+	if err != nil {
+		return "", err
+	}
+	if len(res.Prompts) == 0 {
+		return "There are no prompts.", nil
+	}
+	lines := []string{"Prompts:"}
+	for _, p := range res.Prompts {
+		lines = append(lines, fmt.Sprintf(" - `%s` %s", p.Name, p.Description))
+		for _, a := range p.Arguments {
+			var required string
+			if a.Required {
+				required = " [required]"
+			}
+			lines = append(lines, fmt.Sprintf("   - Argument%s `%s`: %s", required, a.Name, a.Description))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+type getPromptTool struct {
+	getClient func() (*client.Client, error)
+	prefix    string
+}
+
+// Name implements agent.Tool.
+func (t *getPromptTool) Name() string {
+	return t.prefix + "_get_prompt"
+}
+
+// Description implements agent.Tool.
+func (t *getPromptTool) Description() []string {
+	return []string{
+		fmt.Sprintf("Fetch a prompt from the '%s' MCP server.", t.prefix),
+		"Pass 'name' (string), the name of a listed prompt, and 'arguments' (object of strings) if the prompt takes any.",
+	}
+}
+
+// Call implements agent.Tool.
+func (t *getPromptTool) Call(args map[string]any) (string, error) {
+	res, err := t.CallRich(args)
+	if err != nil {
+		return "", err
+	}
+	return res.TextWithFallback(), nil
+}
+
+// CallRich implements agent.RichTool.
+func (t *getPromptTool) CallRich(args map[string]any) (agent.ToolResult, error) {
+	nameAny, ok := args["name"]
+	if !ok {
+		return agent.ToolResult{}, errors.New("missing required argument: name")
+	}
+	name, ok := nameAny.(string)
+	if !ok {
+		return agent.ToolResult{}, errors.New("name must be a string")
+	}
+	promptArgs := make(map[string]string)
+	if argsAny, ok := args["arguments"]; ok {
+		argsMap, ok := argsAny.(map[string]any)
+		if !ok {
+			return agent.ToolResult{}, errors.New("arguments must be an object")
+		}
+		for k, v := range argsMap {
+			promptArgs[k] = fmt.Sprint(v)
+		}
+	}
+	client, err := t.getClient()
+	if err != nil {
+		return agent.ToolResult{}, err
+	}
+	res, err := client.GetPrompt(context.Background(), mcp.GetPromptRequest{
+		Params: mcp.GetPromptParams{
+			Name:      name,
+			Arguments: promptArgs,
+		},
+	})
+	if err != nil {
+		return agent.ToolResult{}, err
+	}
+	var result agent.ToolResult
+	texts := make([]string, 0)
+	if res.Description != "" {
+		texts = append(texts, res.Description)
+	}
+	for _, msg := range res.Messages {
+		converted, err := convertContent([]mcp.Content{msg.Content})
+		if err != nil {
+			return agent.ToolResult{}, err
+		}
+		texts = append(texts, fmt.Sprintf("%s:\n%s", msg.Role, converted.Text))
+		result.Images = append(result.Images, converted.Images...)
+		result.Resources = append(result.Resources, converted.Resources...)
+	}
+	result.Text = strings.Join(texts, "\n\n")
+	return result, nil
+}
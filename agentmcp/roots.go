@@ -0,0 +1,29 @@
+package agentmcp
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// Lists a fixed set of directories as the roots of the client.
+type rootsHandler []string
+
+// ListRoots implements client.RootsHandler.
+func (r rootsHandler) ListRoots(context.Context, mcp.ListRootsRequest) (*mcp.ListRootsResult, error) {
+	roots := make([]mcp.Root, 0, len(r))
+	for _, dir := range r {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		u := url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}
+		roots = append(roots, mcp.Root{
+			URI:  u.String(),
+			Name: filepath.Base(abs),
+		})
+	}
+	return &mcp.ListRootsResult{Roots: roots}, nil
+}
@@ -0,0 +1,221 @@
+package agentmcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"slices"
+	"strings"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/jpf"
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// A request from an MCP server for the client to generate a message with an LLM.
+type SamplingRequest struct {
+	// The name of the model that was chosen to respond.
+	ModelName    string
+	SystemPrompt string
+	Messages     []jpf.Message
+	// The maximum number of tokens the server asked for. This is advisory, as models are not limited by it.
+	MaxTokens int
+}
+
+// Describes how a model compares to the others a sampler may choose from, so that the priorities of servers can be respected.
+// Each value is between 0 and 1, relative to the other models: a cost of 1 is the most expensive model, a speed of 1 the fastest,
+// and an intelligence of 1 the most capable. Models without traits are treated as 0.5 for all of them.
+type ModelTraits struct {
+	Cost         float64
+	Speed        float64
+	Intelligence float64
+}
+
+var defaultModelTraits = ModelTraits{Cost: 0.5, Speed: 0.5, Intelligence: 0.5}
+
+type samplerParams struct {
+	models       map[string]agent.AgentModelBuilder
+	traits       map[string]ModelTraits
+	usageCounter *jpf.UsageCounter
+	approve      func(SamplingRequest) error
+}
+
+type SamplerOpt func(*samplerParams)
+
+// Add a model that servers may choose with a model hint, or by their priorities (see WithSamplingModelTraits).
+// A hint matches a model if the hint is contained in the model name.
+func WithSamplingModel(name string, builder agent.AgentModelBuilder) SamplerOpt {
+	return func(sp *samplerParams) {
+		sp.models[name] = builder
+	}
+}
+
+// Set the traits of a model, which are used to pick between models when a server gives priorities rather than a matching hint.
+func WithSamplingModelTraits(name string, traits ModelTraits) SamplerOpt {
+	return func(sp *samplerParams) {
+		sp.traits[name] = traits
+	}
+}
+
+// Count the tokens used to respond to sampling requests.
+func WithSamplingUsageCounter(counter *jpf.UsageCounter) SamplerOpt {
+	return func(sp *samplerParams) {
+		sp.usageCounter = counter
+	}
+}
+
+// Set a function which is called before each sampling request is sent to a model.
+// Returning an error rejects the request, and the error is returned to the server.
+// Without this, all requests are approved.
+func WithSamplingApproval(approve func(SamplingRequest) error) SamplerOpt {
+	return func(sp *samplerParams) {
+		sp.approve = approve
+	}
+}
+
+// Responds to sampling requests from MCP servers using agent model builders, allowing servers to use the agent's LLM.
+// Pass it to a client with WithSampler.
+type Sampler struct {
+	defaultModel string
+	params       samplerParams
+}
+
+// Create a sampler which responds with the default model unless the server hints at one of the other models.
+func NewSampler(defaultName string, defaultModel agent.AgentModelBuilder, opts ...SamplerOpt) *Sampler {
+	params := samplerParams{
+		models: map[string]agent.AgentModelBuilder{defaultName: defaultModel},
+		traits: make(map[string]ModelTraits),
+	}
+	for _, o := range opts {
+		o(&params)
+	}
+	return &Sampler{
+		defaultModel: defaultName,
+		params:       params,
+	}
+}
+
+// CreateMessage implements client.SamplingHandler.
+func (s *Sampler) CreateMessage(ctx context.Context, request mcp.CreateMessageRequest) (*mcp.CreateMessageResult, error) {
+	modelName := s.chooseModel(request.ModelPreferences)
+	builder := s.params.models[modelName]
+	messages, err := convertSamplingMessages(request.Messages, agent.ModelBuilderSupportsImages(builder))
+	if err != nil {
+		return nil, err
+	}
+	if s.params.approve != nil {
+		err := s.params.approve(SamplingRequest{
+			ModelName:    modelName,
+			SystemPrompt: request.SystemPrompt,
+			Messages:     messages,
+			MaxTokens:    request.MaxTokens,
+		})
+		if err != nil {
+			return nil, errors.Join(errors.New("sampling request was rejected"), err)
+		}
+	}
+	if request.SystemPrompt != "" {
+		messages = append([]jpf.Message{{Role: jpf.SystemRole, Content: request.SystemPrompt}}, messages...)
+	}
+	model := builder.BuildAgentModel(nil, nil, nil)
+	if s.params.usageCounter != nil {
+		model = jpf.NewUsageCountingModel(model, s.params.usageCounter)
+	}
+	resp, err := model.Respond(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
+	return &mcp.CreateMessageResult{
+		SamplingMessage: mcp.SamplingMessage{
+			Role:    mcp.RoleAssistant,
+			Content: mcp.NewTextContent(resp.PrimaryMessage.Content),
+		},
+		Model:      modelName,
+		StopReason: "endTurn",
+	}, nil
+}
+
+// Pick the first model matching the hints in order.
+// If no hint matches, pick the model that best fits the cost, speed and intelligence priorities, preferring the default on a tie.
+func (s *Sampler) chooseModel(prefs *mcp.ModelPreferences) string {
+	if prefs == nil {
+		return s.defaultModel
+	}
+	names := make([]string, 0, len(s.params.models))
+	for name := range s.params.models {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, hint := range prefs.Hints {
+		if hint.Name == "" {
+			continue
+		}
+		for _, name := range names {
+			if strings.Contains(name, hint.Name) {
+				return name
+			}
+		}
+	}
+	if prefs.CostPriority == 0 && prefs.SpeedPriority == 0 && prefs.IntelligencePriority == 0 {
+		return s.defaultModel
+	}
+	best, bestScore := s.defaultModel, s.priorityScore(s.defaultModel, prefs)
+	for _, name := range names {
+		if score := s.priorityScore(name, prefs); score > bestScore {
+			best, bestScore = name, score
+		}
+	}
+	return best
+}
+
+// Score how well the model fits the priorities of the server, where higher is better.
+// A high cost priority favours cheap models.
+func (s *Sampler) priorityScore(name string, prefs *mcp.ModelPreferences) float64 {
+	traits, ok := s.params.traits[name]
+	if !ok {
+		traits = defaultModelTraits
+	}
+	return prefs.CostPriority*(1-traits.Cost) +
+		prefs.SpeedPriority*traits.Speed +
+		prefs.IntelligencePriority*traits.Intelligence
+}
+
+func convertSamplingMessages(msgs []mcp.SamplingMessage, imagesSupported bool) ([]jpf.Message, error) {
+	messages := make([]jpf.Message, len(msgs))
+	for i, msg := range msgs {
+		role := jpf.UserRole
+		if msg.Role == mcp.RoleAssistant {
+			role = jpf.AssistantRole
+		}
+		messages[i] = jpf.Message{Role: role}
+		switch c := msg.Content.(type) {
+		case mcp.TextContent:
+			messages[i].Content = c.Text
+		case mcp.ImageContent:
+			data, err := base64.StdEncoding.DecodeString(c.Data)
+			if err != nil {
+				return nil, fmt.Errorf("message %d contained an invalid image: %w", i, err)
+			}
+			if !imagesSupported {
+				messages[i].Content = agent.DescribeImage(agent.Image{MIMEType: c.MIMEType, Data: data})
+				continue
+			}
+			decoded, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("message %d contained an image that could not be decoded: %w", i, err)
+			}
+			messages[i].Images = []jpf.ImageAttachment{{Source: decoded}}
+		case mcp.AudioContent:
+			messages[i].Content = fmt.Sprintf("[audio: %s, cannot be shown]", c.MIMEType)
+		default:
+			return nil, fmt.Errorf("message %d has unsupported content", i)
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,42 @@
+package agentmcp
+
+import (
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func TestSamplerChooseModel(t *testing.T) {
+	sampler := NewSampler(
+		"medium", nil,
+		WithSamplingModel("small-fast", nil),
+		WithSamplingModel("large-smart", nil),
+		WithSamplingModel("unrated", nil),
+		WithSamplingModelTraits("medium", ModelTraits{Cost: 0.5, Speed: 0.5, Intelligence: 0.6}),
+		WithSamplingModelTraits("small-fast", ModelTraits{Cost: 0.1, Speed: 0.9, Intelligence: 0.3}),
+		WithSamplingModelTraits("large-smart", ModelTraits{Cost: 0.9, Speed: 0.2, Intelligence: 1}),
+	)
+	tests := []struct {
+		name  string
+		prefs *mcp.ModelPreferences
+		want  string
+	}{
+		{"no preferences", nil, "medium"},
+		{"no hints or priorities", &mcp.ModelPreferences{}, "medium"},
+		{"hint matches", &mcp.ModelPreferences{Hints: []mcp.ModelHint{{Name: "smart"}}}, "large-smart"},
+		{"first matching hint wins", &mcp.ModelPreferences{Hints: []mcp.ModelHint{{Name: "missing"}, {Name: "fast"}}}, "small-fast"},
+		{"hint beats priorities", &mcp.ModelPreferences{Hints: []mcp.ModelHint{{Name: "fast"}}, IntelligencePriority: 1}, "small-fast"},
+		{"cost priority", &mcp.ModelPreferences{CostPriority: 1}, "small-fast"},
+		{"speed priority", &mcp.ModelPreferences{SpeedPriority: 1}, "small-fast"},
+		{"intelligence priority", &mcp.ModelPreferences{IntelligencePriority: 1}, "large-smart"},
+		{"unmatched hint falls back to priorities", &mcp.ModelPreferences{Hints: []mcp.ModelHint{{Name: "missing"}}, IntelligencePriority: 0.8, CostPriority: 0.2}, "large-smart"},
+		{"balanced priorities", &mcp.ModelPreferences{CostPriority: 0.5, SpeedPriority: 0.5, IntelligencePriority: 0.5}, "small-fast"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sampler.chooseModel(tt.prefs); got != tt.want {
+				t.Errorf("chose %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
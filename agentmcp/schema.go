@@ -0,0 +1,224 @@
+package agentmcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// The deepest level of nested objects and arrays that will be described, to guard against recursive schemas.
+const maxSchemaDepth = 6
+
+// Describe the input schema of an MCP tool as one line per parameter.
+// Nested object properties are described with dotted names (`a.b`), and the items of arrays with `[]` (`a[].b`).
+// Properties are ordered with required ones first, then by name, so the description is stable between calls.
+// Any part of the schema that is missing or malformed is skipped rather than failing.
+func describeToolInputSchema(tool mcp.Tool) []string {
+	schema, ok := toolInputSchemaMap(tool)
+	if !ok {
+		return nil
+	}
+	r := &schemaRenderer{defs: schemaDefinitions(schema)}
+	r.describeProperties("", schema, 0)
+	return r.lines
+}
+
+// Get the input schema of the tool as a generic JSON object, whether it was provided as a raw or structured schema.
+func toolInputSchemaMap(tool mcp.Tool) (map[string]any, bool) {
+	bs, err := json.Marshal(tool)
+	if err != nil {
+		return nil, false
+	}
+	var parsed struct {
+		InputSchema map[string]any `json:"inputSchema"`
+	}
+	if err := json.Unmarshal(bs, &parsed); err != nil || parsed.InputSchema == nil {
+		return nil, false
+	}
+	return parsed.InputSchema, true
+}
+
+// Collect the shared definitions of the schema, so that $ref can be resolved.
+func schemaDefinitions(schema map[string]any) map[string]any {
+	defs := make(map[string]any)
+	for _, key := range []string{"definitions", "$defs"} {
+		if d, ok := schema[key].(map[string]any); ok {
+			for name, def := range d {
+				defs[fmt.Sprintf("#/%s/%s", key, name)] = def
+			}
+		}
+	}
+	return defs
+}
+
+type schemaRenderer struct {
+	defs  map[string]any
+	lines []string
+}
+
+// Add a line for each property of the object schema, recursing into nested objects and arrays.
+func (r *schemaRenderer) describeProperties(prefix string, schema map[string]any, depth int) {
+	if depth > maxSchemaDepth {
+		return
+	}
+	schema = r.resolve(schema, 0)
+	props, _ := schema["properties"].(map[string]any)
+	required := make(map[string]bool)
+	if reqList, ok := schema["required"].([]any); ok {
+		for _, req := range reqList {
+			if req, ok := req.(string); ok {
+				required[req] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		if required[a] != required[b] {
+			if required[a] {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	for _, name := range names {
+		prop, ok := props[name].(map[string]any)
+		if !ok {
+			// A schema of `true` or similar allows anything.
+			prop = map[string]any{}
+		}
+		prop = r.resolve(prop, 0)
+		fullName := prefix + name
+		var req string
+		if required[name] {
+			req = " [required]"
+		}
+		line := fmt.Sprintf("Param%s `%s` (%s)", req, fullName, r.describeType(prop, 0))
+		if extra := describeConstraints(prop); extra != "" {
+			line += " " + extra
+		}
+		if desc, ok := prop["description"].(string); ok && desc != "" {
+			line += ": " + desc
+		}
+		r.lines = append(r.lines, line)
+		r.describeChildren(fullName, prop, depth+1)
+	}
+}
+
+// Describe the properties of any objects within the schema, including within arrays and unions.
+func (r *schemaRenderer) describeChildren(name string, schema map[string]any, depth int) {
+	if _, ok := schema["properties"].(map[string]any); ok {
+		r.describeProperties(name+".", schema, depth)
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		r.describeChildren(name+"[]", r.resolve(items, 0), depth)
+	}
+	for _, key := range []string{"anyOf", "oneOf", "allOf"} {
+		if options, ok := schema[key].([]any); ok {
+			for _, option := range options {
+				if option, ok := option.(map[string]any); ok {
+					r.describeChildren(name, r.resolve(option, 0), depth)
+				}
+			}
+		}
+	}
+}
+
+// Describe the type of the schema in a short, human-readable way, such as `array of string` or `string | null`.
+func (r *schemaRenderer) describeType(schema map[string]any, depth int) string {
+	if depth > maxSchemaDepth {
+		return "any"
+	}
+	schema = r.resolve(schema, 0)
+	if enum, ok := schema["enum"].([]any); ok && len(enum) > 0 {
+		values := make([]string, len(enum))
+		for i, v := range enum {
+			values[i] = formatSchemaValue(v)
+		}
+		return "one of " + strings.Join(values, ", ")
+	}
+	if c, ok := schema["const"]; ok {
+		return "must be " + formatSchemaValue(c)
+	}
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if options, ok := schema[key].([]any); ok && len(options) > 0 {
+			types := make([]string, 0, len(options))
+			for _, option := range options {
+				if option, ok := option.(map[string]any); ok {
+					types = append(types, r.describeType(option, depth+1))
+				}
+			}
+			return strings.Join(types, " | ")
+		}
+	}
+	var types []string
+	switch t := schema["type"].(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, tt := range t {
+			if tt, ok := tt.(string); ok {
+				types = append(types, tt)
+			}
+		}
+	}
+	if len(types) == 0 {
+		if _, ok := schema["properties"]; ok {
+			types = []string{"object"}
+		} else if _, ok := schema["items"]; ok {
+			types = []string{"array"}
+		} else {
+			return "any"
+		}
+	}
+	for i, t := range types {
+		if t == "array" {
+			if items, ok := schema["items"].(map[string]any); ok {
+				types[i] = "array of " + r.describeType(items, depth+1)
+			}
+		}
+	}
+	return strings.Join(types, " | ")
+}
+
+// Describe the default value and format of the schema, if it has them.
+func describeConstraints(schema map[string]any) string {
+	parts := make([]string, 0)
+	if format, ok := schema["format"].(string); ok && format != "" {
+		parts = append(parts, "format: "+format)
+	}
+	if def, ok := schema["default"]; ok {
+		parts = append(parts, "default: "+formatSchemaValue(def))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// Follow $ref to a shared definition, if the schema is a reference.
+func (r *schemaRenderer) resolve(schema map[string]any, depth int) map[string]any {
+	ref, ok := schema["$ref"].(string)
+	if !ok || depth > maxSchemaDepth {
+		return schema
+	}
+	def, ok := r.defs[ref].(map[string]any)
+	if !ok {
+		return schema
+	}
+	return r.resolve(def, depth+1)
+}
+
+func formatSchemaValue(v any) string {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(bs)
+}
@@ -0,0 +1,199 @@
+package agentmcp
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func TestDescribeToolInputSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   []string
+	}{
+		{
+			name:   "no properties",
+			schema: `{"type": "object"}`,
+			want:   nil,
+		},
+		{
+			name: "required first then by name",
+			schema: `{
+				"type": "object",
+				"properties": {
+					"b": {"type": "string", "description": "Second"},
+					"a": {"type": "integer"},
+					"c": {"type": "boolean", "default": false}
+				},
+				"required": ["c"]
+			}`,
+			want: []string{
+				"Param [required] `c` (boolean) [default: false]",
+				"Param `a` (integer)",
+				"Param `b` (string): Second",
+			},
+		},
+		{
+			name: "nested objects",
+			schema: `{
+				"type": "object",
+				"properties": {
+					"options": {
+						"type": "object",
+						"properties": {
+							"depth": {"type": "integer"},
+							"path": {"type": "string", "format": "uri"}
+						},
+						"required": ["path"]
+					}
+				}
+			}`,
+			want: []string{
+				"Param `options` (object)",
+				"Param [required] `options.path` (string) [format: uri]",
+				"Param `options.depth` (integer)",
+			},
+		},
+		{
+			name: "arrays of scalars and objects",
+			schema: `{
+				"type": "object",
+				"properties": {
+					"tags": {"type": "array", "items": {"type": "string"}},
+					"edits": {
+						"type": "array",
+						"items": {
+							"type": "object",
+							"properties": {"old": {"type": "string"}, "new": {"type": "string"}},
+							"required": ["old", "new"]
+						}
+					}
+				}
+			}`,
+			want: []string{
+				"Param `edits` (array of object)",
+				"Param [required] `edits[].new` (string)",
+				"Param [required] `edits[].old` (string)",
+				"Param `tags` (array of string)",
+			},
+		},
+		{
+			name: "enums and consts",
+			schema: `{
+				"type": "object",
+				"properties": {
+					"mode": {"type": "string", "enum": ["fast", "slow"]},
+					"version": {"const": 2}
+				}
+			}`,
+			want: []string{
+				"Param `mode` (one of \"fast\", \"slow\")",
+				"Param `version` (must be 2)",
+			},
+		},
+		{
+			name: "refs to definitions",
+			schema: `{
+				"type": "object",
+				"properties": {
+					"point": {"$ref": "#/$defs/point"},
+					"colour": {"$ref": "#/definitions/colour"}
+				},
+				"$defs": {
+					"point": {
+						"type": "object",
+						"properties": {"x": {"type": "number"}, "y": {"type": "number"}},
+						"required": ["x", "y"]
+					}
+				},
+				"definitions": {
+					"colour": {"enum": ["red", "green"]}
+				}
+			}`,
+			want: []string{
+				"Param `colour` (one of \"red\", \"green\")",
+				"Param `point` (object)",
+				"Param [required] `point.x` (number)",
+				"Param [required] `point.y` (number)",
+			},
+		},
+		{
+			name: "unresolvable ref falls back to any",
+			schema: `{
+				"type": "object",
+				"properties": {"thing": {"$ref": "#/$defs/missing"}}
+			}`,
+			want: []string{
+				"Param `thing` (any)",
+			},
+		},
+		{
+			name: "anyOf unions with objects",
+			schema: `{
+				"type": "object",
+				"properties": {
+					"limit": {"anyOf": [{"type": "integer"}, {"type": "null"}]},
+					"target": {
+						"oneOf": [
+							{"type": "string"},
+							{"type": "object", "properties": {"id": {"type": "string"}}}
+						]
+					}
+				}
+			}`,
+			want: []string{
+				"Param `limit` (integer | null)",
+				"Param `target` (string | object)",
+				"Param `target.id` (string)",
+			},
+		},
+		{
+			name: "type lists and untyped properties",
+			schema: `{
+				"type": "object",
+				"properties": {
+					"value": {"type": ["string", "null"]},
+					"anything": true
+				}
+			}`,
+			want: []string{
+				"Param `anything` (any)",
+				"Param `value` (string | null)",
+			},
+		},
+		{
+			name: "recursive schema is cut off",
+			schema: `{
+				"type": "object",
+				"properties": {"node": {"$ref": "#/$defs/node"}},
+				"$defs": {
+					"node": {
+						"type": "object",
+						"properties": {"child": {"$ref": "#/$defs/node"}}
+					}
+				}
+			}`,
+			want: []string{
+				"Param `node` (object)",
+				"Param `node.child` (object)",
+				"Param `node.child.child` (object)",
+				"Param `node.child.child.child` (object)",
+				"Param `node.child.child.child.child` (object)",
+				"Param `node.child.child.child.child.child` (object)",
+				"Param `node.child.child.child.child.child.child` (object)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tool := mcp.NewToolWithRawSchema("test", "", json.RawMessage(tt.schema))
+			got := describeToolInputSchema(tool)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
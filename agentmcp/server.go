@@ -0,0 +1,245 @@
+package agentmcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoshPattman/agent"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+type serverParams struct {
+	serverName       string
+	serverVersion    string
+	tools            []agent.Tool
+	maxConversations int
+	idleTimeout      time.Duration
+}
+
+type ServerOpt func(*serverParams)
+
+// Also expose the tools as MCP tools, so clients can call them directly instead of via the agent.
+func WithExposedTools(tools ...agent.Tool) ServerOpt {
+	return func(sp *serverParams) {
+		sp.tools = append(sp.tools, tools...)
+	}
+}
+
+// Set the name and version that the server reports to clients.
+func WithServerInfo(name, version string) ServerOpt {
+	return func(sp *serverParams) {
+		sp.serverName = name
+		sp.serverVersion = version
+	}
+}
+
+// Keep at most max conversations, forgetting the least recently used conversation to start a new one (default 1000).
+func WithMaxConversations(max int) ServerOpt {
+	return func(sp *serverParams) {
+		sp.maxConversations = max
+	}
+}
+
+// Forget conversations that have not been continued for the timeout (default one hour).
+func WithConversationIdleTimeout(timeout time.Duration) ServerOpt {
+	return func(sp *serverParams) {
+		sp.idleTimeout = timeout
+	}
+}
+
+// Create an MCP server which exposes agents built by buildAgent as a tool with the given name.
+// Calling the tool without a conversation ID starts a new conversation with a fresh agent,
+// and the returned conversation ID can be passed to later calls to continue that conversation.
+func NewAgentServer(buildAgent func() agent.Agent, name string, description []string, opts ...ServerOpt) *server.MCPServer {
+	params := &serverParams{
+		serverName:       "MCP-Agent",
+		serverVersion:    "1.0.0",
+		maxConversations: 1000,
+		idleTimeout:      time.Hour,
+	}
+	for _, o := range opts {
+		o(params)
+	}
+	s := server.NewMCPServer(
+		params.serverName,
+		params.serverVersion,
+		server.WithToolCapabilities(false),
+		server.WithRecovery(),
+	)
+	conversations := &agentConversations{
+		buildAgent:       buildAgent,
+		maxConversations: params.maxConversations,
+		idleTimeout:      params.idleTimeout,
+		agents:           make(map[string]*lockedAgent),
+	}
+	s.AddTool(
+		mcp.NewTool(
+			name,
+			mcp.WithDescription(strings.Join(append(
+				description,
+				"Continue an earlier conversation by passing the conversation_id returned by a previous call.",
+			), "\n")),
+			mcp.WithString("query", mcp.Required(), mcp.Description("The message to send to the agent.")),
+			mcp.WithString("conversation_id", mcp.Description("The conversation to continue. Leave empty to start a new conversation.")),
+		),
+		conversations.handle,
+	)
+	for _, tool := range params.tools {
+		s.AddTool(
+			mcp.NewToolWithRawSchema(
+				tool.Name(),
+				strings.Join(tool.Description(), "\n"),
+				json.RawMessage(`{"type":"object","additionalProperties":true}`),
+			),
+			toolHandler(tool),
+		)
+	}
+	return s
+}
+
+// Serve the MCP server over stdio, until stdin is closed.
+func ServeStdio(s *server.MCPServer) error {
+	return server.ServeStdio(s)
+}
+
+// Serve the MCP server over streamable HTTP at the address (such as ":8080"), on the /mcp path.
+func ServeHTTP(s *server.MCPServer, addr string) error {
+	return server.NewStreamableHTTPServer(s).Start(addr)
+}
+
+// An agent that may only answer one query at a time.
+type lockedAgent struct {
+	lock  sync.Mutex
+	agent agent.Agent
+	// When the conversation was last continued, which is guarded by the lock of the conversations.
+	lastUsed time.Time
+}
+
+// The conversations of an agent server, which are forgotten once idle for too long or to make room for new ones.
+type agentConversations struct {
+	buildAgent       func() agent.Agent
+	maxConversations int
+	idleTimeout      time.Duration
+	lock             sync.Mutex
+	agents           map[string]*lockedAgent
+}
+
+func (c *agentConversations) handle(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	query, err := request.RequireString("query")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	conversationID := request.GetString("conversation_id", "")
+	la, err := c.get(conversationID)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	la.lock.Lock()
+	defer la.lock.Unlock()
+	answer, err := agent.AnswerWithContext(ctx, la.agent, query)
+	if err != nil {
+		return mcp.NewToolResultErrorFromErr("agent failed to answer", err), nil
+	}
+	// A new conversation is only kept once it has been answered, so failed calls do not leave conversations behind
+	if conversationID == "" {
+		conversationID = c.add(la)
+	} else {
+		c.touch(la)
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("%s\n\n(conversation_id: %s)", answer, conversationID)), nil
+}
+
+// Get the agent for the conversation, or a fresh agent for a new conversation if the ID is empty.
+func (c *agentConversations) get(conversationID string) (*lockedAgent, error) {
+	if conversationID == "" {
+		return &lockedAgent{agent: c.buildAgent()}, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.forgetIdle()
+	la, ok := c.agents[conversationID]
+	if !ok {
+		return nil, fmt.Errorf("no conversation found with conversation_id '%s'", conversationID)
+	}
+	la.lastUsed = time.Now()
+	return la, nil
+}
+
+// Keep the conversation of the agent so it can be continued, returning its ID.
+func (c *agentConversations) add(la *lockedAgent) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.forgetIdle()
+	for len(c.agents) > 0 && len(c.agents) >= c.maxConversations {
+		c.forgetLeastRecentlyUsed()
+	}
+	conversationID := newConversationID()
+	la.lastUsed = time.Now()
+	c.agents[conversationID] = la
+	return conversationID
+}
+
+func (c *agentConversations) touch(la *lockedAgent) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	la.lastUsed = time.Now()
+}
+
+// Forget the conversations that have been idle for longer than the timeout.
+// Must be called with the lock held.
+func (c *agentConversations) forgetIdle() {
+	if c.idleTimeout <= 0 {
+		return
+	}
+	for id, la := range c.agents {
+		if time.Since(la.lastUsed) > c.idleTimeout {
+			delete(c.agents, id)
+		}
+	}
+}
+
+// Must be called with the lock held.
+func (c *agentConversations) forgetLeastRecentlyUsed() {
+	oldestID := ""
+	var oldest time.Time
+	for id, la := range c.agents {
+		if oldestID == "" || la.lastUsed.Before(oldest) {
+			oldestID, oldest = id, la.lastUsed
+		}
+	}
+	delete(c.agents, oldestID)
+}
+
+func newConversationID() string {
+	bs := make([]byte, 8)
+	rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+func toolHandler(tool agent.Tool) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := agent.CallTool(tool, request.GetArguments())
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		content := make([]mcp.Content, 0)
+		if result.Text != "" {
+			content = append(content, mcp.NewTextContent(result.Text))
+		}
+		for _, img := range result.Images {
+			content = append(content, mcp.NewImageContent(base64.StdEncoding.EncodeToString(img.Data), img.MIMEType))
+		}
+		for _, res := range result.Resources {
+			content = append(content, mcp.NewResourceLink(res.URI, res.Name, res.Description, res.MIMEType))
+		}
+		return &mcp.CallToolResult{Content: content}, nil
+	}
+}
@@ -0,0 +1,117 @@
+package agentmcp
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/JoshPattman/agent"
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+type fakeAgent struct {
+	err error
+}
+
+func (a *fakeAgent) Answer(query string) (string, error) {
+	if a.err != nil {
+		return "", a.err
+	}
+	return "answer to " + query, nil
+}
+
+func (a *fakeAgent) SetOnReActInitCallback(func(string, []agent.Action))                {}
+func (a *fakeAgent) SetOnReActCompleteCallback(func(string, []agent.ActionObservation)) {}
+func (a *fakeAgent) SetOnBeginStreamAnswerCallback(func())                              {}
+func (a *fakeAgent) SetOnStreamAnswerChunkCallback(func(string))                        {}
+
+var conversationIDPattern = regexp.MustCompile(`conversation_id: (\w+)`)
+
+func callConversation(t *testing.T, c *agentConversations, query, conversationID string) (string, bool) {
+	t.Helper()
+	request := mcp.CallToolRequest{}
+	request.Params.Arguments = map[string]any{"query": query, "conversation_id": conversationID}
+	result, err := c.handle(context.Background(), request)
+	if err != nil {
+		t.Fatalf("handle returned an error: %v", err)
+	}
+	if result.IsError {
+		return "", false
+	}
+	match := conversationIDPattern.FindStringSubmatch(result.Content[0].(mcp.TextContent).Text)
+	if match == nil {
+		t.Fatalf("result has no conversation id: %v", result.Content)
+	}
+	return match[1], true
+}
+
+func TestAgentConversationsOnlyKeepAnsweredConversations(t *testing.T) {
+	failing := true
+	c := &agentConversations{
+		buildAgent: func() agent.Agent {
+			if failing {
+				return &fakeAgent{err: errors.New("model unavailable")}
+			}
+			return &fakeAgent{}
+		},
+		maxConversations: 10,
+		idleTimeout:      time.Hour,
+		agents:           make(map[string]*lockedAgent),
+	}
+	if _, ok := callConversation(t, c, "hello", ""); ok {
+		t.Fatal("expected the call to fail")
+	}
+	if len(c.agents) != 0 {
+		t.Fatalf("expected no conversations to be kept after a failed answer, got %d", len(c.agents))
+	}
+	failing = false
+	id, ok := callConversation(t, c, "hello", "")
+	if !ok {
+		t.Fatal("expected the call to succeed")
+	}
+	if _, ok := callConversation(t, c, "again", id); !ok {
+		t.Fatal("expected the conversation to be continued")
+	}
+	if len(c.agents) != 1 {
+		t.Fatalf("expected one conversation, got %d", len(c.agents))
+	}
+}
+
+func TestAgentConversationsForgetLeastRecentlyUsed(t *testing.T) {
+	c := &agentConversations{
+		buildAgent:       func() agent.Agent { return &fakeAgent{} },
+		maxConversations: 2,
+		idleTimeout:      time.Hour,
+		agents:           make(map[string]*lockedAgent),
+	}
+	first, _ := callConversation(t, c, "1", "")
+	second, _ := callConversation(t, c, "2", "")
+	// Using the first conversation makes the second the least recently used
+	time.Sleep(time.Millisecond)
+	callConversation(t, c, "1 again", first)
+	third, _ := callConversation(t, c, "3", "")
+	if len(c.agents) != 2 {
+		t.Fatalf("expected at most 2 conversations, got %d", len(c.agents))
+	}
+	for id, want := range map[string]bool{first: true, second: false, third: true} {
+		if _, ok := c.agents[id]; ok != want {
+			t.Errorf("conversation %s kept = %v, want %v", id, ok, want)
+		}
+	}
+}
+
+func TestAgentConversationsForgetIdle(t *testing.T) {
+	c := &agentConversations{
+		buildAgent:       func() agent.Agent { return &fakeAgent{} },
+		maxConversations: 10,
+		idleTimeout:      time.Minute,
+		agents:           make(map[string]*lockedAgent),
+	}
+	id, _ := callConversation(t, c, "hello", "")
+	c.agents[id].lastUsed = time.Now().Add(-2 * time.Minute)
+	if _, ok := callConversation(t, c, "again", id); ok {
+		t.Fatal("expected the idle conversation to have been forgotten")
+	}
+}
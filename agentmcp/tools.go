@@ -2,9 +2,12 @@ package agentmcp
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"slices"
+	"io"
+	"os"
+	"os/exec"
 	"strings"
 
 	"github.com/JoshPattman/agent"
@@ -13,8 +16,52 @@ import (
 	"github.com/mark3labs/mcp-go/mcp"
 )
 
+type clientParams struct {
+	sampler        *Sampler
+	roots          []string
+	onNotification func(mcp.JSONRPCNotification)
+}
+
+type ClientOpt func(*clientParams)
+
+// Allow the server to request LLM completions, which are responded to by the sampler.
+func WithSampler(sampler *Sampler) ClientOpt {
+	return func(cp *clientParams) {
+		cp.sampler = sampler
+	}
+}
+
+// Tell the server which directories the agent is working in, so it can limit what it operates on.
+func WithRoots(dirs ...string) ClientOpt {
+	return func(cp *clientParams) {
+		cp.roots = append(cp.roots, dirs...)
+	}
+}
+
+// Handle notifications from the server, including any sent straight after it is initialised.
+func withNotificationHandler(handler func(mcp.JSONRPCNotification)) ClientOpt {
+	return func(cp *clientParams) {
+		cp.onNotification = handler
+	}
+}
+
+func (cp clientParams) clientOptions() []client.ClientOption {
+	opts := make([]client.ClientOption, 0)
+	if cp.sampler != nil {
+		opts = append(opts, client.WithSamplingHandler(cp.sampler))
+	}
+	if len(cp.roots) > 0 {
+		opts = append(opts, client.WithRootsHandler(rootsHandler(cp.roots)))
+	}
+	return opts
+}
+
 // Create an MCP HTTP client and initialise it
-func CreateClient(addr string, customHeaders map[string]string) (*client.Client, error) {
+func CreateClient(addr string, customHeaders map[string]string, opts ...ClientOpt) (*client.Client, error) {
+	params := clientParams{}
+	for _, o := range opts {
+		o(&params)
+	}
 	httpTransport, err := transport.NewStreamableHTTP(
 		addr,
 		transport.WithHTTPHeaders(customHeaders),
@@ -22,8 +69,67 @@ func CreateClient(addr string, customHeaders map[string]string) (*client.Client,
 	if err != nil {
 		return nil, err
 	}
-	c := client.NewClient(httpTransport)
+	c := client.NewClient(httpTransport, params.clientOptions()...)
+	err = initialiseClient(c, params)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Create an MCP client that launches the command as a subprocess and talks to it over stdio, and initialise it.
+// The env is added to the current environment, and the process is run in workDir (or the current directory if empty).
+// Anything the process writes to stderr is copied to stderrLog, which may be nil to discard it.
+// The process is stopped when the client is closed.
+func CreateStdioClient(command string, args []string, env map[string]string, workDir string, stderrLog io.Writer, opts ...ClientOpt) (*client.Client, error) {
+	params := clientParams{}
+	for _, o := range opts {
+		o(&params)
+	}
+	envList := make([]string, 0, len(env))
+	for k, v := range env {
+		envList = append(envList, fmt.Sprintf("%s=%s", k, v))
+	}
+	stdioTransport := transport.NewStdioWithOptions(
+		command,
+		envList,
+		args,
+		transport.WithCommandFunc(func(ctx context.Context, command string, env []string, args []string) (*exec.Cmd, error) {
+			cmd := exec.CommandContext(ctx, command, args...)
+			cmd.Env = append(os.Environ(), env...)
+			cmd.Dir = workDir
+			return cmd, nil
+		}),
+	)
+	err := stdioTransport.Start(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	c := client.NewClient(stdioTransport, params.clientOptions()...)
+	// The stderr pipe must always be drained, otherwise the process may block when writing to it.
+	if stderr, ok := client.GetStderr(c); ok {
+		if stderrLog == nil {
+			stderrLog = io.Discard
+		}
+		go io.Copy(stderrLog, stderr)
+	}
+	err = initialiseClient(c, params)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
 
+func initialiseClient(c *client.Client, params clientParams) error {
+	if params.onNotification != nil {
+		c.OnNotification(params.onNotification)
+	}
+	// Starting the client installs the handlers for notifications and requests from the server.
+	err := c.Start(context.Background())
+	if err != nil {
+		return err
+	}
 	initRequest := mcp.InitializeRequest{}
 	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
 	initRequest.Params.ClientInfo = mcp.Implementation{
@@ -33,14 +139,19 @@ func CreateClient(addr string, customHeaders map[string]string) (*client.Client,
 	initRequest.Params.Capabilities = mcp.ClientCapabilities{}
 
 	_, err = c.Initialize(context.Background(), initRequest)
-	if err != nil {
-		return nil, err
-	}
-	return c, nil
+	return err
 }
 
 // Get the tools from the MCP client and convert them to agent tools
 func CreateToolsFromMCP(client *client.Client) ([]agent.Tool, error) {
+	return listTools(&toolHooks{getClient: staticClient(client)})
+}
+
+func listTools(hooks *toolHooks) ([]agent.Tool, error) {
+	client, err := hooks.getClient()
+	if err != nil {
+		return nil, err
+	}
 	ctx := context.Background()
 	result, err := client.ListTools(ctx, mcp.ListToolsRequest{})
 	if err != nil {
@@ -48,7 +159,7 @@ func CreateToolsFromMCP(client *client.Client) ([]agent.Tool, error) {
 	}
 	tools := make([]agent.Tool, len(result.Tools))
 	for i, mcpTool := range result.Tools {
-		agentTool, err := createTool(client, mcpTool)
+		agentTool, err := createTool(hooks, mcpTool)
 		if err != nil {
 			return nil, err
 		}
@@ -57,52 +168,138 @@ func CreateToolsFromMCP(client *client.Client) ([]agent.Tool, error) {
 	return tools, nil
 }
 
-func createTool(client *client.Client, tool mcp.Tool) (agent.Tool, error) {
-	return &mcpTool{client, tool}, nil
+// Allows tools to use the connection they were created from, which may change the client it uses over time.
+type toolHooks struct {
+	// Get the client to use for the next call.
+	getClient func() (*client.Client, error)
+	// Called when a call fails in a way that may mean the connection was lost. May be nil.
+	onCallFailed func(error)
+	// Start tracking progress of a tool call, returning the token to send and a function to stop tracking. May be nil.
+	beginProgress func(toolName string) (mcp.ProgressToken, func())
+}
+
+func staticClient(c *client.Client) func() (*client.Client, error) {
+	return func() (*client.Client, error) { return c, nil }
+}
+
+func createTool(hooks *toolHooks, tool mcp.Tool) (agent.Tool, error) {
+	return &mcpTool{hooks, tool}, nil
 }
 
 type mcpTool struct {
-	client *client.Client
-	tool   mcp.Tool
+	hooks *toolHooks
+	tool  mcp.Tool
 }
 
 // Call implements agent.Tool.
 func (m *mcpTool) Call(args map[string]any) (string, error) {
-	res, err := m.client.CallTool(context.Background(), mcp.CallToolRequest{
-		Params: mcp.CallToolParams{
-			Name:      m.tool.Name,
-			Arguments: args,
-		},
-	})
+	res, err := m.CallRich(args)
 	if err != nil {
 		return "", err
 	}
-	contents := make([]string, 0)
-	for _, c := range res.Content {
-		if c, ok := c.(mcp.TextContent); ok {
-			contents = append(contents, c.Text)
+	return res.TextWithFallback(), nil
+}
+
+// CallRich implements agent.RichTool.
+func (m *mcpTool) CallRich(args map[string]any) (agent.ToolResult, error) {
+	return m.CallContext(context.Background(), args)
+}
+
+// CallContext implements agent.ContextTool.
+func (m *mcpTool) CallContext(ctx context.Context, args map[string]any) (agent.ToolResult, error) {
+	client, err := m.hooks.getClient()
+	if err != nil {
+		return agent.ToolResult{}, err
+	}
+	params := mcp.CallToolParams{
+		Name:      m.tool.Name,
+		Arguments: args,
+	}
+	if m.hooks.beginProgress != nil {
+		token, done := m.hooks.beginProgress(m.tool.Name)
+		defer done()
+		params.Meta = &mcp.Meta{ProgressToken: token}
+	}
+	res, err := client.CallTool(ctx, mcp.CallToolRequest{
+		Params: params,
+	})
+	if err != nil {
+		// A cancelled call does not mean the connection was lost
+		if m.hooks.onCallFailed != nil && ctx.Err() == nil {
+			m.hooks.onCallFailed(err)
+		}
+		return agent.ToolResult{}, err
+	}
+	result, err := convertContent(res.Content)
+	if err != nil {
+		return agent.ToolResult{}, err
+	}
+	if res.IsError {
+		// The server reported that the tool failed, so the content describes the error.
+		msg := result.TextWithFallback()
+		if msg == "" {
+			msg = "tool reported an error without a description"
 		}
+		return agent.ToolResult{}, errors.New(msg)
 	}
-	if len(contents) == 0 {
-		return "", errors.New("tool returned no content")
+	if result.Text == "" && len(result.Images) == 0 && len(result.Resources) == 0 {
+		return agent.ToolResult{}, errors.New("tool returned no content")
 	}
-	return strings.Join(contents, "\n\n\n"), nil
+	return result, nil
+}
+
+// Convert MCP content into a tool result.
+// Content that cannot be represented (such as audio) is described in the text instead.
+func convertContent(content []mcp.Content) (agent.ToolResult, error) {
+	var result agent.ToolResult
+	texts := make([]string, 0)
+	for _, c := range content {
+		switch c := c.(type) {
+		case mcp.TextContent:
+			texts = append(texts, c.Text)
+		case mcp.ImageContent:
+			data, err := base64.StdEncoding.DecodeString(c.Data)
+			if err != nil {
+				return agent.ToolResult{}, fmt.Errorf("tool returned an invalid image: %w", err)
+			}
+			result.Images = append(result.Images, agent.Image{MIMEType: c.MIMEType, Data: data})
+		case mcp.AudioContent:
+			texts = append(texts, fmt.Sprintf("[audio: %s, cannot be shown]", c.MIMEType))
+		case mcp.ResourceLink:
+			result.Resources = append(result.Resources, agent.ResourceReference{
+				URI:         c.URI,
+				Name:        c.Name,
+				MIMEType:    c.MIMEType,
+				Description: c.Description,
+			})
+		case mcp.EmbeddedResource:
+			switch r := c.Resource.(type) {
+			case mcp.TextResourceContents:
+				texts = append(texts, fmt.Sprintf("Resource %s:\n%s", r.URI, r.Text))
+			case mcp.BlobResourceContents:
+				if strings.HasPrefix(r.MIMEType, "image/") {
+					data, err := base64.StdEncoding.DecodeString(r.Blob)
+					if err != nil {
+						return agent.ToolResult{}, fmt.Errorf("tool returned an invalid image resource: %w", err)
+					}
+					result.Images = append(result.Images, agent.Image{MIMEType: r.MIMEType, Data: data})
+				} else {
+					result.Resources = append(result.Resources, agent.ResourceReference{
+						URI:      r.URI,
+						MIMEType: r.MIMEType,
+					})
+				}
+			}
+		}
+	}
+	result.Text = strings.Join(texts, "\n\n\n")
+	return result, nil
 }
 
 // Description implements agent.Tool.
 func (m *mcpTool) Description() []string {
 	desc := []string{m.tool.Description}
-	for pname, prop := range m.tool.InputSchema.Properties {
-		var required string
-		if slices.Contains(m.tool.InputSchema.Required, pname) {
-			required = " [required]"
-		}
-		desc = append(
-			desc,
-			fmt.Sprintf("Param%s `%s` (%s): %s", required, pname, prop.(map[string]any)["type"].(string), prop.(map[string]any)["description"].(string)),
-		)
-	}
-	return desc
+	return append(desc, describeToolInputSchema(m.tool)...)
 }
 
 // Name implements agent.Tool.
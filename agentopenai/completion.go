@@ -0,0 +1,164 @@
+package agentopenai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/JoshPattman/agent"
+)
+
+// A single response to a chat completion request.
+type completion struct {
+	id        string
+	created   int64
+	model     string
+	sessionID string
+	events    bool
+}
+
+// Answer the query and respond with the whole answer at once.
+func (c *completion) respond(ctx context.Context, w http.ResponseWriter, a agent.Agent, query string) {
+	msg := &responseMessage{Role: "assistant"}
+	reasoning := make([]string, 0)
+	if c.events {
+		a.SetOnReActCompleteCallback(func(s string, aos []agent.ActionObservation) {
+			if s != "" {
+				reasoning = append(reasoning, s)
+			}
+			msg.AgentActions = append(msg.AgentActions, convertActions(aos)...)
+		})
+	} else {
+		a.SetOnReActCompleteCallback(func(string, []agent.ActionObservation) {})
+	}
+	a.SetOnBeginStreamAnswerCallback(func() {})
+	a.SetOnStreamAnswerChunkCallback(func(string) {})
+	answer, err := agent.AnswerWithContext(ctx, a, query)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "agent_error", fmt.Sprintf("The agent failed to answer: %v", err))
+		return
+	}
+	msg.Content = answer
+	msg.ReasoningContent = strings.Join(reasoning, "\n\n")
+	finish := "stop"
+	writeJSON(w, http.StatusOK, c.object("chat.completion", choice{Message: msg, FinishReason: &finish}))
+}
+
+// Answer the query, streaming the answer as server-sent events as it is generated.
+func (c *completion) stream(ctx context.Context, w http.ResponseWriter, a agent.Agent, query string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	var lock sync.Mutex
+	streamedAnswer := false
+	send := func(v any) {
+		lock.Lock()
+		defer lock.Unlock()
+		bs, _ := json.Marshal(v)
+		fmt.Fprintf(w, "data: %s\n\n", bs)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	sendDelta := func(delta *responseDelta, finish *string) {
+		send(c.object("chat.completion.chunk", choice{Delta: delta, FinishReason: finish}))
+	}
+
+	sendDelta(&responseDelta{Role: "assistant"}, nil)
+	if c.events {
+		a.SetOnReActCompleteCallback(func(s string, aos []agent.ActionObservation) {
+			sendDelta(&responseDelta{ReasoningContent: s, AgentActions: convertActions(aos)}, nil)
+		})
+	} else {
+		a.SetOnReActCompleteCallback(func(string, []agent.ActionObservation) {})
+	}
+	a.SetOnBeginStreamAnswerCallback(func() {})
+	a.SetOnStreamAnswerChunkCallback(func(chunk string) {
+		lock.Lock()
+		streamedAnswer = true
+		lock.Unlock()
+		sendDelta(&responseDelta{Content: chunk}, nil)
+	})
+	answer, err := agent.AnswerWithContext(ctx, a, query)
+	if err != nil {
+		send(errorResponse{Error: apiError{Message: fmt.Sprintf("The agent failed to answer: %v", err), Type: "agent_error"}})
+		return
+	}
+	// Not all agents stream their answer, so send it whole if it was not streamed.
+	if !streamedAnswer {
+		sendDelta(&responseDelta{Content: answer}, nil)
+	}
+	finish := "stop"
+	sendDelta(&responseDelta{}, &finish)
+	lock.Lock()
+	defer lock.Unlock()
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+func (c *completion) object(object string, ch choice) chatCompletion {
+	return chatCompletion{
+		ID:        c.id,
+		Object:    object,
+		Created:   c.created,
+		Model:     c.model,
+		Choices:   []choice{ch},
+		SessionID: c.sessionID,
+	}
+}
+
+func convertActions(aos []agent.ActionObservation) []agentAction {
+	actions := make([]agentAction, len(aos))
+	for i, ao := range aos {
+		args := make(map[string]any, len(ao.Action.Args))
+		for _, arg := range ao.Action.Args {
+			args[arg.ArgName] = arg.ArgData
+		}
+		actions[i] = agentAction{
+			Name:        ao.Action.Name,
+			Args:        args,
+			Observation: ao.Observation.Observed,
+		}
+	}
+	return actions
+}
+
+// Get the last user message, which is the only message a session's agent needs, as it remembers the rest of the conversation.
+func lastUserMessage(messages []chatMessage) (string, error) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return string(messages[i].Content), nil
+		}
+	}
+	return "", errors.New("messages must contain at least one user message")
+}
+
+// Get the last user message, preceded by the earlier messages as context for an agent which has not seen them.
+func queryWithContext(messages []chatMessage) (string, error) {
+	last := -1
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			last = i
+			break
+		}
+	}
+	if last == -1 {
+		return "", errors.New("messages must contain at least one user message")
+	}
+	if last == 0 {
+		return string(messages[0].Content), nil
+	}
+	lines := []string{"Here is the conversation so far, for context:", ""}
+	for _, msg := range messages[:last] {
+		lines = append(lines, fmt.Sprintf("%s: %s", msg.Role, msg.Content), "")
+	}
+	lines = append(lines, "Respond to this message:", string(messages[last].Content))
+	return strings.Join(lines, "\n"), nil
+}
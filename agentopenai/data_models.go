@@ -0,0 +1,112 @@
+package agentopenai
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+type chatRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+	// Extension: the session to continue, as an alternative to the session header.
+	SessionID string `json:"session_id,omitempty"`
+	// Extension: include the agent's reasoning and tool calls in the response.
+	AgentEvents bool `json:"agent_events,omitempty"`
+}
+
+type chatMessage struct {
+	Role    string         `json:"role"`
+	Content messageContent `json:"content"`
+}
+
+// The text of a message, which may be sent as a string or as a list of content parts.
+// Parts other than text (such as images) are ignored.
+type messageContent string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *messageContent) UnmarshalJSON(data []byte) error {
+	var s *string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if s != nil {
+			*c = messageContent(*s)
+		}
+		return nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New("content must be a string or a list of content parts")
+	}
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	*c = messageContent(strings.Join(texts, "\n"))
+	return nil
+}
+
+type chatCompletion struct {
+	ID      string   `json:"id"`
+	Object  string   `json:"object"`
+	Created int64    `json:"created"`
+	Model   string   `json:"model"`
+	Choices []choice `json:"choices"`
+	// Extension: the session this completion belongs to.
+	SessionID string `json:"session_id"`
+}
+
+type choice struct {
+	Index        int              `json:"index"`
+	Message      *responseMessage `json:"message,omitempty"`
+	Delta        *responseDelta   `json:"delta,omitempty"`
+	FinishReason *string          `json:"finish_reason"`
+}
+
+type responseMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Extension: the agent's reasoning for each step, if agent events were requested.
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+	// Extension: the tools the agent called, if agent events were requested.
+	AgentActions []agentAction `json:"agent_actions,omitempty"`
+}
+
+type responseDelta struct {
+	Role             string        `json:"role,omitempty"`
+	Content          string        `json:"content,omitempty"`
+	ReasoningContent string        `json:"reasoning_content,omitempty"`
+	AgentActions     []agentAction `json:"agent_actions,omitempty"`
+}
+
+type agentAction struct {
+	Name        string         `json:"name"`
+	Args        map[string]any `json:"args"`
+	Observation string         `json:"observation"`
+}
+
+type modelList struct {
+	Object string        `json:"object"`
+	Data   []modelObject `json:"data"`
+}
+
+type modelObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
@@ -0,0 +1,211 @@
+// Package agentopenai serves agents over an OpenAI-compatible chat completions API,
+// so that any OpenAI client can talk to an agent as if it were a model.
+package agentopenai
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/agentsession"
+)
+
+// The header used to continue a session, which is also set on every response.
+const SessionHeader = "X-Session-Id"
+
+type serverParams struct {
+	apiKeys     []string
+	sessionOpts []agentsession.ManagerOpt
+}
+
+type ServerOpt func(*serverParams)
+
+// Require clients to send one of the keys as a bearer token.
+// Without this, the server accepts any request.
+func WithAPIKeys(keys ...string) ServerOpt {
+	return func(sp *serverParams) {
+		sp.apiKeys = append(sp.apiKeys, keys...)
+	}
+}
+
+// Configure how sessions are kept, such as how long they are kept after their last request (default 1h), or a store to save them to.
+// Sessions are stored with IDs of the form `<key>/<model>/<session id>`, where `<key>` is a hash of the client's API key
+// (or `public` if the server has no keys), so that clients cannot continue each other's sessions, and `<model>` is path escaped.
+func WithSessionOptions(opts ...agentsession.ManagerOpt) ServerOpt {
+	return func(sp *serverParams) {
+		sp.sessionOpts = append(sp.sessionOpts, opts...)
+	}
+}
+
+// An http.Handler which serves agents as models on /v1/chat/completions, and lists them on /v1/models.
+//
+// Requests without a session ID start a new session: a fresh agent is built, and any earlier messages in the request are given to it as context.
+// To continue with the same agent (and its history of tool calls), pass the session ID in the X-Session-Id header or the session_id field.
+// The session ID is returned in the same header and field of every response, and only the last user message of a request is sent to a session's agent.
+// Passing an unknown session ID starts a new session with that ID.
+// Sessions belong to the API key that started them, so a client using a different key cannot continue them.
+// If the client disconnects before the answer is complete, the agent is cancelled if it supports it.
+type Server struct {
+	agents   map[string]func() agent.Agent
+	params   serverParams
+	mux      *http.ServeMux
+	sessions *agentsession.Manager
+}
+
+// Create a server for the agents, which are named by the model name clients use to request them.
+func NewServer(agents map[string]func() agent.Agent, opts ...ServerOpt) *Server {
+	params := serverParams{
+		sessionOpts: []agentsession.ManagerOpt{agentsession.WithIdleTimeout(time.Hour)},
+	}
+	for _, o := range opts {
+		o(&params)
+	}
+	s := &Server{
+		agents: agents,
+		params: params,
+		mux:    http.NewServeMux(),
+	}
+	s.sessions = agentsession.NewManager(nil, params.sessionOpts...)
+	s.mux.HandleFunc("GET /v1/models", s.handleModels)
+	s.mux.HandleFunc("POST /v1/chat/completions", s.handleChatCompletions)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorised(r) {
+		writeError(w, http.StatusUnauthorized, "invalid_api_key", "Incorrect API key provided")
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// Stop managing sessions. The server must not be used after it is closed.
+func (s *Server) Close() {
+	s.sessions.Close()
+}
+
+// Serve the agents at the address (such as ":8080") until the server fails.
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s)
+}
+
+func (s *Server) authorised(r *http.Request) bool {
+	if len(s.params.apiKeys) == 0 {
+		return true
+	}
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	for _, k := range s.params.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.agents))
+	for name := range s.agents {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	models := make([]modelObject, len(names))
+	for i, name := range names {
+		models[i] = modelObject{ID: name, Object: "model", OwnedBy: "agent"}
+	}
+	writeJSON(w, http.StatusOK, modelList{Object: "list", Data: models})
+}
+
+func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	var req chatRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Could not parse request: %v", err))
+		return
+	}
+	build, ok := s.agents[req.Model]
+	if !ok {
+		writeError(w, http.StatusNotFound, "model_not_found", fmt.Sprintf("The model '%s' does not exist", req.Model))
+		return
+	}
+	sessionID := r.Header.Get(SessionHeader)
+	if sessionID == "" {
+		sessionID = req.SessionID
+	}
+	var query string
+	if sessionID != "" {
+		query, err = lastUserMessage(req.Messages)
+	} else {
+		sessionID = newSessionID()
+		query, err = queryWithContext(req.Messages)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	w.Header().Set(SessionHeader, sessionID)
+
+	completion := &completion{
+		id:        "chatcmpl-" + newSessionID(),
+		created:   time.Now().Unix(),
+		model:     req.Model,
+		sessionID: sessionID,
+		events:    req.AgentEvents,
+	}
+	started := false
+	// The model is escaped so that a model name containing a slash cannot make the same ID as another model and session ID.
+	err = s.sessions.DoWithFactory(s.sessionScope(r)+"/"+url.PathEscape(req.Model)+"/"+sessionID, build, func(a agent.Agent) error {
+		started = true
+		if req.Stream {
+			completion.stream(r.Context(), w, a, query)
+		} else {
+			completion.respond(r.Context(), w, a, query)
+		}
+		return nil
+	})
+	if errors.Is(err, agentsession.ErrTooManySessions) {
+		writeError(w, http.StatusServiceUnavailable, "server_busy", "The server has too many active sessions, try again later")
+	} else if err != nil && !started {
+		writeError(w, http.StatusInternalServerError, "session_error", fmt.Sprintf("Could not load session: %v", err))
+	}
+}
+
+// Get the part of session IDs which keeps the sessions of each API key apart.
+// The key is hashed so that it is not saved in the session store.
+func (s *Server) sessionScope(r *http.Request) string {
+	if len(s.params.apiKeys) == 0 {
+		return "public"
+	}
+	key, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:8])
+}
+
+func newSessionID() string {
+	bs := make([]byte, 12)
+	rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, errType, message string) {
+	writeJSON(w, status, errorResponse{Error: apiError{Message: message, Type: errType}})
+}
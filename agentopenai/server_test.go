@@ -0,0 +1,254 @@
+package agentopenai
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/agentsession"
+)
+
+// An agent which streams its answer word by word, and numbers its answers so that tests can tell whether a session was continued.
+type echoAgent struct {
+	answered int
+	onChunk  func(string)
+}
+
+func (a *echoAgent) Answer(query string) (string, error) {
+	a.answered++
+	answer := fmt.Sprintf("answer %d to %s", a.answered, query)
+	for i, word := range strings.Split(answer, " ") {
+		if i > 0 {
+			word = " " + word
+		}
+		a.onChunk(word)
+	}
+	return answer, nil
+}
+
+func (a *echoAgent) SetOnReActInitCallback(func(string, []agent.Action))                {}
+func (a *echoAgent) SetOnReActCompleteCallback(func(string, []agent.ActionObservation)) {}
+func (a *echoAgent) SetOnBeginStreamAnswerCallback(func())                              {}
+func (a *echoAgent) SetOnStreamAnswerChunkCallback(callback func(string))               { a.onChunk = callback }
+
+func newTestServer(t *testing.T, opts ...ServerOpt) *httptest.Server {
+	t.Helper()
+	s := NewServer(map[string]func() agent.Agent{
+		"echo":      func() agent.Agent { return &echoAgent{} },
+		"team/echo": func() agent.Agent { return &echoAgent{} },
+	}, opts...)
+	hs := httptest.NewServer(s)
+	t.Cleanup(func() {
+		hs.Close()
+		s.Close()
+	})
+	return hs
+}
+
+func postCompletion(t *testing.T, url, key, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/chat/completions", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func decodeCompletion(t *testing.T, resp *http.Response) chatCompletion {
+	t.Helper()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	var c chatCompletion
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Choices) != 1 || c.Choices[0].Message == nil {
+		t.Fatalf("expected one choice with a message, got %+v", c.Choices)
+	}
+	return c
+}
+
+func decodeError(t *testing.T, resp *http.Response, status int) apiError {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Fatalf("expected status %d, got %d", status, resp.StatusCode)
+	}
+	var e errorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	return e.Error
+}
+
+func TestServerRespondsWithWholeAnswer(t *testing.T) {
+	hs := newTestServer(t)
+	resp := postCompletion(t, hs.URL, "", `{"model": "echo", "messages": [{"role": "user", "content": "hi"}]}`)
+	c := decodeCompletion(t, resp)
+	if c.Object != "chat.completion" || c.Model != "echo" {
+		t.Errorf("unexpected completion %+v", c)
+	}
+	if got := c.Choices[0].Message.Content; got != "answer 1 to hi" {
+		t.Errorf("unexpected answer %q", got)
+	}
+	if c.SessionID == "" || resp.Header.Get(SessionHeader) != c.SessionID {
+		t.Errorf("expected the session id %q in the body and header, got %q", c.SessionID, resp.Header.Get(SessionHeader))
+	}
+}
+
+func TestServerStreamsAnswer(t *testing.T) {
+	hs := newTestServer(t)
+	resp := postCompletion(t, hs.URL, "", `{"model": "echo", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream, got %q", ct)
+	}
+	var content strings.Builder
+	chunks, done := 0, false
+	var finish string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var chunk chatCompletion
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("could not decode chunk %q: %v", data, err)
+		}
+		if chunk.Object != "chat.completion.chunk" || len(chunk.Choices) != 1 || chunk.Choices[0].Delta == nil {
+			t.Fatalf("unexpected chunk %q", data)
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+		if chunk.Choices[0].FinishReason != nil {
+			finish = *chunk.Choices[0].FinishReason
+		}
+		chunks++
+	}
+	if !done {
+		t.Error("stream did not end with [DONE]")
+	}
+	if finish != "stop" {
+		t.Errorf("expected finish reason stop, got %q", finish)
+	}
+	if content.String() != "answer 1 to hi" {
+		t.Errorf("unexpected streamed answer %q", content.String())
+	}
+	// The role, one chunk per word, and the finish
+	if chunks != 6 {
+		t.Errorf("expected the answer to be streamed in pieces, got %d chunks", chunks)
+	}
+}
+
+func TestServerRejectsBadAPIKeys(t *testing.T) {
+	hs := newTestServer(t, WithAPIKeys("secret"))
+	body := `{"model": "echo", "messages": [{"role": "user", "content": "hi"}]}`
+	for _, key := range []string{"", "wrong"} {
+		e := decodeError(t, postCompletion(t, hs.URL, key, body), http.StatusUnauthorized)
+		if e.Type != "invalid_api_key" {
+			t.Errorf("key %q: unexpected error type %q", key, e.Type)
+		}
+	}
+	decodeCompletion(t, postCompletion(t, hs.URL, "secret", body))
+}
+
+func TestServerRejectsUnknownModel(t *testing.T) {
+	hs := newTestServer(t)
+	resp := postCompletion(t, hs.URL, "", `{"model": "missing", "messages": [{"role": "user", "content": "hi"}]}`)
+	e := decodeError(t, resp, http.StatusNotFound)
+	if e.Type != "model_not_found" {
+		t.Errorf("unexpected error type %q", e.Type)
+	}
+}
+
+func TestServerContinuesSessions(t *testing.T) {
+	hs := newTestServer(t)
+	first := decodeCompletion(t, postCompletion(t, hs.URL, "", `{"model": "echo", "messages": [{"role": "user", "content": "one"}]}`))
+	second := decodeCompletion(t, postCompletion(t, hs.URL, "", fmt.Sprintf(
+		`{"model": "echo", "session_id": %q, "messages": [{"role": "user", "content": "one"}, {"role": "user", "content": "two"}]}`,
+		first.SessionID,
+	)))
+	if got := second.Choices[0].Message.Content; got != "answer 2 to two" {
+		t.Errorf("expected the session to be continued, got %q", got)
+	}
+}
+
+func TestServerScopesSessionsToAPIKey(t *testing.T) {
+	hs := newTestServer(t, WithAPIKeys("alice", "bob"))
+	first := decodeCompletion(t, postCompletion(t, hs.URL, "alice", `{"model": "echo", "messages": [{"role": "user", "content": "one"}]}`))
+	continued := fmt.Sprintf(`{"model": "echo", "session_id": %q, "messages": [{"role": "user", "content": "two"}]}`, first.SessionID)
+	other := decodeCompletion(t, postCompletion(t, hs.URL, "bob", continued))
+	if got := other.Choices[0].Message.Content; got != "answer 1 to two" {
+		t.Errorf("expected another key to get a new session, got %q", got)
+	}
+	same := decodeCompletion(t, postCompletion(t, hs.URL, "alice", continued))
+	if got := same.Choices[0].Message.Content; got != "answer 2 to two" {
+		t.Errorf("expected the same key to continue its session, got %q", got)
+	}
+}
+
+func TestServerSavesSessionsToFileStore(t *testing.T) {
+	store, err := agentsession.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := newTestServer(t, WithSessionOptions(agentsession.WithStore(store)))
+	first := decodeCompletion(t, postCompletion(t, hs.URL, "", `{"model": "echo", "messages": [{"role": "user", "content": "one"}]}`))
+	second := decodeCompletion(t, postCompletion(t, hs.URL, "", fmt.Sprintf(
+		`{"model": "echo", "session_id": %q, "messages": [{"role": "user", "content": "two"}]}`,
+		first.SessionID,
+	)))
+	if got := second.Choices[0].Message.Content; got != "answer 2 to two" {
+		t.Errorf("expected the session to be continued, got %q", got)
+	}
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "public/echo/"+first.SessionID {
+		t.Errorf("expected the session to be saved, got %+v", sessions)
+	}
+}
+
+func TestServerServesModelsWithSlashes(t *testing.T) {
+	store, err := agentsession.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := newTestServer(t, WithSessionOptions(agentsession.WithStore(store)))
+	first := decodeCompletion(t, postCompletion(t, hs.URL, "", `{"model": "team/echo", "messages": [{"role": "user", "content": "one"}]}`))
+	second := decodeCompletion(t, postCompletion(t, hs.URL, "", fmt.Sprintf(
+		`{"model": "team/echo", "session_id": %q, "messages": [{"role": "user", "content": "two"}]}`,
+		first.SessionID,
+	)))
+	if got := second.Choices[0].Message.Content; got != "answer 2 to two" {
+		t.Errorf("expected the session to be continued, got %q", got)
+	}
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The model is escaped, so that its slash cannot be confused with the one before the session ID
+	if len(sessions) != 1 || sessions[0].ID != "public/team%2Fecho/"+first.SessionID {
+		t.Errorf("expected the session to be saved with the model escaped, got %+v", sessions)
+	}
+}
@@ -0,0 +1,133 @@
+package agentsession
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A store which saves each session as a JSON file in a directory.
+// Characters in session IDs which are not safe in file names (such as `/`) are escaped, so any ID can be stored.
+type FileStore struct {
+	dir string
+}
+
+// Create a store which saves sessions in the directory, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Load implements Store.
+func (s *FileStore) Load(id string) (SessionData, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return SessionData{}, err
+	}
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return SessionData{}, ErrSessionNotFound
+	} else if err != nil {
+		return SessionData{}, err
+	}
+	var data SessionData
+	err = json.Unmarshal(bs, &data)
+	if err != nil {
+		return SessionData{}, fmt.Errorf("could not parse session '%s': %w", id, err)
+	}
+	return data, nil
+}
+
+// Save implements Store.
+func (s *FileStore) Save(data SessionData) error {
+	path, err := s.path(data.ID)
+	if err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(data, "", "    ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash while saving does not lose the previous save.
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, bs, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Delete implements Store.
+func (s *FileStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List implements Store.
+func (s *FileStore) List() ([]SessionData, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]SessionData, 0)
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if e.IsDir() || !ok {
+			continue
+		}
+		id, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		data, err := s.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		data.History = nil
+		sessions = append(sessions, data)
+	}
+	slices.SortFunc(sessions, func(a, b SessionData) int {
+		return b.UpdatedAt.Compare(a.UpdatedAt)
+	})
+	return sessions, nil
+}
+
+// Get the file for the session, escaping the ID so that it cannot refer to a file outside the directory.
+func (s *FileStore) path(id string) (string, error) {
+	if id == "" {
+		return "", errors.New("invalid empty session id")
+	}
+	return filepath.Join(s.dir, escapeFileName(id)+".json"), nil
+}
+
+// Escape every byte of the name other than letters, digits, `-`, `_` and `.` as `%XX`, so it is safe as a file name on any platform.
+// A leading `.` is also escaped so the file is not hidden, and so the name cannot be `.` or `..`.
+// The name can be recovered with url.PathUnescape.
+func escapeFileName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		safe := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' && i > 0
+		if safe {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
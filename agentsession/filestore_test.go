@@ -0,0 +1,63 @@
+package agentsession
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreEscapesIDs(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(filepath.Join(dir, "sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{"plain-id_1", "model/session", "../escape", "..", ".hidden", `C:\windows`, "with space?", "a%2Fb"}
+	for _, id := range ids {
+		if err := store.Save(SessionData{ID: id}); err != nil {
+			t.Fatalf("could not save %q: %v", id, err)
+		}
+		data, err := store.Load(id)
+		if err != nil {
+			t.Fatalf("could not load %q: %v", id, err)
+		}
+		if data.ID != id {
+			t.Errorf("loaded %q for %q", data.ID, id)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the sessions directory to be written to, got %d entries", len(entries))
+	}
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != len(ids) {
+		t.Fatalf("expected %d sessions, got %d", len(ids), len(sessions))
+	}
+	listed := make(map[string]bool)
+	for _, s := range sessions {
+		listed[s.ID] = true
+	}
+	for _, id := range ids {
+		if !listed[id] {
+			t.Errorf("session %q was not listed", id)
+		}
+	}
+	for _, id := range ids {
+		if err := store.Delete(id); err != nil {
+			t.Fatalf("could not delete %q: %v", id, err)
+		}
+		if _, err := store.Load(id); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("expected %q to be deleted, got %v", id, err)
+		}
+	}
+	if err := store.Save(SessionData{}); err == nil {
+		t.Error("expected an empty id to be rejected")
+	}
+}
@@ -0,0 +1,294 @@
+// Package agentsession manages many concurrent conversations with agents, such as for a server with many users.
+// Each session has its own agent, which answers one query at a time, and sessions can be saved to a store so they outlive the process.
+package agentsession
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/JoshPattman/agent"
+)
+
+// Returned when a new session is needed but the maximum number of sessions are all in use.
+var ErrTooManySessions = errors.New("too many active sessions")
+
+type managerParams struct {
+	store       Store
+	idleTimeout time.Duration
+	maxSessions int
+}
+
+type ManagerOpt func(*managerParams)
+
+// Save sessions to the store after every call, and restore them from it when they are not in memory.
+// Only the history of agents implementing agent.StatefulAgent can be saved.
+func WithStore(store Store) ManagerOpt {
+	return func(mp *managerParams) {
+		mp.store = store
+	}
+}
+
+// Remove sessions from memory once they have not been used for the timeout (default 30m).
+// A zero timeout keeps sessions in memory until they are deleted or the maximum number of sessions is reached.
+func WithIdleTimeout(timeout time.Duration) ManagerOpt {
+	return func(mp *managerParams) {
+		mp.idleTimeout = timeout
+	}
+}
+
+// Limit the number of sessions kept in memory (default unlimited).
+// When the limit is reached, the least recently used session that is not in use is removed to make space.
+func WithMaxSessions(n int) ManagerOpt {
+	return func(mp *managerParams) {
+		mp.maxSessions = n
+	}
+}
+
+// Keeps an agent per session ID, creating them on demand.
+type Manager struct {
+	factory func(id string) agent.Agent
+	params  managerParams
+
+	lock     sync.Mutex
+	sessions map[string]*liveSession
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// A session which is in memory.
+type liveSession struct {
+	// Closed once the agent has been created and the session restored from the store, after which agent, data and err are not changed.
+	ready chan struct{}
+	err   error
+	// Held while the agent is in use.
+	lock  sync.Mutex
+	agent agent.Agent
+	// Set once the session is deleted, so that a call which was waiting for it does not save it again.
+	// Protected by lock.
+	deleted bool
+	// Not changed after the session is ready, as UpdatedAt is tracked by lastUsed instead.
+	data SessionData
+	// The following are protected by the manager's lock.
+	lastUsed time.Time
+	users    int
+}
+
+// Create a manager which creates the agent for each new session with the factory.
+// The factory may be nil if every call gives the factory for its session with DoWithFactory.
+func NewManager(factory func(id string) agent.Agent, opts ...ManagerOpt) *Manager {
+	params := managerParams{
+		idleTimeout: 30 * time.Minute,
+	}
+	for _, o := range opts {
+		o(&params)
+	}
+	m := &Manager{
+		factory:  factory,
+		params:   params,
+		sessions: make(map[string]*liveSession),
+		closed:   make(chan struct{}),
+	}
+	if params.idleTimeout > 0 {
+		go m.evictLoop()
+	}
+	return m
+}
+
+// Call f with the agent of the session, creating the session (or restoring it from the store) if needed.
+// Calls for the same session run one at a time, so f may freely set callbacks on the agent and answer queries.
+// The session is saved to the store once f returns.
+func (m *Manager) Do(id string, f func(agent.Agent) error) error {
+	return m.do(id, m.factory, f)
+}
+
+// Call f with the agent of the session like Do, but create the agent with the factory if the session is new,
+// such as when the caller already knows which agent the session is for.
+func (m *Manager) DoWithFactory(id string, factory func() agent.Agent, f func(agent.Agent) error) error {
+	return m.do(id, func(string) agent.Agent { return factory() }, f)
+}
+
+func (m *Manager) do(id string, factory func(id string) agent.Agent, f func(agent.Agent) error) error {
+	ls, err := m.acquire(id, factory)
+	if err != nil {
+		return err
+	}
+	defer m.release(ls)
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	err = f(ls.agent)
+	return errors.Join(err, m.save(ls))
+}
+
+// Answer the query with the agent of the session.
+func (m *Manager) Answer(id, query string) (string, error) {
+	var answer string
+	err := m.Do(id, func(a agent.Agent) error {
+		var err error
+		answer, err = a.Answer(query)
+		return err
+	})
+	return answer, err
+}
+
+// Delete the session from memory and from the store, waiting for any call using it to finish first.
+func (m *Manager) Delete(id string) error {
+	m.lock.Lock()
+	ls, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.lock.Unlock()
+	if ok {
+		ls.lock.Lock()
+		defer ls.lock.Unlock()
+		ls.deleted = true
+	}
+	if m.params.store != nil {
+		return m.params.store.Delete(id)
+	}
+	return nil
+}
+
+// List the sessions in the store, or the sessions in memory if there is no store, without their history.
+func (m *Manager) List() ([]SessionData, error) {
+	if m.params.store != nil {
+		return m.params.store.List()
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	sessions := make([]SessionData, 0, len(m.sessions))
+	for _, ls := range m.sessions {
+		data := ls.data
+		data.UpdatedAt = ls.lastUsed
+		sessions = append(sessions, data)
+	}
+	return sessions, nil
+}
+
+// Stop evicting idle sessions and forget all sessions in memory.
+// Sessions are saved after every call, so nothing is lost.
+func (m *Manager) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.sessions = make(map[string]*liveSession)
+	})
+}
+
+// Get the session, marking it as in use so it will not be evicted.
+// A new session is added before its agent is created and it is restored from the store, which happens without the manager's lock held
+// so that a slow store does not hold up other sessions. Calls for the same session meanwhile wait for it to be ready.
+func (m *Manager) acquire(id string, factory func(id string) agent.Agent) (*liveSession, error) {
+	m.lock.Lock()
+	ls, isNew := m.sessions[id], false
+	if ls == nil {
+		if m.params.maxSessions > 0 && len(m.sessions) >= m.params.maxSessions && !m.evictLeastRecentlyUsed() {
+			m.lock.Unlock()
+			return nil, ErrTooManySessions
+		}
+		now := time.Now()
+		ls = &liveSession{
+			ready: make(chan struct{}),
+			data:  SessionData{ID: id, CreatedAt: now, UpdatedAt: now},
+		}
+		m.sessions[id] = ls
+		isNew = true
+	}
+	ls.users++
+	ls.lastUsed = time.Now()
+	m.lock.Unlock()
+
+	if isNew {
+		ls.err = m.initSession(ls, factory)
+		close(ls.ready)
+	} else {
+		<-ls.ready
+	}
+	if ls.err != nil {
+		m.lock.Lock()
+		if m.sessions[id] == ls {
+			delete(m.sessions, id)
+		}
+		m.lock.Unlock()
+		m.release(ls)
+		return nil, ls.err
+	}
+	return ls, nil
+}
+
+func (m *Manager) release(ls *liveSession) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ls.users--
+	ls.lastUsed = time.Now()
+}
+
+// Create the agent for a new session, restoring its history from the store if it was saved before.
+func (m *Manager) initSession(ls *liveSession, factory func(id string) agent.Agent) error {
+	ls.agent = factory(ls.data.ID)
+	if m.params.store == nil {
+		return nil
+	}
+	data, err := m.params.store.Load(ls.data.ID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if sa, ok := ls.agent.(agent.StatefulAgent); ok {
+		sa.SetHistory(data.History)
+	}
+	data.History = nil
+	ls.data = data
+	return nil
+}
+
+// Must be called with the session's lock held.
+func (m *Manager) save(ls *liveSession) error {
+	if m.params.store == nil || ls.deleted {
+		return nil
+	}
+	data := ls.data
+	data.UpdatedAt = time.Now()
+	if sa, ok := ls.agent.(agent.StatefulAgent); ok {
+		data.History = sa.History()
+	}
+	return m.params.store.Save(data)
+}
+
+// Remove the least recently used session that is not in use, returning false if all sessions are in use.
+// Must be called with the manager's lock held.
+func (m *Manager) evictLeastRecentlyUsed() bool {
+	var oldestID string
+	var oldest *liveSession
+	for id, ls := range m.sessions {
+		if ls.users == 0 && (oldest == nil || ls.lastUsed.Before(oldest.lastUsed)) {
+			oldestID, oldest = id, ls
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(m.sessions, oldestID)
+	return true
+}
+
+func (m *Manager) evictLoop() {
+	ticker := time.NewTicker(max(m.params.idleTimeout/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closed:
+			return
+		case <-ticker.C:
+			m.lock.Lock()
+			for id, ls := range m.sessions {
+				if ls.users == 0 && time.Since(ls.lastUsed) > m.params.idleTimeout {
+					delete(m.sessions, id)
+				}
+			}
+			m.lock.Unlock()
+		}
+	}
+}
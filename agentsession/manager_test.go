@@ -0,0 +1,314 @@
+package agentsession
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JoshPattman/agent"
+)
+
+// An agent which remembers the queries it has answered.
+type historyAgent struct {
+	history []agent.CompletedTask
+}
+
+func (a *historyAgent) Answer(query string) (string, error) {
+	answer := fmt.Sprintf("answer %d", len(a.history)+1)
+	a.history = append(a.history, agent.CompletedTask{Task: query, Response: answer})
+	return answer, nil
+}
+
+func (a *historyAgent) History() []agent.CompletedTask                                     { return a.history }
+func (a *historyAgent) SetHistory(history []agent.CompletedTask)                           { a.history = history }
+func (a *historyAgent) SetOnReActInitCallback(func(string, []agent.Action))                {}
+func (a *historyAgent) SetOnReActCompleteCallback(func(string, []agent.ActionObservation)) {}
+func (a *historyAgent) SetOnBeginStreamAnswerCallback(func())                              {}
+func (a *historyAgent) SetOnStreamAnswerChunkCallback(func(string))                        {}
+
+// Create a manager of history agents, counting the agents created.
+func newTestManager(t *testing.T, opts ...ManagerOpt) (*Manager, *atomic.Int32) {
+	t.Helper()
+	created := &atomic.Int32{}
+	m := NewManager(func(string) agent.Agent {
+		created.Add(1)
+		return &historyAgent{}
+	}, opts...)
+	t.Cleanup(m.Close)
+	return m, created
+}
+
+func newTestStore(t *testing.T) *FileStore {
+	t.Helper()
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// Call Do in the background, returning a channel to let f return and a channel which receives the result of Do.
+// The call is in f once started is received from.
+func doInBackground(m *Manager, id string) (started <-chan struct{}, finish chan<- struct{}, result <-chan error) {
+	startedC, finishC, resultC := make(chan struct{}), make(chan struct{}), make(chan error, 1)
+	go func() {
+		resultC <- m.Do(id, func(a agent.Agent) error {
+			close(startedC)
+			<-finishC
+			return nil
+		})
+	}()
+	return startedC, finishC, resultC
+}
+
+func TestManagerRunsCallsForASessionOneAtATime(t *testing.T) {
+	m, created := newTestManager(t)
+	var running, maxRunning atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := m.Do("a", func(a agent.Agent) error {
+				n := running.Add(1)
+				if n > maxRunning.Load() {
+					maxRunning.Store(n)
+				}
+				time.Sleep(time.Millisecond)
+				a.Answer("hi")
+				running.Add(-1)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxRunning.Load() != 1 {
+		t.Errorf("expected calls to run one at a time, got %d at once", maxRunning.Load())
+	}
+	if created.Load() != 1 {
+		t.Errorf("expected one agent for the session, got %d", created.Load())
+	}
+	answer, err := m.Answer("a", "again")
+	if err != nil || answer != "answer 21" {
+		t.Errorf("expected the session to have answered every call, got %q (%v)", answer, err)
+	}
+}
+
+func TestManagerRunsSessionsConcurrently(t *testing.T) {
+	m, _ := newTestManager(t)
+	startedA, finishA, resultA := doInBackground(m, "a")
+	<-startedA
+	startedB, finishB, resultB := doInBackground(m, "b")
+	select {
+	case <-startedB:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a call for another session waited for the first")
+	}
+	close(finishA)
+	close(finishB)
+	if err := errors.Join(<-resultA, <-resultB); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagerEvictsIdleSessions(t *testing.T) {
+	m, created := newTestManager(t, WithIdleTimeout(time.Millisecond))
+	if _, err := m.Answer("a", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.lock.Lock()
+		_, ok := m.sessions["a"]
+		m.lock.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the idle session was not evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	answer, err := m.Answer("a", "hi")
+	if err != nil || answer != "answer 1" || created.Load() != 2 {
+		t.Errorf("expected a new agent after eviction, got %q (%v) with %d agents created", answer, err, created.Load())
+	}
+}
+
+func TestManagerDoesNotEvictSessionsInUse(t *testing.T) {
+	m, created := newTestManager(t, WithIdleTimeout(time.Millisecond))
+	started, finish, result := doInBackground(m, "a")
+	<-started
+	time.Sleep(1500 * time.Millisecond)
+	close(finish)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Do("a", func(agent.Agent) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if created.Load() != 1 {
+		t.Errorf("expected the session in use to be kept, got %d agents created", created.Load())
+	}
+}
+
+func TestManagerLimitsSessions(t *testing.T) {
+	m, created := newTestManager(t, WithMaxSessions(1), WithIdleTimeout(0))
+	started, finish, result := doInBackground(m, "a")
+	<-started
+	err := m.Do("b", func(agent.Agent) error { return nil })
+	if !errors.Is(err, ErrTooManySessions) {
+		t.Errorf("expected too many sessions while the only session is in use, got %v", err)
+	}
+	close(finish)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Answer("b", "hi"); err != nil {
+		t.Fatalf("expected the idle session to make space, got %v", err)
+	}
+	if _, err := m.Answer("a", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if created.Load() != 3 {
+		t.Errorf("expected the least recently used session to be evicted, got %d agents created", created.Load())
+	}
+}
+
+func TestManagerRestoresSessionsFromStore(t *testing.T) {
+	store := newTestStore(t)
+	first, _ := newTestManager(t, WithStore(store))
+	if _, err := first.Answer("a", "one"); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := newTestManager(t, WithStore(store))
+	answer, err := second.Answer("a", "two")
+	if err != nil || answer != "answer 2" {
+		t.Errorf("expected the session to be restored, got %q (%v)", answer, err)
+	}
+	data, err := store.Load("a")
+	if err != nil || len(data.History) != 2 {
+		t.Errorf("expected both answers to be saved, got %+v (%v)", data, err)
+	}
+}
+
+func TestManagerDeleteWaitsForCallInFlight(t *testing.T) {
+	store := newTestStore(t)
+	m, created := newTestManager(t, WithStore(store))
+	started, finish, result := doInBackground(m, "a")
+	<-started
+	deleted := make(chan error, 1)
+	go func() { deleted <- m.Delete("a") }()
+	select {
+	case <-deleted:
+		t.Fatal("delete returned while the session was in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(finish)
+	if err := errors.Join(<-result, <-deleted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load("a"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected the session to be deleted from the store, got %v", err)
+	}
+	answer, err := m.Answer("a", "hi")
+	if err != nil || answer != "answer 1" || created.Load() != 2 {
+		t.Errorf("expected a new session after deletion, got %q (%v)", answer, err)
+	}
+}
+
+// A store whose loads of one session wait until they are let through.
+type slowStore struct {
+	Store
+	slowID  string
+	loading chan struct{}
+	proceed chan struct{}
+}
+
+func (s *slowStore) Load(id string) (SessionData, error) {
+	if id == s.slowID {
+		close(s.loading)
+		<-s.proceed
+	}
+	return s.Store.Load(id)
+}
+
+func TestManagerLoadsWithoutBlockingOtherSessions(t *testing.T) {
+	store := &slowStore{newTestStore(t), "slow", make(chan struct{}), make(chan struct{})}
+	m, _ := newTestManager(t, WithStore(store))
+	if _, err := m.Answer("a", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	loaded := make(chan error, 1)
+	go func() {
+		_, err := m.Answer("slow", "hi")
+		loaded <- err
+	}()
+	<-store.loading
+	done := make(chan error, 1)
+	go func() {
+		_, errA := m.Answer("a", "again")
+		_, errB := m.Answer("b", "hi")
+		done <- errors.Join(errA, errB)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow load blocked other sessions")
+	}
+	close(store.proceed)
+	if err := <-loaded; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A store whose loads fail.
+type failingStore struct {
+	Store
+}
+
+func (failingStore) Load(string) (SessionData, error) {
+	return SessionData{}, errors.New("store is down")
+}
+
+func TestManagerForgetsSessionsThatFailToLoad(t *testing.T) {
+	m, _ := newTestManager(t, WithStore(failingStore{newTestStore(t)}))
+	if err := m.Do("a", func(agent.Agent) error { return nil }); err == nil {
+		t.Fatal("expected the load to fail")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.sessions) != 0 {
+		t.Errorf("expected the failed session not to be kept, got %d sessions", len(m.sessions))
+	}
+}
+
+func TestManagerDoWithFactory(t *testing.T) {
+	m := NewManager(nil)
+	defer m.Close()
+	built := 0
+	factory := func() agent.Agent {
+		built++
+		return &historyAgent{}
+	}
+	for range 2 {
+		if err := m.DoWithFactory("a", factory, func(a agent.Agent) error {
+			_, err := a.Answer("hi")
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if built != 1 {
+		t.Errorf("expected the factory to build the agent of the new session only, got %d agents", built)
+	}
+}
@@ -0,0 +1,104 @@
+package agentsession
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// A store which saves sessions in a table of a SQLite database.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// Create a store which saves sessions in the database, creating the sessions table if it does not exist.
+// The database must be opened with a SQLite driver, such as modernc.org/sqlite or github.com/mattn/go-sqlite3.
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS agent_sessions (
+		id TEXT PRIMARY KEY,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		metadata TEXT NOT NULL,
+		history TEXT NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Load implements Store.
+func (s *SQLiteStore) Load(id string) (SessionData, error) {
+	row := s.db.QueryRow(`SELECT id, created_at, updated_at, metadata, history FROM agent_sessions WHERE id = ?`, id)
+	data, err := scanSession(row, true)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SessionData{}, ErrSessionNotFound
+	}
+	return data, err
+}
+
+// Save implements Store.
+func (s *SQLiteStore) Save(data SessionData) error {
+	metadata, err := json.Marshal(data.Metadata)
+	if err != nil {
+		return err
+	}
+	history, err := json.Marshal(data.History)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO agent_sessions (id, created_at, updated_at, metadata, history) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET updated_at = excluded.updated_at, metadata = excluded.metadata, history = excluded.history`,
+		data.ID, data.CreatedAt.UnixMilli(), data.UpdatedAt.UnixMilli(), string(metadata), string(history),
+	)
+	return err
+}
+
+// Delete implements Store.
+func (s *SQLiteStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM agent_sessions WHERE id = ?`, id)
+	return err
+}
+
+// List implements Store.
+func (s *SQLiteStore) List() ([]SessionData, error) {
+	rows, err := s.db.Query(`SELECT id, created_at, updated_at, metadata, '' FROM agent_sessions ORDER BY updated_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := make([]SessionData, 0)
+	for rows.Next() {
+		data, err := scanSession(rows, false)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, data)
+	}
+	return sessions, rows.Err()
+}
+
+func scanSession(row interface{ Scan(...any) error }, withHistory bool) (SessionData, error) {
+	var data SessionData
+	var createdAt, updatedAt int64
+	var metadata, history string
+	err := row.Scan(&data.ID, &createdAt, &updatedAt, &metadata, &history)
+	if err != nil {
+		return SessionData{}, err
+	}
+	data.CreatedAt = time.UnixMilli(createdAt)
+	data.UpdatedAt = time.UnixMilli(updatedAt)
+	err = json.Unmarshal([]byte(metadata), &data.Metadata)
+	if err != nil {
+		return SessionData{}, err
+	}
+	if withHistory {
+		err = json.Unmarshal([]byte(history), &data.History)
+		if err != nil {
+			return SessionData{}, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,33 @@
+package agentsession
+
+import (
+	"errors"
+	"time"
+
+	"github.com/JoshPattman/agent"
+)
+
+// Returned by a store when there is no session with the requested ID.
+var ErrSessionNotFound = errors.New("session not found")
+
+// A session as it is saved in a store.
+type SessionData struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Extra information about the session for the application, such as the name of the agent.
+	Metadata map[string]string     `json:"metadata,omitempty"`
+	History  []agent.CompletedTask `json:"history"`
+}
+
+// Saves sessions so that they can be restored after they are evicted, or after a restart.
+type Store interface {
+	// Load the session, returning ErrSessionNotFound if it does not exist.
+	Load(id string) (SessionData, error)
+	// Save the session, replacing any existing session with the same ID.
+	Save(SessionData) error
+	// Delete the session. Deleting a session that does not exist is not an error.
+	Delete(id string) error
+	// List all sessions without their history, most recently updated first.
+	List() ([]SessionData, error)
+}
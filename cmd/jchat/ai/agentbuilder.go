@@ -2,6 +2,7 @@ package ai
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/JoshPattman/agent"
@@ -10,40 +11,56 @@ import (
 	"github.com/JoshPattman/jpf"
 )
 
-func BuildAgentBuilder(activeAgentName string, modelsConf ModelsConfig, agentsConf AgentsConfig, mcpsConf MCPServersConfig, commandsConf CustomCommandsConfig, usageCounter *jpf.UsageCounter) (func() agent.Agent, error) {
+// Create a function to build the configured agent, also returning the tools that agent currently has.
+// The tools of MCP servers may change while the agent runs, as the agent always uses the latest tools of each server.
+func BuildAgentBuilder(activeAgentName string, modelsConf ModelsConfig, agentsConf AgentsConfig, mcpClients *MCPClients, commandsConf CustomCommandsConfig, usageCounter *jpf.UsageCounter) (func() agent.Agent, []agent.Tool, error) {
 	agentConf, ok := agentsConf.Agents[activeAgentName]
 	if !ok {
-		return nil, fmt.Errorf("could not find a configured agent called '%s'", activeAgentName)
+		return nil, nil, fmt.Errorf("could not find a configured agent called '%s'", activeAgentName)
+	}
+	if cycle := agentsConf.SubAgentCycle(activeAgentName); cycle != nil {
+		return nil, nil, fmt.Errorf("the sub agents of '%s' form a cycle (%s)", activeAgentName, strings.Join(cycle, " -> "))
 	}
 	// Get model builder
 	model, ok := modelsConf.Models[agentConf.ModelName]
 	if !ok {
-		return nil, fmt.Errorf("could not find model for %s", model)
+		return nil, nil, fmt.Errorf("could not find model '%s'", agentConf.ModelName)
 	}
-	modelBuilder := &ModelBuilder{
-		model.Key,
-		model.Name,
-		model.URL,
-		usageCounter,
-		model.Headers,
+	if err := model.CheckUsable(); err != nil {
+		return nil, nil, fmt.Errorf("could not use model '%s': %w", agentConf.ModelName, err)
 	}
+	modelBuilder := NewModelBuilder(model, usageCounter)
 
 	// Create MCPtools
 	tools := make([]agent.Tool, 0)
+	toolProviders := make([]agent.ToolProvider, 0)
 	for _, serverName := range agentConf.MCPServers {
-		server, ok := mcpsConf.MCPServers[serverName]
-		if !ok {
-			return nil, fmt.Errorf("could not find mcp server '%s'", serverName)
+		conn, err := mcpClients.Get(serverName)
+		if err != nil {
+			return nil, nil, err
 		}
-		client, err := agentmcp.CreateClient(server.Addr, server.Headers)
+		toolProviders = append(toolProviders, conn)
+		tools = append(tools, conn.ResourceAndPromptTools(serverName)...)
+	}
+
+	// Read MCP resources to add to the system prompt
+	contextDocuments := make(map[string]string)
+	for serverName, uris := range agentConf.MCPResources {
+		conn, err := mcpClients.Get(serverName)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		clientTools, err := agentmcp.CreateToolsFromMCP(client)
+		client, err := conn.Client()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		for _, uri := range uris {
+			content, err := agentmcp.ReadResourceText(client, uri)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not read resource '%s' from mcp server '%s': %w", uri, serverName, err)
+			}
+			contextDocuments[uri] = content
 		}
-		tools = append(tools, clientTools...)
 	}
 
 	// Create built-in tools
@@ -61,9 +78,9 @@ func BuildAgentBuilder(activeAgentName string, modelsConf ModelsConfig, agentsCo
 
 	// Create agent-as-tool tools
 	for _, ac := range agentConf.SubAgents {
-		ab, err := BuildAgentBuilder(ac, modelsConf, agentsConf, mcpsConf, commandsConf, usageCounter)
+		ab, _, err := BuildAgentBuilder(ac, modelsConf, agentsConf, mcpClients, commandsConf, usageCounter)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		subAgentConfig := agentsConf.Agents[ac] // This is safe to not check as we already checked above recursively
 		tools = append(tools, agent.NewAgentQuickQuestionTool(ab, ac, strings.Join(subAgentConfig.AgentDescription, ". ")))
@@ -73,7 +90,7 @@ func BuildAgentBuilder(activeAgentName string, modelsConf ModelsConfig, agentsCo
 	for _, ccID := range agentConf.CustomCommands {
 		ccConf, ok := commandsConf.Commands[ccID]
 		if !ok {
-			return nil, fmt.Errorf("could not find custom command '%s'", ccID)
+			return nil, nil, fmt.Errorf("could not find custom command '%s'", ccID)
 		}
 		tools = append(tools, agent.NewCustomExecuteCommandTool(
 			ccID,
@@ -88,9 +105,15 @@ func BuildAgentBuilder(activeAgentName string, modelsConf ModelsConfig, agentsCo
 		return craig.New(
 			modelBuilder,
 			craig.WithTools(tools...),
+			craig.WithToolProviders(toolProviders...),
 			craig.WithPersonality(agentConf.Personality),
 			craig.WithScenarios(agentConf.Scenarios),
+			craig.WithContextDocuments(contextDocuments),
 		)
 	}
-	return ab, nil
+	currentTools := slices.Clone(tools)
+	for _, p := range toolProviders {
+		currentTools = append(currentTools, p.Tools()...)
+	}
+	return ab, currentTools, nil
 }
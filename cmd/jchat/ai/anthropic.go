@@ -0,0 +1,211 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/JoshPattman/jpf"
+)
+
+// The Anthropic API requires a limit on the tokens generated, so one is used if none is configured.
+const defaultAnthropicMaxTokens = 8192
+
+// How many tokens a model may think for at each reasoning effort.
+var anthropicThinkingBudgets = map[string]int{
+	"minimal": 1024,
+	"low":     4096,
+	"medium":  10000,
+	"high":    32000,
+}
+
+// A model behind the Anthropic Messages API.
+// It has no structured output, so is wrapped to ask for JSON in the prompt when a schema is needed.
+type anthropicModel struct {
+	modelSettings
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	TopP        *float64           `json:"top_p,omitempty"`
+	Thinking    *anthropicThinking `json:"thinking,omitempty"`
+	Stream      bool               `json:"stream,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string                 `json:"role"`
+	Content []anthropicContentPart `json:"content"`
+}
+
+type anthropicContentPart struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      anthropicUsage `json:"usage"`
+}
+
+// An event in a streamed response, of which only the fields of the events that matter are read.
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (m *anthropicModel) Respond(ctx context.Context, msgs []jpf.Message) (jpf.ModelResponse, error) {
+	req, err := m.request(msgs)
+	if err != nil {
+		return jpf.ModelResponse{}, err
+	}
+	resp, err := m.post(ctx, req)
+	if err != nil {
+		return jpf.ModelResponse{}, err
+	}
+	defer resp.Body.Close()
+	if req.Stream {
+		return m.readStream(resp.Body)
+	}
+	var decoded anthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return jpf.ModelResponse{}, fmt.Errorf("could not decode model response: %w", err)
+	}
+	if decoded.StopReason == "refusal" {
+		return jpf.ModelResponse{}, errors.New("model refused to respond")
+	}
+	content := &strings.Builder{}
+	for _, part := range decoded.Content {
+		// Thinking is not part of the answer
+		if part.Type == "text" {
+			content.WriteString(part.Text)
+		}
+	}
+	return jpf.ModelResponse{
+		PrimaryMessage: jpf.Message{Role: jpf.AssistantRole, Content: content.String()},
+		Usage:          jpf.Usage{InputTokens: decoded.Usage.InputTokens, OutputTokens: decoded.Usage.OutputTokens},
+	}, nil
+}
+
+// Write the request for the messages, with the system messages taken out into the system prompt.
+func (m *anthropicModel) request(msgs []jpf.Message) (anthropicRequest, error) {
+	req := anthropicRequest{
+		Model:       m.name,
+		MaxTokens:   m.params.MaxTokens,
+		Temperature: m.params.Temperature,
+		TopP:        m.params.TopP,
+		Stream:      m.streams(),
+	}
+	if budget, ok := anthropicThinkingBudgets[m.params.ReasoningEffort]; ok {
+		req.Thinking = &anthropicThinking{Type: "enabled", BudgetTokens: budget}
+		// The budget is part of the limit, so leave room for the answer after thinking
+		if req.MaxTokens <= budget {
+			req.MaxTokens = budget + defaultAnthropicMaxTokens
+		}
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = defaultAnthropicMaxTokens
+	}
+	system := make([]string, 0)
+	conversation := make([]jpf.Message, 0, len(msgs))
+	for _, msg := range withoutReasoning(msgs) {
+		if msg.Role == jpf.SystemRole {
+			system = append(system, msg.Content)
+		} else {
+			conversation = append(conversation, msg)
+		}
+	}
+	req.System = strings.Join(system, "\n\n")
+	for _, msg := range mergeConsecutiveMessages(conversation) {
+		role := "user"
+		if msg.Role == jpf.AssistantRole {
+			role = "assistant"
+		}
+		parts := make([]anthropicContentPart, 0, len(msg.Images)+1)
+		for _, img := range msg.Images {
+			data, err := encodeImage(img)
+			if err != nil {
+				return anthropicRequest{}, err
+			}
+			parts = append(parts, anthropicContentPart{Type: "image", Source: &anthropicImageSource{Type: "base64", MediaType: "image/png", Data: data}})
+		}
+		if msg.Content != "" || len(parts) == 0 {
+			parts = append(parts, anthropicContentPart{Type: "text", Text: msg.Content})
+		}
+		req.Messages = append(req.Messages, anthropicMessage{Role: role, Content: parts})
+	}
+	return req, nil
+}
+
+// Read a streamed response of server-sent events, passing each piece of text on as it arrives.
+func (m *anthropicModel) readStream(body io.Reader) (jpf.ModelResponse, error) {
+	content := &strings.Builder{}
+	var usage jpf.Usage
+	err := readServerSentEvents(body, func(_, data string) error {
+		var event anthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("could not decode streamed model response: %w", err)
+		}
+		switch event.Type {
+		case "message_start":
+			usage.InputTokens = event.Message.Usage.InputTokens
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" {
+				m.streamText(content, event.Delta.Text)
+			}
+		case "message_delta":
+			usage.OutputTokens = event.Usage.OutputTokens
+			if event.Delta.StopReason == "refusal" {
+				return errors.New("model refused to respond")
+			}
+		case "error":
+			return fmt.Errorf("model stream failed: %s", event.Error.Message)
+		}
+		return nil
+	})
+	if err != nil {
+		return jpf.ModelResponse{}, err
+	}
+	return jpf.ModelResponse{
+		PrimaryMessage: jpf.Message{Role: jpf.AssistantRole, Content: content.String()},
+		Usage:          usage,
+	}, nil
+}
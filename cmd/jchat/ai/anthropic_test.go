@@ -0,0 +1,144 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/JoshPattman/jpf"
+)
+
+func TestAnthropicRequestShape(t *testing.T) {
+	var body map[string]any
+	server := newRecordingServer(t, &body, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") != "sk-ant" || r.Header.Get("anthropic-version") != anthropicVersion {
+			t.Errorf("unexpected auth headers %v", r.Header)
+		}
+		fmt.Fprint(w, `{"content": [{"type": "thinking", "thinking": "hmm"}, {"type": "text", "text": "hi"}], "stop_reason": "end_turn", "usage": {"input_tokens": 5, "output_tokens": 7}}`)
+	})
+	model := &anthropicModel{modelSettings{
+		url:         server.URL,
+		name:        "claude-test",
+		authHeaders: authHeaders(ProviderAnthropic, "sk-ant"),
+	}}
+	resp, err := model.Respond(context.Background(), []jpf.Message{
+		{Role: jpf.SystemRole, Content: "Be brief."},
+		{Role: jpf.UserRole, Content: "one"},
+		{Role: jpf.SystemRole, Content: "Be kind."},
+		{Role: jpf.UserRole, Content: "two"},
+		{Role: jpf.AssistantRole, Content: "three"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PrimaryMessage.Content != "hi" {
+		t.Errorf("expected only the text of the answer, got %q", resp.PrimaryMessage.Content)
+	}
+	if resp.Usage.InputTokens != 5 || resp.Usage.OutputTokens != 7 {
+		t.Errorf("unexpected usage %+v", resp.Usage)
+	}
+	if body["model"] != "claude-test" || body["system"] != "Be brief.\n\nBe kind." {
+		t.Errorf("expected the system messages to be lifted into the system prompt, got %v", body)
+	}
+	if body["max_tokens"] != float64(defaultAnthropicMaxTokens) {
+		t.Errorf("expected the default max tokens, got %v", body["max_tokens"])
+	}
+	if _, ok := body["thinking"]; ok {
+		t.Error("expected no thinking without a reasoning effort")
+	}
+	messages, _ := body["messages"].([]any)
+	roles := make([]string, 0)
+	texts := make([]string, 0)
+	for _, m := range messages {
+		m := m.(map[string]any)
+		roles = append(roles, m["role"].(string))
+		texts = append(texts, m["content"].([]any)[0].(map[string]any)["text"].(string))
+	}
+	if !slices.Equal(roles, []string{"user", "assistant"}) || !slices.Equal(texts, []string{"one\n\ntwo", "three"}) {
+		t.Errorf("expected consecutive user messages to be merged, got roles %q and texts %q", roles, texts)
+	}
+}
+
+func TestAnthropicThinkingBudget(t *testing.T) {
+	for _, tc := range []struct {
+		effort     string
+		maxTokens  int
+		wantBudget int
+		wantMax    int
+	}{
+		{"minimal", 0, 1024, 1024 + defaultAnthropicMaxTokens},
+		{"medium", 0, 10000, 10000 + defaultAnthropicMaxTokens},
+		{"high", 40000, 32000, 40000},
+		{"low", 4096, 4096, 4096 + defaultAnthropicMaxTokens},
+	} {
+		model := &anthropicModel{modelSettings{params: GenerationParams{ReasoningEffort: tc.effort, MaxTokens: tc.maxTokens}}}
+		req, err := model.request(testMessages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Thinking == nil || req.Thinking.Type != "enabled" || req.Thinking.BudgetTokens != tc.wantBudget {
+			t.Errorf("%s: expected a budget of %d, got %+v", tc.effort, tc.wantBudget, req.Thinking)
+		}
+		if req.MaxTokens != tc.wantMax {
+			t.Errorf("%s with max tokens %d: expected max tokens %d, got %d", tc.effort, tc.maxTokens, tc.wantMax, req.MaxTokens)
+		}
+	}
+}
+
+func TestAnthropicStream(t *testing.T) {
+	var body map[string]any
+	server := newRecordingServer(t, &body, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range []string{
+			`{"type": "message_start", "message": {"usage": {"input_tokens": 10}}}`,
+			`{"type": "content_block_delta", "delta": {"type": "thinking_delta", "thinking": "hmm"}}`,
+			`{"type": "content_block_delta", "delta": {"type": "text_delta", "text": "Hel"}}`,
+			`{"type": "ping"}`,
+			`{"type": "content_block_delta", "delta": {"type": "text_delta", "text": "lo"}}`,
+			`{"type": "message_delta", "delta": {"stop_reason": "end_turn"}, "usage": {"output_tokens": 3}}`,
+			`{"type": "message_stop"}`,
+		} {
+			fmt.Fprintf(w, "event: x\ndata: %s\n\n", event)
+		}
+	})
+	began := 0
+	chunks := make([]string, 0)
+	model := &anthropicModel{modelSettings{
+		url:           server.URL,
+		onStreamBegin: func() { began++ },
+		onStreamText:  func(s string) { chunks = append(chunks, s) },
+	}}
+	resp, err := model.Respond(context.Background(), testMessages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body["stream"] != true {
+		t.Errorf("expected the request to stream, got %v", body["stream"])
+	}
+	if resp.PrimaryMessage.Content != "Hello" || !slices.Equal(chunks, []string{"Hel", "lo"}) || began != 1 {
+		t.Errorf("unexpected stream: content %q, chunks %q, began %d times", resp.PrimaryMessage.Content, chunks, began)
+	}
+	if resp.Usage.InputTokens != 10 || resp.Usage.OutputTokens != 3 {
+		t.Errorf("unexpected usage %+v", resp.Usage)
+	}
+}
+
+func TestAnthropicStreamErrors(t *testing.T) {
+	for name, events := range map[string][]string{
+		"error event": {`{"type": "error", "error": {"message": "overloaded"}}`},
+		"refusal":     {`{"type": "message_delta", "delta": {"stop_reason": "refusal"}}`},
+	} {
+		var body map[string]any
+		server := newRecordingServer(t, &body, func(w http.ResponseWriter, r *http.Request) {
+			for _, event := range events {
+				fmt.Fprintf(w, "data: %s\n\n", event)
+			}
+		})
+		model := &anthropicModel{modelSettings{url: server.URL, onStreamText: func(string) {}}}
+		if _, err := model.Respond(context.Background(), testMessages); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -1,19 +1,39 @@
 package ai
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
-	"slices"
+	"path/filepath"
 	"strings"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/JoshPattman/agent"
 	"github.com/JoshPattman/jpf"
 )
 
+const (
+	// The maximum number of characters of a file sent to the model in a single map step.
+	fileQAChunkSize = 24000
+	// The number of characters shared between neighbouring chunks, so answers spanning a boundary are not lost.
+	fileQAChunkOverlap = 500
+	// The maximum number of model calls that may be in flight at once for a single tool call.
+	fileQAMaxConcurrency = 4
+	// The number of leading bytes inspected when deciding if a file is binary.
+	fileQABinarySniffLen = 8000
+	// Files larger than this are skipped rather than queried, as they would take too many model calls.
+	fileQAMaxFileBytes = 2_000_000
+	// Files split into more chunks than this are skipped.
+	fileQAMaxChunks = 100
+	// The most answers combined by a single reduce step, and the most characters of answers it is sent.
+	// More answers than this are combined in rounds, so the combining prompt never grows past the context of the model.
+	fileQAReduceBatchSize  = 8
+	fileQAReduceBatchChars = fileQAChunkSize
+)
+
 func NewFileQATool(builder *ModelBuilder) agent.Tool {
 	return &batchFileQA{builder}
 }
@@ -23,12 +43,21 @@ type fileQAInput struct {
 	Query   string
 }
 
+type fileQAReduceInput struct {
+	Query   string
+	Answers []fileQAPartialAnswer
+}
+
+type fileQAPartialAnswer struct {
+	Source string
+	Answer string
+}
+
 type batchFileQA struct {
 	builder *ModelBuilder
 }
 
 func (b *batchFileQA) Call(args map[string]any) (string, error) {
-	mf := b.buildMF()
 	queryAny, ok1 := args["query"]
 	pathsAny, ok2 := args["paths"]
 	if !(ok1 && ok2) {
@@ -39,56 +68,202 @@ func (b *batchFileQA) Call(args map[string]any) (string, error) {
 	if !(ok1 && ok2) {
 		return "", errors.New("query must be a string and paths muct be a list of strings")
 	}
-	paths := make([]string, len(pathsAnyList))
-	for i := range paths {
-		paths[i], ok1 = pathsAnyList[i].(string)
+	patterns := make([]string, len(pathsAnyList))
+	for i := range patterns {
+		patterns[i], ok1 = pathsAnyList[i].(string)
 		if !ok1 {
 			return "", errors.New("all paths must be strings")
 		}
 	}
-	contents := make([]string, len(paths))
+	combine := false
+	if combineAny, ok := args["combine"]; ok {
+		combine, ok = combineAny.(bool)
+		if !ok {
+			return "", errors.New("combine must be a boolean (or not specified)")
+		}
+	}
+	paths, err := expandFileQAPaths(patterns)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", errors.New("no files matched the provided paths")
+	}
+
+	mapMF := b.buildMapMF()
+	reduceMF := b.buildReduceMF()
+	sem := make(chan struct{}, fileQAMaxConcurrency)
+	results := make([]fileQAResult, len(paths))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(paths))
 	for i, pth := range paths {
-		err := func() error {
-			f, err := os.Open(pth)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			data, err := io.ReadAll(f)
-			if err != nil {
-				return err
-			}
-			contents[i] = string(data)
-			return nil
+		go func() {
+			defer wg.Done()
+			results[i] = b.answerFile(mapMF, reduceMF, sem, pth, query)
 		}()
+	}
+	wg.Wait()
+
+	answers := make([]fileQAPartialAnswer, 0)
+	report := make([]string, 0)
+	numFailed := 0
+	for _, res := range results {
+		switch {
+		case res.err != nil:
+			numFailed++
+			report = append(report, fmt.Sprintf("%s:\nerror: %s", res.path, res.err.Error()))
+		case res.skipped != "":
+			report = append(report, fmt.Sprintf("%s:\nskipped: %s", res.path, res.skipped))
+		default:
+			answers = append(answers, fileQAPartialAnswer{res.path, res.answer})
+			report = append(report, fmt.Sprintf("%s:\n%s", res.path, res.answer))
+		}
+	}
+	if numFailed == len(results) {
+		errs := make([]error, len(results))
+		for i, res := range results {
+			errs[i] = fmt.Errorf("%s: %w", res.path, res.err)
+		}
+		return "", errors.Join(errs...)
+	}
+	if combine && len(answers) > 1 {
+		combined, err := reduceAnswers(reduceMF, sem, query, answers)
 		if err != nil {
-			return "", err
+			report = append(report, fmt.Sprintf("Combined answer:\nerror: %s", err.Error()))
+		} else {
+			report = append([]string{fmt.Sprintf("Combined answer:\n%s", combined)}, report...)
 		}
 	}
-	results := make([]string, len(paths))
-	errs := make([]error, len(paths))
+	return strings.Join(report, "\n\n"), nil
+}
+
+type fileQAResult struct {
+	path    string
+	answer  string
+	skipped string
+	err     error
+}
+
+// Answer the query for a single file by mapping over each chunk then reducing the chunk answers.
+func (b *batchFileQA) answerFile(
+	mapMF jpf.MapFunc[fileQAInput, string],
+	reduceMF jpf.MapFunc[fileQAReduceInput, string],
+	sem chan struct{},
+	pth string,
+	query string,
+) fileQAResult {
+	info, err := os.Stat(pth)
+	if err != nil {
+		return fileQAResult{path: pth, err: err}
+	}
+	if info.Size() > fileQAMaxFileBytes {
+		return fileQAResult{path: pth, skipped: fmt.Sprintf("file is larger than the limit of %d bytes", fileQAMaxFileBytes)}
+	}
+	data, err := os.ReadFile(pth)
+	if err != nil {
+		return fileQAResult{path: pth, err: err}
+	}
+	if isBinaryContent(data) {
+		return fileQAResult{path: pth, skipped: "file appears to be binary"}
+	}
+	chunks := chunkText(string(data), fileQAChunkSize, fileQAChunkOverlap)
+	if len(chunks) == 0 {
+		return fileQAResult{path: pth, skipped: "file is empty"}
+	}
+	if len(chunks) > fileQAMaxChunks {
+		return fileQAResult{path: pth, skipped: fmt.Sprintf("file would be split into %d parts, more than the limit of %d", len(chunks), fileQAMaxChunks)}
+	}
+	chunkAnswers := make([]fileQAPartialAnswer, len(chunks))
+	errs := make([]error, len(chunks))
 	wg := &sync.WaitGroup{}
-	wg.Add(len(paths))
-	for i, content := range contents {
+	wg.Add(len(chunks))
+	for i, chunk := range chunks {
 		go func() {
 			defer wg.Done()
-			res, _, err := mf.Call(context.Background(), fileQAInput{content, query})
+			res, err := callLimited(sem, mapMF, fileQAInput{chunk, query})
 			if err != nil {
 				errs[i] = err
-			} else {
-				results[i] = fmt.Sprintf("%s:\n%s", paths[i], res)
+				return
 			}
+			chunkAnswers[i] = fileQAPartialAnswer{fmt.Sprintf("part %d of %d", i+1, len(chunks)), res}
 		}()
 	}
 	wg.Wait()
-	errs = slices.DeleteFunc(errs, func(err error) bool { return err == nil })
-	if len(errs) != 0 {
-		return "", errors.Join(errs...)
+	if err := errors.Join(errs...); err != nil {
+		return fileQAResult{path: pth, err: err}
 	}
-	return strings.Join(results, "\n\n"), nil
+	if len(chunkAnswers) == 1 {
+		return fileQAResult{path: pth, answer: chunkAnswers[0].Answer}
+	}
+	res, err := reduceAnswers(reduceMF, sem, query, chunkAnswers)
+	if err != nil {
+		return fileQAResult{path: pth, err: err}
+	}
+	return fileQAResult{path: pth, answer: res}
 }
 
-func (b *batchFileQA) buildMF() jpf.MapFunc[fileQAInput, string] {
+// Combine the answers into one, in rounds of small batches so that no single reduce step is sent too much.
+func reduceAnswers(
+	reduceMF jpf.MapFunc[fileQAReduceInput, string],
+	sem chan struct{},
+	query string,
+	answers []fileQAPartialAnswer,
+) (string, error) {
+	for len(answers) > 1 {
+		batches := batchAnswers(answers, fileQAReduceBatchSize, fileQAReduceBatchChars)
+		reduced := make([]fileQAPartialAnswer, len(batches))
+		errs := make([]error, len(batches))
+		wg := &sync.WaitGroup{}
+		wg.Add(len(batches))
+		for i, batch := range batches {
+			go func() {
+				defer wg.Done()
+				if len(batch) == 1 {
+					reduced[i] = batch[0]
+					return
+				}
+				res, err := callLimited(sem, reduceMF, fileQAReduceInput{query, batch})
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				reduced[i] = fileQAPartialAnswer{fmt.Sprintf("%s to %s", batch[0].Source, batch[len(batch)-1].Source), res}
+			}()
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			return "", err
+		}
+		answers = reduced
+	}
+	return answers[0].Answer, nil
+}
+
+// Split the answers into batches of at most size answers and (unless a single answer is longer) at most chars characters.
+// Each batch has at least two answers where possible, so every round of reducing makes progress.
+func batchAnswers(answers []fileQAPartialAnswer, size, chars int) [][]fileQAPartialAnswer {
+	batches := make([][]fileQAPartialAnswer, 0)
+	batch := make([]fileQAPartialAnswer, 0)
+	batchChars := 0
+	for _, answer := range answers {
+		if len(batch) >= 2 && (len(batch) >= size || batchChars+len(answer.Answer) > chars) {
+			batches = append(batches, batch)
+			batch, batchChars = make([]fileQAPartialAnswer, 0), 0
+		}
+		batch = append(batch, answer)
+		batchChars += len(answer.Answer)
+	}
+	return append(batches, batch)
+}
+
+func callLimited[T any](sem chan struct{}, mf jpf.MapFunc[T, string], input T) (string, error) {
+	sem <- struct{}{}
+	defer func() { <-sem }()
+	res, _, err := mf.Call(context.Background(), input)
+	return res, err
+}
+
+func (b *batchFileQA) buildMapMF() jpf.MapFunc[fileQAInput, string] {
 	return jpf.NewOneShotMapFunc(
 		jpf.NewTemplateMessageEncoder[fileQAInput]("", "Document:\n{{ .Content }}\n\n\nQuery: {{ .Query }}"),
 		jpf.NewRawStringResponseDecoder[fileQAInput](),
@@ -96,11 +271,101 @@ func (b *batchFileQA) buildMF() jpf.MapFunc[fileQAInput, string] {
 	)
 }
 
+func (b *batchFileQA) buildReduceMF() jpf.MapFunc[fileQAReduceInput, string] {
+	return jpf.NewOneShotMapFunc(
+		jpf.NewTemplateMessageEncoder[fileQAReduceInput](
+			"",
+			"The following are answers to the same query, each produced from a different part of the source material.\n"+
+				"Combine them into a single answer to the query. Where parts disagree or only some parts are relevant, say so.\n\n"+
+				"{{ range .Answers }}Answer from {{ .Source }}:\n{{ .Answer }}\n\n\n{{ end }}"+
+				"Query: {{ .Query }}",
+		),
+		jpf.NewRawStringResponseDecoder[fileQAReduceInput](),
+		b.builder.BuildFileQAModel(),
+	)
+}
+
+// Expand any glob patterns in the paths, removing duplicates but keeping order.
+// Patterns that match nothing are kept as-is so the missing file is reported.
+func expandFileQAPaths(patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	paths := make([]string, 0)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern '%s': %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			matches = []string{pattern}
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.IsDir() {
+				continue
+			}
+			if !seen[match] {
+				seen[match] = true
+				paths = append(paths, match)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// Decide if the content is binary by looking for NUL bytes or invalid utf8 near the start.
+func isBinaryContent(data []byte) bool {
+	sniff := data[:min(len(data), fileQABinarySniffLen)]
+	if bytes.IndexByte(sniff, 0) != -1 {
+		return true
+	}
+	if len(sniff) < len(data) {
+		// Allow for a multi-byte rune to have been cut off at the end of the sniffed region.
+		for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(sniff); i++ {
+			sniff = sniff[:len(sniff)-1]
+		}
+	}
+	return !utf8.Valid(sniff)
+}
+
+// Split text into chunks of at most size runes, preferring to split on line boundaries.
+// Each chunk after the first begins with the last overlap runes of the previous chunk.
+func chunkText(text string, size, overlap int) []string {
+	runes := []rune(text)
+	if len(runes) == 0 {
+		return nil
+	}
+	if len(runes) <= size {
+		return []string{text}
+	}
+	chunks := make([]string, 0)
+	start := 0
+	for start < len(runes) {
+		end := min(start+size, len(runes))
+		if end < len(runes) {
+			// Walk back to the last newline in the second half of the chunk, if there is one.
+			for i := end; i > start+size/2; i-- {
+				if runes[i-1] == '\n' {
+					end = i
+					break
+				}
+			}
+		}
+		chunks = append(chunks, string(runes[start:end]))
+		if end == len(runes) {
+			break
+		}
+		start = max(end-overlap, start+1)
+	}
+	return chunks
+}
+
 func (b *batchFileQA) Description() []string {
 	return []string{
 		"Run a plaintext query across one or more files.",
 		"The query can be as simple or advanced as you need.",
-		"Pass two arguments, 'query' (string) and 'paths' (list of strings).",
+		"Pass two arguments, 'query' (string) and 'paths' (list of strings). Paths may be glob patterns such as 'src/*.go'.",
+		fmt.Sprintf("Large files are split into parts which are queried separately and then summarised into one answer per file. Files over %d bytes are skipped.", fileQAMaxFileBytes),
+		"Optionally pass 'combine' (bool) to also get a single combined answer across all files.",
+		"Binary files are skipped, and a file that fails to be read or queried is reported without failing the others.",
 	}
 }
 
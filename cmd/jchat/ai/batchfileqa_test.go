@@ -0,0 +1,82 @@
+package ai
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChunkText(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		text          string
+		size, overlap int
+		want          []string
+	}{
+		{"empty", "", 4, 1, nil},
+		{"fits in one chunk", "abc", 5, 1, []string{"abc"}},
+		{"overlapping chunks", "abcdefghij", 4, 1, []string{"abcd", "defg", "ghij"}},
+		{"splits on a newline in the second half", "ab\ncdefgh", 5, 0, []string{"ab\n", "cdefg", "h"}},
+		{"ignores a newline in the first half", "a\nbcdefgh", 6, 0, []string{"a\nbcde", "fgh"}},
+		{"counts runes not bytes", "héllo wörld", 4, 0, []string{"héll", "o wö", "rld"}},
+		{"always moves forward", "abcdef", 2, 5, []string{"ab", "bc", "cd", "de", "ef"}},
+	} {
+		if got := chunkText(tc.text, tc.size, tc.overlap); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBatchAnswers(t *testing.T) {
+	answers := func(lengths ...int) []fileQAPartialAnswer {
+		as := make([]fileQAPartialAnswer, len(lengths))
+		for i, l := range lengths {
+			as[i] = fileQAPartialAnswer{Source: string(rune('a' + i)), Answer: strings.Repeat("x", l)}
+		}
+		return as
+	}
+	sources := func(batches [][]fileQAPartialAnswer) []string {
+		s := make([]string, len(batches))
+		for i, batch := range batches {
+			for _, a := range batch {
+				s[i] += a.Source
+			}
+		}
+		return s
+	}
+	for _, tc := range []struct {
+		name        string
+		answers     []fileQAPartialAnswer
+		size, chars int
+		want        []string
+	}{
+		{"one answer", answers(1), 2, 100, []string{"a"}},
+		{"limited by count", answers(1, 1, 1, 1, 1), 2, 100, []string{"ab", "cd", "e"}},
+		{"limited by characters", answers(5, 5, 5, 5), 10, 12, []string{"ab", "cd"}},
+		{"at least two answers per batch", answers(50, 50, 50), 10, 10, []string{"ab", "c"}},
+	} {
+		if got := sources(batchAnswers(tc.answers, tc.size, tc.chars)); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got batches %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIsBinaryContent(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"empty", "", false},
+		{"text", "hello\nworld\n", false},
+		{"multi-byte text", "héllo wörld ✓", false},
+		{"null byte", "hel\x00lo", true},
+		{"invalid utf-8", "\xff\xfe\xfd", true},
+		{"rune cut off at the end of the sniffed region", strings.Repeat("a", fileQABinarySniffLen-1) + "✓ more text", false},
+		{"null byte after the sniffed region", strings.Repeat("a", fileQABinarySniffLen) + "\x00", false},
+	} {
+		if got := isBinaryContent([]byte(tc.data)); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -1,28 +1,165 @@
 package ai
 
-import "github.com/JoshPattman/agent"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/JoshPattman/agent"
+)
 
 type ModelsConfig struct {
 	Models map[string]ModelConfig `json:"models"`
 }
 
+// Configures a model.
+// The provider decides which API the model is spoken to with, and is OpenAI-compatible chat completions if not set.
+// The generation params apply to every request to the model, and can be overridden for the reasoning steps of agents (ReAct),
+// for their final answers (Answer), and for questions about files (FileQA).
 type ModelConfig struct {
-	URL     string            `json:"url"`
-	Name    string            `json:"name"`
-	Key     string            `json:"key"`
-	Headers map[string]string `json:"headers"`
+	URL            string            `json:"url" resolve:"true"`
+	Name           string            `json:"name"`
+	Key            string            `json:"key" secret:"true"`
+	Headers        map[string]string `json:"headers" secret:"named"`
+	SupportsImages bool              `json:"supports_images"`
+	Provider       string            `json:"provider,omitempty"`
+	// Ask for JSON in the prompt rather than with the provider's structured output, for servers that do not support it.
+	PromptedJSON bool `json:"prompted_json,omitempty"`
+	GenerationParams
+	ReAct  *GenerationParams `json:"react,omitempty"`
+	Answer *GenerationParams `json:"answer,omitempty"`
+	FileQA *GenerationParams `json:"file_qa,omitempty"`
+	Retry  RetryConfig       `json:"retry,omitzero"`
+	// Why the secrets of the model could not be resolved, which is only reported once the model is used.
+	secretsErr error
+}
+
+// The APIs that models can be spoken to with.
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+	ProviderOllama    = "ollama"
+)
+
+var Providers = []string{ProviderOpenAI, ProviderAnthropic, ProviderOllama}
+
+// Check that the provider of the model is one that can be spoken to.
+func (c ModelConfig) CheckProvider() error {
+	if c.Provider != "" && !slices.Contains(Providers, c.Provider) {
+		return fmt.Errorf("unknown provider '%s', must be one of %s", c.Provider, strings.Join(Providers, ", "))
+	}
+	return nil
+}
+
+// Get why the secrets of the model could not be resolved, or nil if they were (or the model has not been resolved).
+func (c ModelConfig) SecretsError() error {
+	return c.secretsErr
+}
+
+// Check that the model can be used, which needs its secrets to have been resolved and its provider to be one that can be spoken to.
+func (c ModelConfig) CheckUsable() error {
+	if c.secretsErr != nil {
+		return c.secretsErr
+	}
+	return c.CheckProvider()
+}
+
+// Get the headers that authenticate requests to the model with its key, which differ between providers.
+func (c ModelConfig) AuthHeaders() map[string]string {
+	return authHeaders(c.Provider, c.Key)
+}
+
+// Optional settings for how a model generates, which are left to the provider's defaults if not set.
+type GenerationParams struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	// One of minimal, low, medium or high, for models that reason before answering.
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	// How long a single request may take before it is cancelled (and retried).
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// Get the params with any that are set in over replacing them.
+func (p GenerationParams) Override(over *GenerationParams) GenerationParams {
+	if over == nil {
+		return p
+	}
+	if over.Temperature != nil {
+		p.Temperature = over.Temperature
+	}
+	if over.TopP != nil {
+		p.TopP = over.TopP
+	}
+	if over.MaxTokens != 0 {
+		p.MaxTokens = over.MaxTokens
+	}
+	if over.Seed != nil {
+		p.Seed = over.Seed
+	}
+	if over.ReasoningEffort != "" {
+		p.ReasoningEffort = over.ReasoningEffort
+	}
+	if over.Timeout != 0 {
+		p.Timeout = over.Timeout
+	}
+	return p
+}
+
+// The reasoning efforts that can be configured.
+var ReasoningEfforts = []string{"minimal", "low", "medium", "high"}
+
+// Configures how failed requests to a model are retried.
+// By default a request is tried 5 more times, 2 seconds apart.
+type RetryConfig struct {
+	MaxRetries *int `json:"max_retries,omitempty"`
+	// How long to wait between retries.
+	Delay Duration `json:"delay,omitempty"`
+}
+
+// A duration written in the config as a string such as "30s" or "2m".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("a duration must be a string such as \"30s\" or \"2m\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return fmt.Errorf("duration %s cannot be negative", s)
+	}
+	*d = Duration(parsed)
+	return nil
 }
 
 type AgentsConfig struct {
 	Agents map[string]AgentConfig `json:"agents"`
 }
 
+// Configures an agent.
+// If Extends is set (to the name of another agent), any fields that are not set are taken from that agent.
 type AgentConfig struct {
+	Extends          string                    `json:"extends,omitempty"`
 	AgentDescription []string                  `json:"agent_description"`
 	Personality      string                    `json:"personality"`
 	Scenarios        map[string]agent.Scenario `json:"scenarios"`
 	ModelName        string                    `json:"model_name"`
 	MCPServers       []string                  `json:"mcp_servers"`
+	MCPResources     map[string][]string       `json:"mcp_resources,omitempty"`
 	SubAgents        []string                  `json:"sub_agents"`
 	ViewFiles        bool                      `json:"view_files"`
 	QuestionFiles    bool                      `json:"question_files"`
@@ -44,7 +181,187 @@ type MCPServersConfig struct {
 	MCPServers map[string]MCPServerConfig `json:"mcp_servers"`
 }
 
+// Configures an MCP server.
+// If Command is set the server is launched as a subprocess and spoken to over stdio,
+// otherwise it is connected to over streamable HTTP at Addr.
+// If SamplingModel is set (to the key of a model), the server may request completions from that model.
 type MCPServerConfig struct {
-	Addr    string            `json:"addr"`
-	Headers map[string]string `json:"headers"`
+	Addr          string            `json:"addr,omitempty" resolve:"true"`
+	Headers       map[string]string `json:"headers,omitempty" secret:"named"`
+	Command       string            `json:"command,omitempty"`
+	Args          []string          `json:"args,omitempty"`
+	Env           map[string]string `json:"env,omitempty" secret:"named"`
+	WorkDir       string            `json:"work_dir,omitempty"`
+	SamplingModel string            `json:"sampling_model,omitempty"`
+	Roots         []string          `json:"roots,omitempty"`
+	// Why the secrets of the server could not be resolved, which is only reported once the server is used.
+	secretsErr error
+}
+
+// Get why the secrets of the server could not be resolved, or nil if they were (or the server has not been resolved).
+func (c MCPServerConfig) SecretsError() error {
+	return c.secretsErr
+}
+
+// Resolve the secrets of each model with resolve, which is given a pointer to a config of just that model, so that errors name the model.
+// A model whose secrets cannot be resolved is kept as it is written, and the error is returned when it is used,
+// so that a secret that is missing only stops the agents that need it.
+func (c ModelsConfig) ResolveSecrets(resolve func(conf any) error) ModelsConfig {
+	resolved := make(map[string]ModelConfig, len(c.Models))
+	for name, model := range c.Models {
+		// Maps are resolved in place, so copy them to keep the model as it is written if it fails
+		model.Headers = maps.Clone(model.Headers)
+		entry := ModelsConfig{map[string]ModelConfig{name: model}}
+		if err := resolve(&entry); err != nil {
+			model = c.Models[name]
+			model.secretsErr = err
+			resolved[name] = model
+			continue
+		}
+		resolved[name] = entry.Models[name]
+	}
+	return ModelsConfig{resolved}
+}
+
+// Resolve the secrets of each server with resolve, like ModelsConfig.ResolveSecrets.
+func (c MCPServersConfig) ResolveSecrets(resolve func(conf any) error) MCPServersConfig {
+	resolved := make(map[string]MCPServerConfig, len(c.MCPServers))
+	for name, server := range c.MCPServers {
+		server.Headers = maps.Clone(server.Headers)
+		server.Env = maps.Clone(server.Env)
+		entry := MCPServersConfig{map[string]MCPServerConfig{name: server}}
+		if err := resolve(&entry); err != nil {
+			server = c.MCPServers[name]
+			server.secretsErr = err
+			resolved[name] = server
+			continue
+		}
+		resolved[name] = entry.MCPServers[name]
+	}
+	return MCPServersConfig{resolved}
+}
+
+// Find a cycle of sub agents reachable from the agent, such as ["a", "b", "a"], or nil if there is none.
+// Sub agents that are not configured are ignored.
+func (c AgentsConfig) SubAgentCycle(from string) []string {
+	path := make([]string, 0)
+	onPath := make(map[string]bool)
+	done := make(map[string]bool)
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		if onPath[name] {
+			start := slices.Index(path, name)
+			return append(slices.Clone(path[start:]), name)
+		}
+		agentConf, ok := c.Agents[name]
+		if done[name] || !ok {
+			return nil
+		}
+		path = append(path, name)
+		onPath[name] = true
+		for _, sub := range agentConf.SubAgents {
+			if cycle := visit(sub); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		onPath[name] = false
+		done[name] = true
+		return nil
+	}
+	return visit(from)
+}
+
+// Get the config with the entries of over added, replacing any entries of the same name.
+func (c ModelsConfig) Merge(over ModelsConfig) ModelsConfig {
+	return ModelsConfig{mergeEntries(c.Models, over.Models)}
+}
+
+// Get the config with the entries of over added, replacing any entries of the same name.
+func (c AgentsConfig) Merge(over AgentsConfig) AgentsConfig {
+	return AgentsConfig{mergeEntries(c.Agents, over.Agents)}
+}
+
+// Get the config with the entries of over added, replacing any entries of the same name.
+func (c MCPServersConfig) Merge(over MCPServersConfig) MCPServersConfig {
+	return MCPServersConfig{mergeEntries(c.MCPServers, over.MCPServers)}
+}
+
+// Get the config with the entries of over added, replacing any entries of the same name.
+func (c CustomCommandsConfig) Merge(over CustomCommandsConfig) CustomCommandsConfig {
+	return CustomCommandsConfig{mergeEntries(c.Commands, over.Commands)}
+}
+
+func mergeEntries[T any](under, over map[string]T) map[string]T {
+	merged := maps.Clone(under)
+	if merged == nil {
+		merged = make(map[string]T)
+	}
+	maps.Copy(merged, over)
+	return merged
+}
+
+// Get the config with every agent that extends another filled in from the agent it extends.
+// Any field of an agent that is empty (or false) is taken from the agent it extends, which may itself extend another agent.
+// If some agents cannot be resolved, they are left as they are and an error describes why.
+func (c AgentsConfig) ResolveExtends() (AgentsConfig, error) {
+	resolved := make(map[string]AgentConfig, len(c.Agents))
+	failed := make(map[string]error)
+	var resolve func(name string, path []string) (AgentConfig, error)
+	resolve = func(name string, path []string) (AgentConfig, error) {
+		if agentConf, ok := resolved[name]; ok {
+			return agentConf, nil
+		}
+		if err, ok := failed[name]; ok {
+			return AgentConfig{}, err
+		}
+		if slices.Contains(path, name) {
+			return AgentConfig{}, fmt.Errorf("agents extend themselves: %s", strings.Join(append(path, name), " -> "))
+		}
+		agentConf, ok := c.Agents[name]
+		if !ok {
+			return AgentConfig{}, fmt.Errorf("agent '%s' extends '%s', which does not exist", path[len(path)-1], name)
+		}
+		if agentConf.Extends != "" {
+			base, err := resolve(agentConf.Extends, append(path, name))
+			if err != nil {
+				failed[name] = err
+				return AgentConfig{}, err
+			}
+			agentConf = inheritAgentConfig(agentConf, base)
+		}
+		resolved[name] = agentConf
+		return agentConf, nil
+	}
+	errs := make([]error, 0)
+	for _, name := range slices.Sorted(maps.Keys(c.Agents)) {
+		// Agents extending a broken agent fail with the same error, so only report it once
+		if _, err := resolve(name, nil); err != nil && !slices.Contains(errs, err) {
+			errs = append(errs, err)
+		}
+	}
+	// Failed agents are only added once every agent has been tried, so that no agent is resolved against a failed one
+	for name := range failed {
+		resolved[name] = c.Agents[name]
+	}
+	return AgentsConfig{resolved}, errors.Join(errs...)
+}
+
+func inheritAgentConfig(agentConf, base AgentConfig) AgentConfig {
+	v := reflect.ValueOf(&agentConf).Elem()
+	baseV := reflect.ValueOf(base)
+	for i := range v.NumField() {
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Slice, reflect.Map:
+			if field.Len() == 0 {
+				field.Set(baseV.Field(i))
+			}
+		default:
+			if field.IsZero() {
+				field.Set(baseV.Field(i))
+			}
+		}
+	}
+	return agentConf
 }
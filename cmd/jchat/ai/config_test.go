@@ -0,0 +1,77 @@
+package ai
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveExtends(t *testing.T) {
+	conf := AgentsConfig{Agents: map[string]AgentConfig{
+		"base":   {Personality: "base personality", ModelName: "base_model", MCPServers: []string{"docs"}, RunCommands: true},
+		"child":  {Extends: "base", Personality: "child personality"},
+		"grand":  {Extends: "child", ModelName: "grand_model"},
+		"broken": {Extends: "missing", Personality: "broken personality"},
+		// Named to be resolved both before and after the agent they extend
+		"0_of_broken": {Extends: "broken"},
+		"z_of_broken": {Extends: "broken"},
+		"loop_a":      {Extends: "loop_b"},
+		"loop_b":      {Extends: "loop_a"},
+	}}
+	resolved, err := conf.ResolveExtends()
+	if err == nil {
+		t.Fatal("expected the broken agents to fail")
+	}
+	// Agents failing for the same reason report it once
+	if got := strings.Count(err.Error(), "'missing', which does not exist"); got != 1 {
+		t.Errorf("expected the missing agent to be reported once, got %d times in %q", got, err)
+	}
+	if !strings.Contains(err.Error(), "agents extend themselves") {
+		t.Errorf("expected the loop to be reported, got %q", err)
+	}
+	grand := resolved.Agents["grand"]
+	if grand.Personality != "child personality" || grand.ModelName != "grand_model" || !grand.RunCommands || len(grand.MCPServers) != 1 {
+		t.Errorf("expected grand to inherit through child, got %+v", grand)
+	}
+	for _, name := range []string{"broken", "0_of_broken", "z_of_broken", "loop_a", "loop_b"} {
+		got, ok := resolved.Agents[name]
+		if !ok {
+			t.Errorf("expected the failed agent %s to be kept", name)
+			continue
+		}
+		if got.Personality != conf.Agents[name].Personality {
+			t.Errorf("expected the failed agent %s to be left as it is, got %+v", name, got)
+		}
+	}
+}
+
+func TestResolveSecretsKeepsEntriesThatFail(t *testing.T) {
+	t.Setenv("JCHAT_TEST_KEY", "sk-from-env")
+	models := ModelsConfig{Models: map[string]ModelConfig{
+		"set":   {Key: "${JCHAT_TEST_KEY}"},
+		"unset": {Key: "${JCHAT_TEST_UNSET}", Headers: map[string]string{"X-Api-Key": "${JCHAT_TEST_KEY}"}},
+	}}
+	servers := MCPServersConfig{MCPServers: map[string]MCPServerConfig{
+		// The headers are resolved before the env fails
+		"unset": {Command: "server", Headers: map[string]string{"X-Api-Key": "${JCHAT_TEST_KEY}"}, Env: map[string]string{"TOKEN": "${JCHAT_TEST_UNSET}"}},
+	}}
+	r := NewSecretResolver()
+	resolve := func(conf any) error { return r.Resolve("models.json", conf) }
+	resolved := models.ResolveSecrets(resolve)
+	if set := resolved.Models["set"]; set.Key != "sk-from-env" || set.CheckUsable() != nil {
+		t.Errorf("expected the model with its secret set to be resolved, got %+v", set)
+	}
+	unset := resolved.Models["unset"]
+	if err := unset.CheckUsable(); err == nil || !strings.Contains(err.Error(), "models.unset.key: environment variable JCHAT_TEST_UNSET is not set") {
+		t.Errorf("expected the model with its secret unset to fail when used, got %v", err)
+	}
+	if unset.Key != "${JCHAT_TEST_UNSET}" || models.Models["unset"].Headers["X-Api-Key"] != "${JCHAT_TEST_KEY}" {
+		t.Errorf("expected the model that failed to be left as it is written, got %+v", unset)
+	}
+	resolvedServers := servers.ResolveSecrets(resolve)
+	if err := resolvedServers.MCPServers["unset"].SecretsError(); err == nil {
+		t.Error("expected the server with its secret unset to fail when used")
+	}
+	if servers.MCPServers["unset"].Headers["X-Api-Key"] != "${JCHAT_TEST_KEY}" || resolvedServers.MCPServers["unset"].Headers["X-Api-Key"] != "${JCHAT_TEST_KEY}" {
+		t.Errorf("expected the server's headers not to be changed, got %v", servers.MCPServers["unset"].Headers)
+	}
+}
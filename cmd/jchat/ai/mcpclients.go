@@ -0,0 +1,177 @@
+package ai
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/JoshPattman/agent/agentmcp"
+	"github.com/JoshPattman/jpf"
+	"github.com/mark3labs/mcp-go/client"
+)
+
+// Connects to the configured MCP servers on demand, and keeps each connection open until closed,
+// so that an MCP server used by several agents is only connected to (or launched) once.
+// Connections are re-established automatically if a server stops responding.
+type MCPClients struct {
+	conf         MCPServersConfig
+	modelsConf   ModelsConfig
+	usageCounter *jpf.UsageCounter
+	logDir       string
+	redactor     *Redactor
+	lock         sync.Mutex
+	clients      map[string]*agentmcp.Connection
+	logs         []io.Closer
+	cbLock       sync.RWMutex
+	onProgress   func(agentmcp.ToolProgress)
+	onStatus     func(serverName string, connected bool, err error)
+}
+
+// Create a new set of MCP clients for the config.
+// The stderr of any stdio servers, and any sampling requests, are written to a log file per server in logDir.
+// Sampling requests use the configured models, and their usage is added to the usage counter.
+// Secrets are redacted from the logs and from connection errors by the redactor, which may be nil.
+func NewMCPClients(conf MCPServersConfig, modelsConf ModelsConfig, usageCounter *jpf.UsageCounter, logDir string, redactor *Redactor) *MCPClients {
+	return &MCPClients{
+		conf:         conf,
+		modelsConf:   modelsConf,
+		usageCounter: usageCounter,
+		logDir:       logDir,
+		redactor:     redactor,
+		clients:      make(map[string]*agentmcp.Connection),
+	}
+}
+
+// Set the callbacks for tool call progress and for servers disconnecting and reconnecting.
+// Either may be nil.
+func (m *MCPClients) SetCallbacks(onProgress func(agentmcp.ToolProgress), onStatus func(serverName string, connected bool, err error)) {
+	m.cbLock.Lock()
+	defer m.cbLock.Unlock()
+	m.onProgress = onProgress
+	m.onStatus = onStatus
+}
+
+func (m *MCPClients) notifyProgress(progress agentmcp.ToolProgress) {
+	m.cbLock.RLock()
+	defer m.cbLock.RUnlock()
+	if m.onProgress != nil {
+		m.onProgress(progress)
+	}
+}
+
+func (m *MCPClients) notifyStatus(serverName string, connected bool, err error) {
+	m.cbLock.RLock()
+	defer m.cbLock.RUnlock()
+	if m.onStatus != nil {
+		m.onStatus(serverName, connected, m.redactor.RedactError(err))
+	}
+}
+
+// Get the connection to the named server, connecting to it if this has not happened yet.
+func (m *MCPClients) Get(serverName string) (*agentmcp.Connection, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if c, ok := m.clients[serverName]; ok {
+		return c, nil
+	}
+	server, ok := m.conf.MCPServers[serverName]
+	if !ok {
+		return nil, fmt.Errorf("could not find mcp server '%s'", serverName)
+	}
+	if err := server.SecretsError(); err != nil {
+		return nil, fmt.Errorf("could not use mcp server '%s': %w", serverName, err)
+	}
+	var log io.Writer
+	if server.Command != "" || server.SamplingModel != "" {
+		var err error
+		log, err = m.openLog(serverName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	clientOpts := make([]agentmcp.ClientOpt, 0)
+	if server.SamplingModel != "" {
+		model, ok := m.modelsConf.Models[server.SamplingModel]
+		if !ok {
+			return nil, fmt.Errorf("could not find sampling model '%s' for mcp server '%s'", server.SamplingModel, serverName)
+		}
+		if err := model.CheckUsable(); err != nil {
+			return nil, fmt.Errorf("could not use sampling model '%s' for mcp server '%s': %w", server.SamplingModel, serverName, err)
+		}
+		sampler := agentmcp.NewSampler(
+			server.SamplingModel,
+			NewModelBuilder(model, m.usageCounter),
+			agentmcp.WithSamplingApproval(logSamplingRequest(log)),
+		)
+		clientOpts = append(clientOpts, agentmcp.WithSampler(sampler))
+	}
+	if len(server.Roots) > 0 {
+		clientOpts = append(clientOpts, agentmcp.WithRoots(server.Roots...))
+	}
+	var connect func(opts ...agentmcp.ClientOpt) (*client.Client, error)
+	if server.Command != "" {
+		connect = func(opts ...agentmcp.ClientOpt) (*client.Client, error) {
+			return agentmcp.CreateStdioClient(server.Command, server.Args, server.Env, server.WorkDir, log, slices.Concat(clientOpts, opts)...)
+		}
+	} else {
+		connect = func(opts ...agentmcp.ClientOpt) (*client.Client, error) {
+			return agentmcp.CreateClient(server.Addr, server.Headers, slices.Concat(clientOpts, opts)...)
+		}
+	}
+	c, err := agentmcp.NewConnection(
+		connect,
+		agentmcp.WithProgressCallback(m.notifyProgress),
+		agentmcp.WithStatusCallback(func(connected bool, err error) {
+			m.notifyStatus(serverName, connected, err)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to mcp server '%s': %w", serverName, m.redactor.RedactError(err))
+	}
+	m.clients[serverName] = c
+	return c, nil
+}
+
+// Sampling requests are allowed for any server configured with a sampling model, but are logged so they can be audited.
+func logSamplingRequest(log io.Writer) func(agentmcp.SamplingRequest) error {
+	return func(req agentmcp.SamplingRequest) error {
+		fmt.Fprintf(log, "[%s] sampling request for model '%s' with %d messages\n", time.Now().Format(time.RFC3339), req.ModelName, len(req.Messages))
+		return nil
+	}
+}
+
+func (m *MCPClients) openLog(serverName string) (io.Writer, error) {
+	err := os.MkdirAll(m.logDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(m.logDir, fmt.Sprintf("mcp_%s.log", serverName)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m.logs = append(m.logs, f)
+	return m.redactor.Writer(f), nil
+}
+
+// Close all connections, stopping any servers that were launched as subprocesses.
+func (m *MCPClients) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	errs := make([]error, 0)
+	for name, c := range m.clients {
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing mcp server '%s': %w", name, err))
+		}
+	}
+	for _, l := range m.logs {
+		errs = append(errs, l.Close())
+	}
+	m.clients = make(map[string]*agentmcp.Connection)
+	m.logs = nil
+	return errors.Join(errs...)
+}
@@ -14,60 +14,134 @@ type ModelBuilder struct {
 	URL          string
 	UsageCounter *jpf.UsageCounter
 	Headers      map[string]string
+	Images       bool
+	Provider     string
+	PromptedJSON bool
+	Generation   GenerationParams
+	// Overrides of the generation params for each use of the model, or nil to use the generation params.
+	ReActGeneration  *GenerationParams
+	AnswerGeneration *GenerationParams
+	FileQAGeneration *GenerationParams
+	Retry            RetryConfig
 }
 
-func (b *ModelBuilder) BuildAgentModel(responseType any, onFinalStreamBegin func(), onFinalStreamChunk func(string)) jpf.Model {
-	opts := []jpf.OpenAIModelOpt{
-		jpf.WithURL{X: b.URL},
-	}
-	if b.Headers != nil {
-		for k, v := range b.Headers {
-			opts = append(opts, jpf.WithHTTPHeader{K: k, V: v})
-		}
+func NewModelBuilder(conf ModelConfig, usageCounter *jpf.UsageCounter) *ModelBuilder {
+	return &ModelBuilder{
+		conf.Key,
+		conf.Name,
+		conf.URL,
+		usageCounter,
+		conf.Headers,
+		conf.SupportsImages,
+		conf.Provider,
+		conf.PromptedJSON,
+		conf.GenerationParams,
+		conf.ReAct,
+		conf.Answer,
+		conf.FileQA,
+		conf.Retry,
 	}
+}
+
+func (b *ModelBuilder) SupportsImages() bool {
+	return b.Images
+}
+
+// Build a model for an agent, which uses the ReAct generation params for structured reasoning steps and the answer generation params otherwise.
+func (b *ModelBuilder) BuildAgentModel(responseType any, onFinalStreamBegin func(), onFinalStreamChunk func(string)) jpf.Model {
+	settings := b.settings(b.Generation.Override(b.AnswerGeneration))
 	if responseType != nil {
 		rformat, err := getSchema(responseType)
 		if err != nil {
 			panic(err)
 		}
-		opts = append(opts, jpf.WithJsonSchema{X: rformat})
-	}
-	if onFinalStreamBegin != nil || onFinalStreamChunk != nil {
-		opts = append(
-			opts,
-			jpf.WithStreamResponse{
-				OnBegin: onFinalStreamBegin,
-				OnText:  onFinalStreamChunk,
-			},
-		)
-	}
-	model := jpf.NewOpenAIModel(
-		b.Key,
-		b.ModelName,
-		opts...,
-	)
-	model = jpf.NewRetryModel(model, 5, jpf.WithDelay{X: time.Second * 2})
-	model = jpf.NewUsageCountingModel(model, b.UsageCounter)
-	return model
+		settings.params = b.Generation.Override(b.ReActGeneration)
+		settings.schema = rformat
+	}
+	settings.onStreamBegin = onFinalStreamBegin
+	settings.onStreamText = onFinalStreamChunk
+	return b.build(settings)
 }
 
 func (b *ModelBuilder) BuildFileQAModel() jpf.Model {
-	opts := []jpf.OpenAIModelOpt{
-		jpf.WithURL{X: b.URL},
+	return b.build(b.settings(b.Generation.Override(b.FileQAGeneration)))
+}
+
+func (b *ModelBuilder) settings(params GenerationParams) modelSettings {
+	return modelSettings{
+		url:         b.URL,
+		name:        b.ModelName,
+		headers:     b.Headers,
+		authHeaders: authHeaders(b.Provider, b.Key),
+		params:      params,
 	}
-	if b.Headers != nil {
-		for k, v := range b.Headers {
-			opts = append(opts, jpf.WithHTTPHeader{K: k, V: v})
-		}
+}
+
+// Build a model for the provider, with timeouts, retries and usage counting.
+// Providers without structured output (or models configured not to use it) are asked for JSON in the prompt instead.
+func (b *ModelBuilder) build(settings modelSettings) jpf.Model {
+	schema := settings.schema
+	promptedJSON := schema != nil && (b.PromptedJSON || b.Provider == ProviderAnthropic)
+	if promptedJSON {
+		settings.schema = nil
+	}
+	var model jpf.Model
+	switch b.Provider {
+	case ProviderAnthropic:
+		model = &anthropicModel{settings}
+	case ProviderOllama:
+		model = &ollamaModel{settings}
+	default:
+		model = b.buildOpenAI(settings)
+	}
+	if promptedJSON {
+		model = &promptedJSONModel{model, schema}
+	}
+	if settings.params.Timeout > 0 {
+		model = &timeoutModel{model, time.Duration(settings.params.Timeout)}
+	}
+	maxRetries, delay := defaultMaxRetries, defaultRetryDelay
+	if b.Retry.MaxRetries != nil {
+		maxRetries = *b.Retry.MaxRetries
+	}
+	if b.Retry.Delay != 0 {
+		delay = time.Duration(b.Retry.Delay)
+	}
+	model = jpf.NewRetryModel(model, maxRetries, jpf.WithDelay{X: delay})
+	return jpf.NewUsageCountingModel(model, b.UsageCounter)
+}
+
+// Defaults for retrying failed requests to a model.
+const (
+	defaultMaxRetries = 5
+	defaultRetryDelay = 2 * time.Second
+)
+
+// Build a model behind an OpenAI-compatible chat completions endpoint.
+// jpf's model does not support max_tokens or seed, and its top_p option is not a fraction, so these are not sent.
+func (b *ModelBuilder) buildOpenAI(settings modelSettings) jpf.Model {
+	opts := []jpf.OpenAIModelOpt{jpf.WithURL{X: settings.url}}
+	for k, v := range settings.headers {
+		opts = append(opts, jpf.WithHTTPHeader{K: k, V: v})
+	}
+	if settings.schema != nil {
+		opts = append(opts, jpf.WithJsonSchema{X: settings.schema})
+	}
+	if settings.streams() {
+		opts = append(opts, jpf.WithStreamResponse{OnBegin: settings.onStreamBegin, OnText: settings.onStreamText})
+	}
+	if settings.params.Temperature != nil {
+		opts = append(opts, jpf.WithTemperature{X: *settings.params.Temperature})
+	}
+	switch settings.params.ReasoningEffort {
+	case "minimal", "low":
+		opts = append(opts, jpf.WithReasoningEffort{X: jpf.LowReasoning})
+	case "medium":
+		opts = append(opts, jpf.WithReasoningEffort{X: jpf.MediumReasoning})
+	case "high":
+		opts = append(opts, jpf.WithReasoningEffort{X: jpf.HighReasoning})
 	}
-	model := jpf.NewOpenAIModel(
-		b.Key,
-		b.ModelName,
-		opts...,
-	)
-	model = jpf.NewRetryModel(model, 5, jpf.WithDelay{X: time.Second * 2})
-	model = jpf.NewUsageCountingModel(model, b.UsageCounter)
-	return model
+	return jpf.NewOpenAIModel(b.Key, settings.name, opts...)
 }
 
 func getSchema(obj any) (map[string]any, error) {
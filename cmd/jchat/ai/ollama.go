@@ -0,0 +1,148 @@
+package ai
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/JoshPattman/jpf"
+)
+
+// A model served by Ollama, spoken to with its native chat API rather than its OpenAI-compatible one.
+type ollamaModel struct {
+	modelSettings
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	// Ollama streams unless told not to, so this is always sent.
+	Stream  bool           `json:"stream"`
+	Format  map[string]any `json:"format,omitempty"`
+	Options ollamaOptions  `json:"options,omitzero"`
+	Think   *bool          `json:"think,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+type ollamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+}
+
+// A response, or a chunk of a streamed response.
+type ollamaResponse struct {
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	Error           string `json:"error"`
+}
+
+func (m *ollamaModel) Respond(ctx context.Context, msgs []jpf.Message) (jpf.ModelResponse, error) {
+	req := ollamaRequest{
+		Model:  m.name,
+		Stream: m.streams(),
+		Format: m.schema,
+		Options: ollamaOptions{
+			Temperature: m.params.Temperature,
+			TopP:        m.params.TopP,
+			NumPredict:  m.params.MaxTokens,
+			Seed:        m.params.Seed,
+		},
+	}
+	if m.params.ReasoningEffort != "" {
+		think := m.params.ReasoningEffort != "minimal"
+		req.Think = &think
+	}
+	for _, msg := range withoutReasoning(msgs) {
+		converted := ollamaMessage{Role: ollamaRole(msg.Role), Content: msg.Content}
+		for _, img := range msg.Images {
+			data, err := encodeImage(img)
+			if err != nil {
+				return jpf.ModelResponse{}, err
+			}
+			converted.Images = append(converted.Images, data)
+		}
+		req.Messages = append(req.Messages, converted)
+	}
+	resp, err := m.post(ctx, req)
+	if err != nil {
+		return jpf.ModelResponse{}, err
+	}
+	defer resp.Body.Close()
+	if req.Stream {
+		return m.readStream(resp.Body)
+	}
+	var decoded ollamaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return jpf.ModelResponse{}, fmt.Errorf("could not decode model response: %w", err)
+	}
+	if decoded.Error != "" {
+		return jpf.ModelResponse{}, fmt.Errorf("model failed to respond: %s", decoded.Error)
+	}
+	return jpf.ModelResponse{
+		PrimaryMessage: jpf.Message{Role: jpf.AssistantRole, Content: decoded.Message.Content},
+		Usage:          jpf.Usage{InputTokens: decoded.PromptEvalCount, OutputTokens: decoded.EvalCount},
+	}, nil
+}
+
+// Read a streamed response, which is a JSON object on each line, passing each piece of text on as it arrives.
+func (m *ollamaModel) readStream(body io.Reader) (jpf.ModelResponse, error) {
+	content := &strings.Builder{}
+	var usage jpf.Usage
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	done := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var chunk ollamaResponse
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			return jpf.ModelResponse{}, fmt.Errorf("could not decode streamed model response: %w", err)
+		}
+		if chunk.Error != "" {
+			return jpf.ModelResponse{}, fmt.Errorf("model stream failed: %s", chunk.Error)
+		}
+		m.streamText(content, chunk.Message.Content)
+		if chunk.Done {
+			usage = jpf.Usage{InputTokens: chunk.PromptEvalCount, OutputTokens: chunk.EvalCount}
+			done = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return jpf.ModelResponse{}, fmt.Errorf("could not read streamed model response: %w", err)
+	}
+	if !done {
+		return jpf.ModelResponse{}, errors.New("model stream ended before the response was done")
+	}
+	return jpf.ModelResponse{
+		PrimaryMessage: jpf.Message{Role: jpf.AssistantRole, Content: content.String()},
+		Usage:          usage,
+	}, nil
+}
+
+func ollamaRole(role jpf.Role) string {
+	switch role {
+	case jpf.SystemRole:
+		return "system"
+	case jpf.AssistantRole:
+		return "assistant"
+	default:
+		return "user"
+	}
+}
@@ -0,0 +1,112 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/JoshPattman/jpf"
+)
+
+func TestOllamaRequestShape(t *testing.T) {
+	var body map[string]any
+	server := newRecordingServer(t, &body, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"message": {"content": "{}"}, "done": true, "prompt_eval_count": 4, "eval_count": 6}`)
+	})
+	temperature := 0.2
+	seed := 7
+	model := &ollamaModel{modelSettings{
+		url:    server.URL,
+		name:   "llama-test",
+		params: GenerationParams{Temperature: &temperature, MaxTokens: 50, Seed: &seed, ReasoningEffort: "minimal"},
+		schema: map[string]any{"type": "object"},
+	}}
+	resp, err := model.Respond(context.Background(), []jpf.Message{
+		{Role: jpf.SystemRole, Content: "Be brief."},
+		{Role: jpf.UserRole, Content: "hello"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PrimaryMessage.Content != "{}" || resp.Usage.InputTokens != 4 || resp.Usage.OutputTokens != 6 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if body["model"] != "llama-test" || body["stream"] != false || body["think"] != false {
+		t.Errorf("expected a request which does not stream or think, got %v", body)
+	}
+	if format, _ := body["format"].(map[string]any); format["type"] != "object" {
+		t.Errorf("expected the schema as the format, got %v", body["format"])
+	}
+	options, _ := body["options"].(map[string]any)
+	if options["temperature"] != 0.2 || options["num_predict"] != 50.0 || options["seed"] != 7.0 {
+		t.Errorf("unexpected options %v", options)
+	}
+	messages, _ := body["messages"].([]any)
+	if len(messages) != 2 || messages[0].(map[string]any)["role"] != "system" {
+		t.Errorf("expected the system message to be kept in place, got %v", messages)
+	}
+}
+
+func TestOllamaOmitsThinkWithoutEffort(t *testing.T) {
+	var body map[string]any
+	server := newRecordingServer(t, &body, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"message": {"content": "hi"}, "done": true}`)
+	})
+	for effort, want := range map[string]any{"": nil, "high": true} {
+		model := &ollamaModel{modelSettings{url: server.URL, params: GenerationParams{ReasoningEffort: effort}}}
+		if _, err := model.Respond(context.Background(), testMessages); err != nil {
+			t.Fatal(err)
+		}
+		if body["think"] != want {
+			t.Errorf("effort %q: expected think to be %v, got %v", effort, want, body["think"])
+		}
+	}
+}
+
+func TestOllamaStream(t *testing.T) {
+	var body map[string]any
+	server := newRecordingServer(t, &body, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintln(w, `{"message": {"content": "Hel"}, "done": false}`)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, `{"message": {"content": "lo"}, "done": false}`)
+		fmt.Fprintln(w, `{"message": {"content": ""}, "done": true, "prompt_eval_count": 8, "eval_count": 2}`)
+	})
+	chunks := make([]string, 0)
+	model := &ollamaModel{modelSettings{url: server.URL, onStreamText: func(s string) { chunks = append(chunks, s) }}}
+	resp, err := model.Respond(context.Background(), testMessages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body["stream"] != true {
+		t.Errorf("expected the request to stream, got %v", body["stream"])
+	}
+	if resp.PrimaryMessage.Content != "Hello" || !slices.Equal(chunks, []string{"Hel", "lo"}) {
+		t.Errorf("unexpected stream: content %q, chunks %q", resp.PrimaryMessage.Content, chunks)
+	}
+	if resp.Usage.InputTokens != 8 || resp.Usage.OutputTokens != 2 {
+		t.Errorf("unexpected usage %+v", resp.Usage)
+	}
+}
+
+func TestOllamaStreamErrors(t *testing.T) {
+	for name, lines := range map[string][]string{
+		"error line":       {`{"error": "model not loaded"}`},
+		"ended early":      {`{"message": {"content": "Hel"}, "done": false}`},
+		"error after text": {`{"message": {"content": "Hel"}, "done": false}`, `{"error": "out of memory"}`},
+	} {
+		var body map[string]any
+		server := newRecordingServer(t, &body, func(w http.ResponseWriter, r *http.Request) {
+			for _, line := range lines {
+				fmt.Fprintln(w, line)
+			}
+		})
+		model := &ollamaModel{modelSettings{url: server.URL, onStreamText: func(string) {}}}
+		_, err := model.Respond(context.Background(), testMessages)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package ai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/JoshPattman/jpf"
+)
+
+// What a model is asked to do, which is the same whichever provider it is sent to.
+type modelSettings struct {
+	url     string
+	name    string
+	headers map[string]string
+	// The headers that authenticate with the provider, which the configured headers may replace.
+	authHeaders map[string]string
+	params      GenerationParams
+	// The schema the response must follow, or nil for a text response.
+	schema        map[string]any
+	onStreamBegin func()
+	onStreamText  func(string)
+}
+
+// Whether the response should be streamed, as someone is waiting to see it arrive.
+func (s modelSettings) streams() bool {
+	return s.onStreamBegin != nil || s.onStreamText != nil
+}
+
+// Add a piece of streamed text to the content, telling the listeners about it (and that the stream began, if it is the first piece).
+func (s modelSettings) streamText(content *strings.Builder, text string) {
+	if text == "" {
+		return
+	}
+	if content.Len() == 0 && s.onStreamBegin != nil {
+		s.onStreamBegin()
+	}
+	content.WriteString(text)
+	if s.onStreamText != nil {
+		s.onStreamText(text)
+	}
+}
+
+// Post the body as JSON to the model, returning the response if it was successful.
+func (s modelSettings) post(ctx context.Context, body any) (*http.Response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.authHeaders {
+		req.Header.Set(k, v)
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &statusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(respBody))}
+	}
+	return resp, nil
+}
+
+// An error response from a model provider.
+type statusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("model responded with status %d: %s", e.StatusCode, e.Body)
+}
+
+// The version of the Anthropic API that requests are written for.
+const anthropicVersion = "2023-06-01"
+
+func authHeaders(provider, key string) map[string]string {
+	headers := make(map[string]string)
+	switch {
+	case provider == ProviderAnthropic:
+		headers["anthropic-version"] = anthropicVersion
+		if key != "" {
+			headers["x-api-key"] = key
+		}
+	case key != "":
+		headers["Authorization"] = "Bearer " + key
+	}
+	return headers
+}
+
+// Read server-sent events, calling onEvent with the type and data of each event until the stream ends.
+func readServerSentEvents(body io.Reader, onEvent func(event, data string) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	event := ""
+	data := make([]string, 0)
+	dispatch := func() error {
+		defer func() { event, data = "", data[:0] }()
+		if len(data) == 0 {
+			return nil
+		}
+		return onEvent(event, strings.Join(data, "\n"))
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if err := dispatch(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read streamed model response: %w", err)
+	}
+	return dispatch()
+}
+
+// Encode an image as a PNG, returning the base64 encoded data.
+func encodeImage(img jpf.ImageAttachment) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img.Source); err != nil {
+		return "", fmt.Errorf("could not encode image: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Leave out the reasoning of earlier responses, which is not part of the conversation that providers are sent.
+func withoutReasoning(msgs []jpf.Message) []jpf.Message {
+	return slices.DeleteFunc(slices.Clone(msgs), func(msg jpf.Message) bool {
+		return msg.Role == jpf.ReasoningRole
+	})
+}
+
+// Merge messages of the same role that follow each other into one, for providers that need the roles to alternate.
+func mergeConsecutiveMessages(msgs []jpf.Message) []jpf.Message {
+	merged := make([]jpf.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if last := len(merged) - 1; last >= 0 && merged[last].Role == msg.Role {
+			merged[last].Content += "\n\n" + msg.Content
+			merged[last].Images = append(merged[last].Images, msg.Images...)
+			continue
+		}
+		msg.Images = append([]jpf.ImageAttachment(nil), msg.Images...)
+		merged = append(merged, msg)
+	}
+	return merged
+}
+
+// Asks a model for JSON following a schema in the system prompt, for providers without structured output.
+// The JSON is taken out of any text the model writes around it.
+type promptedJSONModel struct {
+	model  jpf.Model
+	schema map[string]any
+}
+
+func (m *promptedJSONModel) Respond(ctx context.Context, msgs []jpf.Message) (jpf.ModelResponse, error) {
+	schema, err := json.MarshalIndent(m.schema, "", "  ")
+	if err != nil {
+		return jpf.ModelResponse{}, err
+	}
+	instruction := jpf.Message{
+		Role:    jpf.SystemRole,
+		Content: "Respond with only a JSON object that follows this JSON schema, without any other text or code fences:\n" + string(schema),
+	}
+	withInstruction := make([]jpf.Message, 0, len(msgs)+1)
+	if len(msgs) > 0 && msgs[0].Role == jpf.SystemRole {
+		withInstruction = append(withInstruction, msgs[0], instruction)
+		withInstruction = append(withInstruction, msgs[1:]...)
+	} else {
+		withInstruction = append(append(withInstruction, instruction), msgs...)
+	}
+	resp, err := m.model.Respond(ctx, withInstruction)
+	if err != nil {
+		return resp, err
+	}
+	resp.PrimaryMessage.Content = extractJSONObject(resp.PrimaryMessage.Content)
+	return resp, nil
+}
+
+// Get the JSON object in the text, which may be in a code fence or have text around it.
+func extractJSONObject(text string) string {
+	start := strings.Index(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return strings.TrimSpace(text)
+	}
+	return text[start : end+1]
+}
+
+// Cancels a request to a model that takes longer than the timeout.
+type timeoutModel struct {
+	model   jpf.Model
+	timeout time.Duration
+}
+
+func (m *timeoutModel) Respond(ctx context.Context, msgs []jpf.Message) (jpf.ModelResponse, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	resp, err := m.model.Respond(timeoutCtx, msgs)
+	if err != nil && ctx.Err() == nil && timeoutCtx.Err() != nil {
+		return resp, fmt.Errorf("model did not respond within %s: %w", m.timeout, err)
+	}
+	return resp, err
+}
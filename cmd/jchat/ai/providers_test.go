@@ -0,0 +1,160 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/JoshPattman/jpf"
+)
+
+var testMessages = []jpf.Message{{Role: jpf.UserRole, Content: "hello"}}
+
+// Start a server which decodes each request body into body, then responds with the handler.
+func newRecordingServer(t *testing.T, body *map[string]any, respond http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*body = nil
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			t.Errorf("could not decode request: %v", err)
+		}
+		respond(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMergeConsecutiveMessages(t *testing.T) {
+	merged := mergeConsecutiveMessages([]jpf.Message{
+		{Role: jpf.UserRole, Content: "one"},
+		{Role: jpf.UserRole, Content: "two"},
+		{Role: jpf.AssistantRole, Content: "three"},
+		{Role: jpf.UserRole, Content: "four"},
+	})
+	if len(merged) != 3 || merged[0].Role != jpf.UserRole || merged[0].Content != "one\n\ntwo" {
+		t.Fatalf("expected the first two messages to be merged, got %+v", merged)
+	}
+	if merged[1].Content != "three" || merged[2].Content != "four" {
+		t.Errorf("expected the other messages to be kept, got %+v", merged)
+	}
+}
+
+func TestReadServerSentEvents(t *testing.T) {
+	stream := "event: first\ndata: one\n\n: a comment\ndata: two\ndata: lines\n\nevent: last\ndata: three\n\n"
+	events := make([]string, 0)
+	err := readServerSentEvents(strings.NewReader(stream), func(event, data string) error {
+		events = append(events, event+"="+data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"first=one", "=two\nlines", "last=three"}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("got events %q, want %q", events, want)
+	}
+}
+
+func TestPromptedJSONModel(t *testing.T) {
+	var body map[string]any
+	server := newRecordingServer(t, &body, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"content":     []map[string]any{{"type": "text", "text": "Here it is:\n```json\n{\"answer\": 42}\n```"}},
+			"stop_reason": "end_turn",
+		})
+	})
+	model := &promptedJSONModel{
+		model:  &anthropicModel{modelSettings{url: server.URL}},
+		schema: map[string]any{"type": "object", "properties": map[string]any{"answer": map[string]any{"type": "number"}}},
+	}
+	resp, err := model.Respond(context.Background(), []jpf.Message{
+		{Role: jpf.SystemRole, Content: "You are helpful."},
+		{Role: jpf.UserRole, Content: "What is the answer?"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PrimaryMessage.Content != `{"answer": 42}` {
+		t.Errorf("expected the JSON to be taken out of the answer, got %q", resp.PrimaryMessage.Content)
+	}
+	system, _ := body["system"].(string)
+	before, after, ok := strings.Cut(system, "\n\n")
+	if !ok || before != "You are helpful." || !strings.Contains(after, "JSON schema") || !strings.Contains(after, `"answer"`) {
+		t.Errorf("expected the schema to be asked for after the system prompt, got %q", system)
+	}
+}
+
+func TestExtractJSONObject(t *testing.T) {
+	for text, want := range map[string]string{
+		`{"a": 1}`:                          `{"a": 1}`,
+		"```json\n{\"a\": {\"b\": 2}}\n```": `{"a": {"b": 2}}`,
+		"Sure! {\"a\": 1} Hope that helps":  `{"a": 1}`,
+		"  no json here ":                   "no json here",
+	} {
+		if got := extractJSONObject(text); got != want {
+			t.Errorf("extractJSONObject(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestProvidersReturnStatusErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "invalid key"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	settings := modelSettings{url: server.URL}
+	for name, model := range map[string]jpf.Model{
+		"anthropic": &anthropicModel{settings},
+		"ollama":    &ollamaModel{settings},
+	} {
+		_, err := model.Respond(context.Background(), testMessages)
+		var statusErr *statusError
+		if !errors.As(err, &statusErr) {
+			t.Errorf("%s: expected a status error, got %v", name, err)
+			continue
+		}
+		if statusErr.StatusCode != http.StatusUnauthorized || statusErr.Body != `{"error": "invalid key"}` {
+			t.Errorf("%s: unexpected status error %+v", name, statusErr)
+		}
+		if !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "invalid key") {
+			t.Errorf("%s: expected the status and body in the message, got %q", name, err.Error())
+		}
+	}
+}
+
+func TestProvidersLeaveOutReasoning(t *testing.T) {
+	msgs := []jpf.Message{
+		{Role: jpf.UserRole, Content: "one"},
+		{Role: jpf.ReasoningRole, Content: "thinking about one"},
+		{Role: jpf.AssistantRole, Content: "two"},
+		{Role: jpf.UserRole, Content: "three"},
+	}
+	for name, tc := range map[string]struct {
+		build  func(modelSettings) jpf.Model
+		answer string
+	}{
+		"anthropic": {func(s modelSettings) jpf.Model { return &anthropicModel{s} }, `{"content": [{"type": "text", "text": "four"}], "stop_reason": "end_turn"}`},
+		"ollama":    {func(s modelSettings) jpf.Model { return &ollamaModel{s} }, `{"message": {"content": "four"}, "done": true}`},
+	} {
+		var body map[string]any
+		server := newRecordingServer(t, &body, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, tc.answer)
+		})
+		if _, err := tc.build(modelSettings{url: server.URL}).Respond(context.Background(), msgs); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		sent, _ := json.Marshal(body["messages"])
+		if strings.Contains(string(sent), "thinking") {
+			t.Errorf("%s: expected the reasoning to be left out, got %s", name, sent)
+		}
+		if messages, _ := body["messages"].([]any); len(messages) != 3 {
+			t.Errorf("%s: expected the other messages to be sent, got %s", name, sent)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The key that older versions of jchat wrote to models.json by default, which must be replaced before the model can be used.
+const PlaceholderModelKey = "Your API Key Here"
+
+// The shortest secret that is redacted, as shorter values are likely to appear by chance.
+const minRedactedSecretLength = 6
+
+// Resolves references in config strings, and remembers the secrets that were used so they can be redacted.
+//
+// Only config fields tagged `secret:"true"` or `resolve:"true"`, and the entries of maps tagged `secret:"named"`, are resolved.
+// Other strings (such as prompts, or resource URIs starting with file://) are left as they are.
+// A resolved string may contain ${ENV_VAR}, which is replaced with the value of the environment variable (use $${ for a literal ${).
+// A whole string may instead be file:<path>, which is replaced with the trimmed contents of the file,
+// or cmd:<command>, which is replaced with the trimmed output of running the command in the shell.
+//
+// Config fields tagged `secret:"true"` hold secrets, as do the entries of maps tagged `secret:"named"` whose names suggest they are credentials (such as an Authorization header).
+// Values read from files and commands are always treated as secrets.
+type SecretResolver struct {
+	secrets  []string
+	warnings []string
+	// Resolved file and cmd references, so each command is only run once.
+	cache map[string]string
+	// Whether cmd references may be run in the config being resolved.
+	allowCommands bool
+	// Whether any references may be used in the config being resolved.
+	allowReferences bool
+}
+
+func NewSecretResolver() *SecretResolver {
+	return &SecretResolver{cache: make(map[string]string)}
+}
+
+// Resolve the strings in the config in place. The config must be a pointer.
+// The file name is used to describe where values came from in errors and warnings.
+func (r *SecretResolver) Resolve(fileName string, conf any) error {
+	r.allowCommands, r.allowReferences = true, true
+	return r.resolveValue(reflect.ValueOf(conf), fileName, nil, false, false)
+}
+
+// Resolve the strings in the config in place like Resolve, but fail on any cmd references.
+// This is for config that may not have been written by the user, such as config committed to a repository,
+// which must not be able to run commands just by being loaded.
+func (r *SecretResolver) ResolveWithoutCommands(fileName string, conf any) error {
+	r.allowCommands, r.allowReferences = false, true
+	return r.resolveValue(reflect.ValueOf(conf), fileName, nil, false, false)
+}
+
+// Resolve the strings in the config in place like Resolve, but fail on any ${ENV_VAR}, file: or cmd: references.
+// This is for config that has not been trusted by the user, which must not be able to read their environment or files.
+func (r *SecretResolver) ResolveWithoutReferences(fileName string, conf any) error {
+	r.allowCommands, r.allowReferences = false, false
+	return r.resolveValue(reflect.ValueOf(conf), fileName, nil, false, false)
+}
+
+// Get warnings about secrets that were written in plain text, rather than referenced.
+func (r *SecretResolver) PlaintextWarnings() []string {
+	return slices.Clone(r.warnings)
+}
+
+// Create a redactor for the secrets that have been resolved so far.
+func (r *SecretResolver) Redactor() *Redactor {
+	return NewRedactor(r.secrets...)
+}
+
+// Resolve the strings within the value if resolve is set, or within the fields tagged to be resolved.
+func (r *SecretResolver) resolveValue(v reflect.Value, fileName string, path []string, resolve, secret bool) error {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return r.resolveValue(v.Elem(), fileName, path, resolve, secret)
+	case reflect.Struct:
+		t := v.Type()
+		for i := range t.NumField() {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" {
+				name = field.Name
+			}
+			fieldSecret := secret || field.Tag.Get("secret") == "true"
+			fieldResolve := resolve || fieldSecret || field.Tag.Get("resolve") == "true"
+			if field.Tag.Get("secret") == "named" && v.Field(i).Kind() == reflect.Map {
+				if err := r.resolveNamedMap(v.Field(i), fileName, append(path, name)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := r.resolveValue(v.Field(i), fileName, append(path, name), fieldResolve, fieldSecret); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			if err := r.resolveMapEntry(v, key, fileName, path, resolve, secret); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			if err := r.resolveValue(v.Index(i), fileName, append(path, fmt.Sprint(i)), resolve, secret); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		if !resolve || !v.CanSet() {
+			return nil
+		}
+		resolved, err := r.resolveString(v.String(), fileName, path, secret)
+		if err != nil {
+			return err
+		}
+		v.SetString(resolved)
+	}
+	return nil
+}
+
+func (r *SecretResolver) resolveNamedMap(v reflect.Value, fileName string, path []string) error {
+	for _, key := range v.MapKeys() {
+		if err := r.resolveMapEntry(v, key, fileName, path, true, looksLikeCredential(key.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Map values cannot be changed in place, so resolve a copy and put it back.
+func (r *SecretResolver) resolveMapEntry(m, key reflect.Value, fileName string, path []string, resolve, secret bool) error {
+	value := reflect.New(m.Type().Elem()).Elem()
+	value.Set(m.MapIndex(key))
+	if err := r.resolveValue(value, fileName, append(path, fmt.Sprint(key.Interface())), resolve, secret); err != nil {
+		return err
+	}
+	m.SetMapIndex(key, value)
+	return nil
+}
+
+func (r *SecretResolver) resolveString(s, fileName string, path []string, secret bool) (string, error) {
+	location := fileName + ": " + strings.Join(path, ".")
+	if !r.allowReferences && isReference(s) {
+		return "", fmt.Errorf("%s: ${ENV_VAR}, file: and cmd: references are not allowed here", location)
+	}
+	if ref, ok := strings.CutPrefix(s, "file:"); ok {
+		value, err := r.cached(s, func() (string, error) { return readSecretFile(ref) })
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", location, err)
+		}
+		r.addSecret(value)
+		return value, nil
+	}
+	if ref, ok := strings.CutPrefix(s, "cmd:"); ok {
+		if !r.allowCommands {
+			return "", fmt.Errorf("%s: cmd references are not allowed here, use ${ENV_VAR} or file: instead", location)
+		}
+		value, err := r.cached(s, func() (string, error) { return runSecretCommand(ref) })
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", location, err)
+		}
+		r.addSecret(value)
+		return value, nil
+	}
+	value, usedEnv, err := expandEnv(s)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", location, err)
+	}
+	if secret {
+		r.addSecret(value)
+		if !usedEnv && value != "" && value != PlaceholderModelKey {
+			r.warnings = append(r.warnings, fmt.Sprintf("%s is a secret written in plain text, consider using ${ENV_VAR}, file: or cmd: instead", location))
+		}
+	}
+	return value, nil
+}
+
+func (r *SecretResolver) cached(ref string, resolve func() (string, error)) (string, error) {
+	if value, ok := r.cache[ref]; ok {
+		return value, nil
+	}
+	value, err := resolve()
+	if err != nil {
+		return "", err
+	}
+	r.cache[ref] = value
+	return value, nil
+}
+
+func (r *SecretResolver) addSecret(value string) {
+	if len(value) >= minRedactedSecretLength && !slices.Contains(r.secrets, value) {
+		r.secrets = append(r.secrets, value)
+	}
+	// The credential in a value such as "Bearer <token>" may also appear on its own
+	if _, credential, ok := strings.Cut(value, " "); ok {
+		r.addSecret(strings.TrimSpace(credential))
+	}
+}
+
+// Whether the string references an environment variable, file or command, rather than being used as written.
+func isReference(s string) bool {
+	return strings.HasPrefix(s, "file:") || strings.HasPrefix(s, "cmd:") || strings.Contains(strings.ReplaceAll(s, "$${", ""), "${")
+}
+
+// Replace each ${VAR} with the value of the environment variable, returning whether any variables were used.
+func expandEnv(s string) (string, bool, error) {
+	b := &strings.Builder{}
+	usedEnv := false
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), usedEnv, nil
+		}
+		if start > 0 && s[start-1] == '$' {
+			// $${ is an escaped ${
+			b.WriteString(s[:start-1] + "${")
+			s = s[start+2:]
+			continue
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return "", false, fmt.Errorf("'${' is not closed by a '}' (use $${ for a literal ${)")
+		}
+		name := s[start+2 : start+end]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", false, fmt.Errorf("environment variable %s is not set", name)
+		}
+		usedEnv = true
+		b.WriteString(s[:start] + value)
+		s = s[start+end+1:]
+	}
+}
+
+func readSecretFile(path string) (string, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, rest)
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read secret file: %w", err)
+	}
+	return strings.TrimSpace(string(bs)), nil
+}
+
+func runSecretCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("secret command '%s' failed: %w: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Whether the name of a header or environment variable suggests that its value is a credential.
+func looksLikeCredential(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range []string{"auth", "key", "token", "secret", "password", "cookie", "credential"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces secrets in text with a placeholder. A nil redactor redacts nothing.
+type Redactor struct {
+	replacer *strings.Replacer
+}
+
+func NewRedactor(secrets ...string) *Redactor {
+	// Replace longer secrets first, in case one secret contains another
+	secrets = slices.Clone(secrets)
+	slices.SortFunc(secrets, func(a, b string) int { return len(b) - len(a) })
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, s := range secrets {
+		if len(s) >= minRedactedSecretLength {
+			pairs = append(pairs, s, "[REDACTED]")
+		}
+	}
+	if len(pairs) == 0 {
+		return &Redactor{}
+	}
+	return &Redactor{strings.NewReplacer(pairs...)}
+}
+
+// Replace any secrets in the text.
+func (r *Redactor) Redact(s string) string {
+	if r == nil || r.replacer == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// Replace any secrets in the message of the error, keeping the original error so it can still be unwrapped.
+func (r *Redactor) RedactError(err error) error {
+	if err == nil || r == nil || r.replacer == nil {
+		return err
+	}
+	msg := r.Redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg, err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// Wrap the writer so that secrets are redacted from what is written.
+// Secrets split across writes are not redacted, so this is intended for line-based output such as logs.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	if r == nil || r.replacer == nil {
+		return w
+	}
+	return &redactingWriter{r, w}
+}
+
+type redactingWriter struct {
+	redactor *Redactor
+	w        io.Writer
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(w.w, w.redactor.Redact(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
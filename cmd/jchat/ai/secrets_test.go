@@ -0,0 +1,99 @@
+package ai
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretResolverResolvesTaggedFields(t *testing.T) {
+	t.Setenv("JCHAT_TEST_KEY", "sk-from-env")
+	t.Setenv("JCHAT_TEST_HOST", "models.example.com")
+	keyFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(keyFile, []byte("token-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := ModelsConfig{Models: map[string]ModelConfig{
+		"default": {
+			URL:     "https://${JCHAT_TEST_HOST}/v1",
+			Key:     "${JCHAT_TEST_KEY}",
+			Headers: map[string]string{"X-Api-Key": "file:" + keyFile, "X-Region": "${JCHAT_TEST_HOST}"},
+		},
+	}}
+	r := NewSecretResolver()
+	if err := r.Resolve("models.json", &conf); err != nil {
+		t.Fatal(err)
+	}
+	model := conf.Models["default"]
+	if model.URL != "https://models.example.com/v1" {
+		t.Errorf("url was not resolved: %q", model.URL)
+	}
+	if model.Key != "sk-from-env" {
+		t.Errorf("key was not resolved: %q", model.Key)
+	}
+	if model.Headers["X-Api-Key"] != "token-from-file" || model.Headers["X-Region"] != "models.example.com" {
+		t.Errorf("headers were not resolved: %v", model.Headers)
+	}
+	redacted := r.Redactor().Redact("sk-from-env token-from-file models.example.com")
+	if redacted != "[REDACTED] [REDACTED] models.example.com" {
+		t.Errorf("unexpected redaction %q", redacted)
+	}
+}
+
+func TestSecretResolverLeavesOtherStrings(t *testing.T) {
+	agents := AgentsConfig{Agents: map[string]AgentConfig{
+		"docs": {
+			AgentDescription: []string{"Explains ${VARIABLES} in templates"},
+			Personality:      "You write shell like ${HOME} and file:names without worrying about them.",
+			MCPResources:     map[string][]string{"filesystem": {"file:///path/to/CONTRIBUTING.md"}},
+		},
+	}}
+	servers := MCPServersConfig{MCPServers: map[string]MCPServerConfig{
+		"filesystem": {Command: "cmd:not-a-reference", Args: []string{"${UNSET_IN_TESTS}", "file:///root"}},
+	}}
+	r := NewSecretResolver()
+	if err := r.ResolveWithoutCommands("agents.json", &agents); err != nil {
+		t.Fatalf("agents could not be resolved: %v", err)
+	}
+	if err := r.ResolveWithoutCommands("mcp.json", &servers); err != nil {
+		t.Fatalf("mcp servers could not be resolved: %v", err)
+	}
+	docs := agents.Agents["docs"]
+	if docs.Personality != "You write shell like ${HOME} and file:names without worrying about them." {
+		t.Errorf("personality was changed: %q", docs.Personality)
+	}
+	if docs.AgentDescription[0] != "Explains ${VARIABLES} in templates" {
+		t.Errorf("description was changed: %q", docs.AgentDescription[0])
+	}
+	if uri := docs.MCPResources["filesystem"][0]; uri != "file:///path/to/CONTRIBUTING.md" {
+		t.Errorf("resource uri was changed: %q", uri)
+	}
+	server := servers.MCPServers["filesystem"]
+	if server.Command != "cmd:not-a-reference" || server.Args[0] != "${UNSET_IN_TESTS}" || server.Args[1] != "file:///root" {
+		t.Errorf("server was changed: %+v", server)
+	}
+}
+
+func TestSecretResolverWithoutCommandsRejectsCmd(t *testing.T) {
+	conf := ModelsConfig{Models: map[string]ModelConfig{"default": {Key: "cmd:echo secret"}}}
+	if err := NewSecretResolver().ResolveWithoutCommands("models.json", &conf); err == nil {
+		t.Error("expected a cmd reference to be rejected")
+	}
+}
+
+func TestSecretResolverWithoutReferences(t *testing.T) {
+	t.Setenv("JCHAT_TEST_KEY", "sk-from-env")
+	for _, key := range []string{"${JCHAT_TEST_KEY}", "Bearer ${JCHAT_TEST_KEY}", "file:/etc/passwd", "cmd:echo secret"} {
+		conf := ModelsConfig{Models: map[string]ModelConfig{"default": {Key: key}}}
+		if err := NewSecretResolver().ResolveWithoutReferences("models.json", &conf); err == nil {
+			t.Errorf("expected %q to be rejected", key)
+		}
+	}
+	conf := ModelsConfig{Models: map[string]ModelConfig{"default": {URL: "http://localhost:11434/$${literal}", Key: "not-a-reference"}}}
+	if err := NewSecretResolver().ResolveWithoutReferences("models.json", &conf); err != nil {
+		t.Fatalf("expected plain values to be allowed: %v", err)
+	}
+	if url := conf.Models["default"].URL; url != "http://localhost:11434/${literal}" {
+		t.Errorf("unexpected url %q", url)
+	}
+}
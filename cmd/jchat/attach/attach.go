@@ -0,0 +1,240 @@
+// Package attach attaches files and directories to messages with @path references,
+// and splits them off again so that a message can be shown as it was typed.
+package attach
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on what is attached to a message with @path references, so that a large file does not fill the context of the model.
+const (
+	maxAttachedFileBytes  = 100_000
+	maxAttachedTotalBytes = 300_000
+	maxAttachedDirEntries = 200
+)
+
+// A file or directory attached to a message with an @path reference.
+type Attachment struct {
+	// The path as it was referred to in the message.
+	Path      string
+	Directory bool
+	// The size of the file in bytes, or the number of entries in the directory.
+	Size int
+	// Whether only the start of the file or directory listing was attached.
+	Truncated bool
+	// What was attached, including any notice that it was truncated.
+	Content string
+}
+
+// Describe the attachment in a few words, such as "main.go (2.1 KB)".
+func (a Attachment) Describe() string {
+	var size string
+	if a.Directory {
+		size = fmt.Sprintf("%d entries", a.Size)
+	} else {
+		size = formatBytes(a.Size)
+	}
+	if a.Truncated {
+		return fmt.Sprintf("%s (%s, truncated)", a.Path, size)
+	}
+	return fmt.Sprintf("%s (%s)", a.Path, size)
+}
+
+// Attachments are added to the end of the message as a block of tags, which can be split off again to show the message as it was typed.
+const (
+	attachmentsStart = "\n\n<attachments>\n"
+	attachmentsEnd   = "\n</attachments>"
+)
+
+var attachmentTagPattern = regexp.MustCompile(`(?m)^<(file|directory) path=("(?:[^"\\]|\\.)*") size="(\d+)"( truncated="true")?>$`)
+
+// Split a message sent with attachments into the message as it was typed and the attachments.
+// Messages without attachments are returned unchanged.
+func Split(task string) (string, []Attachment) {
+	start := strings.LastIndex(task, attachmentsStart)
+	if start < 0 || !strings.HasSuffix(task, attachmentsEnd) {
+		return task, nil
+	}
+	block := task[start : len(task)-len(attachmentsEnd)]
+	matches := attachmentTagPattern.FindAllStringSubmatchIndex(block, -1)
+	attachments := make([]Attachment, 0, len(matches))
+	for i, match := range matches {
+		path, err := strconv.Unquote(block[match[4]:match[5]])
+		if err != nil {
+			continue
+		}
+		size, _ := strconv.Atoi(block[match[6]:match[7]])
+		tag := block[match[2]:match[3]]
+		// The content runs up to the closing tag before the next attachment
+		end := len(block)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		content := strings.TrimSuffix(strings.TrimSuffix(block[match[1]:end], "\n"), "\n</"+tag+">")
+		attachments = append(attachments, Attachment{
+			Path:      path,
+			Directory: tag == "directory",
+			Size:      size,
+			Truncated: match[8] >= 0,
+			Content:   strings.TrimPrefix(content, "\n"),
+		})
+	}
+	return task[:start], attachments
+}
+
+// Find the @path references in the message to files or directories that exist, and attach their contents to the message.
+// References to paths that do not exist, or to any of the names (such as agents in a room), are left as they are, so an @ can still be used for other things.
+func Files(message string, names []string) (string, []Attachment, error) {
+	b := &strings.Builder{}
+	attachments := make([]Attachment, 0)
+	remaining := maxAttachedTotalBytes
+	for _, path := range findAttachmentRefs(message, names) {
+		if slices.ContainsFunc(attachments, func(a Attachment) bool { return a.Path == path }) {
+			continue
+		}
+		if remaining <= 0 {
+			return "", nil, fmt.Errorf("could not attach @%s: the attachments are already at the limit of %s", path, formatBytes(maxAttachedTotalBytes))
+		}
+		attachment, err := readAttachment(path, min(remaining, maxAttachedFileBytes))
+		if err != nil {
+			return "", nil, fmt.Errorf("could not attach @%s: %w", path, err)
+		}
+		remaining -= len(attachment.Content)
+		tag := "file"
+		if attachment.Directory {
+			tag = "directory"
+		}
+		truncated := ""
+		if attachment.Truncated {
+			truncated = ` truncated="true"`
+		}
+		fmt.Fprintf(b, "<%s path=%s size=\"%d\"%s>\n%s\n</%s>\n", tag, strconv.Quote(path), attachment.Size, truncated, attachment.Content, tag)
+		attachments = append(attachments, attachment)
+	}
+	if len(attachments) == 0 {
+		return message, nil, nil
+	}
+	return message + attachmentsStart + strings.TrimSuffix(b.String(), "\n") + attachmentsEnd, attachments, nil
+}
+
+// Find the paths referred to with @path in the message that exist.
+// A reference starts with an @ at the start of a word, and punctuation at the end of the word is ignored if the path does not exist with it.
+func findAttachmentRefs(message string, names []string) []string {
+	paths := make([]string, 0)
+	for _, word := range strings.Fields(message) {
+		path, ok := strings.CutPrefix(word, "@")
+		if !ok {
+			continue
+		}
+		for path != "" {
+			if slices.Contains(names, path) {
+				break
+			}
+			if _, err := os.Stat(ExpandHome(path)); err == nil {
+				paths = append(paths, path)
+				break
+			}
+			trimmed := strings.TrimRight(path, ".,;:!?)]}'\"")
+			if trimmed == path {
+				break
+			}
+			path = trimmed
+		}
+	}
+	return paths
+}
+
+// Read a file, or list a directory, to attach, with at most limit bytes of content and a notice if it was truncated.
+func readAttachment(path string, limit int) (Attachment, error) {
+	info, err := os.Stat(ExpandHome(path))
+	if err != nil {
+		return Attachment{}, err
+	}
+	if info.IsDir() {
+		return readDirAttachment(path, limit)
+	}
+	f, err := os.Open(ExpandHome(path))
+	if err != nil {
+		return Attachment{}, err
+	}
+	defer f.Close()
+	content, err := io.ReadAll(io.LimitReader(f, int64(limit)))
+	if err != nil {
+		return Attachment{}, err
+	}
+	truncated := info.Size() > int64(len(content))
+	if truncated {
+		// Cut at the end of a line, and never in the middle of a character
+		if i := bytes.LastIndexByte(content, '\n'); i > 0 {
+			content = content[:i]
+		}
+		for i := 0; i < utf8.UTFMax-1 && len(content) > 0 && !utf8.Valid(content); i++ {
+			content = content[:len(content)-1]
+		}
+	}
+	if bytes.IndexByte(content, 0) >= 0 || !utf8.Valid(content) {
+		return Attachment{}, errors.New("it is not a text file")
+	}
+	text := string(content)
+	if truncated {
+		text += fmt.Sprintf("\n[Truncated: only the first %s of %s are attached]", formatBytes(len(content)), formatBytes(int(info.Size())))
+	}
+	return Attachment{Path: path, Size: int(info.Size()), Truncated: truncated, Content: text}, nil
+}
+
+func readDirAttachment(path string, limit int) (Attachment, error) {
+	entries, err := os.ReadDir(ExpandHome(path))
+	if err != nil {
+		return Attachment{}, err
+	}
+	lines := make([]string, 0, len(entries))
+	length := 0
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		if len(lines) >= maxAttachedDirEntries || length+len(name)+1 > limit {
+			break
+		}
+		lines = append(lines, name)
+		length += len(name) + 1
+	}
+	truncated := len(lines) < len(entries)
+	text := strings.Join(lines, "\n")
+	if truncated {
+		text += fmt.Sprintf("\n[Truncated: only the first %d of %d entries are listed]", len(lines), len(entries))
+	}
+	return Attachment{Path: path, Directory: true, Size: len(entries), Truncated: truncated, Content: text}, nil
+}
+
+// Expand a path starting with ~/ to be within the home directory.
+func ExpandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+func formatBytes(n int) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1f MB", float64(n)/1_000_000)
+	case n >= 1_000:
+		return fmt.Sprintf("%.1f KB", float64(n)/1_000)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
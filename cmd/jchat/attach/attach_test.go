@@ -0,0 +1,37 @@
+package attach
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilesAndSplit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(path, []byte("first line\nsecond line"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	message := "summarise @" + path + ", and ignore @nobody"
+	withAttachments, attached, err := Files(message, []string{"nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attached) != 1 || attached[0].Path != path {
+		t.Fatalf("expected the file to be attached, got %+v", attached)
+	}
+	split, attachments := Split(withAttachments)
+	if split != message {
+		t.Errorf("expected the message as it was typed, got %q", split)
+	}
+	if len(attachments) != 1 {
+		t.Fatalf("expected one attachment, got %d", len(attachments))
+	}
+	a := attachments[0]
+	if a.Path != path || a.Directory || a.Size != 22 || a.Truncated || a.Content != "first line\nsecond line" {
+		t.Errorf("unexpected attachment %+v", a)
+	}
+	if split, attachments := Split("no attachments here"); split != "no attachments here" || attachments != nil {
+		t.Errorf("expected a message without attachments to be unchanged, got %q, %v", split, attachments)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/cmd/jchat/ai"
+	"github.com/JoshPattman/jpf"
+)
+
+// Run the batch subcommand, which answers each query in a JSONL file with a fresh agent, writing the results to another JSONL file.
+func runBatch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	agentName := fs.String("a", "", "The name of the agent to answer each query with")
+	outPath := fs.String("o", "", "The JSONL file to write results to (default the input file with the extension .results.jsonl)")
+	parallel := fs.Int("parallel", 4, "How many queries to answer at once")
+	timeout := fs.Duration("timeout", 5*time.Minute, "How long the agent may take to answer each query, or 0 for no limit")
+	retries := fs.Int("retries", 2, "How many times to retry a query that fails because of the model or a timeout")
+	maxSteps := fs.Int("max-steps", 0, "The most steps with tool calls the agent may take for each query (default no limit)")
+	maxTokens := fs.Int("max-tokens", 0, "The most tokens (input and output) that may be used for each query (default no limit)")
+	configDir := addConfigDirFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: jchat batch -a <agent> [flags] <input.jsonl>")
+		fmt.Fprintln(fs.Output(), "\nAnswer each query in the input file with a new agent, sharing MCP servers between them.")
+		fmt.Fprintln(fs.Output(), "Each line of the input is a JSON string, or an object with a 'query' and optionally an 'id' (default the line number).")
+		fmt.Fprintln(fs.Output(), "A result is appended to the output as soon as each query is finished, and queries that already have a successful result in the output are skipped,")
+		fmt.Fprintln(fs.Output(), "so an interrupted batch can be continued by running the same command again.")
+		fmt.Fprintln(fs.Output(), "")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *agentName == "" || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *parallel < 1 {
+		fmt.Fprintln(os.Stderr, "Error: -parallel must be at least 1")
+		os.Exit(exitUsage)
+	}
+	inPath := fs.Arg(0)
+	if *outPath == "" {
+		*outPath = strings.TrimSuffix(inPath, ".jsonl") + ".results.jsonl"
+	}
+	if *outPath == inPath {
+		fmt.Fprintln(os.Stderr, "Error: the output must be a different file to the input")
+		os.Exit(exitUsage)
+	}
+	items, err := readBatchItems(inPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading input:", err)
+		os.Exit(exitUsage)
+	}
+	done, err := readCompletedBatchItems(*outPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading previous results:", err)
+		os.Exit(exitUsage)
+	}
+
+	conf, err := loadConfig(*configDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		os.Exit(exitConfig)
+	}
+	for _, w := range conf.Warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", w)
+	}
+	mcpClients := ai.NewMCPClients(conf.MCPServers, conf.Models, jpf.NewUsageCounter(), conf.LogsPath, conf.Redactor)
+	defer mcpClients.Close()
+	// Check the agent can be built before starting, so a config error is reported once rather than for every query
+	if _, err := conf.createAgentBuilder(*agentName, mcpClients, jpf.NewUsageCounter()); err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading agent:", err)
+		mcpClients.Close()
+		os.Exit(exitConfig)
+	}
+
+	out, err := openBatchOutput(*outPath, conf.Redactor)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening output:", err)
+		mcpClients.Close()
+		os.Exit(exitError)
+	}
+	defer out.Close()
+
+	ctx, cancel := interruptibleContext(0)
+	defer cancel(nil)
+	b := &batchRun{
+		conf:       conf,
+		agentName:  *agentName,
+		mcpClients: mcpClients,
+		timeout:    *timeout,
+		retries:    *retries,
+		maxSteps:   *maxSteps,
+		maxTokens:  *maxTokens,
+		out:        out,
+	}
+	todo := make([]batchItem, 0, len(items))
+	for _, item := range items {
+		if !done[item.ID] {
+			todo = append(todo, item)
+		}
+	}
+	if skipped := len(items) - len(todo); skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Skipping %d queries that already have results in %s\n", skipped, *outPath)
+	}
+	b.run(ctx, todo, *parallel)
+
+	fmt.Fprintf(os.Stderr, "Finished %d of %d queries: %d succeeded, %d failed. Results are in %s\n", b.succeeded+b.failed, len(todo), b.succeeded, b.failed, *outPath)
+	code := exitOK
+	switch {
+	case ctx.Err() != nil:
+		fmt.Fprintln(os.Stderr, "Interrupted, run the same command again to continue")
+		code = exitInterrupted
+	case b.writeErr != nil:
+		fmt.Fprintln(os.Stderr, "Error writing results:", b.writeErr)
+		code = exitError
+	case b.failed > 0:
+		code = exitModel
+	}
+	if code != exitOK {
+		out.Close()
+		mcpClients.Close()
+		os.Exit(code)
+	}
+}
+
+type batchItem struct {
+	ID    string
+	Query string
+}
+
+// The result of a query, written as a line of the output.
+type batchResult struct {
+	ID    string `json:"id"`
+	Query string `json:"query"`
+	// Either ok or error.
+	Status     string     `json:"status"`
+	Answer     string     `json:"answer,omitempty"`
+	Error      *pipeError `json:"error,omitempty"`
+	Steps      []pipeStep `json:"steps"`
+	Attempts   int        `json:"attempts"`
+	Usage      pipeUsage  `json:"usage"`
+	DurationMS int64      `json:"duration_ms"`
+}
+
+const (
+	batchStatusOK    = "ok"
+	batchStatusError = "error"
+)
+
+// Read the items of the input, giving each item without an id its line number.
+func readBatchItems(path string) ([]batchItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	items := make([]batchItem, 0)
+	ids := make(map[string]int)
+	for lineNum := 1; lines.Scan(); lineNum++ {
+		line := bytes.TrimSpace(lines.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		item := batchItem{ID: strconv.Itoa(lineNum)}
+		if line[0] == '"' {
+			if err := json.Unmarshal(line, &item.Query); err != nil {
+				return nil, fmt.Errorf("line %d is not valid JSON: %w", lineNum, err)
+			}
+		} else {
+			var obj struct {
+				ID    json.RawMessage `json:"id"`
+				Query string          `json:"query"`
+			}
+			if err := json.Unmarshal(line, &obj); err != nil {
+				return nil, fmt.Errorf("line %d is not valid JSON: %w", lineNum, err)
+			}
+			item.Query = obj.Query
+			if len(obj.ID) > 0 && string(obj.ID) != "null" {
+				// Use string ids as they are, and other ids (such as numbers) as written
+				var id string
+				if json.Unmarshal(obj.ID, &id) != nil {
+					id = string(obj.ID)
+				}
+				item.ID = id
+			}
+		}
+		if item.Query == "" {
+			return nil, fmt.Errorf("line %d has no query", lineNum)
+		}
+		if prev, ok := ids[item.ID]; ok {
+			return nil, fmt.Errorf("line %d has the same id '%s' as line %d", lineNum, item.ID, prev)
+		}
+		ids[item.ID] = lineNum
+		items = append(items, item)
+	}
+	return items, lines.Err()
+}
+
+// Get the ids of the items that were answered successfully by an earlier run, from its output (if it exists).
+func readCompletedBatchItems(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	lines.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lines.Scan() {
+		var result struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		}
+		// A line cut short by an interruption is ignored, so its item is answered again
+		if json.Unmarshal(lines.Bytes(), &result) == nil && result.Status == batchStatusOK {
+			done[result.ID] = true
+		}
+	}
+	return done, lines.Err()
+}
+
+// Open the output for appending, starting a new line if the last line was cut short.
+func openBatchOutput(path string, redactor *ai.Redactor) (*batchOutput, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if last[0] != '\n' {
+			if _, err := f.Write([]byte("\n")); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+	return &batchOutput{f: f, w: redactor.Writer(f)}, nil
+}
+
+// Appends results to the output, a whole line at a time.
+type batchOutput struct {
+	lock sync.Mutex
+	f    *os.File
+	w    io.Writer
+}
+
+func (o *batchOutput) write(result batchResult) error {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	_, err = o.w.Write(append(line, '\n'))
+	return err
+}
+
+func (o *batchOutput) Close() error {
+	return o.f.Close()
+}
+
+// Answers the items of a batch, keeping count of how it is going.
+type batchRun struct {
+	conf       jchatConfig
+	agentName  string
+	mcpClients *ai.MCPClients
+	timeout    time.Duration
+	retries    int
+	maxSteps   int
+	maxTokens  int
+	out        *batchOutput
+
+	lock      sync.Mutex
+	succeeded int
+	failed    int
+	writeErr  error
+}
+
+// Answer the items with a fixed number of workers, until they are all answered or the context is cancelled.
+func (b *batchRun) run(ctx context.Context, items []batchItem, parallel int) {
+	queue := make(chan batchItem)
+	wg := &sync.WaitGroup{}
+	for range min(parallel, len(items)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				b.runItem(ctx, item, len(items))
+			}
+		}()
+	}
+	for _, item := range items {
+		select {
+		case queue <- item:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func (b *batchRun) runItem(ctx context.Context, item batchItem, total int) {
+	start := time.Now()
+	result := batchResult{ID: item.ID, Query: item.Query}
+	for attempt := 1; ; attempt++ {
+		result.Attempts = attempt
+		answer, steps, usage, err, retryable := b.answer(ctx, item.Query)
+		result.Steps = steps
+		result.Usage.InputTokens += usage.InputTokens
+		result.Usage.OutputTokens += usage.OutputTokens
+		if ctx.Err() != nil {
+			// Interrupted, so leave the item to be answered when the batch is continued
+			return
+		}
+		if err == nil {
+			result.Status = batchStatusOK
+			result.Answer = answer
+			result.Error = nil
+			break
+		}
+		result.Status = batchStatusError
+		result.Error = err
+		if attempt > b.retries || !retryable {
+			break
+		}
+		// Back off before retrying, in case the model is overloaded
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+	result.DurationMS = time.Since(start).Milliseconds()
+	writeErr := b.out.write(result)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if result.Status == batchStatusOK {
+		b.succeeded++
+	} else {
+		b.failed++
+	}
+	if writeErr != nil && b.writeErr == nil {
+		b.writeErr = writeErr
+	}
+	status := result.Status
+	if result.Error != nil {
+		status = fmt.Sprintf("%s (%s): %s", status, result.Error.Kind, b.conf.Redactor.Redact(result.Error.Message))
+	}
+	fmt.Fprintf(os.Stderr, "[%d/%d] %s %s in %s\n", b.succeeded+b.failed, total, item.ID, status, time.Since(start).Round(100*time.Millisecond))
+}
+
+// Answer the query with a new agent, which shares the MCP servers of the batch.
+// Errors from the model and timeouts may be retried, but other errors (such as running out of steps) would most likely happen again.
+func (b *batchRun) answer(ctx context.Context, query string) (answer string, steps []pipeStep, usage jpf.Usage, pipeErr *pipeError, retryable bool) {
+	usageCounter := jpf.NewUsageCounter()
+	steps = make([]pipeStep, 0)
+	loaded, err := b.conf.createAgentBuilder(b.agentName, b.mcpClients, usageCounter)
+	if err != nil {
+		return "", steps, jpf.Usage{}, &pipeError{Kind: "config", Message: err.Error()}, false
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if b.timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, b.timeout, fmt.Errorf("%w: the agent took longer than %s", errBudgetExhausted, b.timeout))
+		defer cancelTimeout()
+	}
+	a := loaded.Build()
+	limitAgentBudget(a, usageCounter, b.maxSteps, b.maxTokens, cancel)
+	// Steps are reported by the goroutine answering, so they need no lock
+	a.SetOnReActCompleteCallback(func(reasoning string, aos []agent.ActionObservation) {
+		steps = append(steps, newPipeStep(reasoning, aos))
+	})
+	answer, err = agent.AnswerWithContext(ctx, a, query)
+	if err != nil {
+		kind, _, err := classifyPipeError(ctx, err)
+		retryable = kind == "model" || errors.Is(ctx.Err(), context.DeadlineExceeded)
+		return "", steps, usageCounter.Get(), &pipeError{Kind: kind, Message: err.Error()}, retryable
+	}
+	return answer, steps, usageCounter.Get(), nil, false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/agentsession"
+	"github.com/JoshPattman/agent/cmd/jchat/ui"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// The agent being chatted to in the TUI, which slash commands may switch to another agent or model.
+type chatSession struct {
+	lock      sync.Mutex
+	conf      jchatConfig
+	store     *agentsession.FileStore
+	agentName string
+	loaded    loadedAgent
+	current   *sessionAgent
+	// The session that the next agent built continues, or nil to start a new session.
+	next *agentsession.SessionData
+	// The room of agents being chatted to, or nil if chatting to a single agent.
+	room *roomConfig
+}
+
+func newChatSession(store *agentsession.FileStore, agentName string, loaded loadedAgent, resumed *agentsession.SessionData, room *roomConfig) *chatSession {
+	return &chatSession{
+		conf:      loaded.Config,
+		store:     store,
+		agentName: agentName,
+		loaded:    loaded,
+		next:      resumed,
+		room:      room,
+	}
+}
+
+// Build the current agent, continuing a session if one is due to be continued, or starting a new session.
+func (c *chatSession) build() (agent.Agent, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	a, ok := c.loaded.Build().(agent.StatefulAgent)
+	if !ok {
+		return nil, errors.New("the agent does not support saving sessions")
+	}
+	if c.next != nil {
+		c.current = resumeSessionAgent(c.store, c.conf.Redactor, *c.next, a, c.loaded.UsageCounter)
+		c.next = nil
+	} else {
+		c.current = newSessionAgent(c.store, c.conf.Redactor, c.agentName, a, c.loaded.UsageCounter)
+		if c.room != nil {
+			c.current.data.Metadata[sessionRoomKey] = strings.Join(c.room.Agents, ",")
+			c.current.data.Metadata[sessionModeratorKey] = c.room.Moderator
+		}
+	}
+	return c.current, nil
+}
+
+func (c *chatSession) commands() []ui.SlashCommand {
+	return []ui.SlashCommand{
+		{
+			Name:        "agent",
+			Args:        "<name>",
+			Description: "Start a new session with another agent",
+			Complete:    func(string) []string { return c.agentNames() },
+			Run:         c.switchAgent,
+		},
+		{
+			Name:        "model",
+			Args:        "<name>",
+			Description: "Continue the session with another model",
+			Complete:    func(string) []string { return c.modelNames() },
+			Run:         c.switchModel,
+		},
+		{
+			Name:        "tools",
+			Description: "List the tools the agent can use",
+			Run:         func(string) tea.Msg { return ui.CommandOutputMessage{Output: c.describeTools()} },
+		},
+		{
+			Name:        "scenarios",
+			Description: "List the scenarios the agent knows how to handle",
+			Run:         func(string) tea.Msg { return ui.CommandOutputMessage{Output: c.describeScenarios()} },
+		},
+		{
+			Name:        "usage",
+			Description: "Show the tokens used by this session and since jchat started",
+			Run:         func(string) tea.Msg { return ui.CommandOutputMessage{Output: c.describeUsage()} },
+		},
+	}
+}
+
+func (c *chatSession) agentNames() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return slices.Sorted(maps.Keys(c.conf.Agents.Agents))
+}
+
+func (c *chatSession) modelNames() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return slices.Sorted(maps.Keys(c.conf.Models.Models))
+}
+
+// The agent is built (which may connect to MCP servers) without holding the lock, so that autocompletion in the UI is not blocked meanwhile.
+func (c *chatSession) switchAgent(name string) tea.Msg {
+	if name == "" {
+		return ui.CommandOutputMessage{Error: errors.New("usage: /agent <name>")}
+	}
+	c.lock.Lock()
+	conf, loaded := c.conf, c.loaded
+	c.lock.Unlock()
+	loaded, err := conf.createAgentBuilder(name, loaded.MCPClients, loaded.UsageCounter)
+	if err != nil {
+		return ui.CommandOutputMessage{Error: fmt.Errorf("could not switch agent: %w", err)}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.agentName = name
+	c.loaded = loaded
+	c.next = nil
+	c.room = nil
+	return ui.SwitchAgentMessage{Summary: loaded.Summary}
+}
+
+// Rebuild the current agent with another model, continuing the current session.
+// The model is used by the agent until jchat exits. Like switchAgent, the agent is built without holding the lock.
+func (c *chatSession) switchModel(name string) tea.Msg {
+	if name == "" {
+		return ui.CommandOutputMessage{Error: errors.New("usage: /model <name>")}
+	}
+	c.lock.Lock()
+	if c.room != nil {
+		c.lock.Unlock()
+		return ui.CommandOutputMessage{Error: errors.New("the agents in a room each use the model in their config, so the model cannot be switched")}
+	}
+	if _, ok := c.conf.Models.Models[name]; !ok {
+		c.lock.Unlock()
+		return ui.CommandOutputMessage{Error: fmt.Errorf("could not find model '%s'", name)}
+	}
+	agentName, loaded := c.agentName, c.loaded
+	conf := c.conf
+	conf.Agents.Agents = maps.Clone(c.conf.Agents.Agents)
+	c.lock.Unlock()
+	agentConf := conf.Agents.Agents[agentName]
+	agentConf.ModelName = name
+	conf.Agents.Agents[agentName] = agentConf
+	loaded, err := conf.createAgentBuilder(agentName, loaded.MCPClients, loaded.UsageCounter)
+	if err != nil {
+		return ui.CommandOutputMessage{Error: fmt.Errorf("could not switch model: %w", err)}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.agentName != agentName || c.room != nil {
+		return ui.CommandOutputMessage{Error: errors.New("could not switch model: the agent was switched at the same time")}
+	}
+	c.conf = conf
+	c.loaded = loaded
+	if c.current != nil {
+		session := c.current.Session()
+		c.next = &session
+	}
+	return ui.SwitchAgentMessage{Summary: loaded.Summary}
+}
+
+func (c *chatSession) describeTools() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.loaded.Tools) == 0 {
+		return "The agent has no tools"
+	}
+	lines := []string{"Tools"}
+	for _, t := range c.loaded.Tools {
+		line := "  └▶ " + t.Name()
+		if desc := t.Description(); len(desc) > 0 {
+			line += ": " + desc[0]
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c *chatSession) describeScenarios() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	agentNames := []string{c.agentName}
+	if c.room != nil {
+		agentNames = c.room.Agents
+	}
+	lines := []string{"Scenarios"}
+	for _, agentName := range agentNames {
+		scenarios := c.conf.Agents.Agents[agentName].Scenarios
+		for _, name := range slices.Sorted(maps.Keys(scenarios)) {
+			line := fmt.Sprintf("  └▶ %s: %s", name, scenarios[name].Headline)
+			if c.room != nil {
+				line = fmt.Sprintf("  └▶ %s (%s): %s", name, agentName, scenarios[name].Headline)
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 1 {
+		return "The agent has no scenarios"
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c *chatSession) describeUsage() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	total := c.loaded.UsageCounter.Get()
+	text := fmt.Sprintf("Since jchat started: %d input tokens, %d output tokens", total.InputTokens, total.OutputTokens)
+	if c.current != nil {
+		session := c.current.usage()
+		text = fmt.Sprintf("This session: %d input tokens, %d output tokens\n%s", session.InputTokens, session.OutputTokens, text)
+	}
+	return text
+}
+
+// Get the tokens used by each agent in the room, or nil if not chatting to a room.
+func (c *chatSession) participantUsage() []ui.ParticipantUsage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.current == nil {
+		return nil
+	}
+	room, ok := c.current.StatefulAgent.(*roomAgent)
+	if !ok {
+		return nil
+	}
+	return room.participantUsage()
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoshPattman/agent/agentmcp"
+	"github.com/JoshPattman/agent/cmd/jchat/ai"
+	"github.com/mark3labs/mcp-go/client"
+)
+
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	offline := fs.Bool("offline", false, "Only check the config files, without contacting models or starting MCP servers")
+	timeout := fs.Duration("timeout", 10*time.Second, "How long to wait for each model and MCP server to respond")
+	configDir := addConfigDirFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: jchat doctor [flags]")
+		fmt.Fprintln(fs.Output(), "\nCheck the config files for mistakes, such as unknown fields and references to models, MCP servers, commands or agents that do not exist,")
+		fmt.Fprintln(fs.Output(), "then check that each model and MCP server can be reached. Exits with a non-zero status if any problems are found.")
+		fmt.Fprintln(fs.Output(), "")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	layers, err := findConfigLayers(*configDir)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	r := &doctorReport{}
+	layerConfs := make([]jchatConfig, len(layers))
+	for i, layer := range layers {
+		if layer.defaults {
+			layerConfs[i] = defaultConfig()
+			continue
+		}
+		if layer.user {
+			fmt.Println("Checking user config in", layer.dir)
+		} else if layer.trusted {
+			fmt.Println("Checking trusted project config in", layer.dir)
+		} else {
+			fmt.Println("Checking untrusted project config in", layer.dir)
+		}
+		layerConfs[i] = jchatConfig{
+			Models:     loadConfigFileForDoctor(r, layer, modelsFile, DefaultModelsConfig),
+			Agents:     loadConfigFileForDoctor(r, layer, agentsFile, DefaultAgentsConfig),
+			MCPServers: loadConfigFileForDoctor(r, layer, mcpFile, DefaultMCPServersConfig),
+			Commands:   loadConfigFileForDoctor(r, layer, commandsFile, DefaultCustomCommandsConfig),
+		}
+	}
+	r.section("Secrets")
+	checkSecrets(r, layers, layerConfs)
+	if slices.ContainsFunc(layers, func(l configLayer) bool { return !l.defaults && !l.user }) {
+		r.section("Project trust")
+		checkProjectTrust(r, layers, layerConfs)
+	}
+	conf := layerConfs[0]
+	for _, layerConf := range layerConfs[1:] {
+		conf = conf.merge(layerConf)
+	}
+	r.section("Models")
+	checkModelConfigs(r, conf)
+	r.section("MCP servers")
+	checkMCPServerConfigs(r, conf)
+	r.section("Commands")
+	checkCommandConfigs(r, conf)
+	r.section("Agents")
+	conf.Agents = checkAgentExtends(r, conf.Agents)
+	checkAgentConfigs(r, conf)
+	if !*offline {
+		r.section("Connectivity")
+		checkConnectivity(r, conf, *timeout)
+	}
+
+	fmt.Println()
+	if r.failures == 0 {
+		fmt.Printf("No problems found (%d warnings)\n", r.warnings)
+		return
+	}
+	fmt.Printf("Found %d problems and %d warnings\n", r.failures, r.warnings)
+	os.Exit(1)
+}
+
+// Prints the results of each check, counting the problems found.
+// Once the secrets in the config are known, they are redacted from what is printed.
+type doctorReport struct {
+	failures int
+	warnings int
+	redactor *ai.Redactor
+}
+
+func (r *doctorReport) section(title string) {
+	fmt.Printf("\n%s\n", title)
+}
+
+func (r *doctorReport) ok(msg string) {
+	msg = r.redactor.Redact(msg)
+	fmt.Printf("  ✓ %s\n", msg)
+}
+
+// Report something which may be a mistake, but does not stop jchat working.
+func (r *doctorReport) warn(msg, hint string) {
+	r.warnings++
+	msg = r.redactor.Redact(msg)
+	fmt.Printf("  ! %s\n", msg)
+	if hint != "" {
+		fmt.Printf("      %s\n", hint)
+	}
+}
+
+// Report a problem which must be fixed, with a hint for how to fix it.
+func (r *doctorReport) fail(msg, hint string) {
+	r.failures++
+	msg = r.redactor.Redact(msg)
+	fmt.Printf("  ✗ %s\n", msg)
+	if hint != "" {
+		fmt.Printf("      %s\n", hint)
+	}
+}
+
+// Load the config file strictly, reporting any problems.
+// If the file is missing, or cannot be parsed strictly but can be loaded the way jchat normally loads it, the checks continue with what was loaded.
+func loadConfigFileForDoctor[T any](r *doctorReport, layer configLayer, fileName string, defaultVal T) T {
+	path := filepath.Join(layer.dir, fileName)
+	conf, err := loadJSONFileStrict[T](path)
+	if errors.Is(err, os.ErrNotExist) && !layer.user {
+		// Project config files are optional
+		return *new(T)
+	}
+	r.section(path)
+	if errors.Is(err, os.ErrNotExist) {
+		r.warn("file does not exist", "It will be created with the default config when jchat next starts")
+		return defaultVal
+	} else if err == nil {
+		r.ok("parsed")
+		return conf
+	}
+	if strings.Contains(err.Error(), "unknown field") {
+		r.fail(err.Error(), "Remove the field or correct its name, as it is ignored by jchat")
+	} else {
+		r.fail(err.Error(), "Fix the JSON so that it matches the format in the README")
+	}
+	conf, err = loadJSONFile[T](path)
+	if err != nil {
+		return *new(T)
+	}
+	return conf
+}
+
+// Resolve the environment variables and secrets referenced by each layer, in place, and warn about secrets written in plain text.
+// Models and MCP servers whose secrets cannot be resolved are only warned about, as jchat can still use the others,
+// and only if they are not replaced by a layer above.
+func checkSecrets(r *doctorReport, layers []configLayer, layerConfs []jchatConfig) {
+	resolver := ai.NewSecretResolver()
+	problems := false
+	hint := "Set the environment variable, or fix the file: or cmd: reference (use $${ for a literal ${)"
+	for i, layer := range layers {
+		if err := layerConfs[i].resolveSecrets(resolver, layer); err != nil {
+			r.fail(err.Error(), hint)
+			problems = true
+		}
+	}
+	conf := layerConfs[0]
+	for _, layerConf := range layerConfs[1:] {
+		conf = conf.merge(layerConf)
+	}
+	for _, name := range slices.Sorted(maps.Keys(conf.Models.Models)) {
+		if err := conf.Models.Models[name].SecretsError(); err != nil {
+			r.warn(err.Error(), fmt.Sprintf("%s, as model '%s' cannot be used until then", hint, name))
+			problems = true
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(conf.MCPServers.MCPServers)) {
+		if err := conf.MCPServers.MCPServers[name].SecretsError(); err != nil {
+			r.warn(err.Error(), fmt.Sprintf("%s, as mcp server '%s' cannot be used until then", hint, name))
+			problems = true
+		}
+	}
+	r.redactor = resolver.Redactor()
+	for _, w := range resolver.PlaintextWarnings() {
+		r.warn(w, "Anyone who can read the file can see the secret")
+		problems = true
+	}
+	if !problems {
+		r.ok("all references resolved, and no secrets are written in plain text")
+	}
+}
+
+// Report what each untrusted project config does that it may not, and leave out the commands it would launch,
+// so that checking connectivity does not run them.
+func checkProjectTrust(r *doctorReport, layers []configLayer, layerConfs []jchatConfig) {
+	for i, layer := range layers {
+		if !layer.untrustedProject() {
+			if !layer.defaults && !layer.user {
+				r.ok(fmt.Sprintf("project config in %s is trusted", layer.dir))
+			}
+			continue
+		}
+		under := layerConfs[0]
+		for _, layerConf := range layerConfs[1:i] {
+			under = under.merge(layerConf)
+		}
+		problems := untrustedProjectProblems(under, layerConfs[i])
+		if len(problems) == 0 {
+			r.ok(fmt.Sprintf("project config in %s is not trusted, but does not need to be", layer.dir))
+			continue
+		}
+		for _, problem := range problems {
+			r.fail(fmt.Sprintf("project config in %s is not trusted, so %s", layer.dir, problem), "Review the project config, then run 'jchat trust' in the project to trust it")
+		}
+		for name, server := range layerConfs[i].MCPServers.MCPServers {
+			if server.Command != "" {
+				delete(layerConfs[i].MCPServers.MCPServers, name)
+			}
+		}
+		layerConfs[i].Commands.Commands = nil
+	}
+}
+
+func checkModelConfigs(r *doctorReport, conf jchatConfig) {
+	if len(conf.Models.Models) == 0 {
+		r.fail("no models are defined", fmt.Sprintf("Add a model to %s", modelsFile))
+	}
+	for _, name := range slices.Sorted(maps.Keys(conf.Models.Models)) {
+		model := conf.Models.Models[name]
+		subject := fmt.Sprintf("model '%s'", name)
+		problems := false
+		if u, err := url.Parse(model.URL); model.URL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			r.fail(fmt.Sprintf("%s has an invalid url '%s'", subject, model.URL), "Set url to the http(s) chat endpoint of the model provider, such as its chat completions endpoint")
+			problems = true
+		}
+		if err := model.CheckProvider(); err != nil {
+			r.fail(fmt.Sprintf("%s has an %v", subject, err), "Leave provider out for an OpenAI-compatible endpoint")
+			problems = true
+		}
+		if model.Name == "" {
+			r.fail(fmt.Sprintf("%s has no name", subject), "Set name to the name the provider uses for the model, such as gpt-4.1")
+			problems = true
+		}
+		switch model.Key {
+		case ai.PlaceholderModelKey:
+			r.fail(fmt.Sprintf("%s still has the placeholder key", subject), "Set key to a reference to your API key for the provider, such as ${OPENAI_API_KEY}")
+			problems = true
+		case "":
+			r.warn(fmt.Sprintf("%s has no key", subject), "This is fine for local models, otherwise set key to your API key")
+			problems = true
+		}
+		uses := []struct {
+			name   string
+			params *ai.GenerationParams
+		}{{"", &model.GenerationParams}, {"react", model.ReAct}, {"answer", model.Answer}, {"file_qa", model.FileQA}}
+		for _, use := range uses {
+			if use.params != nil && !checkGenerationParams(r, subject, use.name, model.Provider, *use.params) {
+				problems = true
+			}
+		}
+		if model.Retry.MaxRetries != nil && *model.Retry.MaxRetries < 0 {
+			r.fail(fmt.Sprintf("%s has a negative retry setting", subject), "Set max_retries in retry to zero or more")
+			problems = true
+		}
+		if !problems {
+			r.ok(subject)
+		}
+	}
+}
+
+// Check the generation params of a model (or of one use of it), returning false if there are problems.
+func checkGenerationParams(r *doctorReport, subject, use, provider string, params ai.GenerationParams) bool {
+	if use != "" {
+		subject = fmt.Sprintf("%s (%s)", subject, use)
+	}
+	ok := true
+	if params.ReasoningEffort != "" && !slices.Contains(ai.ReasoningEfforts, params.ReasoningEffort) {
+		r.fail(fmt.Sprintf("%s has an unknown reasoning effort '%s'", subject, params.ReasoningEffort), fmt.Sprintf("Set reasoning_effort to one of %s", strings.Join(ai.ReasoningEfforts, ", ")))
+		ok = false
+	}
+	if params.Temperature != nil && (*params.Temperature < 0 || *params.Temperature > 2) {
+		r.fail(fmt.Sprintf("%s has a temperature of %g", subject, *params.Temperature), "Set temperature to between 0 and 2")
+		ok = false
+	}
+	if params.TopP != nil && (*params.TopP <= 0 || *params.TopP > 1) {
+		r.fail(fmt.Sprintf("%s has a top_p of %g", subject, *params.TopP), "Set top_p to more than 0 and at most 1")
+		ok = false
+	}
+	if params.MaxTokens < 0 {
+		r.fail(fmt.Sprintf("%s has a negative max_tokens", subject), "Set max_tokens to the most tokens the model may generate in a response")
+		ok = false
+	}
+	if (provider == "" || provider == ai.ProviderOpenAI) && (params.MaxTokens != 0 || params.Seed != nil || params.TopP != nil) {
+		r.warn(fmt.Sprintf("%s sets max_tokens, seed or top_p, which the openai provider does not send", subject), "Remove them, as they are ignored")
+		ok = false
+	}
+	if provider == ai.ProviderAnthropic && params.Seed != nil {
+		r.warn(fmt.Sprintf("%s sets a seed, which the anthropic provider does not support", subject), "Remove seed, as it is ignored")
+		ok = false
+	}
+	if provider == ai.ProviderAnthropic && params.ReasoningEffort != "" && (params.Temperature != nil || params.TopP != nil) {
+		r.fail(fmt.Sprintf("%s sets a temperature or top_p as well as a reasoning effort", subject), "The anthropic provider cannot change the temperature or top_p while thinking, so remove them or the reasoning_effort")
+		ok = false
+	}
+	return ok
+}
+
+func checkMCPServerConfigs(r *doctorReport, conf jchatConfig) {
+	for _, name := range slices.Sorted(maps.Keys(conf.MCPServers.MCPServers)) {
+		server := conf.MCPServers.MCPServers[name]
+		subject := fmt.Sprintf("mcp server '%s'", name)
+		problems := false
+		switch {
+		case server.Addr == "" && server.Command == "":
+			r.fail(fmt.Sprintf("%s has neither an addr nor a command", subject), "Set addr to the URL of a streamable HTTP server, or command to the program to launch")
+			problems = true
+		case server.Addr != "" && server.Command != "":
+			r.warn(fmt.Sprintf("%s has both an addr and a command, so addr is ignored", subject), "Remove whichever of addr or command is not needed")
+			problems = true
+		case server.Command != "":
+			if _, err := exec.LookPath(server.Command); err != nil {
+				r.fail(fmt.Sprintf("%s command '%s' could not be found", subject, server.Command), "Install the command, or set command to its full path")
+				problems = true
+			}
+		default:
+			if u, err := url.Parse(server.Addr); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				r.fail(fmt.Sprintf("%s has an invalid addr '%s'", subject, server.Addr), "Set addr to the http(s) URL of the server's MCP endpoint")
+				problems = true
+			}
+		}
+		if server.SamplingModel != "" {
+			if _, ok := conf.Models.Models[server.SamplingModel]; !ok {
+				r.fail(fmt.Sprintf("%s has sampling model '%s' which is not defined", subject, server.SamplingModel), hintOneOf("sampling_model", modelsFile, conf.Models.Models))
+				problems = true
+			}
+		}
+		for _, dir := range append(slices.Clone(server.Roots), server.WorkDir) {
+			if dir == "" {
+				continue
+			}
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				r.warn(fmt.Sprintf("%s uses directory '%s' which does not exist", subject, dir), "Check the work_dir and roots of the server")
+				problems = true
+			}
+		}
+		if !problems {
+			r.ok(subject)
+		}
+	}
+}
+
+func checkCommandConfigs(r *doctorReport, conf jchatConfig) {
+	for _, name := range slices.Sorted(maps.Keys(conf.Commands.Commands)) {
+		command := conf.Commands.Commands[name]
+		subject := fmt.Sprintf("command '%s'", name)
+		if command.Command == "" {
+			r.fail(fmt.Sprintf("%s has no command to run", subject), "Set command to the program to run")
+		} else if _, err := exec.LookPath(command.Command); err != nil {
+			// Some commands (such as the default ping pong commands) only exist on some platforms
+			r.warn(fmt.Sprintf("%s runs '%s' which could not be found", subject, command.Command), "Agents using it will get an error when calling it on this machine")
+		} else {
+			r.ok(subject)
+		}
+	}
+}
+
+// Resolve the agents that extend other agents, reporting any that cannot be resolved.
+// Agents that cannot be resolved are left as they are, so the other checks can continue.
+func checkAgentExtends(r *doctorReport, agents ai.AgentsConfig) ai.AgentsConfig {
+	resolved, err := agents.ResolveExtends()
+	if err != nil {
+		r.fail(err.Error(), "Set extends to the name of another agent, making sure that no agent ends up extending itself")
+	}
+	return resolved
+}
+
+func checkAgentConfigs(r *doctorReport, conf jchatConfig) {
+	if len(conf.Agents.Agents) == 0 {
+		r.fail("no agents are defined", fmt.Sprintf("Add an agent to %s", agentsFile))
+	}
+	reportedCycles := make(map[string]bool)
+	for _, name := range slices.Sorted(maps.Keys(conf.Agents.Agents)) {
+		agentConf := conf.Agents.Agents[name]
+		subject := fmt.Sprintf("agent '%s'", name)
+		problems := false
+		if model, ok := conf.Models.Models[agentConf.ModelName]; !ok {
+			r.fail(fmt.Sprintf("%s uses model '%s' which is not defined", subject, agentConf.ModelName), hintOneOf("model_name", modelsFile, conf.Models.Models))
+			problems = true
+		} else if model.SecretsError() != nil {
+			r.fail(fmt.Sprintf("%s uses model '%s' whose secrets could not be resolved", subject, agentConf.ModelName), "Fix the secrets of the model (see above)")
+			problems = true
+		}
+		for _, server := range agentConf.MCPServers {
+			if serverConf, ok := conf.MCPServers.MCPServers[server]; !ok {
+				r.fail(fmt.Sprintf("%s uses mcp server '%s' which is not defined", subject, server), hintOneOf("mcp_servers", mcpFile, conf.MCPServers.MCPServers))
+				problems = true
+			} else if serverConf.SecretsError() != nil {
+				r.fail(fmt.Sprintf("%s uses mcp server '%s' whose secrets could not be resolved", subject, server), "Fix the secrets of the mcp server (see above)")
+				problems = true
+			}
+		}
+		for _, server := range slices.Sorted(maps.Keys(agentConf.MCPResources)) {
+			if _, ok := conf.MCPServers.MCPServers[server]; !ok {
+				r.fail(fmt.Sprintf("%s reads resources from mcp server '%s' which is not defined", subject, server), hintOneOf("mcp_resources", mcpFile, conf.MCPServers.MCPServers))
+				problems = true
+			}
+		}
+		for _, command := range agentConf.CustomCommands {
+			if _, ok := conf.Commands.Commands[command]; !ok {
+				r.fail(fmt.Sprintf("%s uses command '%s' which is not defined", subject, command), hintOneOf("custom_commands", commandsFile, conf.Commands.Commands))
+				problems = true
+			}
+		}
+		for _, sub := range agentConf.SubAgents {
+			if _, ok := conf.Agents.Agents[sub]; !ok {
+				r.fail(fmt.Sprintf("%s has sub agent '%s' which is not defined", subject, sub), hintOneOf("sub_agents", agentsFile, conf.Agents.Agents))
+				problems = true
+			}
+		}
+		if cycle := conf.Agents.SubAgentCycle(name); cycle != nil {
+			if key := cycleKey(cycle); !reportedCycles[key] {
+				reportedCycles[key] = true
+				r.fail(fmt.Sprintf("sub agents form a cycle (%s)", strings.Join(cycle, " -> ")), "Remove one of the agents from the sub_agents of the agent before it, as agents cannot be built if they contain themselves")
+			}
+			problems = true
+		}
+		if !problems {
+			r.ok(subject)
+		}
+	}
+}
+
+// Get a key which is the same for every rotation of the cycle.
+func cycleKey(cycle []string) string {
+	members := slices.Clone(cycle[:len(cycle)-1])
+	slices.Sort(members)
+	return strings.Join(members, ",")
+}
+
+func hintOneOf[T any](field, fileName string, defined map[string]T) string {
+	if len(defined) == 0 {
+		return fmt.Sprintf("Define it in %s", fileName)
+	}
+	return fmt.Sprintf("Define it in %s, or set %s to one of: %s", fileName, field, strings.Join(slices.Sorted(maps.Keys(defined)), ", "))
+}
+
+// The result of contacting a model or MCP server.
+type connectivityResult struct {
+	subject string
+	err     error
+	hint    string
+	warning bool
+	detail  string
+}
+
+// Contact every model and MCP server at once, reporting the results in order.
+func checkConnectivity(r *doctorReport, conf jchatConfig, timeout time.Duration) {
+	modelNames := slices.Sorted(maps.Keys(conf.Models.Models))
+	serverNames := slices.Sorted(maps.Keys(conf.MCPServers.MCPServers))
+	results := make([]connectivityResult, len(modelNames)+len(serverNames))
+	wg := &sync.WaitGroup{}
+	for i, name := range modelNames {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = checkModelConnectivity(name, conf.Models.Models[name], timeout)
+		}()
+	}
+	for i, name := range serverNames {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[len(modelNames)+i] = checkMCPServerConnectivity(name, conf.MCPServers.MCPServers[name], timeout)
+		}()
+	}
+	wg.Wait()
+	for _, res := range results {
+		switch {
+		case res.err != nil && res.warning:
+			r.warn(fmt.Sprintf("%s: %v", res.subject, res.err), res.hint)
+		case res.err != nil:
+			r.fail(fmt.Sprintf("%s: %v", res.subject, res.err), res.hint)
+		default:
+			r.ok(fmt.Sprintf("%s: %s", res.subject, res.detail))
+		}
+	}
+}
+
+// Check that the model's endpoint responds.
+// If the endpoint is where the provider usually has it, the endpoint that lists models next to it is used,
+// which also checks the key and that the model exists without using any tokens.
+func checkModelConnectivity(name string, model ai.ModelConfig, timeout time.Duration) connectivityResult {
+	res := connectivityResult{subject: fmt.Sprintf("model '%s'", name)}
+	if model.SecretsError() != nil {
+		res.err = errors.New("skipped, as its secrets could not be resolved")
+		res.warning = true
+		return res
+	}
+	u, err := url.Parse(model.URL)
+	if err != nil || model.URL == "" {
+		res.err = errors.New("skipped, as the url is invalid")
+		res.warning = true
+		return res
+	}
+	chatPath, listPath := "/chat/completions", "/models"
+	switch model.Provider {
+	case ai.ProviderAnthropic:
+		chatPath = "/messages"
+	case ai.ProviderOllama:
+		chatPath, listPath = "/api/chat", "/api/tags"
+	}
+	listsModels := strings.HasSuffix(u.Path, chatPath)
+	if listsModels {
+		u.Path = strings.TrimSuffix(u.Path, chatPath) + listPath
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	for k, v := range model.AuthHeaders() {
+		req.Header.Set(k, v)
+	}
+	for k, v := range model.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		res.err = fmt.Errorf("could not reach %s: %w", u.Host, err)
+		res.hint = "Check the url of the model and your network connection"
+		return res
+	}
+	defer resp.Body.Close()
+	if !listsModels {
+		res.detail = fmt.Sprintf("reachable (status %d)", resp.StatusCode)
+		return res
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		res.err = fmt.Errorf("the key was rejected (status %d)", resp.StatusCode)
+		res.hint = "Check the key (and any auth headers) of the model"
+		return res
+	case resp.StatusCode != http.StatusOK:
+		res.detail = fmt.Sprintf("reachable, but could not list models (status %d)", resp.StatusCode)
+		return res
+	}
+	// Ollama lists its models differently to the other providers
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil || len(list.Data)+len(list.Models) == 0 {
+		res.detail = "reachable and key accepted"
+		return res
+	}
+	ids := make([]string, 0, len(list.Data)+len(list.Models))
+	for _, m := range list.Data {
+		ids = append(ids, m.ID)
+	}
+	for _, m := range list.Models {
+		ids = append(ids, m.Name, strings.TrimSuffix(m.Name, ":latest"))
+	}
+	for _, id := range ids {
+		if id == model.Name {
+			res.detail = "reachable, key accepted and model available"
+			return res
+		}
+	}
+	res.err = fmt.Errorf("the provider does not list a model called '%s'", model.Name)
+	res.hint = "Check the name of the model, as the provider may not have it"
+	res.warning = true
+	return res
+}
+
+// Check that the server can be connected to (or launched) and list its tools.
+func checkMCPServerConnectivity(name string, server ai.MCPServerConfig, timeout time.Duration) connectivityResult {
+	res := connectivityResult{subject: fmt.Sprintf("mcp server '%s'", name)}
+	if server.Addr == "" && server.Command == "" {
+		res.err = errors.New("skipped, as it has neither an addr nor a command")
+		res.warning = true
+		return res
+	}
+	if server.SecretsError() != nil {
+		res.err = errors.New("skipped, as its secrets could not be resolved")
+		res.warning = true
+		return res
+	}
+	stderr := &lockedBuffer{}
+	type connected struct {
+		numTools int
+		err      error
+	}
+	done := make(chan connected, 1)
+	// The client is closed by this goroutine once it has listed the tools, so that a server which
+	// only responds after the timeout is still stopped rather than left running.
+	go func() {
+		var c *client.Client
+		var err error
+		if server.Command != "" {
+			c, err = agentmcp.CreateStdioClient(server.Command, server.Args, server.Env, server.WorkDir, stderr)
+		} else {
+			c, err = agentmcp.CreateClient(server.Addr, server.Headers)
+		}
+		if err != nil {
+			done <- connected{err: err}
+			return
+		}
+		defer c.Close()
+		tools, err := agentmcp.CreateToolsFromMCP(c)
+		done <- connected{len(tools), err}
+	}()
+	var result connected
+	select {
+	case result = <-done:
+	case <-time.After(timeout):
+		result.err = fmt.Errorf("did not respond within %s", timeout)
+	}
+	if result.err != nil {
+		res.err = result.err
+		if server.Command != "" {
+			res.hint = "Check that the command starts an MCP server"
+			if lastLine := stderr.lastLine(); lastLine != "" {
+				res.hint += fmt.Sprintf(", it last wrote: %s", lastLine)
+			}
+		} else {
+			res.hint = "Check the addr and headers of the server, and that it is running"
+		}
+		return res
+	}
+	res.detail = fmt.Sprintf("connected, %d tools", result.numTools)
+	return res
+}
+
+// Collects the stderr of a launched server, which is written to from another goroutine.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) lastLine() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	lines := strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/agentsession"
+	"github.com/JoshPattman/agent/cmd/jchat/ai"
+	"github.com/JoshPattman/agent/cmd/jchat/attach"
+)
+
+// The formats that transcripts can be exported in, keyed by name, with the file extension for each.
+var exportFormats = map[string]string{
+	"markdown": ".md",
+	"html":     ".html",
+	"json":     ".json",
+}
+
+// Get the format to export a file in from its extension, defaulting to markdown.
+func exportFormatForFile(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	for format, formatExt := range exportFormats {
+		if ext == formatExt {
+			return format
+		}
+	}
+	return "markdown"
+}
+
+// A session in the form it is exported as JSON.
+type exportedTranscript struct {
+	SessionID    string                `json:"session_id"`
+	Agent        string                `json:"agent"`
+	Title        string                `json:"title"`
+	CreatedAt    time.Time             `json:"created_at"`
+	UpdatedAt    time.Time             `json:"updated_at"`
+	InputTokens  int                   `json:"input_tokens"`
+	OutputTokens int                   `json:"output_tokens"`
+	Tasks        []agent.CompletedTask `json:"tasks"`
+}
+
+func newExportedTranscript(data agentsession.SessionData) exportedTranscript {
+	usage := sessionUsage(data)
+	return exportedTranscript{
+		SessionID:    data.ID,
+		Agent:        data.Metadata[sessionAgentKey],
+		Title:        data.Metadata[sessionTitleKey],
+		CreatedAt:    data.CreatedAt,
+		UpdatedAt:    data.UpdatedAt,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		Tasks:        data.History,
+	}
+}
+
+// Write the transcript of the session in the format, redacting any secrets.
+func exportTranscript(w io.Writer, data agentsession.SessionData, format string, redactor *ai.Redactor) error {
+	t := newExportedTranscript(redactSession(redactor, data))
+	switch format {
+	case "markdown":
+		_, err := io.WriteString(w, transcriptMarkdown(t))
+		return err
+	case "html":
+		return transcriptHTMLTemplate.Execute(w, t)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(t)
+	default:
+		return fmt.Errorf("unknown export format '%s', must be one of markdown, html or json", format)
+	}
+}
+
+func transcriptMarkdown(t exportedTranscript) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# %s\n\n", t.Title)
+	fmt.Fprintf(b, "- Session: `%s`\n", t.SessionID)
+	fmt.Fprintf(b, "- Agent: %s\n", t.Agent)
+	fmt.Fprintf(b, "- Started: %s\n", t.CreatedAt.Local().Format(time.RFC1123))
+	fmt.Fprintf(b, "- Last updated: %s\n", t.UpdatedAt.Local().Format(time.RFC1123))
+	fmt.Fprintf(b, "- Usage: %d input tokens, %d output tokens\n", t.InputTokens, t.OutputTokens)
+	for _, task := range t.Tasks {
+		message, attachments := attach.Split(task.Task)
+		fmt.Fprintf(b, "\n## User\n\n%s\n", message)
+		for _, a := range attachments {
+			fmt.Fprintf(b, "\n**Attached %s**\n\n%s\n", a.Describe(), fenceMarkdown(a.Content, ""))
+		}
+		for i, step := range task.Steps {
+			fmt.Fprintf(b, "\n### Step %d\n\n", i+1)
+			if step.Reasoning != "" {
+				fmt.Fprintf(b, "%s\n", quoteMarkdown(step.Reasoning))
+			}
+			for _, ao := range step.ActionObservations {
+				fmt.Fprintf(b, "\n**Called `%s`**\n\n%s\n", ao.Action.Name, fenceMarkdown(formatActionArgs(ao.Action.Args), "json"))
+				fmt.Fprintf(b, "\n**Observed**\n\n%s\n", fenceMarkdown(ao.Observation.Observed, ""))
+				if descs := describeAttachments(ao.Observation); len(descs) > 0 {
+					fmt.Fprintf(b, "\n- %s\n", strings.Join(descs, "\n- "))
+				}
+			}
+		}
+		if task.Cancelled {
+			fmt.Fprintf(b, "\n*Cancelled before it was answered.*\n")
+			continue
+		}
+		fmt.Fprintf(b, "\n## %s\n\n%s\n", t.Agent, task.Response)
+	}
+	return b.String()
+}
+
+func quoteMarkdown(s string) string {
+	lines := strings.Split(s, "\n")
+	for i := range lines {
+		lines[i] = "> " + lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Put the content in a fenced code block, using a fence longer than any run of backticks in the content.
+func fenceMarkdown(content, lang string) string {
+	longest, run := 0, 0
+	for _, r := range content {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+	return fmt.Sprintf("%s%s\n%s\n%s", fence, lang, content, fence)
+}
+
+func formatActionArgs(args []agent.ActionArg) string {
+	m := make(map[string]any, len(args))
+	for _, arg := range args {
+		m[arg.ArgName] = arg.ArgData
+	}
+	bs, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return fmt.Sprint(m)
+	}
+	return string(bs)
+}
+
+func describeAttachments(obs agent.Observation) []string {
+	descs := make([]string, 0, len(obs.Images)+len(obs.Resources))
+	for _, img := range obs.Images {
+		descs = append(descs, agent.DescribeImage(img))
+	}
+	for _, res := range obs.Resources {
+		descs = append(descs, agent.DescribeResourceReference(res))
+	}
+	return descs
+}
+
+var transcriptHTMLTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"formatTime": func(t time.Time) string { return t.Local().Format(time.RFC1123) },
+	"formatArgs": formatActionArgs,
+	"imageURL": func(img agent.Image) template.URL {
+		return template.URL(fmt.Sprintf("data:%s;base64,%s", img.MIMEType, base64.StdEncoding.EncodeToString(img.Data)))
+	},
+	"describeResource": agent.DescribeResourceReference,
+	"inc":              func(i int) int { return i + 1 },
+	"taskMessage": func(task string) string {
+		message, _ := attach.Split(task)
+		return message
+	},
+	"taskAttachments": func(task string) []attach.Attachment {
+		_, attachments := attach.Split(task)
+		return attachments
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 60rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+.meta { color: #666; font-size: 0.9rem; }
+.message { border-radius: 0.5rem; padding: 0.75rem 1rem; margin: 1rem 0; white-space: pre-wrap; }
+.user { background: #e8f0fe; }
+.agent { background: #f1f3f4; }
+.role { font-weight: bold; margin-bottom: 0.25rem; white-space: normal; }
+details { margin: 0.5rem 0 0.5rem 1rem; }
+summary { cursor: pointer; color: #555; }
+.reasoning { color: #555; font-style: italic; white-space: pre-wrap; }
+pre { background: #f8f8f8; border: 1px solid #ddd; border-radius: 0.25rem; padding: 0.5rem; overflow-x: auto; white-space: pre-wrap; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<div class="meta">
+Session <code>{{.SessionID}}</code> with {{.Agent}}<br>
+Started {{formatTime .CreatedAt}}, last updated {{formatTime .UpdatedAt}}<br>
+Usage: {{.InputTokens}} input tokens, {{.OutputTokens}} output tokens
+</div>
+{{- $agent := .Agent}}
+{{- range .Tasks}}
+<div class="message user"><div class="role">User</div>{{taskMessage .Task}}</div>
+{{- range taskAttachments .Task}}
+<details>
+<summary>Attached {{.Describe}}</summary>
+<pre>{{.Content}}</pre>
+</details>
+{{- end}}
+{{- range $i, $step := .Steps}}
+<details>
+<summary>Step {{inc $i}}{{if .ActionObservations}}: called {{len .ActionObservations}} tool(s){{end}}</summary>
+{{- if .Reasoning}}
+<div class="reasoning">{{.Reasoning}}</div>
+{{- end}}
+{{- range .ActionObservations}}
+<p>Called <code>{{.Action.Name}}</code></p>
+<pre>{{formatArgs .Action.Args}}</pre>
+<p>Observed</p>
+<pre>{{.Observation.Observed}}</pre>
+{{- range .Observation.Images}}
+<img src="{{imageURL .}}" alt="Image returned by the tool">
+{{- end}}
+{{- range .Observation.Resources}}
+<p>{{describeResource .}}</p>
+{{- end}}
+{{- end}}
+</details>
+{{- end}}
+{{- if .Cancelled}}
+<p class="meta">Cancelled before it was answered.</p>
+{{- else}}
+<div class="message agent"><div class="role">{{$agent}}</div>{{.Response}}</div>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
@@ -1,25 +1,65 @@
 package main
 
 import (
+	"cmp"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/JoshPattman/agent/cmd/jchat/ai"
 	"github.com/JoshPattman/agent/cmd/jchat/ui"
 
 	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/agentmcp"
+	"github.com/JoshPattman/agent/agentsession"
 	"github.com/JoshPattman/jpf"
 	tea "github.com/charmbracelet/bubbletea"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve-mcp" {
+		runServeMCP(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		runServe(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sessions" {
+		runSessions(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "batch" {
+		runBatch(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "trust" {
+		runTrust(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "doctor" || os.Args[1] == "validate") {
+		runDoctor(os.Args[2:])
+		return
+	}
+
 	agentName := flag.String("a", "", "The name of the agent in the agent file to chat to, matching an agent name from your agent configuration")
-	quickChat := flag.String("q", "", "If specified will not run interactive mode, but will instead send the specified message to a new agent and print the result to the terminal, without any follow ups")
+	quickChat := flag.String("q", "", "If specified will not run interactive mode, but will instead send the specified message to a new agent and print the result to the terminal, without any follow ups (the same as -p with the message as the query)")
+	pipe := flag.Bool("p", false, "Pipe mode: answer the query given as arguments (or on stdin) without the interactive UI, then exit. See -input, -output and the budget flags")
+	pipeInput := flag.String("input", "text", "In pipe mode, how stdin is read: 'text' for a single query, or 'jsonl' for a query per line (a JSON string or {\"query\": ...}), each a turn of the same conversation")
+	pipeOutput := flag.String("output", "text", "In pipe mode, what is written to stdout: 'text' for the answers, 'json' for a document with the answers, steps, tool calls, usage and any error, or 'stream-json' for a JSON event per line as things happen")
+	maxSteps := flag.Int("max-steps", 0, "In pipe mode, the most steps with tool calls the agent may take in total (default no limit)")
+	maxTokens := flag.Int("max-tokens", 0, "In pipe mode, the most tokens (input and output) that may be used in total (default no limit)")
+	timeout := flag.Duration("timeout", 0, "In pipe mode, how long the agent may take in total (default no limit)")
+	roomAgents := flag.String("room", "", "If specified, chat to a room of several agents at once, given as a comma separated list of agent names (instead of -a)")
+	moderator := flag.String("moderator", moderatorRoundRobin, "In a room, how the agent that answers a message which does not @mention any agents is picked: 'round-robin', 'router' (a model picks the best agent) or 'user' (the agent last mentioned)")
+	routerModel := flag.String("router-model", "", "In a room moderated by 'router', the model that picks the agent to answer (default the model of the first agent)")
+	resumeID := flag.String("resume", "", "If specified, resume the saved session with this ID (see 'jchat sessions'), using the agent of that session if -a is not specified")
+	configDir := addConfigDirFlag(flag.CommandLine)
 	us := flag.Usage
 	flag.Usage = func() {
 		us()
@@ -30,58 +70,137 @@ func main() {
 		dataPath := filepath.Join(homeDir, "jchat")
 		fmt.Println("\nData is stored at:", dataPath)
 		fmt.Println("\nTo configure JChat, modify the json files at the data directory")
-		fmt.Println(" - agents.json\n\tSet up the different agents to chat to, their personalities, tools they can access, and base models to use")
-		fmt.Println(" - models.json\n\tSpecify the different base models for agents to use")
-		fmt.Println(" - mcp.json\n\tSpecify the MCP servers available to add to agents (only http/https supported right now)")
+		fmt.Println(" - agent.json\n\tSet up the different agents to chat to, their personalities, tools they can access, and base models to use")
+		fmt.Println(" - models.json\n\tSpecify the different base models for agents to use, served by an OpenAI-compatible API (the default) or a native Anthropic or Ollama API (set with 'provider'), and how they generate")
+		fmt.Println(" - mcp.json\n\tSpecify the MCP servers available to add to agents, either by 'addr' (http/https) or by 'command' to launch (stdio), with optional 'args', 'env' and 'work_dir'. Set 'sampling_model' to let a server use a model, and 'roots' to tell it which directories to work in")
 		fmt.Println(" - commands.json\n\tSetup custom commands to run on the host machine that the agents can run as tools (if added to an agent), arguments are passed to the command as environment variables")
+		fmt.Println("\nA project can have its own config in a .jchat directory (found in the working directory or a parent), holding any of the same files. Its entries are layered over the user config, replacing entries of the same name. Use -config-dir to load the user config from another directory.")
+		fmt.Println("Until a project config is trusted with 'jchat trust', it may not launch commands, reference secrets, or replace entries of the user config.")
+		fmt.Println("An agent can set 'extends' to the name of another agent, to take any fields it does not set from that agent.")
 		fmt.Println("\nTo allow an agent to use a command or mcp server, you must add its key to the agent. You must also specify the key of the model for each agent to use (different agents may use different keys).")
+		fmt.Println("\nThe stderr output of MCP servers launched by jchat is logged in the logs folder of the data directory.")
+		fmt.Println("\nChat sessions are saved in the sessions folder of the data directory, and can be continued with -resume.")
+		fmt.Println("\nUse -room to chat to several agents at once. Address agents with @name (or @all), and the moderator picks who answers other messages.")
+		fmt.Println("\nSubcommands:")
+		fmt.Println(" - serve-mcp\n\tServe an agent as an MCP server, run 'jchat serve-mcp -h' for details")
+		fmt.Println(" - serve\n\tServe agents over an OpenAI-compatible chat completions API, run 'jchat serve -h' for details")
+		fmt.Println(" - sessions\n\tList, delete or rename saved chat sessions, run 'jchat sessions -h' for details")
+		fmt.Println(" - batch\n\tAnswer each query in a JSONL file with a new agent, writing the results to another JSONL file, run 'jchat batch -h' for details")
+		fmt.Println(" - trust\n\tTrust the project config in the nearest .jchat directory, allowing it to launch commands and reference secrets, run 'jchat trust -h' for details")
+		fmt.Println(" - doctor (or validate)\n\tCheck the config files for mistakes and that models and MCP servers can be reached, run 'jchat doctor -h' for details")
+		fmt.Println("\nIn pipe mode (-p or -q) the exit code says why jchat failed: 2 for invalid flags or input, 3 for config errors, 4 for errors from the model, 5 if a budget was exhausted and 130 if interrupted.")
 	}
 	flag.Parse()
 
-	if *agentName == "" {
-		fmt.Println("Must specify agent name")
-		os.Exit(1)
+	if *roomAgents != "" && *agentName != "" {
+		fmt.Println("Cannot use -room together with -a")
+		os.Exit(exitUsage)
 	}
 
-	agentBuilder, agentSum, usageCounter, err := loadAndCreateAgentBuilder(*agentName)
+	if *pipe || *quickChat != "" {
+		if *roomAgents != "" {
+			fmt.Fprintln(os.Stderr, "Rooms can only be chatted to interactively, so -room cannot be used in pipe mode")
+			os.Exit(exitUsage)
+		}
+		os.Exit(runPipe(pipeParams{
+			agentName: *agentName,
+			configDir: *configDir,
+			query:     *quickChat,
+			args:      flag.Args(),
+			input:     *pipeInput,
+			output:    *pipeOutput,
+			maxSteps:  *maxSteps,
+			maxTokens: *maxTokens,
+			timeout:   *timeout,
+		}))
+	}
+
+	sessions, err := openSessionStore()
 	if err != nil {
-		fmt.Println("Error loading config:", err)
+		fmt.Println("Error opening sessions:", err)
 		os.Exit(1)
 	}
-
-	if *quickChat != "" {
-		agent, err := agentBuilder()
+	var resumed *agentsession.SessionData
+	if *resumeID != "" {
+		data, err := sessions.Load(*resumeID)
 		if err != nil {
-			fmt.Println("Could not create quick agent:", err)
+			fmt.Printf("Could not load session '%s': %v\n", *resumeID, err)
 			os.Exit(1)
 		}
-		result, err := agent.Answer(*quickChat)
-		if err != nil {
-			fmt.Println("Could not run quick agent:", err)
-			os.Exit(1)
+		if *agentName == "" && *roomAgents == "" {
+			if agents, ok := data.Metadata[sessionRoomKey]; ok {
+				*roomAgents = agents
+				*moderator = cmp.Or(data.Metadata[sessionModeratorKey], *moderator)
+			} else {
+				*agentName = data.Metadata[sessionAgentKey]
+			}
 		}
-		fmt.Println(result)
+		resumed = &data
+	}
+
+	if *agentName == "" && *roomAgents == "" {
+		fmt.Println("Must specify agent name")
+		os.Exit(1)
+	}
+
+	var loaded loadedAgent
+	var room *roomConfig
+	if *roomAgents != "" {
+		var r roomConfig
+		loaded, r, err = loadAndCreateRoomBuilder(*roomAgents, *moderator, *routerModel, *configDir)
+		*agentName = r.name()
+		room = &r
 	} else {
-		chat := ui.NewChatPage(agentBuilder, agentSum)
-		p := tea.NewProgram(
-			chat,
-			tea.WithAltScreen(),
-			tea.WithoutCatchPanics(),
-		)
-
-		go func() {
-			for {
-				p.Send(ui.UsageMessage{Usage: usageCounter.Get()})
-				time.Sleep(time.Second / 2)
-			}
-		}()
+		loaded, err = loadAndCreateAgentBuilder(*agentName, *configDir)
+	}
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+	defer loaded.MCPClients.Close()
 
-		go p.Send(ui.SetConcurrentMessageSender{MsgSender: p.Send})
+	// The first agent continues the resumed session (if any), and each reset starts a new session.
+	session := newChatSession(sessions, *agentName, loaded, resumed, room)
+	chat := ui.NewChatPage(session.build, loaded.Summary)
+	p := tea.NewProgram(
+		chat,
+		tea.WithAltScreen(),
+		tea.WithoutCatchPanics(),
+	)
 
-		if _, err := p.Run(); err != nil {
-			fmt.Printf("Error running program: %v", err)
-			os.Exit(1)
+	go func() {
+		for {
+			p.Send(ui.UsageMessage{Usage: loaded.UsageCounter.Get(), Participants: session.participantUsage()})
+			time.Sleep(time.Second / 2)
+		}
+	}()
+
+	go p.Send(ui.SetConcurrentMessageSender{MsgSender: p.Send})
+	go p.Send(ui.AddSlashCommands{Commands: session.commands()})
+	if len(loaded.Config.Warnings) > 0 {
+		go p.Send(ui.AddWarningsMessage{Warnings: loaded.Config.Warnings})
+	}
+	go p.Send(ui.SetExportFunc{Export: func(a agent.Agent) (string, error) {
+		sa, ok := a.(*sessionAgent)
+		if !ok {
+			return "", errors.New("the conversation is not a saved session")
 		}
+		return exportSessionToDataDir(sa.Session(), "markdown", loaded.Config.Redactor)
+	}})
+
+	loaded.MCPClients.SetCallbacks(
+		func(tp agentmcp.ToolProgress) {
+			p.Send(ui.ToolProgressMessage{ToolName: tp.ToolName, Progress: tp.Progress, Total: tp.Total, Message: tp.Message})
+		},
+		func(serverName string, connected bool, err error) {
+			p.Send(ui.MCPStatusMessage{ServerName: serverName, Connected: connected, Error: err})
+		},
+	)
+
+	if _, err := p.Run(); err != nil {
+		fmt.Printf("Error running program: %v", err)
+		loaded.MCPClients.Close()
+		os.Exit(1)
 	}
 }
 
@@ -148,12 +267,11 @@ var DefaultAgentsConfig = ai.AgentsConfig{
 var DefaultModelsConfig = ai.ModelsConfig{
 	Models: map[string]ai.ModelConfig{
 		"default_model": {
-			URL:  "https://api.openai.com/v1/chat/completions",
-			Name: "gpt-4.1",
-			Key:  "Your API Key Here",
-			Headers: map[string]string{
-				"Key": "Value",
-			},
+			URL:            "https://api.openai.com/v1/chat/completions",
+			Name:           "gpt-4.1",
+			Key:            "${OPENAI_API_KEY}",
+			Headers:        map[string]string{},
+			SupportsImages: true,
 		},
 	},
 }
@@ -162,9 +280,6 @@ var DefaultMCPServersConfig = ai.MCPServersConfig{
 	MCPServers: map[string]ai.MCPServerConfig{
 		"aws_docs": {
 			Addr: "https://knowledge-mcp.global.api.aws",
-			Headers: map[string]string{
-				"Key": "Value",
-			},
 		},
 	},
 }
@@ -201,42 +316,339 @@ var DefaultCustomCommandsConfig = ai.CustomCommandsConfig{
 	},
 }
 
-func loadAndCreateAgentBuilder(activeAgentName string) (func() (agent.Agent, error), ui.AgentSummary, *jpf.UsageCounter, error) {
+// Everything needed to run an agent, created from the config files.
+type loadedAgent struct {
+	Build        func() agent.Agent
+	Tools        []agent.Tool
+	Summary      ui.AgentSummary
+	UsageCounter *jpf.UsageCounter
+	// The config the agent was created from.
+	Config jchatConfig
+	// Must be closed once the agent is no longer needed.
+	MCPClients *ai.MCPClients
+}
+
+func loadAndCreateAgentBuilder(activeAgentName, configDir string) (loadedAgent, error) {
+	conf, err := loadConfig(configDir)
+	if err != nil {
+		return loadedAgent{}, err
+	}
+	usageCounter := jpf.NewUsageCounter()
+	mcpClients := ai.NewMCPClients(conf.MCPServers, conf.Models, usageCounter, conf.LogsPath, conf.Redactor)
+	loaded, err := conf.createAgentBuilder(activeAgentName, mcpClients, usageCounter)
+	if err != nil {
+		mcpClients.Close()
+		return loadedAgent{}, err
+	}
+	return loaded, nil
+}
+
+func loadAndCreateRoomBuilder(agents, moderator, routerModel, configDir string) (loadedAgent, roomConfig, error) {
+	conf, err := loadConfig(configDir)
+	if err != nil {
+		return loadedAgent{}, roomConfig{}, err
+	}
+	room, err := conf.parseRoomConfig(agents, moderator, routerModel)
+	if err != nil {
+		return loadedAgent{}, roomConfig{}, err
+	}
+	usageCounter := jpf.NewUsageCounter()
+	mcpClients := ai.NewMCPClients(conf.MCPServers, conf.Models, usageCounter, conf.LogsPath, conf.Redactor)
+	loaded, err := conf.createRoomBuilder(room, mcpClients, usageCounter)
+	if err != nil {
+		mcpClients.Close()
+		return loadedAgent{}, roomConfig{}, err
+	}
+	return loaded, room, nil
+}
+
+// The names of the config files in the data directory.
+const (
+	agentsFile   = "agent.json"
+	modelsFile   = "models.json"
+	mcpFile      = "mcp.json"
+	commandsFile = "commands.json"
+)
+
+// All of the config files in the data directory.
+type jchatConfig struct {
+	Models     ai.ModelsConfig
+	Agents     ai.AgentsConfig
+	MCPServers ai.MCPServersConfig
+	Commands   ai.CustomCommandsConfig
+	LogsPath   string
+	// Redacts the secrets referenced by the config.
+	Redactor *ai.Redactor
+	// Warnings about the config, such as secrets written in plain text.
+	Warnings []string
+}
+
+// Get the directory that jchat stores its config and data in.
+func getDataPath() (string, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return nil, ui.AgentSummary{}, nil, errors.Join(errors.New("could not load user home directory"), err)
+		return "", errors.Join(errors.New("could not load user home directory"), err)
+	}
+	return filepath.Join(homeDir, "jchat"), nil
+}
+
+// The name of the directory that holds the config of a project, which is found by looking in the working directory and each of its parents.
+const projectConfigDirName = ".jchat"
+
+// A directory of config files, or the built-in defaults.
+type configLayer struct {
+	dir string
+	// The built-in defaults are the lowest layer, so that default entries are available even if the user config leaves them out.
+	defaults bool
+	// The user config is created from the defaults if it is missing, and is trusted to run commands to get secrets.
+	// Other config, such as a project config committed to a repository, is optional and may not run commands.
+	user bool
+	// Whether the user has trusted the project config with 'jchat trust' since its files last changed.
+	// Until then, it may not launch commands, reference secrets, or replace entries of the user config.
+	trusted bool
+}
+
+// Whether the layer is a project config that has not been trusted.
+func (l configLayer) untrustedProject() bool {
+	return !l.defaults && !l.user && !l.trusted
+}
+
+// Get the path of a config file of the layer, as it is described in errors.
+func (l configLayer) path(fileName string) string {
+	if l.defaults {
+		return "built-in default " + fileName
 	}
-	dataPath := filepath.Join(homeDir, "jchat")
-	agentFileName := filepath.Join(dataPath, "agent.json")
-	modelsFileName := filepath.Join(dataPath, "models.json")
-	mcpFileName := filepath.Join(dataPath, "mcp.json")
-	commandsFileName := filepath.Join(dataPath, "commands.json")
+	return filepath.Join(l.dir, fileName)
+}
 
-	// Load config files
-	modelsConf, err := loadJSONFileButCreateIfNotExist(modelsFileName, DefaultModelsConfig)
+// Find the layers to load config from, in the order they are layered, so that later layers override earlier ones.
+// The built-in defaults are followed by the user config in configDir (or ~/jchat if configDir is empty), and then the project config if one is found.
+func findConfigLayers(configDir string) ([]configLayer, error) {
+	if configDir == "" {
+		dataPath, err := getDataPath()
+		if err != nil {
+			return nil, err
+		}
+		configDir = dataPath
+	}
+	configDir, err := filepath.Abs(configDir)
 	if err != nil {
-		return nil, ui.AgentSummary{}, nil, err
+		return nil, err
 	}
-	agentConf, err := loadJSONFileButCreateIfNotExist(agentFileName, DefaultAgentsConfig)
+	layers := []configLayer{{defaults: true}, {dir: configDir, user: true}}
+	projectDir, err := findProjectConfigDir()
 	if err != nil {
-		return nil, ui.AgentSummary{}, nil, err
+		return nil, err
 	}
-	mcpsConf, err := loadJSONFileButCreateIfNotExist(mcpFileName, DefaultMCPServersConfig)
+	if projectDir != "" && projectDir != configDir {
+		trusted, err := isProjectTrusted(projectDir)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, configLayer{dir: projectDir, trusted: trusted})
+	}
+	return layers, nil
+}
+
+// Find the nearest project config directory in the working directory or its parents, or "" if there is none.
+func findProjectConfigDir() (string, error) {
+	dir, err := os.Getwd()
 	if err != nil {
-		return nil, ui.AgentSummary{}, nil, err
+		return "", err
 	}
-	commandsConf, err := loadJSONFileButCreateIfNotExist(commandsFileName, DefaultCustomCommandsConfig)
+	for {
+		candidate := filepath.Join(dir, projectConfigDirName)
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// Load the config, merging each config file of the user config over the built-in defaults, and that of the project config (if any) over both.
+// Entries of a config file replace entries of the same name in the layers below, and agents are then resolved to include what they extend.
+func loadConfig(configDir string) (jchatConfig, error) {
+	dataPath, err := getDataPath()
 	if err != nil {
-		return nil, ui.AgentSummary{}, nil, err
+		return jchatConfig{}, err
 	}
+	layers, err := findConfigLayers(configDir)
+	if err != nil {
+		return jchatConfig{}, err
+	}
+	resolver := ai.NewSecretResolver()
+	var conf jchatConfig
+	for i, layer := range layers {
+		layerConf, err := loadConfigLayer(layer)
+		if err != nil {
+			return jchatConfig{}, err
+		}
+		if layer.untrustedProject() {
+			if problems := untrustedProjectProblems(conf, layerConf); len(problems) > 0 {
+				return jchatConfig{}, fmt.Errorf("project config in %s is not trusted, so %s (%s)", layer.dir, strings.Join(problems, ", and "), untrustedProjectHint)
+			}
+		}
+		err = layerConf.resolveSecrets(resolver, layer)
+		if err != nil {
+			return jchatConfig{}, err
+		}
+		if i == 0 {
+			conf = layerConf
+		} else {
+			conf = conf.merge(layerConf)
+		}
+	}
+	conf.Agents, err = conf.Agents.ResolveExtends()
+	if err != nil {
+		return jchatConfig{}, fmt.Errorf("%s: %w", agentsFile, err)
+	}
+	conf.LogsPath = filepath.Join(dataPath, "logs")
+	conf.Redactor = resolver.Redactor()
+	conf.Warnings = resolver.PlaintextWarnings()
+	return conf, nil
+}
 
-	// Build the agent
-	usageCounter := jpf.NewUsageCounter()
-	builder, err := ai.BuildAgentBuilder(activeAgentName, modelsConf, agentConf, mcpsConf, commandsConf, usageCounter)
+func loadConfigLayer(layer configLayer) (jchatConfig, error) {
+	if layer.defaults {
+		return defaultConfig(), nil
+	}
+	models, err := loadConfigLayerFile(layer, modelsFile, DefaultModelsConfig)
+	if err != nil {
+		return jchatConfig{}, err
+	}
+	agents, err := loadConfigLayerFile(layer, agentsFile, DefaultAgentsConfig)
+	if err != nil {
+		return jchatConfig{}, err
+	}
+	mcpServers, err := loadConfigLayerFile(layer, mcpFile, DefaultMCPServersConfig)
+	if err != nil {
+		return jchatConfig{}, err
+	}
+	commands, err := loadConfigLayerFile(layer, commandsFile, DefaultCustomCommandsConfig)
 	if err != nil {
-		return nil, ui.AgentSummary{}, nil, err
+		return jchatConfig{}, err
 	}
-	activeAgent := agentConf.Agents[activeAgentName]
+	return jchatConfig{
+		Models:     models,
+		Agents:     agents,
+		MCPServers: mcpServers,
+		Commands:   commands,
+	}, nil
+}
+
+// Load a config file of the layer. Missing user config files are created with the default, and missing files of other layers are empty.
+func loadConfigLayerFile[T any](layer configLayer, fileName string, defaultVal T) (T, error) {
+	path := filepath.Join(layer.dir, fileName)
+	if layer.user {
+		return loadJSONFileButCreateIfNotExist(path, defaultVal)
+	}
+	conf, err := loadJSONFile[T](path)
+	if errors.Is(err, os.ErrNotExist) {
+		return *new(T), nil
+	}
+	return conf, err
+}
+
+// Get a copy of the built-in default config, which can be changed (such as by resolving its secrets) without changing the defaults.
+func defaultConfig() jchatConfig {
+	return jchatConfig{
+		Models:     cloneConfig(DefaultModelsConfig),
+		Agents:     cloneConfig(DefaultAgentsConfig),
+		MCPServers: cloneConfig(DefaultMCPServersConfig),
+		Commands:   cloneConfig(DefaultCustomCommandsConfig),
+	}
+}
+
+// Copy the config, including the maps and slices within it.
+func cloneConfig[T any](conf T) T {
+	bs, err := json.Marshal(conf)
+	if err != nil {
+		panic(err)
+	}
+	var clone T
+	if err := json.Unmarshal(bs, &clone); err != nil {
+		panic(err)
+	}
+	return clone
+}
+
+// Get the config with the entries of each config file of over replacing those of the same name.
+func (conf jchatConfig) merge(over jchatConfig) jchatConfig {
+	conf.Models = conf.Models.Merge(over.Models)
+	conf.Agents = conf.Agents.Merge(over.Agents)
+	conf.MCPServers = conf.MCPServers.Merge(over.MCPServers)
+	conf.Commands = conf.Commands.Merge(over.Commands)
+	return conf
+}
+
+// A config file, and a pointer to the config loaded from it.
+type configFile struct {
+	name string
+	conf any
+}
+
+func (conf *jchatConfig) files() []configFile {
+	return []configFile{
+		{modelsFile, &conf.Models},
+		{agentsFile, &conf.Agents},
+		{mcpFile, &conf.MCPServers},
+		{commandsFile, &conf.Commands},
+	}
+}
+
+// Resolve the environment variables and secrets referenced by the config loaded from the layer, in place.
+// Models and MCP servers whose secrets cannot be resolved are kept, and fail when they are used, so that only an error in the other files is returned.
+func (conf *jchatConfig) resolveSecrets(resolver *ai.SecretResolver, layer configLayer) error {
+	resolveEntry := func(fileName string) func(any) error {
+		return func(entry any) error {
+			err := resolveConfigFileSecrets(resolver, layer, configFile{fileName, entry})
+			if err != nil && layer.untrustedProject() {
+				return fmt.Errorf("%w (%s)", err, untrustedProjectHint)
+			}
+			return err
+		}
+	}
+	conf.Models = conf.Models.ResolveSecrets(resolveEntry(modelsFile))
+	conf.MCPServers = conf.MCPServers.ResolveSecrets(resolveEntry(mcpFile))
+	for _, f := range conf.files() {
+		if f.name == modelsFile || f.name == mcpFile {
+			continue
+		}
+		if err := resolveEntry(f.name)(f.conf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveConfigFileSecrets(resolver *ai.SecretResolver, layer configLayer, f configFile) error {
+	path := layer.path(f.name)
+	switch {
+	case layer.defaults, layer.user:
+		return resolver.Resolve(path, f.conf)
+	case layer.trusted:
+		return resolver.ResolveWithoutCommands(path, f.conf)
+	default:
+		return resolver.ResolveWithoutReferences(path, f.conf)
+	}
+}
+
+// Add the flag for the user config directory to the flag set.
+func addConfigDirFlag(fs *flag.FlagSet) *string {
+	return fs.String("config-dir", "", "The directory of the user config files (default ~/jchat). A .jchat directory in the working directory or a parent is layered over it")
+}
+
+// Build the named agent, using (but not taking ownership of) the MCP clients.
+func (conf jchatConfig) createAgentBuilder(activeAgentName string, mcpClients *ai.MCPClients, usageCounter *jpf.UsageCounter) (loadedAgent, error) {
+	builder, tools, err := ai.BuildAgentBuilder(activeAgentName, conf.Models, conf.Agents, mcpClients, conf.Commands, usageCounter)
+	if err != nil {
+		return loadedAgent{}, err
+	}
+	activeAgent := conf.Agents.Agents[activeAgentName]
 	sum := ui.AgentSummary{
 		Name:         activeAgentName,
 		Description:  activeAgent.AgentDescription,
@@ -244,7 +656,14 @@ func loadAndCreateAgentBuilder(activeAgentName string) (func() (agent.Agent, err
 		NumSubAgents: len(activeAgent.SubAgents),
 		ModelName:    activeAgent.ModelName,
 	}
-	return func() (a agent.Agent, err error) { return builder(), nil }, sum, usageCounter, nil
+	return loadedAgent{
+		Build:        builder,
+		Tools:        tools,
+		Summary:      sum,
+		UsageCounter: usageCounter,
+		Config:       conf,
+		MCPClients:   mcpClients,
+	}, nil
 }
 
 func loadJSONFileButCreateIfNotExist[T any](filePath string, defaultVal T) (T, error) {
@@ -275,6 +694,15 @@ func loadJSONFileButCreateIfNotExist[T any](filePath string, defaultVal T) (T, e
 }
 
 func loadJSONFile[T any](filePath string) (T, error) {
+	return decodeJSONFile[T](filePath, false)
+}
+
+// Load the file, failing if it contains fields that T does not have (such as misspelled keys).
+func loadJSONFileStrict[T any](filePath string) (T, error) {
+	return decodeJSONFile[T](filePath, true)
+}
+
+func decodeJSONFile[T any](filePath string, strict bool) (T, error) {
 	var t T
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -282,6 +710,9 @@ func loadJSONFile[T any](filePath string) (T, error) {
 	}
 	defer file.Close()
 	decoder := json.NewDecoder(file)
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
 	if err := decoder.Decode(&t); err != nil {
 		return t, err
 	}
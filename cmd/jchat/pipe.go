@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/cmd/jchat/ai"
+	"github.com/JoshPattman/jpf"
+)
+
+// The exit codes of pipe mode, so that scripts can tell why jchat failed.
+const (
+	exitOK = 0
+	// Anything not covered by another code, such as failing to write the output.
+	exitError       = 1
+	exitUsage       = 2
+	exitConfig      = 3
+	exitModel       = 4
+	exitBudget      = 5
+	exitInterrupted = 130
+)
+
+var (
+	errBudgetExhausted = errors.New("budget exhausted")
+	errInterrupted     = errors.New("interrupted")
+)
+
+var (
+	pipeInputFormats  = []string{"text", "jsonl"}
+	pipeOutputFormats = []string{"text", "json", "stream-json"}
+)
+
+// Options for answering queries without the TUI.
+type pipeParams struct {
+	agentName string
+	configDir string
+	// The query, or "" to read it from args or stdin.
+	query string
+	args  []string
+	// One of pipeInputFormats and pipeOutputFormats.
+	input  string
+	output string
+	// Limits on the whole run, or zero for no limit.
+	maxSteps  int
+	maxTokens int
+	timeout   time.Duration
+}
+
+// Answer the queries given in args or stdin with the agent, writing the results to stdout, and returning the exit code.
+func runPipe(p pipeParams) int {
+	if !slices.Contains(pipeInputFormats, p.input) {
+		fmt.Fprintf(os.Stderr, "Unknown input format '%s', must be one of %s\n", p.input, strings.Join(pipeInputFormats, ", "))
+		return exitUsage
+	}
+	if !slices.Contains(pipeOutputFormats, p.output) {
+		fmt.Fprintf(os.Stderr, "Unknown output format '%s', must be one of %s\n", p.output, strings.Join(pipeOutputFormats, ", "))
+		return exitUsage
+	}
+	usageCounter := jpf.NewUsageCounter()
+	conf, confErr := loadConfig(p.configDir)
+	var w, stderr io.Writer = os.Stdout, os.Stderr
+	if confErr == nil {
+		w = conf.Redactor.Writer(w)
+		stderr = conf.Redactor.Writer(stderr)
+		for _, warning := range conf.Warnings {
+			fmt.Fprintln(os.Stderr, "Warning:", warning)
+		}
+	}
+	out := newPipeOutput(p.output, w, stderr, p.agentName)
+	code := answerPipeQueries(p, conf, confErr, usageCounter, out)
+	if err := out.finish(usageCounter.Get(), code); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing output:", err)
+		return exitError
+	}
+	return code
+}
+
+func answerPipeQueries(p pipeParams, conf jchatConfig, confErr error, usageCounter *jpf.UsageCounter, out pipeOutput) int {
+	if p.agentName == "" {
+		out.fail("usage", errors.New("must specify agent name with -a"))
+		return exitUsage
+	}
+	if confErr != nil {
+		out.fail("config", confErr)
+		return exitConfig
+	}
+	mcpClients := ai.NewMCPClients(conf.MCPServers, conf.Models, usageCounter, conf.LogsPath, conf.Redactor)
+	defer mcpClients.Close()
+	loaded, err := conf.createAgentBuilder(p.agentName, mcpClients, usageCounter)
+	if err != nil {
+		out.fail("config", err)
+		return exitConfig
+	}
+	queries, err := newPipeQueryReader(p, os.Stdin)
+	if err != nil {
+		out.fail("usage", err)
+		return exitUsage
+	}
+
+	ctx, cancel := interruptibleContext(p.timeout)
+	defer cancel(nil)
+	a := loaded.Build()
+	limitAgentBudget(a, usageCounter, p.maxSteps, p.maxTokens, cancel)
+	a.SetOnReActCompleteCallback(func(reasoning string, aos []agent.ActionObservation) {
+		out.step(newPipeStep(reasoning, aos))
+	})
+	a.SetOnStreamAnswerChunkCallback(out.answerChunk)
+
+	for {
+		query, err := queries.next()
+		if errors.Is(err, io.EOF) {
+			return exitOK
+		} else if err != nil {
+			out.fail("usage", err)
+			return exitUsage
+		}
+		out.turn(query)
+		answer, err := agent.AnswerWithContext(ctx, a, query)
+		if err != nil {
+			kind, code, err := classifyPipeError(ctx, err)
+			out.fail(kind, err)
+			return code
+		}
+		out.answer(answer)
+	}
+}
+
+// Stop the agent, by cancelling its context with errBudgetExhausted, once it needs more steps with tool calls or has used more tokens than allowed.
+// A limit of zero means no limit. The agent is stopped before it acts, and is always allowed to give its final answer.
+func limitAgentBudget(a agent.Agent, usageCounter *jpf.UsageCounter, maxSteps, maxTokens int, cancel context.CancelCauseFunc) {
+	steps := 0
+	a.SetOnReActInitCallback(func(_ string, actions []agent.Action) {
+		if len(actions) > 0 {
+			steps++
+		}
+		used := usageCounter.Get()
+		switch {
+		case maxSteps > 0 && steps > maxSteps:
+			cancel(fmt.Errorf("%w: the agent needed more than %d steps", errBudgetExhausted, maxSteps))
+		case maxTokens > 0 && used.InputTokens+used.OutputTokens > maxTokens:
+			cancel(fmt.Errorf("%w: the agent used %d tokens, more than the %d allowed", errBudgetExhausted, used.InputTokens+used.OutputTokens, maxTokens))
+		}
+	})
+}
+
+// Create a context which is cancelled on the first interrupt (a second interrupt exits immediately), or once the timeout passes.
+func interruptibleContext(timeout time.Duration) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupts:
+			signal.Stop(interrupts)
+			cancel(errInterrupted)
+		case <-ctx.Done():
+			signal.Stop(interrupts)
+		}
+	}()
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			cancel(fmt.Errorf("%w: the agent took longer than %s", errBudgetExhausted, timeout))
+		})
+		return ctx, func(cause error) {
+			timer.Stop()
+			cancel(cause)
+		}
+	}
+	return ctx, cancel
+}
+
+// Get the kind of error and the exit code for an error answering, and the error to report.
+// An answer stopped by the context is reported with the reason it was stopped, and any other error is from the model.
+func classifyPipeError(ctx context.Context, err error) (string, int, error) {
+	cause := context.Cause(ctx)
+	switch {
+	case errors.Is(cause, errBudgetExhausted):
+		return "budget", exitBudget, cause
+	case errors.Is(cause, errInterrupted):
+		return "interrupted", exitInterrupted, cause
+	default:
+		return "model", exitModel, err
+	}
+}
+
+// Reads the queries to answer, one per turn of the conversation.
+type pipeQueryReader struct {
+	// The only query, if it was not read from stdin.
+	query string
+	// Reads a JSON query per line, if the input is jsonl.
+	lines *bufio.Scanner
+	line  int
+	done  bool
+}
+
+func newPipeQueryReader(p pipeParams, stdin *os.File) (*pipeQueryReader, error) {
+	if p.input == "jsonl" {
+		if p.query != "" || len(p.args) > 0 {
+			return nil, errors.New("queries must be given on stdin when the input is jsonl")
+		}
+		lines := bufio.NewScanner(stdin)
+		lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		return &pipeQueryReader{lines: lines}, nil
+	}
+	query := p.query
+	if query == "" {
+		query = strings.Join(p.args, " ")
+	}
+	if query == "" {
+		if info, err := stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return nil, errors.New("no query given, pass it as arguments or pipe it to stdin")
+		}
+		bs, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the query from stdin: %w", err)
+		}
+		query = strings.TrimSpace(string(bs))
+	}
+	if query == "" {
+		return nil, errors.New("the query is empty")
+	}
+	return &pipeQueryReader{query: query}, nil
+}
+
+// Get the next query, or io.EOF if there are no more.
+// Each line of jsonl input is either a JSON string or an object with a query field, and blank lines are skipped.
+func (r *pipeQueryReader) next() (string, error) {
+	if r.lines == nil {
+		if r.done {
+			return "", io.EOF
+		}
+		r.done = true
+		return r.query, nil
+	}
+	for r.lines.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.lines.Text())
+		if line == "" {
+			continue
+		}
+		var query string
+		if strings.HasPrefix(line, `"`) {
+			err := json.Unmarshal([]byte(line), &query)
+			if err != nil {
+				return "", fmt.Errorf("line %d of the input is not valid JSON: %w", r.line, err)
+			}
+		} else {
+			var turn struct {
+				Query string `json:"query"`
+			}
+			err := json.Unmarshal([]byte(line), &turn)
+			if err != nil {
+				return "", fmt.Errorf("line %d of the input is not valid JSON: %w", r.line, err)
+			}
+			query = turn.Query
+		}
+		if query == "" {
+			return "", fmt.Errorf("line %d of the input has no query", r.line)
+		}
+		return query, nil
+	}
+	if err := r.lines.Err(); err != nil {
+		return "", fmt.Errorf("could not read the input: %w", err)
+	}
+	return "", io.EOF
+}
+
+type pipeToolCall struct {
+	Name        string         `json:"name"`
+	Args        map[string]any `json:"args"`
+	Observation string         `json:"observation"`
+	DurationMS  int64          `json:"duration_ms,omitempty"`
+}
+
+type pipeStep struct {
+	Reasoning string         `json:"reasoning"`
+	ToolCalls []pipeToolCall `json:"tool_calls"`
+}
+
+func newPipeStep(reasoning string, aos []agent.ActionObservation) pipeStep {
+	calls := make([]pipeToolCall, len(aos))
+	for i, ao := range aos {
+		args := make(map[string]any, len(ao.Action.Args))
+		for _, arg := range ao.Action.Args {
+			args[arg.ArgName] = arg.ArgData
+		}
+		observed := []string{ao.Observation.Observed}
+		observed = append(observed, describeAttachments(ao.Observation)...)
+		calls[i] = pipeToolCall{
+			Name:        ao.Action.Name,
+			Args:        args,
+			Observation: strings.Join(observed, "\n"),
+			DurationMS:  ao.Duration.Milliseconds(),
+		}
+	}
+	return pipeStep{Reasoning: reasoning, ToolCalls: calls}
+}
+
+type pipeError struct {
+	// One of usage, config, model, budget or interrupted.
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+type pipeUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type pipeTurn struct {
+	Query  string     `json:"query"`
+	Steps  []pipeStep `json:"steps"`
+	Answer string     `json:"answer,omitempty"`
+	Error  *pipeError `json:"error,omitempty"`
+}
+
+// The document written by the json output format.
+type pipeResult struct {
+	Agent string `json:"agent"`
+	// The answer to the last query.
+	Answer   string     `json:"answer"`
+	Turns    []pipeTurn `json:"turns"`
+	Usage    pipeUsage  `json:"usage"`
+	Error    *pipeError `json:"error,omitempty"`
+	ExitCode int        `json:"exit_code"`
+}
+
+// Writes what happens while answering in an output format.
+// Steps and answer chunks may be reported from other goroutines.
+type pipeOutput interface {
+	// A new turn has started with the query.
+	turn(query string)
+	step(step pipeStep)
+	answerChunk(chunk string)
+	answer(answer string)
+	fail(kind string, err error)
+	// Write anything that is left to write, once everything is done.
+	finish(usage jpf.Usage, exitCode int) error
+}
+
+// Errors are written to w, except in the text format where they are written to stderr.
+func newPipeOutput(format string, w, stderr io.Writer, agentName string) pipeOutput {
+	switch format {
+	case "json":
+		return &jsonPipeOutput{w: w, result: pipeResult{Agent: agentName, Turns: make([]pipeTurn, 0)}}
+	case "stream-json":
+		out := &streamPipeOutput{enc: json.NewEncoder(w)}
+		out.enc.SetEscapeHTML(false)
+		out.event("start", map[string]any{"agent": agentName})
+		return out
+	default:
+		return &textPipeOutput{w: w, stderr: stderr}
+	}
+}
+
+// Writes each answer, and reports errors on stderr.
+type textPipeOutput struct {
+	w      io.Writer
+	stderr io.Writer
+	err    error
+}
+
+func (o *textPipeOutput) turn(string)        {}
+func (o *textPipeOutput) step(pipeStep)      {}
+func (o *textPipeOutput) answerChunk(string) {}
+
+func (o *textPipeOutput) answer(answer string) {
+	if o.err == nil {
+		_, o.err = fmt.Fprintln(o.w, answer)
+	}
+}
+
+func (o *textPipeOutput) fail(kind string, err error) {
+	fmt.Fprintf(o.stderr, "Error (%s): %v\n", kind, err)
+}
+
+func (o *textPipeOutput) finish(jpf.Usage, int) error {
+	return o.err
+}
+
+// Collects everything into a single JSON document, written once everything is done.
+type jsonPipeOutput struct {
+	lock   sync.Mutex
+	w      io.Writer
+	result pipeResult
+}
+
+func (o *jsonPipeOutput) turn(query string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.result.Turns = append(o.result.Turns, pipeTurn{Query: query, Steps: make([]pipeStep, 0)})
+}
+
+func (o *jsonPipeOutput) current() *pipeTurn {
+	if len(o.result.Turns) == 0 {
+		return nil
+	}
+	return &o.result.Turns[len(o.result.Turns)-1]
+}
+
+func (o *jsonPipeOutput) step(step pipeStep) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if t := o.current(); t != nil {
+		t.Steps = append(t.Steps, step)
+	}
+}
+
+func (o *jsonPipeOutput) answerChunk(string) {}
+
+func (o *jsonPipeOutput) answer(answer string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.current().Answer = answer
+	o.result.Answer = answer
+}
+
+func (o *jsonPipeOutput) fail(kind string, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	pe := &pipeError{Kind: kind, Message: err.Error()}
+	o.result.Error = pe
+	if t := o.current(); t != nil && t.Answer == "" {
+		t.Error = pe
+	}
+}
+
+func (o *jsonPipeOutput) finish(usage jpf.Usage, exitCode int) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.result.Usage = pipeUsage{usage.InputTokens, usage.OutputTokens}
+	o.result.ExitCode = exitCode
+	enc := json.NewEncoder(o.w)
+	enc.SetIndent("", "    ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(o.result)
+}
+
+// Writes a JSON event per line as soon as each thing happens.
+type streamPipeOutput struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+	// The number of the current turn, counting from 1.
+	turnNum int
+	err     error
+}
+
+func (o *streamPipeOutput) event(eventType string, fields map[string]any) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.err != nil {
+		return
+	}
+	fields["type"] = eventType
+	o.err = o.enc.Encode(fields)
+}
+
+func (o *streamPipeOutput) currentTurn() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.turnNum
+}
+
+func (o *streamPipeOutput) turnStarted() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.turnNum++
+	return o.turnNum
+}
+
+func (o *streamPipeOutput) turn(query string) {
+	o.event("turn", map[string]any{"turn": o.turnStarted(), "query": query})
+}
+
+func (o *streamPipeOutput) step(step pipeStep) {
+	o.event("step", map[string]any{"turn": o.currentTurn(), "reasoning": step.Reasoning, "tool_calls": step.ToolCalls})
+}
+
+func (o *streamPipeOutput) answerChunk(chunk string) {
+	o.event("answer_delta", map[string]any{"turn": o.currentTurn(), "text": chunk})
+}
+
+func (o *streamPipeOutput) answer(answer string) {
+	o.event("answer", map[string]any{"turn": o.currentTurn(), "answer": answer})
+}
+
+func (o *streamPipeOutput) fail(kind string, err error) {
+	o.event("error", map[string]any{"turn": o.currentTurn(), "kind": kind, "message": err.Error()})
+}
+
+func (o *streamPipeOutput) finish(usage jpf.Usage, exitCode int) error {
+	o.event("end", map[string]any{
+		"usage":     pipeUsage{usage.InputTokens, usage.OutputTokens},
+		"exit_code": exitCode,
+	})
+	return o.err
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/cmd/jchat/ai"
+	"github.com/JoshPattman/agent/cmd/jchat/attach"
+	"github.com/JoshPattman/agent/cmd/jchat/ui"
+	"github.com/JoshPattman/jpf"
+)
+
+// How a room picks the agent that answers a message which does not address any agents with @name.
+const (
+	// Each agent answers in turn.
+	moderatorRoundRobin = "round-robin"
+	// A model picks the agent best suited to answer.
+	moderatorRouter = "router"
+	// The agent the user last addressed answers.
+	moderatorUser = "user"
+)
+
+var moderators = []string{moderatorRoundRobin, moderatorRouter, moderatorUser}
+
+// The number of recent messages the router model sees when picking an agent.
+const routerTranscriptLength = 20
+
+// Metadata keys used for sessions of a room.
+const (
+	sessionRoomKey      = "room"
+	sessionModeratorKey = "moderator"
+)
+
+// The agents in a room and how the room is moderated.
+type roomConfig struct {
+	Agents    []string
+	Moderator string
+	// The model that picks who answers when moderated by a router.
+	RouterModel string
+}
+
+// Parse a comma separated list of agents and a moderator into a room config, checking the agents exist.
+func (conf jchatConfig) parseRoomConfig(agents, moderator, routerModel string) (roomConfig, error) {
+	room := roomConfig{Moderator: moderator, RouterModel: routerModel}
+	for _, name := range strings.Split(agents, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := conf.Agents.Agents[name]; !ok {
+			return roomConfig{}, fmt.Errorf("could not find a configured agent called '%s'", name)
+		}
+		if name == ui.AddressEveryone {
+			return roomConfig{}, fmt.Errorf("an agent in a room cannot be called '%s', as @%s addresses every agent", ui.AddressEveryone, ui.AddressEveryone)
+		}
+		if slices.Contains(room.Agents, name) {
+			return roomConfig{}, fmt.Errorf("agent '%s' is in the room more than once", name)
+		}
+		room.Agents = append(room.Agents, name)
+	}
+	if len(room.Agents) < 2 {
+		return roomConfig{}, errors.New("a room needs at least two agents")
+	}
+	if !slices.Contains(moderators, room.Moderator) {
+		return roomConfig{}, fmt.Errorf("unknown moderator '%s', must be one of %s", room.Moderator, strings.Join(moderators, ", "))
+	}
+	if room.Moderator == moderatorRouter {
+		if room.RouterModel == "" {
+			room.RouterModel = conf.Agents.Agents[room.Agents[0]].ModelName
+		}
+		model, ok := conf.Models.Models[room.RouterModel]
+		if !ok {
+			return roomConfig{}, fmt.Errorf("could not find router model '%s'", room.RouterModel)
+		}
+		if err := model.CheckUsable(); err != nil {
+			return roomConfig{}, fmt.Errorf("could not use router model '%s': %w", room.RouterModel, err)
+		}
+	}
+	return room, nil
+}
+
+// The name of the room, as shown in the summary and saved in sessions.
+func (room roomConfig) name() string {
+	return "room: " + strings.Join(room.Agents, ", ")
+}
+
+// Build the agents in the room, using (but not taking ownership of) the MCP clients.
+func (conf jchatConfig) createRoomBuilder(room roomConfig, mcpClients *ai.MCPClients, usageCounter *jpf.UsageCounter) (loadedAgent, error) {
+	participants := make([]loadedAgent, len(room.Agents))
+	sum := ui.AgentSummary{
+		Name:        room.name(),
+		Description: []string{fmt.Sprintf("Address agents with @name (or @%s), otherwise moderated by %s.", ui.AddressEveryone, room.Moderator)},
+		ModelName:   room.Moderator,
+	}
+	tools := make([]agent.Tool, 0)
+	for i, name := range room.Agents {
+		loaded, err := conf.createAgentBuilder(name, mcpClients, usageCounter)
+		if err != nil {
+			return loadedAgent{}, fmt.Errorf("could not build agent '%s' in the room: %w", name, err)
+		}
+		participants[i] = loaded
+		tools = append(tools, loaded.Tools...)
+		sum.NumMCP += loaded.Summary.NumMCP
+		sum.NumSubAgents += loaded.Summary.NumSubAgents
+		sum.Participants = append(sum.Participants, ui.ParticipantSummary{Name: name, ModelName: loaded.Summary.ModelName})
+	}
+	var router jpf.Model
+	if room.Moderator == moderatorRouter {
+		router = ai.NewModelBuilder(conf.Models.Models[room.RouterModel], usageCounter).BuildFileQAModel()
+	}
+	build := func() agent.Agent {
+		return newRoomAgent(room, conf.Agents, participants, router, usageCounter)
+	}
+	return loadedAgent{
+		Build:        build,
+		Tools:        tools,
+		Summary:      sum,
+		UsageCounter: usageCounter,
+		Config:       conf,
+		MCPClients:   mcpClients,
+	}, nil
+}
+
+// A message in the conversation of a room.
+type roomMessage struct {
+	// The name of the agent that wrote the message, or empty if it was written by the user.
+	Speaker string
+	Text    string
+	// Answers restored from a saved session are not split by agent, so the text is labelled with the agents instead.
+	Restored bool
+}
+
+// An agent taking part in a room.
+type roomParticipant struct {
+	name        string
+	description []string
+	agent       agent.StatefulAgent
+	// How many messages of the transcript the agent has been shown.
+	seen int
+	// The tokens used while the agent was answering.
+	usage jpf.Usage
+}
+
+// Where the room and its agents were before a task, so that the task can be forgotten.
+type roomCheckpoint struct {
+	transcript int
+	seen       []int
+	histories  []int
+}
+
+// A conversation between the user and several agents, which is an agent itself so it can be chatted to and saved like any other.
+// Each message from the user is answered by the agents it addresses with @name, or by the agent the moderator picks.
+// Every agent is shown the messages written since it last answered, so all of them follow the whole conversation.
+type roomAgent struct {
+	// Held while answering, so that only one message is answered at a time and the history is not changed during an answer.
+	lock         sync.Mutex
+	config       roomConfig
+	participants []*roomParticipant
+	router       jpf.Model
+	usageCounter *jpf.UsageCounter
+	transcript   []roomMessage
+	history      []agent.CompletedTask
+	checkpoints  []roomCheckpoint
+	// The index of the agent to answer next when moderated round-robin.
+	nextTurn int
+	// The agents the user last addressed, which answer next when moderated by the user.
+	lastAddressed []*roomParticipant
+	// The agent currently answering, whose name is streamed before its answer.
+	answering     *roomParticipant
+	streamedLabel bool
+	// Whether the last thing streamed was part of an answer, rather than a step, so the next answer continues the same message.
+	streamedAnswer  bool
+	onReActInit     func(string, []agent.Action)
+	onReActComplete func(string, []agent.ActionObservation)
+	onStreamBegin   func()
+	onStreamChunk   func(string)
+	// Held while reading or updating the usage of the agents, which is read while answering.
+	usageLock sync.Mutex
+}
+
+func newRoomAgent(config roomConfig, agentsConf ai.AgentsConfig, loaded []loadedAgent, router jpf.Model, usageCounter *jpf.UsageCounter) *roomAgent {
+	r := &roomAgent{
+		config:       config,
+		router:       router,
+		usageCounter: usageCounter,
+	}
+	for i, name := range config.Agents {
+		// Agents built from the config are always stateful
+		a := loaded[i].Build().(agent.StatefulAgent)
+		p := &roomParticipant{
+			name:        name,
+			description: agentsConf.Agents[name].AgentDescription,
+			agent:       a,
+		}
+		a.SetOnReActInitCallback(func(reasoning string, actions []agent.Action) {
+			if r.onReActInit != nil {
+				r.onReActInit(reasoning, actions)
+			}
+		})
+		a.SetOnReActCompleteCallback(func(reasoning string, aos []agent.ActionObservation) {
+			r.streamedAnswer = false
+			if r.onReActComplete != nil {
+				r.onReActComplete(reasoning, aos)
+			}
+		})
+		a.SetOnBeginStreamAnswerCallback(func() {
+			if r.onStreamBegin != nil && r.answering == p {
+				r.onStreamBegin()
+			}
+		})
+		a.SetOnStreamAnswerChunkCallback(func(chunk string) {
+			r.streamChunk(p, chunk)
+		})
+		r.participants = append(r.participants, p)
+	}
+	return r
+}
+
+// Stream a chunk of the answer of an agent, first streaming its name if it is the first chunk of its answer.
+func (r *roomAgent) streamChunk(p *roomParticipant, chunk string) {
+	if r.onStreamChunk == nil || r.answering != p {
+		return
+	}
+	if !r.streamedLabel {
+		r.onStreamChunk(r.answerLabel(p))
+		r.streamedLabel = true
+	}
+	r.onStreamChunk(chunk)
+	r.streamedAnswer = true
+}
+
+// The text put before the answer of an agent, separating it from the answer of the previous agent if that was streamed into the same message.
+func (r *roomAgent) answerLabel(p *roomParticipant) string {
+	label := fmt.Sprintf("**%s**\n\n", p.name)
+	if r.streamedAnswer {
+		label = "\n\n" + label
+	}
+	return label
+}
+
+// Answer implements agent.Agent.
+func (r *roomAgent) Answer(query string) (string, error) {
+	return r.AnswerContext(context.Background(), query)
+}
+
+// AnswerContext implements agent.ContextAgent.
+// If an agent fails to answer, the room forgets the message so it can be sent again.
+// If the answer is cancelled, the answers given so far are remembered as a cancelled task.
+func (r *roomAgent) AnswerContext(ctx context.Context, query string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.streamedAnswer = false
+	checkpoint := r.checkpoint()
+	responders, err := r.pickResponders(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	r.transcript = append(r.transcript, roomMessage{Text: query})
+	task := agent.CompletedTask{Task: query}
+	answers := make([]string, 0, len(responders))
+	for _, p := range responders {
+		answer, steps, err := r.answerAs(ctx, p)
+		task.Steps = append(task.Steps, steps...)
+		if err != nil && ctx.Err() != nil {
+			task.Cancelled = true
+			r.history = append(r.history, task)
+			r.checkpoints = append(r.checkpoints, checkpoint)
+			return "", fmt.Errorf("task was cancelled: %w", ctx.Err())
+		}
+		if err != nil {
+			r.restore(checkpoint)
+			return "", fmt.Errorf("%s could not answer: %w", p.name, err)
+		}
+		answers = append(answers, fmt.Sprintf("**%s**\n\n%s", p.name, answer))
+	}
+	task.Response = strings.Join(answers, "\n\n")
+	r.history = append(r.history, task)
+	r.checkpoints = append(r.checkpoints, checkpoint)
+	return task.Response, nil
+}
+
+// Ask the agent to answer the messages it has not yet seen, adding its answer to the transcript.
+func (r *roomAgent) answerAs(ctx context.Context, p *roomParticipant) (string, []agent.Step, error) {
+	query := r.participantQuery(p)
+	historyLen := len(p.agent.History())
+	before := r.usageCounter.Get()
+	r.answering, r.streamedLabel = p, false
+	answer, err := agent.AnswerWithContext(ctx, p.agent, query)
+	r.answering = nil
+	r.addUsage(p, before)
+	var steps []agent.Step
+	if history := p.agent.History(); len(history) > historyLen {
+		steps = history[len(history)-1].Steps
+	}
+	if err != nil {
+		return "", steps, err
+	}
+	r.transcript = append(r.transcript, roomMessage{Speaker: p.name, Text: answer})
+	p.seen = len(r.transcript)
+	return answer, steps, nil
+}
+
+// Write the query for an agent, which shows it the messages since it last answered.
+func (r *roomAgent) participantQuery(p *roomParticipant) string {
+	others := make([]string, 0, len(r.participants)-1)
+	for _, o := range r.participants {
+		if o != p {
+			others = append(others, o.name)
+		}
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "You are %s, in a conversation between the user and the agents %s.\n", p.name, strings.Join(others, ", "))
+	if p.seen == 0 {
+		b.WriteString("These are the messages so far:\n\n")
+	} else {
+		b.WriteString("These are the messages since you last answered:\n\n")
+	}
+	for _, msg := range r.transcript[p.seen:] {
+		b.WriteString(formatRoomMessage(msg))
+		b.WriteString("\n\n")
+	}
+	fmt.Fprintf(b, "Answer the user as %s. Do not answer for the other agents.", p.name)
+	return b.String()
+}
+
+func formatRoomMessage(msg roomMessage) string {
+	switch {
+	case msg.Restored:
+		return msg.Text
+	case msg.Speaker == "":
+		return "User: " + msg.Text
+	default:
+		return msg.Speaker + ": " + msg.Text
+	}
+}
+
+// Pick the agents that answer the query, in the order they answer.
+func (r *roomAgent) pickResponders(ctx context.Context, query string) ([]*roomParticipant, error) {
+	if addressed := r.addressed(query); len(addressed) > 0 {
+		r.lastAddressed = addressed
+		return addressed, nil
+	}
+	switch r.config.Moderator {
+	case moderatorUser:
+		if len(r.lastAddressed) == 0 {
+			return nil, fmt.Errorf("address the agents that should answer with @name (%s), or @%s for every agent", strings.Join(r.config.Agents, ", "), ui.AddressEveryone)
+		}
+		return r.lastAddressed, nil
+	case moderatorRouter:
+		return []*roomParticipant{r.route(ctx, query)}, nil
+	default:
+		p := r.participants[r.nextTurn%len(r.participants)]
+		r.nextTurn++
+		return []*roomParticipant{p}, nil
+	}
+}
+
+// Find the agents addressed in the query with @name, in the order they are first addressed.
+func (r *roomAgent) addressed(query string) []*roomParticipant {
+	message, _ := attach.Split(query)
+	addressed := make([]*roomParticipant, 0)
+	for _, word := range strings.Fields(message) {
+		name, ok := strings.CutPrefix(word, "@")
+		if !ok {
+			continue
+		}
+		name = strings.TrimRight(name, ".,;:!?)]}'\"")
+		if name == ui.AddressEveryone {
+			return r.participants
+		}
+		for _, p := range r.participants {
+			if p.name == name && !slices.Contains(addressed, p) {
+				addressed = append(addressed, p)
+			}
+		}
+	}
+	return addressed
+}
+
+// Ask the router model which agent should answer, falling back to round-robin if it does not name one.
+func (r *roomAgent) route(ctx context.Context, query string) *roomParticipant {
+	agents := &strings.Builder{}
+	for _, p := range r.participants {
+		fmt.Fprintf(agents, "- %s: %s\n", p.name, strings.Join(p.description, " "))
+	}
+	recent := r.transcript[max(0, len(r.transcript)-routerTranscriptLength):]
+	conversation := &strings.Builder{}
+	for _, msg := range recent {
+		conversation.WriteString(formatRoomMessage(msg) + "\n\n")
+	}
+	message, _ := attach.Split(query)
+	conversation.WriteString(formatRoomMessage(roomMessage{Text: message}))
+	resp, err := r.router.Respond(ctx, []jpf.Message{
+		{
+			Role:    jpf.SystemRole,
+			Content: "You moderate a conversation between a user and these agents:\n" + agents.String() + "\nPick the agent best suited to answer the last message from the user. Reply with only the name of the agent.",
+		},
+		{
+			Role:    jpf.UserRole,
+			Content: conversation.String(),
+		},
+	})
+	if err == nil {
+		reply := strings.Trim(strings.TrimSpace(resp.PrimaryMessage.Content), "@*`'\".")
+		for _, p := range r.participants {
+			if strings.EqualFold(reply, p.name) {
+				return p
+			}
+		}
+	}
+	p := r.participants[r.nextTurn%len(r.participants)]
+	r.nextTurn++
+	return p
+}
+
+// Add the tokens used since the usage counter was at before to the usage of the agent.
+func (r *roomAgent) addUsage(p *roomParticipant, before jpf.Usage) {
+	after := r.usageCounter.Get()
+	r.usageLock.Lock()
+	defer r.usageLock.Unlock()
+	p.usage.InputTokens += after.InputTokens - before.InputTokens
+	p.usage.OutputTokens += after.OutputTokens - before.OutputTokens
+}
+
+// Get the tokens used by each agent in the room.
+func (r *roomAgent) participantUsage() []ui.ParticipantUsage {
+	r.usageLock.Lock()
+	defer r.usageLock.Unlock()
+	usage := make([]ui.ParticipantUsage, len(r.participants))
+	for i, p := range r.participants {
+		usage[i] = ui.ParticipantUsage{Name: p.name, Usage: p.usage}
+	}
+	return usage
+}
+
+func (r *roomAgent) checkpoint() roomCheckpoint {
+	c := roomCheckpoint{transcript: len(r.transcript)}
+	for _, p := range r.participants {
+		c.seen = append(c.seen, p.seen)
+		c.histories = append(c.histories, len(p.agent.History()))
+	}
+	return c
+}
+
+// Go back to the checkpoint, making every agent forget what it was told and answered since.
+func (r *roomAgent) restore(c roomCheckpoint) {
+	r.transcript = r.transcript[:c.transcript]
+	for i, p := range r.participants {
+		p.seen = c.seen[i]
+		if history := p.agent.History(); len(history) > c.histories[i] {
+			p.agent.SetHistory(history[:c.histories[i]])
+		}
+	}
+}
+
+// History implements agent.StatefulAgent.
+// Each task holds the steps of every agent that answered it, and their answers labelled with their names.
+func (r *roomAgent) History() []agent.CompletedTask {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return slices.Clone(r.history)
+}
+
+// SetHistory implements agent.StatefulAgent.
+// If the history is the start of the current history (as when retrying), the room goes back to before the tasks that were removed.
+// Otherwise (as when resuming a session) the agents forget what they remember, and are shown the whole history as the messages so far.
+func (r *roomAgent) SetHistory(history []agent.CompletedTask) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(history) < len(r.history) && isHistoryPrefix(history, r.history) {
+		r.restore(r.checkpoints[len(history)])
+		r.history = slices.Clone(history)
+		r.checkpoints = r.checkpoints[:len(history)]
+		return
+	}
+	r.history = slices.Clone(history)
+	r.transcript = nil
+	r.checkpoints = nil
+	for _, task := range history {
+		r.checkpoints = append(r.checkpoints, roomCheckpoint{transcript: len(r.transcript), seen: make([]int, len(r.participants)), histories: make([]int, len(r.participants))})
+		r.transcript = append(r.transcript, roomMessage{Text: task.Task})
+		if task.Response != "" {
+			r.transcript = append(r.transcript, roomMessage{Text: task.Response, Restored: true})
+		}
+	}
+	for _, p := range r.participants {
+		p.agent.SetHistory(nil)
+		p.seen = 0
+	}
+}
+
+func isHistoryPrefix(prefix, history []agent.CompletedTask) bool {
+	for i := range prefix {
+		if prefix[i].Task != history[i].Task || prefix[i].Response != history[i].Response || prefix[i].Cancelled != history[i].Cancelled {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *roomAgent) SetOnReActInitCallback(callback func(string, []agent.Action)) {
+	r.onReActInit = callback
+}
+
+func (r *roomAgent) SetOnReActCompleteCallback(callback func(string, []agent.ActionObservation)) {
+	r.onReActComplete = callback
+}
+
+func (r *roomAgent) SetOnBeginStreamAnswerCallback(callback func()) {
+	r.onStreamBegin = callback
+}
+
+func (r *roomAgent) SetOnStreamAnswerChunkCallback(callback func(string)) {
+	r.onStreamChunk = callback
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/cmd/jchat/ai"
+	"github.com/JoshPattman/jpf"
+)
+
+// An agent in a room which remembers the queries it was asked, and fails to answer while fail is set.
+// Like the agents built from the config, it remembers a failed task.
+type testRoomParticipant struct {
+	name    string
+	fail    bool
+	history []agent.CompletedTask
+}
+
+func (a *testRoomParticipant) Answer(query string) (string, error) {
+	if a.fail {
+		a.history = append(a.history, agent.CompletedTask{Task: query})
+		return "", errors.New("model is down")
+	}
+	answer := fmt.Sprintf("%s answer %d", a.name, len(a.history)+1)
+	a.history = append(a.history, agent.CompletedTask{Task: query, Response: answer})
+	return answer, nil
+}
+
+func (a *testRoomParticipant) History() []agent.CompletedTask                                     { return a.history }
+func (a *testRoomParticipant) SetHistory(history []agent.CompletedTask)                           { a.history = history }
+func (a *testRoomParticipant) SetOnReActInitCallback(func(string, []agent.Action))                {}
+func (a *testRoomParticipant) SetOnReActCompleteCallback(func(string, []agent.ActionObservation)) {}
+func (a *testRoomParticipant) SetOnBeginStreamAnswerCallback(func())                              {}
+func (a *testRoomParticipant) SetOnStreamAnswerChunkCallback(func(string))                        {}
+
+// A router model which always gives the same reply, or fails if the reply is empty.
+type testRouter struct {
+	reply string
+	calls int
+}
+
+func (m *testRouter) Respond(context.Context, []jpf.Message) (jpf.ModelResponse, error) {
+	m.calls++
+	if m.reply == "" {
+		return jpf.ModelResponse{}, errors.New("router is down")
+	}
+	return jpf.ModelResponse{PrimaryMessage: jpf.Message{Role: jpf.AssistantRole, Content: m.reply}}, nil
+}
+
+// Create a room of alice, bob and carol.
+func newTestRoom(moderator string, router jpf.Model) (*roomAgent, map[string]*testRoomParticipant) {
+	room := roomConfig{Agents: []string{"alice", "bob", "carol"}, Moderator: moderator}
+	agentsConf := ai.AgentsConfig{Agents: make(map[string]ai.AgentConfig)}
+	participants := make(map[string]*testRoomParticipant)
+	loaded := make([]loadedAgent, len(room.Agents))
+	for i, name := range room.Agents {
+		p := &testRoomParticipant{name: name}
+		participants[name] = p
+		agentsConf.Agents[name] = ai.AgentConfig{AgentDescription: []string{"Knows about " + name}}
+		loaded[i] = loadedAgent{Build: func() agent.Agent { return p }}
+	}
+	return newRoomAgent(room, agentsConf, loaded, router, jpf.NewUsageCounter()), participants
+}
+
+func participantNames(participants []*roomParticipant) []string {
+	names := make([]string, len(participants))
+	for i, p := range participants {
+		names[i] = p.name
+	}
+	return names
+}
+
+func TestRoomAddressed(t *testing.T) {
+	r, _ := newTestRoom(moderatorRoundRobin, nil)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"@alice what do you think?", []string{"alice"}},
+		{"@bob, then @alice: go", []string{"bob", "alice"}},
+		{"@carol and @carol again", []string{"carol"}},
+		{"@bob! over to you", []string{"bob"}},
+		{"everyone @all", []string{"alice", "bob", "carol"}},
+		{"@dave is not here", []string{}},
+		{"mail me at me@alice", []string{}},
+		{"no one in particular", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := participantNames(r.addressed(tt.query)); !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v to be addressed, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRoomAnswersAddressedAgentsInOrder(t *testing.T) {
+	router := &testRouter{reply: "carol"}
+	r, participants := newTestRoom(moderatorRouter, router)
+	answer, err := r.Answer("@bob @alice hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "**bob**\n\nbob answer 1\n\n**alice**\n\nalice answer 1" {
+		t.Errorf("unexpected answer %q", answer)
+	}
+	if router.calls != 0 {
+		t.Error("expected the router not to be asked when agents are addressed")
+	}
+	// Alice answers after bob, so is shown his answer
+	if query := participants["alice"].history[0].Task; !strings.Contains(query, "bob: bob answer 1") {
+		t.Errorf("expected alice to be shown bob's answer, got %q", query)
+	}
+}
+
+func TestRoomRoutes(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+	}{
+		{"names an agent", "Carol", "carol"},
+		{"names an agent with formatting", "**@bob.**", "bob"},
+		{"names no agent", "dave", "alice"},
+		{"fails", "", "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestRoom(moderatorRouter, &testRouter{reply: tt.reply})
+			if got := r.route(context.Background(), "hello").name; got != tt.want {
+				t.Errorf("expected %s to be picked, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRoomForgetsFailedTurns(t *testing.T) {
+	r, participants := newTestRoom(moderatorUser, nil)
+	if _, err := r.Answer("@alice first"); err != nil {
+		t.Fatal(err)
+	}
+	participants["bob"].fail = true
+	if _, err := r.Answer("@alice @bob second"); err == nil || !strings.Contains(err.Error(), "bob could not answer") {
+		t.Fatalf("expected bob to fail, got %v", err)
+	}
+	if len(r.History()) != 1 || len(r.transcript) != 2 {
+		t.Errorf("expected the room to forget the failed turn, got %d tasks and %d messages", len(r.History()), len(r.transcript))
+	}
+	if len(participants["alice"].history) != 1 || len(participants["bob"].history) != 0 {
+		t.Errorf("expected the agents to forget the failed turn, got %d and %d tasks", len(participants["alice"].history), len(participants["bob"].history))
+	}
+	participants["bob"].fail = false
+	if _, err := r.Answer("@bob third"); err != nil {
+		t.Fatal(err)
+	}
+	query := participants["bob"].history[0].Task
+	if strings.Contains(query, "second") || !strings.Contains(query, "These are the messages so far") || !strings.Contains(query, "User: @alice first") {
+		t.Errorf("expected bob to be shown the conversation without the failed turn, got %q", query)
+	}
+}
+
+func TestRoomSetHistory(t *testing.T) {
+	r, participants := newTestRoom(moderatorRoundRobin, nil)
+	for _, query := range []string{"one", "two"} {
+		if _, err := r.Answer(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history := r.History()
+
+	// Going back to the first task, as when retrying, makes bob forget the second
+	r.SetHistory(history[:1])
+	if len(r.transcript) != 2 || len(participants["alice"].history) != 1 || len(participants["bob"].history) != 0 {
+		t.Errorf("expected the room to go back to the first task, got %d messages, and %d and %d tasks for alice and bob",
+			len(r.transcript), len(participants["alice"].history), len(participants["bob"].history))
+	}
+
+	// Any other history, as when resuming, is shown to the agents as the messages so far
+	other := []agent.CompletedTask{{Task: "earlier", Response: "**carol**\n\nan answer"}}
+	r.SetHistory(other)
+	if len(participants["alice"].history) != 0 {
+		t.Errorf("expected the agents to forget what they remember, got %d tasks for alice", len(participants["alice"].history))
+	}
+	want := []roomMessage{{Text: "earlier"}, {Text: "**carol**\n\nan answer", Restored: true}}
+	if !slices.Equal(r.transcript, want) {
+		t.Errorf("expected the history as the transcript, got %+v", r.transcript)
+	}
+	if _, err := r.Answer("next"); err != nil {
+		t.Fatal(err)
+	}
+	// Alice and bob answered before, so it is carol's turn
+	answered := participants["carol"].history
+	if len(answered) != 1 || !strings.Contains(answered[0].Task, "User: earlier\n\n**carol**\n\nan answer") {
+		t.Errorf("expected the next agent to be shown the restored history, got %+v", answered)
+	}
+}
+
+func TestIsHistoryPrefix(t *testing.T) {
+	history := []agent.CompletedTask{{Task: "one", Response: "a"}, {Task: "two", Response: "b"}}
+	tests := []struct {
+		name   string
+		prefix []agent.CompletedTask
+		want   bool
+	}{
+		{"empty", nil, true},
+		{"start", history[:1], true},
+		{"whole", history, true},
+		{"different task", []agent.CompletedTask{{Task: "other", Response: "a"}}, false},
+		{"different response", []agent.CompletedTask{{Task: "one", Response: "other"}}, false},
+		{"cancelled", []agent.CompletedTask{{Task: "one", Response: "a", Cancelled: true}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isHistoryPrefix(tt.prefix, history); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
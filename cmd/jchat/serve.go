@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/agentopenai"
+	"github.com/JoshPattman/agent/cmd/jchat/ai"
+	"github.com/JoshPattman/jpf"
+)
+
+// Run the serve subcommand, which serves configured agents over an OpenAI-compatible chat completions API.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	agentNames := fs.String("a", "", "Comma separated names of the agents to serve, each as a model of the same name (default all configured agents)")
+	addr := fs.String("addr", ":8080", "The address to serve on, the API is at /v1/chat/completions")
+	configDir := addConfigDirFlag(fs)
+	keys := fs.String("keys", "", "Comma separated API keys that clients must send as a bearer token (default from the JCHAT_API_KEYS environment variable, or no auth if neither is set)")
+	fs.Parse(args)
+
+	conf, err := loadConfig(*configDir)
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+	for _, w := range conf.Warnings {
+		fmt.Println("Warning:", w)
+	}
+	names := splitList(*agentNames)
+	if len(names) == 0 {
+		for name := range conf.Agents.Agents {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+	apiKeys := splitList(*keys)
+	if len(apiKeys) == 0 {
+		apiKeys = splitList(os.Getenv("JCHAT_API_KEYS"))
+	}
+
+	// All agents share the MCP servers, so each server is only connected to once.
+	usageCounter := jpf.NewUsageCounter()
+	mcpClients := ai.NewMCPClients(conf.MCPServers, conf.Models, usageCounter, conf.LogsPath, conf.Redactor)
+	defer mcpClients.Close()
+	builders := make(map[string]func() agent.Agent)
+	for _, name := range names {
+		loaded, err := conf.createAgentBuilder(name, mcpClients, usageCounter)
+		if err != nil {
+			fmt.Printf("Error loading agent '%s': %v\n", name, err)
+			mcpClients.Close()
+			os.Exit(1)
+		}
+		builders[name] = loaded.Build
+	}
+
+	opts := make([]agentopenai.ServerOpt, 0)
+	if len(apiKeys) > 0 {
+		opts = append(opts, agentopenai.WithAPIKeys(apiKeys...))
+	} else {
+		fmt.Println("Warning: no API keys are set, so anyone who can reach the server can use the agents")
+	}
+	s := agentopenai.NewServer(builders, opts...)
+	fmt.Printf("Serving agents %s on %s, with the API at /v1\n", strings.Join(names, ", "), *addr)
+	err = s.ListenAndServe(*addr)
+	if err != nil {
+		fmt.Println("Error serving:", err)
+		mcpClients.Close()
+		os.Exit(1)
+	}
+}
+
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/JoshPattman/agent/agentmcp"
+)
+
+// Run the serve-mcp subcommand, which serves a configured agent as an MCP server.
+func runServeMCP(args []string) {
+	fs := flag.NewFlagSet("serve-mcp", flag.ExitOnError)
+	agentName := fs.String("a", "", "The name of the agent to serve, matching an agent name from your agent configuration")
+	httpAddr := fs.String("http", "", "If specified, serve over streamable HTTP at this address (such as ':8080') on the /mcp path, instead of over stdio")
+	exposeTools := fs.Bool("tools", false, "If specified, also expose the agent's own tools so clients can call them directly")
+	configDir := addConfigDirFlag(fs)
+	fs.Parse(args)
+
+	// When serving over stdio, stdout belongs to the protocol, so errors must go to stderr.
+	if *agentName == "" {
+		fmt.Fprintln(os.Stderr, "Must specify agent name")
+		os.Exit(1)
+	}
+	loaded, err := loadAndCreateAgentBuilder(*agentName, *configDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		os.Exit(1)
+	}
+	defer loaded.MCPClients.Close()
+	for _, w := range loaded.Config.Warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", w)
+	}
+
+	opts := []agentmcp.ServerOpt{
+		agentmcp.WithServerInfo("jchat-"+*agentName, "1.0.0"),
+	}
+	if *exposeTools {
+		opts = append(opts, agentmcp.WithExposedTools(loaded.Tools...))
+	}
+	s := agentmcp.NewAgentServer(
+		loaded.Build,
+		"ask_"+*agentName,
+		append([]string{fmt.Sprintf("Ask the agent '%s' a question.", *agentName)}, loaded.Summary.Description...),
+		opts...,
+	)
+	if *httpAddr != "" {
+		err = agentmcp.ServeHTTP(s, *httpAddr)
+	} else {
+		err = agentmcp.ServeStdio(s)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error serving MCP:", err)
+		loaded.MCPClients.Close()
+		os.Exit(1)
+	}
+}
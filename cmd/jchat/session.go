@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/agentsession"
+	"github.com/JoshPattman/agent/cmd/jchat/ai"
+	"github.com/JoshPattman/agent/cmd/jchat/attach"
+	"github.com/JoshPattman/jpf"
+)
+
+// Metadata keys used for jchat sessions.
+const (
+	sessionAgentKey        = "agent"
+	sessionTitleKey        = "title"
+	sessionInputTokensKey  = "input_tokens"
+	sessionOutputTokensKey = "output_tokens"
+)
+
+// An agent which saves its history as a session after every answer.
+// Secrets are redacted from the saved session and from errors.
+type sessionAgent struct {
+	agent.StatefulAgent
+	store        *agentsession.FileStore
+	redactor     *ai.Redactor
+	data         agentsession.SessionData
+	usageCounter *jpf.UsageCounter
+	// The value the usage counter would have had if it had counted the whole session.
+	usageBase jpf.Usage
+}
+
+// Start a new session for the agent, which is saved once the agent first answers.
+// Usage is counted from the current value of the usage counter.
+func newSessionAgent(store *agentsession.FileStore, redactor *ai.Redactor, agentName string, a agent.StatefulAgent, usageCounter *jpf.UsageCounter) *sessionAgent {
+	now := time.Now()
+	return &sessionAgent{
+		StatefulAgent: a,
+		store:         store,
+		redactor:      redactor,
+		data: agentsession.SessionData{
+			ID:        newSessionID(now),
+			CreatedAt: now,
+			UpdatedAt: now,
+			Metadata:  map[string]string{sessionAgentKey: agentName},
+		},
+		usageCounter: usageCounter,
+		usageBase:    usageCounter.Get(),
+	}
+}
+
+// Continue a saved session with the agent, restoring its history.
+func resumeSessionAgent(store *agentsession.FileStore, redactor *ai.Redactor, data agentsession.SessionData, a agent.StatefulAgent, usageCounter *jpf.UsageCounter) *sessionAgent {
+	a.SetHistory(data.History)
+	data.History = nil
+	if data.Metadata == nil {
+		data.Metadata = make(map[string]string)
+	}
+	current := usageCounter.Get()
+	saved := sessionUsage(data)
+	return &sessionAgent{
+		StatefulAgent: a,
+		store:         store,
+		redactor:      redactor,
+		data:          data,
+		usageCounter:  usageCounter,
+		usageBase: jpf.Usage{
+			InputTokens:  current.InputTokens - saved.InputTokens,
+			OutputTokens: current.OutputTokens - saved.OutputTokens,
+		},
+	}
+}
+
+// Get the tokens used by the session, as of when it was last saved.
+func sessionUsage(data agentsession.SessionData) jpf.Usage {
+	in, _ := strconv.Atoi(data.Metadata[sessionInputTokensKey])
+	out, _ := strconv.Atoi(data.Metadata[sessionOutputTokensKey])
+	return jpf.Usage{InputTokens: in, OutputTokens: out}
+}
+
+// Get the session as it is now, including its history.
+func (s *sessionAgent) Session() agentsession.SessionData {
+	data := s.data
+	data.Metadata = maps.Clone(s.data.Metadata)
+	data.History = s.History()
+	return data
+}
+
+// Answer implements agent.Agent.
+func (s *sessionAgent) Answer(query string) (string, error) {
+	return s.AnswerContext(context.Background(), query)
+}
+
+// AnswerContext implements agent.ContextAgent.
+// The session is saved even if the answer fails or is cancelled, so that the steps taken are kept.
+func (s *sessionAgent) AnswerContext(ctx context.Context, query string) (string, error) {
+	if s.data.Metadata[sessionTitleKey] == "" {
+		s.data.Metadata[sessionTitleKey], _ = attach.Split(query)
+	}
+	answer, err := agent.AnswerWithContext(ctx, s.StatefulAgent, query)
+	saveErr := s.save()
+	if err != nil {
+		return "", s.redactor.RedactError(err)
+	}
+	if saveErr != nil {
+		return "", fmt.Errorf("answered but could not save session: %w\n\n%s", saveErr, answer)
+	}
+	return answer, nil
+}
+
+// Get the tokens used by the session so far.
+func (s *sessionAgent) usage() jpf.Usage {
+	usage := s.usageCounter.Get()
+	return jpf.Usage{
+		InputTokens:  usage.InputTokens - s.usageBase.InputTokens,
+		OutputTokens: usage.OutputTokens - s.usageBase.OutputTokens,
+	}
+}
+
+func (s *sessionAgent) save() error {
+	usage := s.usage()
+	s.data.Metadata[sessionInputTokensKey] = strconv.Itoa(usage.InputTokens)
+	s.data.Metadata[sessionOutputTokensKey] = strconv.Itoa(usage.OutputTokens)
+	s.data.UpdatedAt = time.Now()
+	return s.store.Save(redactSession(s.redactor, s.Session()))
+}
+
+// Copy the session with any secrets redacted from its history.
+func redactSession(r *ai.Redactor, data agentsession.SessionData) agentsession.SessionData {
+	data.Metadata = maps.Clone(data.Metadata)
+	if title, ok := data.Metadata[sessionTitleKey]; ok {
+		data.Metadata[sessionTitleKey] = r.Redact(title)
+	}
+	history := make([]agent.CompletedTask, len(data.History))
+	for i, task := range data.History {
+		steps := make([]agent.Step, len(task.Steps))
+		for j, step := range task.Steps {
+			aos := make([]agent.ActionObservation, len(step.ActionObservations))
+			for k, ao := range step.ActionObservations {
+				aos[k] = redactActionObservation(r, ao)
+			}
+			steps[j] = agent.Step{Reasoning: r.Redact(step.Reasoning), ActionObservations: aos}
+		}
+		task.Task = r.Redact(task.Task)
+		task.Response = r.Redact(task.Response)
+		task.Steps = steps
+		history[i] = task
+	}
+	data.History = history
+	return data
+}
+
+func redactActionObservation(r *ai.Redactor, ao agent.ActionObservation) agent.ActionObservation {
+	args := make([]agent.ActionArg, len(ao.Action.Args))
+	for i, arg := range ao.Action.Args {
+		args[i] = agent.ActionArg{ArgName: arg.ArgName, ArgData: redactAny(r, arg.ArgData)}
+	}
+	ao.Action.Args = args
+	resources := make([]agent.ResourceReference, len(ao.Observation.Resources))
+	for i, res := range ao.Observation.Resources {
+		res.URI = r.Redact(res.URI)
+		res.Name = r.Redact(res.Name)
+		res.Description = r.Redact(res.Description)
+		resources[i] = res
+	}
+	ao.Observation.Resources = resources
+	ao.Observation.Observed = r.Redact(ao.Observation.Observed)
+	return ao
+}
+
+// Redact the strings in a value decoded from JSON, such as the arguments of a tool call.
+func redactAny(r *ai.Redactor, v any) any {
+	switch v := v.(type) {
+	case string:
+		return r.Redact(v)
+	case []any:
+		redacted := make([]any, len(v))
+		for i, x := range v {
+			redacted[i] = redactAny(r, x)
+		}
+		return redacted
+	case map[string]any:
+		redacted := make(map[string]any, len(v))
+		for k, x := range v {
+			redacted[k] = redactAny(r, x)
+		}
+		return redacted
+	default:
+		return v
+	}
+}
+
+// Session IDs start with the time so they sort in the order they were created.
+func newSessionID(t time.Time) string {
+	bs := make([]byte, 3)
+	rand.Read(bs)
+	return fmt.Sprintf("%s-%s", t.Format("20060102-150405"), hex.EncodeToString(bs))
+}
+
+func openSessionStore() (*agentsession.FileStore, error) {
+	dataPath, err := getDataPath()
+	if err != nil {
+		return nil, err
+	}
+	return agentsession.NewFileStore(filepath.Join(dataPath, "sessions"))
+}
+
+// Run the sessions subcommand, which lists, deletes or renames saved sessions.
+func runSessions(args []string) {
+	fs := flag.NewFlagSet("sessions", flag.ExitOnError)
+	deleteID := fs.String("delete", "", "Delete the session with this ID")
+	renameID := fs.String("rename", "", "Rename the session with this ID to the title given by -title")
+	title := fs.String("title", "", "The new title of the session to rename")
+	exportID := fs.String("export", "", "Export the transcript of the session with this ID")
+	exportFormat := fs.String("format", "", "The format to export in, one of markdown, html or json (default from the extension of -o, or markdown)")
+	exportPath := fs.String("o", "", "The file to export to (default stdout)")
+	configDir := addConfigDirFlag(fs)
+	fs.Parse(args)
+
+	store, err := openSessionStore()
+	if err != nil {
+		fmt.Println("Error opening sessions:", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case *deleteID != "":
+		_, err = store.Load(*deleteID)
+		if err == nil {
+			err = store.Delete(*deleteID)
+		}
+	case *renameID != "":
+		err = renameSession(store, *renameID, *title)
+	case *exportID != "":
+		err = exportSession(store, *exportID, *exportFormat, *exportPath, loadRedactorForExport(*configDir))
+	default:
+		err = listSessions(store)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+func renameSession(store *agentsession.FileStore, id, title string) error {
+	if title == "" {
+		return errors.New("must specify the new title with -title")
+	}
+	data, err := store.Load(id)
+	if err != nil {
+		return err
+	}
+	if data.Metadata == nil {
+		data.Metadata = make(map[string]string)
+	}
+	data.Metadata[sessionTitleKey] = title
+	return store.Save(data)
+}
+
+// Get a redactor for the secrets in the config, so that sessions saved before a secret was added to the config are still redacted when exported.
+// If the config cannot be loaded, the session is exported without further redaction.
+func loadRedactorForExport(configDir string) *ai.Redactor {
+	conf, err := loadConfig(configDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: could not load config, so secrets in it will not be redacted:", err)
+		return nil
+	}
+	return conf.Redactor
+}
+
+func exportSession(store *agentsession.FileStore, id, format, path string, redactor *ai.Redactor) error {
+	data, err := store.Load(id)
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		format = exportFormatForFile(path)
+	}
+	if path == "" {
+		return exportTranscript(os.Stdout, data, format, redactor)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return exportTranscript(f, data, format, redactor)
+}
+
+// Export the transcript of the session into the exports folder of the data directory, returning the path of the file.
+func exportSessionToDataDir(data agentsession.SessionData, format string, redactor *ai.Redactor) (string, error) {
+	dataPath, err := getDataPath()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(dataPath, "exports")
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, data.ID+exportFormats[format])
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return path, exportTranscript(f, data, format, redactor)
+}
+
+func listSessions(store *agentsession.FileStore) error {
+	sessions, err := store.List()
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		fmt.Println("There are no saved sessions")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tAGENT\tUPDATED\tTITLE")
+	for _, s := range sessions {
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\n",
+			s.ID,
+			s.Metadata[sessionAgentKey],
+			s.UpdatedAt.Local().Format("2006-01-02 15:04"),
+			truncateTitle(s.Metadata[sessionTitleKey], 60),
+		)
+	}
+	return w.Flush()
+}
+
+func truncateTitle(title string, n int) string {
+	title = strings.Join(strings.Fields(title), " ")
+	runes := []rune(title)
+	if len(runes) <= n {
+		return title
+	}
+	return string(runes[:n-3]) + "..."
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The file in the data directory which records the project configs that the user has trusted,
+// with a hash of their files when they were trusted, so that changed config must be trusted again.
+const trustedProjectsFile = "trusted_projects.json"
+
+// Tells the user how to let an untrusted project config do what it was stopped from doing.
+const untrustedProjectHint = "review the project config, then run 'jchat trust' in the project to trust it"
+
+func runTrust(args []string) {
+	fs := flag.NewFlagSet("trust", flag.ExitOnError)
+	revoke := fs.Bool("revoke", false, "Stop trusting the project config")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: jchat trust [flags]")
+		fmt.Fprintln(fs.Output(), "\nTrust the project config in the nearest .jchat directory (in the working directory or a parent), like 'direnv allow'.")
+		fmt.Fprintln(fs.Output(), "Until it is trusted, a project config may not launch MCP servers or custom commands, let agents run commands,")
+		fmt.Fprintln(fs.Output(), "reference secrets with ${ENV_VAR} or file:, or replace entries of the user config.")
+		fmt.Fprintln(fs.Output(), "If any of its files change, it must be trusted again.")
+		fmt.Fprintln(fs.Output(), "")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	projectDir, err := findProjectConfigDir()
+	if err == nil && projectDir == "" {
+		err = fmt.Errorf("no %s directory was found in the working directory or its parents", projectConfigDirName)
+	}
+	if err == nil {
+		if *revoke {
+			err = revokeProjectTrust(projectDir)
+		} else {
+			err = trustProject(projectDir)
+		}
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+// Trust the project config as its files are now, after describing the commands it will be able to run.
+func trustProject(projectDir string) error {
+	conf, err := loadConfigLayer(configLayer{dir: projectDir})
+	if err != nil {
+		return err
+	}
+	hash, err := hashProjectConfig(projectDir)
+	if err != nil {
+		return err
+	}
+	trusted, err := loadTrustedProjects()
+	if err != nil {
+		return err
+	}
+	trusted[projectDir] = hash
+	if err := saveTrustedProjects(trusted); err != nil {
+		return err
+	}
+	fmt.Println("Trusted the project config in", projectDir)
+	if commands := describeProjectCommands(conf); len(commands) > 0 {
+		fmt.Println("It may run these commands:")
+		for _, c := range commands {
+			fmt.Println(" -", c)
+		}
+	}
+	fmt.Println("If any of its files change, run 'jchat trust' again to trust the new config.")
+	return nil
+}
+
+func revokeProjectTrust(projectDir string) error {
+	trusted, err := loadTrustedProjects()
+	if err != nil {
+		return err
+	}
+	delete(trusted, projectDir)
+	if err := saveTrustedProjects(trusted); err != nil {
+		return err
+	}
+	fmt.Println("The project config in", projectDir, "is no longer trusted")
+	return nil
+}
+
+// Whether the project config has been trusted, and has not changed since.
+func isProjectTrusted(projectDir string) (bool, error) {
+	trusted, err := loadTrustedProjects()
+	if err != nil {
+		return false, err
+	}
+	trustedHash, ok := trusted[projectDir]
+	if !ok {
+		return false, nil
+	}
+	hash, err := hashProjectConfig(projectDir)
+	if err != nil {
+		return false, err
+	}
+	return hash == trustedHash, nil
+}
+
+// Hash the contents of each config file of the project, so that any change to them can be detected.
+func hashProjectConfig(projectDir string) (string, error) {
+	h := sha256.New()
+	for _, name := range []string{modelsFile, agentsFile, mcpFile, commandsFile} {
+		bs, err := os.ReadFile(filepath.Join(projectDir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(h, "%s missing\n", name)
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d\n", name, len(bs))
+		h.Write(bs)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Load the trusted project config directories, and the hash of their files when they were trusted.
+func loadTrustedProjects() (map[string]string, error) {
+	dataPath, err := getDataPath()
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := loadJSONFile[map[string]string](filepath.Join(dataPath, trustedProjectsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]string), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load trusted projects: %w", err)
+	}
+	if trusted == nil {
+		trusted = make(map[string]string)
+	}
+	return trusted, nil
+}
+
+func saveTrustedProjects(trusted map[string]string) error {
+	dataPath, err := getDataPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataPath, os.ModePerm); err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(trusted, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dataPath, trustedProjectsFile), bs, 0600)
+}
+
+// Find what an untrusted project config does that it may not, given the config of the layers it is layered over.
+// Untrusted config may not launch commands, have agents that can run commands (whether by extending an agent, or using the commands
+// and MCP servers of the layers below), or replace entries below it (which could, for example, point a model the user relies on at another url).
+// References to secrets are checked when the config is resolved.
+func untrustedProjectProblems(under, project jchatConfig) []string {
+	problems := make([]string, 0)
+	for _, name := range slices.Sorted(maps.Keys(project.MCPServers.MCPServers)) {
+		if project.MCPServers.MCPServers[name].Command != "" {
+			problems = append(problems, fmt.Sprintf("mcp server '%s' may not launch a command", name))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(project.Commands.Commands)) {
+		problems = append(problems, fmt.Sprintf("custom command '%s' may not be defined", name))
+	}
+	merged := under.merge(project)
+	// Agents that cannot be resolved are left as they are, and the error is reported when the config is loaded
+	merged.Agents, _ = merged.Agents.ResolveExtends()
+	for _, name := range slices.Sorted(maps.Keys(project.Agents.Agents)) {
+		if reason := agentCommandsReason(merged, name, make(map[string]bool)); reason != "" {
+			problems = append(problems, fmt.Sprintf("agent '%s' may not run commands (it %s)", name, reason))
+		}
+	}
+	problems = append(problems, replacedEntries("model", under.Models.Models, project.Models.Models)...)
+	problems = append(problems, replacedEntries("agent", under.Agents.Agents, project.Agents.Agents)...)
+	problems = append(problems, replacedEntries("mcp server", under.MCPServers.MCPServers, project.MCPServers.MCPServers)...)
+	problems = append(problems, replacedEntries("custom command", under.Commands.Commands, project.Commands.Commands)...)
+	return problems
+}
+
+// Describe how the resolved agent can run commands, such as "uses custom command 'build'", or return "" if it cannot.
+// Sub agents are followed, skipping those already seen so that cycles end.
+func agentCommandsReason(conf jchatConfig, name string, seen map[string]bool) string {
+	agentConf, ok := conf.Agents.Agents[name]
+	if !ok || seen[name] {
+		return ""
+	}
+	seen[name] = true
+	if agentConf.RunCommands {
+		return "has run_commands set"
+	}
+	for _, command := range agentConf.CustomCommands {
+		if _, ok := conf.Commands.Commands[command]; ok {
+			return fmt.Sprintf("uses custom command '%s'", command)
+		}
+	}
+	servers := slices.Concat(agentConf.MCPServers, slices.Sorted(maps.Keys(agentConf.MCPResources)))
+	for _, server := range servers {
+		if conf.MCPServers.MCPServers[server].Command != "" {
+			return fmt.Sprintf("uses mcp server '%s', which launches a command", server)
+		}
+	}
+	for _, sub := range agentConf.SubAgents {
+		if agentCommandsReason(conf, sub, seen) != "" {
+			return fmt.Sprintf("has sub agent '%s', which can run commands", sub)
+		}
+	}
+	return ""
+}
+
+func replacedEntries[T any](kind string, under, project map[string]T) []string {
+	problems := make([]string, 0)
+	for _, name := range slices.Sorted(maps.Keys(project)) {
+		if _, ok := under[name]; ok {
+			problems = append(problems, fmt.Sprintf("%s '%s' may not replace the user's %s of the same name", kind, name, kind))
+		}
+	}
+	return problems
+}
+
+// Describe the commands that the project config launches, so the user can review them before trusting it.
+func describeProjectCommands(conf jchatConfig) []string {
+	commands := make([]string, 0)
+	for _, name := range slices.Sorted(maps.Keys(conf.MCPServers.MCPServers)) {
+		server := conf.MCPServers.MCPServers[name]
+		if server.Command != "" {
+			commands = append(commands, fmt.Sprintf("mcp server '%s': %s", name, strings.Join(append([]string{server.Command}, server.Args...), " ")))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(conf.Commands.Commands)) {
+		command := conf.Commands.Commands[name]
+		commands = append(commands, fmt.Sprintf("custom command '%s': %s", name, strings.Join(append([]string{command.Command}, command.Args...), " ")))
+	}
+	for _, name := range slices.Sorted(maps.Keys(conf.Agents.Agents)) {
+		if conf.Agents.Agents[name].RunCommands {
+			commands = append(commands, fmt.Sprintf("agent '%s': any command the agent chooses to run", name))
+		}
+	}
+	return commands
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/JoshPattman/agent/cmd/jchat/ai"
+)
+
+func TestUntrustedProjectProblems(t *testing.T) {
+	user := jchatConfig{
+		Models: ai.ModelsConfig{Models: map[string]ai.ModelConfig{"default_model": {}}},
+		Agents: ai.AgentsConfig{Agents: map[string]ai.AgentConfig{
+			"runner":     {RunCommands: true},
+			"reader":     {ViewFiles: true},
+			"uses_stdio": {MCPServers: []string{"local"}},
+		}},
+		MCPServers: ai.MCPServersConfig{MCPServers: map[string]ai.MCPServerConfig{
+			"local":  {Command: "local-server"},
+			"remote": {Addr: "https://example.com/mcp"},
+		}},
+		Commands: ai.CustomCommandsConfig{Commands: map[string]ai.CustomCommandConfig{
+			"build": {Command: "make"},
+		}},
+	}
+	tests := []struct {
+		name    string
+		project jchatConfig
+		// Substrings of the problems expected, or none if the project needs no trust
+		want []string
+	}{
+		{
+			name: "harmless agent",
+			project: jchatConfig{Agents: ai.AgentsConfig{Agents: map[string]ai.AgentConfig{
+				"helper": {Extends: "reader", MCPServers: []string{"remote"}, CustomCommands: []string{"missing"}},
+			}}},
+		},
+		{
+			name: "runs commands",
+			project: jchatConfig{Agents: ai.AgentsConfig{Agents: map[string]ai.AgentConfig{
+				"helper": {RunCommands: true},
+			}}},
+			want: []string{"agent 'helper' may not run commands (it has run_commands set)"},
+		},
+		{
+			name: "extends an agent that runs commands",
+			project: jchatConfig{Agents: ai.AgentsConfig{Agents: map[string]ai.AgentConfig{
+				"helper": {Extends: "runner"},
+			}}},
+			want: []string{"agent 'helper' may not run commands (it has run_commands set)"},
+		},
+		{
+			name: "extends through another project agent",
+			project: jchatConfig{Agents: ai.AgentsConfig{Agents: map[string]ai.AgentConfig{
+				"middle": {Extends: "uses_stdio"},
+				"helper": {Extends: "middle"},
+			}}},
+			want: []string{
+				"agent 'helper' may not run commands (it uses mcp server 'local', which launches a command)",
+				"agent 'middle' may not run commands (it uses mcp server 'local', which launches a command)",
+			},
+		},
+		{
+			name: "uses a user custom command",
+			project: jchatConfig{Agents: ai.AgentsConfig{Agents: map[string]ai.AgentConfig{
+				"helper": {CustomCommands: []string{"build"}},
+			}}},
+			want: []string{"agent 'helper' may not run commands (it uses custom command 'build')"},
+		},
+		{
+			name: "reads resources of a stdio server",
+			project: jchatConfig{Agents: ai.AgentsConfig{Agents: map[string]ai.AgentConfig{
+				"helper": {MCPResources: map[string][]string{"local": {"file:///notes"}}},
+			}}},
+			want: []string{"agent 'helper' may not run commands (it uses mcp server 'local', which launches a command)"},
+		},
+		{
+			name: "has a sub agent that runs commands",
+			project: jchatConfig{Agents: ai.AgentsConfig{Agents: map[string]ai.AgentConfig{
+				"helper": {SubAgents: []string{"reader", "runner"}},
+				"loop":   {SubAgents: []string{"loop"}},
+			}}},
+			want: []string{"agent 'helper' may not run commands (it has sub agent 'runner', which can run commands)"},
+		},
+		{
+			name: "launches commands itself",
+			project: jchatConfig{
+				MCPServers: ai.MCPServersConfig{MCPServers: map[string]ai.MCPServerConfig{"tools": {Command: "tools-server"}}},
+				Commands:   ai.CustomCommandsConfig{Commands: map[string]ai.CustomCommandConfig{"deploy": {Command: "deploy"}}},
+			},
+			want: []string{"mcp server 'tools' may not launch a command", "custom command 'deploy' may not be defined"},
+		},
+		{
+			name: "replaces user entries",
+			project: jchatConfig{
+				Models: ai.ModelsConfig{Models: map[string]ai.ModelConfig{"default_model": {}}},
+				Agents: ai.AgentsConfig{Agents: map[string]ai.AgentConfig{"reader": {}}},
+			},
+			want: []string{"model 'default_model' may not replace", "agent 'reader' may not replace"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := untrustedProjectProblems(user, tt.project)
+			if len(problems) != len(tt.want) {
+				t.Fatalf("expected %d problems, got %q", len(tt.want), problems)
+			}
+			for _, want := range tt.want {
+				found := false
+				for _, problem := range problems {
+					found = found || strings.Contains(problem, want)
+				}
+				if !found {
+					t.Errorf("expected a problem containing %q, got %q", want, problems)
+				}
+			}
+		})
+	}
+}
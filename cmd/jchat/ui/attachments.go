@@ -0,0 +1,56 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/JoshPattman/agent/cmd/jchat/attach"
+)
+
+// The most completions suggested for an @path reference, so that completing in a large directory stays quick.
+const maxPathCompletions = 50
+
+// Complete an @path reference at the end of the text to the files and directories it could refer to.
+func completeAttachmentPath(text string) []string {
+	start := strings.LastIndexAny(text, " \t\n") + 1
+	partial, ok := strings.CutPrefix(text[start:], "@")
+	if !ok {
+		return nil
+	}
+	dir, prefix := filepath.Split(partial)
+	listDir := dir
+	if listDir == "" {
+		listDir = "."
+	}
+	entries, err := os.ReadDir(attach.ExpandHome(listDir))
+	if err != nil {
+		return nil
+	}
+	completions := make([]string, 0)
+	for _, e := range entries {
+		name := e.Name()
+		// Only suggest hidden files once a dot has been typed
+		if !strings.HasPrefix(name, prefix) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(prefix, ".")) {
+			continue
+		}
+		if e.IsDir() {
+			name += "/"
+		}
+		completions = append(completions, text[:start]+"@"+dir+name)
+		if len(completions) >= maxPathCompletions {
+			break
+		}
+	}
+	return completions
+}
+
+// Describe the attachments of a message, in the same way as the tools called in a step.
+func formatAttachments(attachments []attach.Attachment) string {
+	lines := make([]string, len(attachments))
+	for i, a := range attachments {
+		lines[i] = fmt.Sprintf("  └▶ %s", a.Describe())
+	}
+	return fmt.Sprintf("%s\n%s", "Attached", strings.Join(lines, "\n"))
+}
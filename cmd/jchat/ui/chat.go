@@ -10,8 +10,9 @@ import (
 
 func NewChat() tea.Model {
 	return chat{
-		height: 10,
-		width:  10,
+		height:   10,
+		width:    10,
+		markdown: newMarkdownRenderer(),
 	}
 }
 
@@ -22,6 +23,12 @@ type chat struct {
 	scrollOffset            int
 	info                    string
 	lastMessageWasReasoning bool
+	inspecting              bool
+	// The index of the message selected in the inspector.
+	selected int
+	markdown *markdownRenderer
+	// Whether answers are shown as the Markdown they were written in, rather than rendered.
+	raw bool
 }
 
 func (m chat) Init() tea.Cmd {
@@ -35,7 +42,51 @@ func (m chat) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, nil
 	case ResetMessages:
 		m.messages = make([]tea.Model, 0)
+		m.lastMessageWasReasoning = false
+		m.inspecting = false
 		return m, nil
+	case SetInspectorFocus:
+		if msg.Focused == m.inspecting {
+			return m, nil
+		}
+		if msg.Focused {
+			// Start at the most recent step
+			m.selected = len(m.messages)
+			m.selectNextStep(-1)
+			if m.selected < 0 {
+				return m, func() tea.Msg { return InspectorFocusChanged{false} }
+			}
+		}
+		m.inspecting = msg.Focused
+		m.setSelected(msg.Focused)
+		if !msg.Focused {
+			m.scrollOffset = 0
+		}
+		return m, func() tea.Msg { return InspectorFocusChanged{msg.Focused} }
+	case MoveInspectorSelection:
+		if !m.inspecting {
+			return m, nil
+		}
+		m.setSelected(false)
+		previous := m.selected
+		m.selectNextStep(msg.Delta)
+		if m.selected < 0 {
+			m.selected = previous
+		}
+		m.setSelected(true)
+		return m, nil
+	case ToggleInspectorExpanded:
+		if !m.inspecting {
+			return m, nil
+		}
+		item := m.messages[m.selected].(Message)
+		item.expanded = !item.expanded
+		m.messages[m.selected] = item
+		m.scrollToSelected()
+		return m, nil
+	case AddStepMessage:
+		step := msg.Step
+		return m.addMessage(m.newMessage(CRAIGReasoningMessage, msg.Content, &step, false)), nil
 	case ScrollMessage:
 		m.scrollOffset += msg.Delta
 		m.scrollOffset = max(m.scrollOffset, 0)
@@ -50,6 +101,13 @@ func (m chat) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case SetHeight:
 		m.height = msg.Height
 		return m, nil
+	case ToggleRawMarkdown:
+		m.raw = !m.raw
+		for i := range m.messages {
+			newMessage, _ := m.messages[i].Update(SetRawMarkdown{m.raw})
+			m.messages[i] = newMessage
+		}
+		return m, nil
 	case AddMessage:
 		if msg.Type == CRAIGPartialMessage {
 			if m.lastMessageWasReasoning {
@@ -60,27 +118,11 @@ func (m chat) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, nil
 			} else {
 				m.lastMessageWasReasoning = true
-				newMessage := Message{
-					CRAIGMessage,
-					msg.Content,
-					m.width,
-				}
-				m.messages = append(m.messages, newMessage)
+				m.messages = append(m.messages, m.newMessage(CRAIGMessage, msg.Content, nil, true))
 				return m, nil
 			}
 		} else {
-			if m.lastMessageWasReasoning {
-				m.lastMessageWasReasoning = false
-				m.messages = m.messages[:len(m.messages)-1]
-			}
-			newMessage := Message{
-				msg.Type,
-				msg.Content,
-				m.width,
-			}
-			m.messages = append(m.messages, newMessage)
-			m.lastMessageWasReasoning = false
-			return m, nil
+			return m.addMessage(m.newMessage(msg.Type, msg.Content, nil, false)), nil
 		}
 	case SetChatInfoMessage:
 		m.info = msg.Message
@@ -90,18 +132,95 @@ func (m chat) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	}
 }
 
+func (m chat) newMessage(msgType MessageType, content string, step *StepDetails, streaming bool) Message {
+	return Message{
+		msgType:   msgType,
+		content:   content,
+		width:     m.width,
+		step:      step,
+		markdown:  m.markdown,
+		raw:       m.raw,
+		streaming: streaming,
+	}.renderMarkdown()
+}
+
+// Add a finished message, replacing the message being streamed if there is one.
+func (m chat) addMessage(newMessage Message) chat {
+	if m.lastMessageWasReasoning {
+		m.lastMessageWasReasoning = false
+		m.messages = m.messages[:len(m.messages)-1]
+	}
+	m.messages = append(m.messages, newMessage)
+	return m
+}
+
+// Move the selection to the next message with a step in the direction of delta, setting it to -1 if there are none.
+func (m *chat) selectNextStep(delta int) {
+	step := 1
+	if delta < 0 {
+		step = -1
+	}
+	for i := m.selected + step; i >= 0 && i < len(m.messages); i += step {
+		if item, ok := m.messages[i].(Message); ok && item.step != nil {
+			m.selected = i
+			return
+		}
+	}
+	m.selected = -1
+}
+
+func (m *chat) setSelected(selected bool) {
+	if m.selected < 0 || m.selected >= len(m.messages) {
+		return
+	}
+	item := m.messages[m.selected].(Message)
+	item.selected = selected
+	m.messages[m.selected] = item
+	if selected {
+		m.scrollToSelected()
+	}
+}
+
+// Scroll so that the selected message is visible, showing its top if it is taller than the chat.
+func (m *chat) scrollToSelected() {
+	start, total := 0, 0
+	var end int
+	for i, msg := range m.messages {
+		lines := strings.Count(msg.View(), "\n") + 1
+		if i == m.selected {
+			start, end = total, total+lines
+		}
+		total += lines
+	}
+	height := m.height
+	if m.info != "" || m.inspecting {
+		height--
+	}
+	if end > total-m.scrollOffset {
+		m.scrollOffset = total - end
+	}
+	if start < total-m.scrollOffset-height {
+		m.scrollOffset = total - start - height
+	}
+	m.scrollOffset = max(m.scrollOffset, 0)
+}
+
 func (m chat) View() string {
 	renderedMessages := make([]string, len(m.messages))
 	for i, msg := range m.messages {
 		renderedMessages[i] = msg.View()
 	}
 	fullContent := lipgloss.JoinVertical(lipgloss.Left, renderedMessages...)
-	if m.info == "" {
+	info := m.info
+	if info == "" && m.inspecting {
+		info = "↑/↓: select step, enter: expand or collapse, esc: stop inspecting"
+	}
+	if info == "" {
 		fullContent = truncateHeightWithOffset(fullContent, m.height, m.scrollOffset)
 	} else {
 		fullContent = truncateHeightWithOffset(fullContent, m.height-1, m.scrollOffset)
 		style := lipgloss.NewStyle().Foreground(lipgloss.Color("240"))
-		fullContent = fmt.Sprintf("%s\n %s", fullContent, style.Render(m.info))
+		fullContent = fmt.Sprintf("%s\n %s", fullContent, style.Render(info))
 	}
 	style := lipgloss.NewStyle().Height(m.height).AlignVertical(lipgloss.Bottom)
 	return style.Render(fullContent)
@@ -19,6 +19,17 @@ type Message struct {
 	msgType MessageType
 	content string
 	width   int
+	// The step the message describes, which can be expanded, or nil if the message is not for a step.
+	step     *StepDetails
+	expanded bool
+	selected bool
+	// Renders answers as Markdown, or nil to show them as they were written.
+	markdown *markdownRenderer
+	// Whether to show the Markdown the answer was written in, rather than rendering it.
+	raw bool
+	// Whether the answer is still being streamed in, so it is rendered a block at a time.
+	streaming bool
+	rendered  markdownRender
 }
 
 func (m Message) Init() tea.Cmd {
@@ -29,10 +40,13 @@ func (m Message) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case SetWidth:
 		m.width = msg.Width
-		return m, nil
+		return m.renderMarkdown(), nil
 	case AppendMessageText:
 		m.content += msg.ExtraText
-		return m, nil
+		return m.renderMarkdown(), nil
+	case SetRawMarkdown:
+		m.raw = msg.Raw
+		return m.renderMarkdown(), nil
 	default:
 		return m, nil
 	}
@@ -65,10 +79,41 @@ func (c Message) View() string {
 		style = style.
 			Border(lipgloss.DoubleBorder(), false, false, false, true).
 			BorderForeground(borderColor)
+	} else if c.selected {
+		style = style.
+			Border(lipgloss.ThickBorder(), false, false, false, true).
+			BorderForeground(lipgloss.Color("5"))
+	}
+	text := c.content
+	if c.rendered.rendered != "" {
+		text = c.rendered.rendered
+	}
+	if c.step != nil && c.expanded {
+		text += "\n" + formatStepDetails(*c.step)
+	} else if c.selected {
+		text += "  (enter to expand)"
 	}
-	content := style.Render(c.content)
+	content := style.Render(text)
 	if c.msgType == UserMessage {
 		content = "\n" + content
 	}
 	return content
 }
+
+// Render the content of an answer as Markdown, if it is shown rendered.
+// This is done as the message changes rather than in View, as rendering is too slow to do on every frame.
+func (m Message) renderMarkdown() Message {
+	if m.msgType != CRAIGMessage || m.markdown == nil || m.raw {
+		m.rendered = markdownRender{}
+		return m
+	}
+	// The width left inside the border and padding
+	width := m.width - 3
+	if m.streaming {
+		m.rendered = m.markdown.update(m.rendered, m.content, width)
+	} else {
+		rendered, _ := m.markdown.render(m.content, width)
+		m.rendered = markdownRender{width: width, rendered: rendered}
+	}
+	return m
+}
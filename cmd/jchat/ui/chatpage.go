@@ -1,11 +1,13 @@
 package ui
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/JoshPattman/agent"
+	"github.com/JoshPattman/agent/cmd/jchat/attach"
 	"github.com/JoshPattman/agent/craig"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -17,6 +19,14 @@ type AgentSummary struct {
 	NumMCP       int
 	NumSubAgents int
 	ModelName    string
+	// The agents taking part, if this is a room of several agents, who can be addressed with @name.
+	Participants []ParticipantSummary
+}
+
+// An agent taking part in a room.
+type ParticipantSummary struct {
+	Name      string
+	ModelName string
 }
 
 func NewChatPage(buildAgent func() (agent.Agent, error), summary AgentSummary) tea.Model {
@@ -33,12 +43,24 @@ func NewChatPage(buildAgent func() (agent.Agent, error), summary AgentSummary) t
 		NewSummary(summary),
 		false,
 		make(chan string),
+		"",
+		nil,
+		newSlashCommands(),
+		"",
+		false,
+		&stepTimer{},
+		false,
+		nil,
+		false,
+		nil,
+		participantNames(summary),
 	}
 	cp.textInput, _ = cp.textInput.Update(SetTextboxCompleteMessage{
 		func(s string) tea.Msg {
 			return UserMessageSend{s}
 		},
 	})
+	cp.textInput, _ = cp.textInput.Update(SetTextboxCompletions{completeInput(cp.commands, cp.participants)})
 	return cp
 }
 
@@ -54,6 +76,20 @@ type chatPage struct {
 	summary             tea.Model
 	awaitingResponse    bool
 	streamChunkReady    chan string
+	toolProgress        string
+	export              func(agent.Agent) (string, error)
+	commands            *slashCommands
+	lastUserMessage     string
+	lastAnswerFailed    bool
+	steps               *stepTimer
+	inspecting          bool
+	// Cancels the answer being generated, or nil if the agent is not answering.
+	cancelAnswer context.CancelFunc
+	cancelling   bool
+	// Warnings to show once the first agent has been built.
+	warnings []string
+	// The names of the agents in the room, which are addressed with @name rather than attached as files.
+	participants []string
 }
 
 func (m chatPage) Init() tea.Cmd {
@@ -75,9 +111,14 @@ func (m chatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		if !m.awaitingResponse {
 			return m, nil
 		} else {
-			m.chat, _ = m.chat.Update(SetChatInfoMessage{
-				fmt.Sprintf("Thinking%s", strings.Repeat(".", msg.N)),
-			})
+			info := fmt.Sprintf("Thinking%s", strings.Repeat(".", msg.N))
+			if m.cancelling {
+				info = fmt.Sprintf("Cancelling%s", strings.Repeat(".", msg.N))
+			}
+			if m.toolProgress != "" {
+				info = fmt.Sprintf("%-11s%s", info, m.toolProgress)
+			}
+			m.chat, _ = m.chat.Update(SetChatInfoMessage{info})
 			return m, func() tea.Msg {
 				time.Sleep(time.Second / 4)
 				return SetThinkingNumDots{(msg.N + 1) % 4}
@@ -96,13 +137,38 @@ func (m chatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.summary, _ = m.summary.Update(SetHeight{m.height})
 		return m, nil
 	case UserMessageSend:
+		if name, arg, ok := parseSlashCommand(msg.Message); ok {
+			return m.runCommand(name, arg)
+		}
+		msg.Message = strings.TrimPrefix(msg.Message, "/")
+		query, attachments, err := attach.Files(msg.Message, m.participants)
+		if err != nil {
+			// Give the message back so it can be fixed rather than typed again
+			m.chat, _ = m.chat.Update(AddMessage{ErrorMessage, fmt.Sprintf("Message not sent, %v", err)})
+			m.textInput, _ = m.textInput.Update(SetTextboxText{msg.Message})
+			return m, nil
+		}
+		m.lastUserMessage = msg.Message
+		m.lastAnswerFailed = false
 		m.chat, _ = m.chat.Update(AddMessage{UserMessage, msg.Message})
+		if len(attachments) > 0 {
+			m.chat, _ = m.chat.Update(AddMessage{CRAIGReasoningMessage, formatAttachments(attachments)})
+		}
 		m.textInput, _ = m.textInput.Update(EnableMessage{false})
 		*m.lastUserMessageTime = time.Now()
 		m.awaitingResponse = true
+		m.toolProgress = ""
 		activeAgent := m.activeAgent
+		steps := m.steps
+		ctx, cancel := context.WithCancel(context.Background())
+		m.cancelAnswer = cancel
+		m.cancelling = false
 		cmd := func() tea.Msg {
-			result, err := activeAgent.Answer(msg.Message)
+			steps.begin()
+			result, err := agent.AnswerWithContext(ctx, activeAgent, query)
+			if err != nil && ctx.Err() != nil {
+				return AICancelledSend{}
+			}
 			if err != nil {
 				return AIErrorSend{err}
 			}
@@ -120,32 +186,41 @@ func (m chatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		m.chat, _ = m.chat.Update(AddMessage{CRAIGMessage, msg.Message})
 		m.textInput, _ = m.textInput.Update(EnableMessage{true})
+		m = m.answerFinished()
 		return m, nil
 	case AIReasoningSend:
 		var text string
-		if len(msg.ToolCalls) > 0 {
-			toolCalls := make([]string, len(msg.ToolCalls))
-			for i := range msg.ToolCalls {
-				toolCalls[i] = fmt.Sprintf("  └▶ %s", msg.ToolCalls[i])
-			}
-			text = fmt.Sprintf("%s\n%s", "Called tools", strings.Join(toolCalls, "\n"))
+		if len(msg.Step.ActionObservations) > 0 {
+			text = formatToolCalls(describeToolCalls(msg.Step.ActionObservations))
 		} else {
 			text = fmt.Sprintf("Thougt for %s", formatDuration1dp(msg.For))
 		}
-		m.chat, _ = m.chat.Update(AddMessage{CRAIGReasoningMessage, text})
-		if len(msg.ToolCalls) == 0 {
+		m.chat, _ = m.chat.Update(AddStepMessage{text, msg.Step})
+		m.toolProgress = ""
+		if len(msg.Step.ActionObservations) == 0 {
 			m.awaitingResponse = false
 			m.chat, _ = m.chat.Update(SetChatInfoMessage{""})
 		}
 		return m, nil
 	case AIErrorSend:
+		m.lastAnswerFailed = true
 		m.chat, _ = m.chat.Update(AddMessage{ErrorMessage, msg.Error.Error()})
 		m.textInput, _ = m.textInput.Update(EnableMessage{true})
 		m.awaitingResponse = false
 		m.chat, _ = m.chat.Update(SetChatInfoMessage{""})
+		m = m.answerFinished()
+		return m, nil
+	case AICancelledSend:
+		m.chat, _ = m.chat.Update(AddMessage{CRAIGReasoningMessage, cancelledText})
+		m.textInput, _ = m.textInput.Update(EnableMessage{true})
+		m.awaitingResponse = false
+		m.toolProgress = ""
+		m.chat, _ = m.chat.Update(SetChatInfoMessage{""})
+		m = m.answerFinished()
 		return m, nil
 	case ResetAgentMessage:
 		m.chat, _ = m.chat.Update(ResetMessages{})
+		m.inspecting = false
 		newAgent, err := m.buildAgent()
 		if err != nil {
 			cmd := func() tea.Msg { return AIErrorSend{err} }
@@ -155,40 +230,134 @@ func (m chatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.streamChunkReady <- s
 		})
 		sendConcMsg := m.sendConcMsg
+		steps := m.steps
+		newAgent.SetOnReActInitCallback(func(string, []agent.Action) {
+			steps.reasoned()
+		})
 		newAgent.SetOnReActCompleteCallback(func(s string, ao []agent.ActionObservation) {
-			toolCalls := make([]string, len(ao))
-			for i := range ao {
-				aa := make([]agent.ActionArg, len(ao[i].Action.Args))
-				for j := range aa {
-					aa[j] = ao[i].Action.Args[j]
-				}
-				toolCalls[i] = fmt.Sprintf("%s?%s", ao[i].Action.Name, craig.FormatActionArgsForDisplay(aa))
-			}
+			reasoningTime, actingTime := steps.completed()
 			if sendConcMsg != nil {
-				sendConcMsg(AIReasoningSend{s, toolCalls, time.Since(*m.lastUserMessageTime)})
+				step := StepDetails{
+					Reasoning:          s,
+					ActionObservations: ao,
+					ReasoningTime:      reasoningTime,
+					ActingTime:         actingTime,
+				}
+				sendConcMsg(AIReasoningSend{step, time.Since(*m.lastUserMessageTime)})
 			}
 		})
 		m.activeAgent = newAgent
+		// A resumed agent already has a history, so show it
+		if sa, ok := newAgent.(agent.StatefulAgent); ok {
+			for _, msg := range historyMessages(sa.History()) {
+				m.chat, _ = m.chat.Update(msg)
+			}
+		}
+		for _, w := range m.warnings {
+			m.chat, _ = m.chat.Update(AddMessage{ErrorMessage, w})
+		}
+		m.warnings = nil
+		return m, nil
+	case AddWarningsMessage:
+		if m.activeAgent == nil {
+			m.warnings = append(m.warnings, msg.Warnings...)
+			return m, nil
+		}
+		for _, w := range msg.Warnings {
+			m.chat, _ = m.chat.Update(AddMessage{ErrorMessage, w})
+		}
 		return m, nil
 	case SetConcurrentMessageSender:
 		m.sendConcMsg = msg.MsgSender
 		return m, nil
+	case AddSlashCommands:
+		m.commands.add(msg.Commands...)
+		return m, nil
+	case CommandOutputMessage:
+		if msg.Error != nil {
+			m.chat, _ = m.chat.Update(AddMessage{ErrorMessage, msg.Error.Error()})
+		} else if msg.Output != "" {
+			m.chat, _ = m.chat.Update(AddMessage{CRAIGReasoningMessage, msg.Output})
+		}
+		return m, nil
+	case SwitchAgentMessage:
+		m.summary, _ = m.summary.Update(msg)
+		m.participants = participantNames(msg.Summary)
+		m.textInput, _ = m.textInput.Update(SetTextboxCompletions{completeInput(m.commands, m.participants)})
+		return m, func() tea.Msg { return ResetAgentMessage{} }
+	case ToggleRawMarkdown:
+		m.chat, _ = m.chat.Update(msg)
+		return m, nil
+	case InspectorFocusChanged:
+		m.inspecting = msg.Focused
+		return m, nil
+	case RetryMessage:
+		return m.retry()
+	case SetExportFunc:
+		m.export = msg.Export
+		return m, nil
+	case ExportMessage:
+		if m.answering() || m.export == nil || m.activeAgent == nil {
+			return m, nil
+		}
+		path, err := m.export(m.activeAgent)
+		if err != nil {
+			m.chat, _ = m.chat.Update(AddMessage{ErrorMessage, fmt.Sprintf("Could not export transcript: %v", err)})
+		} else {
+			m.chat, _ = m.chat.Update(AddMessage{CRAIGReasoningMessage, fmt.Sprintf("Exported transcript to %s", path)})
+		}
+		return m, nil
 	case UsageMessage:
 		m.summary, _ = m.summary.Update(msg)
 		return m, nil
+	case ToolProgressMessage:
+		if !m.awaitingResponse {
+			return m, nil
+		}
+		m.toolProgress = formatToolProgress(msg)
+		return m, nil
+	case MCPStatusMessage:
+		if msg.Connected {
+			if msg.Error != nil {
+				m.chat, _ = m.chat.Update(AddMessage{ErrorMessage, fmt.Sprintf("Reconnected to MCP server '%s' but could not refresh its tools: %v", msg.ServerName, msg.Error)})
+			} else {
+				m.chat, _ = m.chat.Update(AddMessage{CRAIGReasoningMessage, fmt.Sprintf("Reconnected to MCP server '%s'", msg.ServerName)})
+			}
+		} else {
+			m.chat, _ = m.chat.Update(AddMessage{ErrorMessage, fmt.Sprintf("Lost connection to MCP server '%s', reconnecting: %v", msg.ServerName, msg.Error)})
+		}
+		return m, nil
 	case tea.KeyMsg:
+		if m.inspecting {
+			return m.updateInspector(msg)
+		}
 		switch msg.String() {
 		case "ctrl+c":
 			return m, tea.Quit
+		case "ctrl+o":
+			var cmd tea.Cmd
+			m.chat, cmd = m.chat.Update(SetInspectorFocus{true})
+			return m, cmd
 		case "up":
 			m.chat, _ = m.chat.Update(ScrollMessage{1})
 			return m, nil
 		case "down":
 			m.chat, _ = m.chat.Update(ScrollMessage{-1})
 			return m, nil
+		case "ctrl+e":
+			return m, func() tea.Msg { return ExportMessage{} }
+		case "ctrl+r":
+			return m, func() tea.Msg { return ToggleRawMarkdown{} }
 		case "esc":
-			m.chat, _ = m.chat.Update(ResetMessages{})
-			return m, nil
+			if m.answering() {
+				if !m.cancelling {
+					m.cancelAnswer()
+					m.cancelling = true
+					m.chat, _ = m.chat.Update(SetChatInfoMessage{"Cancelling..."})
+				}
+				return m, nil
+			}
+			return m, func() tea.Msg { return ResetAgentMessage{} }
 		default:
 			var cmd tea.Cmd
 			m.textInput, cmd = m.textInput.Update(msg)
@@ -199,6 +368,81 @@ func (m chatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	}
 }
 
+func (m chatPage) answering() bool {
+	return m.cancelAnswer != nil
+}
+
+func (m chatPage) answerFinished() chatPage {
+	if m.cancelAnswer != nil {
+		m.cancelAnswer()
+	}
+	m.cancelAnswer = nil
+	m.cancelling = false
+	return m
+}
+
+// Handle keys while the user is inspecting the steps of the agent.
+func (m chatPage) updateInspector(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd
+	switch msg.String() {
+	case "ctrl+c":
+		return m, tea.Quit
+	case "esc", "ctrl+o":
+		m.chat, cmd = m.chat.Update(SetInspectorFocus{false})
+	case "up":
+		m.chat, cmd = m.chat.Update(MoveInspectorSelection{-1})
+	case "down":
+		m.chat, cmd = m.chat.Update(MoveInspectorSelection{1})
+	case "enter", " ", "space":
+		m.chat, cmd = m.chat.Update(ToggleInspectorExpanded{})
+	}
+	return m, cmd
+}
+
+func (m chatPage) runCommand(name, arg string) (tea.Model, tea.Cmd) {
+	command, ok := m.commands.commands[name]
+	if !ok {
+		m.chat, _ = m.chat.Update(AddMessage{ErrorMessage, fmt.Sprintf("Unknown command '/%s', type /help to see the commands", name)})
+		return m, nil
+	}
+	if m.answering() {
+		return m, nil
+	}
+	return m, func() tea.Msg {
+		return command.Run(arg)
+	}
+}
+
+// Ask the last message again, first making the agent forget its answer if it answered.
+func (m chatPage) retry() (tea.Model, tea.Cmd) {
+	if m.answering() || m.lastUserMessage == "" {
+		return m, nil
+	}
+	if !m.lastAnswerFailed {
+		sa, ok := m.activeAgent.(agent.StatefulAgent)
+		history := []agent.CompletedTask{}
+		if ok {
+			history = sa.History()
+		}
+		if len(history) == 0 || !sameMessage(history[len(history)-1].Task, m.lastUserMessage) {
+			m.chat, _ = m.chat.Update(AddMessage{ErrorMessage, "The agent cannot forget its last answer, so it cannot be retried"})
+			return m, nil
+		}
+		sa.SetHistory(history[:len(history)-1])
+		m.chat, _ = m.chat.Update(ResetMessages{})
+		for _, msg := range historyMessages(sa.History()) {
+			m.chat, _ = m.chat.Update(msg)
+		}
+	}
+	// Files are attached again, so any changes to them are seen
+	query := m.lastUserMessage
+	if strings.HasPrefix(query, "/") {
+		// Escape the slash again so the message is not run as a command
+		query = "/" + query
+	}
+	return m, func() tea.Msg { return UserMessageSend{query} }
+}
+
 func (m chatPage) View() string {
 	mainStyle := lipgloss.NewStyle().
 		Width(m.width).
@@ -208,7 +452,115 @@ func (m chatPage) View() string {
 	return mainStyle.Render(content)
 }
 
+const cancelledText = "Cancelled, the steps taken so far are remembered"
+
 func formatDuration1dp(d time.Duration) string {
 	secs := float64(d) / float64(time.Second)
 	return fmt.Sprintf("%.1fs", secs)
 }
+
+func formatToolProgress(msg ToolProgressMessage) string {
+	var progress string
+	if msg.Total > 0 {
+		progress = fmt.Sprintf("%.0f%%", 100*msg.Progress/msg.Total)
+	} else {
+		progress = fmt.Sprint(msg.Progress)
+	}
+	text := fmt.Sprintf("%s: %s", msg.ToolName, progress)
+	if msg.Message != "" {
+		text += " " + msg.Message
+	}
+	return text
+}
+
+func describeToolCalls(ao []agent.ActionObservation) []string {
+	toolCalls := make([]string, len(ao))
+	for i := range ao {
+		aa := make([]agent.ActionArg, len(ao[i].Action.Args))
+		for j := range aa {
+			aa[j] = ao[i].Action.Args[j]
+		}
+		toolCalls[i] = fmt.Sprintf("%s?%s", ao[i].Action.Name, craig.FormatActionArgsForDisplay(aa))
+	}
+	return toolCalls
+}
+
+func formatToolCalls(toolCalls []string) string {
+	lines := make([]string, len(toolCalls))
+	for i := range toolCalls {
+		lines[i] = fmt.Sprintf("  └▶ %s", toolCalls[i])
+	}
+	return fmt.Sprintf("%s\n%s", "Called tools", strings.Join(lines, "\n"))
+}
+
+// Recreate the messages that were shown while the agent built up its history.
+func historyMessages(history []agent.CompletedTask) []tea.Msg {
+	msgs := make([]tea.Msg, 0)
+	for _, task := range history {
+		message, attachments := attach.Split(task.Task)
+		msgs = append(msgs, AddMessage{UserMessage, message})
+		if len(attachments) > 0 {
+			msgs = append(msgs, AddMessage{CRAIGReasoningMessage, formatAttachments(attachments)})
+		}
+		for _, step := range task.Steps {
+			text := "Thought"
+			if len(step.ActionObservations) > 0 {
+				text = formatToolCalls(describeToolCalls(step.ActionObservations))
+			}
+			msgs = append(msgs, AddStepMessage{text, StepDetails{Reasoning: step.Reasoning, ActionObservations: step.ActionObservations}})
+		}
+		if task.Cancelled {
+			msgs = append(msgs, AddMessage{CRAIGReasoningMessage, cancelledText})
+		} else {
+			msgs = append(msgs, AddMessage{CRAIGMessage, task.Response})
+		}
+	}
+	return msgs
+}
+
+// Whether the task is the message, once any attachments have been split off.
+func sameMessage(task, message string) bool {
+	taskMessage, _ := attach.Split(task)
+	return taskMessage == message
+}
+
+// Complete slash commands, or an @name or @path reference at the end of the text.
+func completeInput(commands *slashCommands, participants []string) func(string) []string {
+	return func(text string) []string {
+		if completions := commands.complete(text); len(completions) > 0 {
+			return completions
+		}
+		return append(completeParticipant(text, participants), completeAttachmentPath(text)...)
+	}
+}
+
+// Complete an @name reference at the end of the text to the agents in the room it could address.
+func completeParticipant(text string, participants []string) []string {
+	start := strings.LastIndexAny(text, " \t\n") + 1
+	partial, ok := strings.CutPrefix(text[start:], "@")
+	if !ok {
+		return nil
+	}
+	completions := make([]string, 0)
+	for _, name := range participants {
+		if strings.HasPrefix(name, partial) {
+			completions = append(completions, text[:start]+"@"+name+" ")
+		}
+	}
+	return completions
+}
+
+// Addressing this name in a room asks every agent in the room to answer.
+const AddressEveryone = "all"
+
+// Get the names that can be addressed with @name in a room, or none if the agent is not a room.
+func participantNames(summary AgentSummary) []string {
+	if len(summary.Participants) == 0 {
+		return nil
+	}
+	names := make([]string, len(summary.Participants))
+	for i, p := range summary.Participants {
+		names[i] = p.Name
+	}
+	return append(names, AddressEveryone)
+}
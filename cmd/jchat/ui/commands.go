@@ -0,0 +1,131 @@
+package ui
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// A command the user can run by typing /<name> into the textbox.
+type SlashCommand struct {
+	Name string
+	// How the argument is written in help, such as "<name>", or empty if the command takes no argument.
+	Args        string
+	Description string
+	// Suggest arguments for the partially typed argument. May be nil.
+	Complete func(arg string) []string
+	// Run the command with its trimmed argument, returning a message for the chat page (or nil).
+	// This is not run on the UI goroutine, so it may block.
+	Run func(arg string) tea.Msg
+}
+
+// The slash commands that can be run, shared between the chat page and its textbox.
+type slashCommands struct {
+	commands map[string]SlashCommand
+}
+
+func newSlashCommands() *slashCommands {
+	r := &slashCommands{commands: make(map[string]SlashCommand)}
+	r.add(
+		SlashCommand{
+			Name:        "help",
+			Description: "List the available commands",
+			Run: func(string) tea.Msg {
+				return CommandOutputMessage{Output: r.help()}
+			},
+		},
+		SlashCommand{
+			Name:        "reset",
+			Description: "Start a new session",
+			Run:         func(string) tea.Msg { return ResetAgentMessage{} },
+		},
+		SlashCommand{
+			Name:        "export",
+			Description: "Export the conversation as Markdown",
+			Run:         func(string) tea.Msg { return ExportMessage{} },
+		},
+		SlashCommand{
+			Name:        "raw",
+			Description: "Switch between rendered answers and the Markdown they were written in",
+			Run:         func(string) tea.Msg { return ToggleRawMarkdown{} },
+		},
+		SlashCommand{
+			Name:        "retry",
+			Description: "Forget the last answer and ask the last message again",
+			Run:         func(string) tea.Msg { return RetryMessage{} },
+		},
+	)
+	return r
+}
+
+// Add the commands, replacing any existing commands with the same names.
+func (r *slashCommands) add(commands ...SlashCommand) {
+	for _, c := range commands {
+		r.commands[c.Name] = c
+	}
+}
+
+func (r *slashCommands) sortedNames() []string {
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (r *slashCommands) help() string {
+	lines := []string{"Commands (start a message with // to send it with a single /)"}
+	for _, name := range r.sortedNames() {
+		c := r.commands[name]
+		usage := "/" + c.Name
+		if c.Args != "" {
+			usage += " " + c.Args
+		}
+		lines = append(lines, fmt.Sprintf("  %-18s %s", usage, c.Description))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Get the texts that the partially typed command could be completed to.
+func (r *slashCommands) complete(text string) []string {
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") {
+		return nil
+	}
+	name, arg, hasArg := strings.Cut(text[1:], " ")
+	completions := make([]string, 0)
+	if !hasArg {
+		for _, n := range r.sortedNames() {
+			if !strings.HasPrefix(n, name) {
+				continue
+			}
+			completion := "/" + n
+			if r.commands[n].Args != "" {
+				completion += " "
+			}
+			completions = append(completions, completion)
+		}
+		return completions
+	}
+	c, ok := r.commands[name]
+	if !ok || c.Complete == nil {
+		return nil
+	}
+	for _, a := range c.Complete(arg) {
+		if strings.HasPrefix(a, arg) {
+			completions = append(completions, "/"+name+" "+a)
+		}
+	}
+	return completions
+}
+
+// Parse a message into a command, returning false if the message is not a command.
+func parseSlashCommand(text string) (name, arg string, ok bool) {
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") {
+		return "", "", false
+	}
+	name, arg, _ = strings.Cut(text[1:], " ")
+	return name, strings.TrimSpace(arg), true
+}
@@ -0,0 +1,93 @@
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JoshPattman/agent"
+)
+
+// Everything the agent did in one step, shown when the step is expanded in the inspector.
+type StepDetails struct {
+	Reasoning          string
+	ActionObservations []agent.ActionObservation
+	// How long the model took to reason, and how long the tools then took, or zero if not known.
+	ReasoningTime time.Duration
+	ActingTime    time.Duration
+}
+
+// Times the steps of an agent. It is only used by the goroutine answering, as the agent calls its callbacks from there.
+type stepTimer struct {
+	stepStart  time.Time
+	reasonedAt time.Time
+}
+
+func (t *stepTimer) begin() {
+	t.stepStart = time.Now()
+}
+
+func (t *stepTimer) reasoned() {
+	t.reasonedAt = time.Now()
+}
+
+// Mark the step as complete, returning how long was spent reasoning and acting, and starting the next step.
+func (t *stepTimer) completed() (reasoning, acting time.Duration) {
+	now := time.Now()
+	reasoning, acting = t.reasonedAt.Sub(t.stepStart), now.Sub(t.reasonedAt)
+	t.stepStart = now
+	return reasoning, acting
+}
+
+func formatStepDetails(step StepDetails) string {
+	sections := make([]string, 0)
+	reasoningTitle := "Reasoning"
+	if step.ReasoningTime > 0 {
+		reasoningTitle += fmt.Sprintf(" (%s)", formatDuration1dp(step.ReasoningTime))
+	}
+	reasoning := step.Reasoning
+	if reasoning == "" {
+		reasoning = "(none)"
+	}
+	sections = append(sections, reasoningTitle+"\n"+indent(reasoning))
+	if len(step.ActionObservations) > 0 && step.ActingTime > 0 {
+		sections = append(sections, fmt.Sprintf("Called %d tool(s) in %s", len(step.ActionObservations), formatDuration1dp(step.ActingTime)))
+	}
+	for _, ao := range step.ActionObservations {
+		title := "Tool " + ao.Action.Name
+		if ao.Duration > 0 {
+			title += fmt.Sprintf(" (%s)", formatDuration1dp(ao.Duration))
+		}
+		observed := ao.Observation.Observed
+		for _, img := range ao.Observation.Images {
+			observed += "\n" + agent.DescribeImage(img)
+		}
+		for _, res := range ao.Observation.Resources {
+			observed += "\n" + agent.DescribeResourceReference(res)
+		}
+		sections = append(sections, fmt.Sprintf(
+			"%s\n  Arguments\n%s\n  Observation\n%s",
+			title,
+			indent(indent(formatArgsJSON(ao.Action.Args))),
+			indent(indent(observed)),
+		))
+	}
+	return strings.Join(sections, "\n")
+}
+
+func formatArgsJSON(args []agent.ActionArg) string {
+	m := make(map[string]any, len(args))
+	for _, arg := range args {
+		m[arg.ArgName] = arg.ArgData
+	}
+	bs, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Sprint(m)
+	}
+	return string(bs)
+}
+
+func indent(s string) string {
+	return "  " + strings.ReplaceAll(s, "\n", "\n  ")
+}
@@ -0,0 +1,114 @@
+package ui
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/glamour"
+	"github.com/charmbracelet/glamour/ansi"
+	"github.com/charmbracelet/glamour/styles"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Renders Markdown for the terminal, keeping a renderer for each width that has been used.
+// It is shared by the messages of a chat, which are only rendered on the UI goroutine.
+type markdownRenderer struct {
+	style     ansi.StyleConfig
+	renderers map[int]*glamour.TermRenderer
+}
+
+// Create a renderer with a style for the background of the terminal.
+// This queries the terminal, so must be called before the UI starts reading input.
+func newMarkdownRenderer() *markdownRenderer {
+	style := styles.LightStyleConfig
+	if lipgloss.HasDarkBackground() {
+		style = styles.DarkStyleConfig
+	}
+	// Messages already have their own padding
+	noMargin := uint(0)
+	style.Document.Margin = &noMargin
+	return &markdownRenderer{
+		style:     style,
+		renderers: make(map[int]*glamour.TermRenderer),
+	}
+}
+
+// Render the Markdown to fit in the width, returning false if it could not be rendered.
+func (r *markdownRenderer) render(source string, width int) (string, bool) {
+	if r == nil || width <= 0 {
+		return "", false
+	}
+	tr, ok := r.renderers[width]
+	if !ok {
+		var err error
+		tr, err = glamour.NewTermRenderer(
+			glamour.WithStyles(r.style),
+			glamour.WithWordWrap(width),
+			glamour.WithColorProfile(lipgloss.ColorProfile()),
+		)
+		if err != nil {
+			return "", false
+		}
+		r.renderers[width] = tr
+	}
+	out, err := tr.Render(source)
+	if err != nil {
+		return "", false
+	}
+	return strings.Trim(out, "\n"), true
+}
+
+// The rendering of a message that is being streamed in.
+// Text before the last complete block is only rendered once, and only the block still being written is rendered on each update.
+// Blocks rendered separately may differ slightly from rendering the whole text (such as list numbering), so a finished message should be rendered from scratch.
+type markdownRender struct {
+	width int
+	// How much of the source has been rendered in stable, which ends at a block boundary so it will not change as more text arrives.
+	stableLen int
+	stable    string
+	// The rendering of the whole source, or empty if it could not be rendered.
+	rendered string
+}
+
+// Render the source, reusing the rendering of the start of the previous source if the source has only been appended to.
+func (r *markdownRenderer) update(prev markdownRender, source string, width int) markdownRender {
+	if prev.width != width || prev.stableLen > len(source) {
+		prev = markdownRender{width: width}
+	}
+	if boundary := lastBlockBoundary(source); boundary > prev.stableLen {
+		stable, ok := r.render(source[:boundary], width)
+		if !ok {
+			return markdownRender{width: width}
+		}
+		prev.stable, prev.stableLen = stable, boundary
+	}
+	tail, ok := r.render(source[prev.stableLen:], width)
+	if !ok {
+		return markdownRender{width: width}
+	}
+	switch {
+	case prev.stable == "":
+		prev.rendered = tail
+	case tail == "":
+		prev.rendered = prev.stable
+	default:
+		prev.rendered = prev.stable + "\n\n" + tail
+	}
+	return prev
+}
+
+// Find the end of the last blank line that is not in a code block, or 0 if there is none.
+func lastBlockBoundary(source string) int {
+	boundary := 0
+	inFence := false
+	pos := 0
+	for _, line := range strings.SplitAfter(source, "\n") {
+		pos += len(line)
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		} else if trimmed == "" && !inFence && strings.HasSuffix(line, "\n") {
+			boundary = pos
+		}
+	}
+	return boundary
+}
@@ -3,6 +3,7 @@ package ui
 import (
 	"time"
 
+	"github.com/JoshPattman/agent"
 	"github.com/JoshPattman/jpf"
 	tea "github.com/charmbracelet/bubbletea"
 )
@@ -26,12 +27,40 @@ type AddMessage struct {
 	Content string
 }
 
+// Add a reasoning message for a step, which can be expanded in the inspector to show the step.
+type AddStepMessage struct {
+	Content string
+	Step    StepDetails
+}
+
+type SetInspectorFocus struct {
+	Focused bool
+}
+
+type MoveInspectorSelection struct {
+	Delta int
+}
+
+type ToggleInspectorExpanded struct{}
+
+// Sent by the chat when it starts or stops inspecting steps.
+type InspectorFocusChanged struct {
+	Focused bool
+}
+
 type AppendMessageText struct {
 	ExtraText string
 }
 
 type ResetMessages struct{}
 
+// Switch between showing answers rendered as Markdown and showing the Markdown they were written in.
+type ToggleRawMarkdown struct{}
+
+type SetRawMarkdown struct {
+	Raw bool
+}
+
 type EnableMessage struct {
 	Enable bool
 }
@@ -50,15 +79,17 @@ type AIMessageSend struct {
 }
 
 type AIReasoningSend struct {
-	Reasoning string
-	ToolCalls []string
-	For       time.Duration
+	Step StepDetails
+	For  time.Duration
 }
 
 type AIErrorSend struct {
 	Error error
 }
 
+// Sent once the agent has stopped answering after being cancelled.
+type AICancelledSend struct{}
+
 type ResetAgentMessage struct{}
 
 type SetConcurrentMessageSender struct {
@@ -67,6 +98,13 @@ type SetConcurrentMessageSender struct {
 
 type UsageMessage struct {
 	Usage jpf.Usage
+	// The usage of each agent, if chatting to a room of several agents.
+	Participants []ParticipantUsage
+}
+
+type ParticipantUsage struct {
+	Name  string
+	Usage jpf.Usage
 }
 
 type SetChatInfoMessage struct {
@@ -76,3 +114,53 @@ type SetChatInfoMessage struct {
 type SetThinkingNumDots struct {
 	N int
 }
+
+type ToolProgressMessage struct {
+	ToolName string
+	Progress float64
+	Total    float64
+	Message  string
+}
+
+type MCPStatusMessage struct {
+	ServerName string
+	Connected  bool
+	Error      error
+}
+
+type SetExportFunc struct {
+	// Export the conversation of the agent, returning where it was exported to.
+	Export func(agent.Agent) (string, error)
+}
+
+type ExportMessage struct{}
+
+type AddSlashCommands struct {
+	Commands []SlashCommand
+}
+
+type CommandOutputMessage struct {
+	Output string
+	Error  error
+}
+
+// Warnings about the config, such as secrets written in plain text, shown in the chat.
+type AddWarningsMessage struct {
+	Warnings []string
+}
+
+type RetryMessage struct{}
+
+// Sent once the agent that the chat page builds has been switched, so a new agent should be built.
+type SwitchAgentMessage struct {
+	Summary AgentSummary
+}
+
+// Replace the text in the textbox, such as to give back a message that could not be sent.
+type SetTextboxText struct {
+	Text string
+}
+
+type SetTextboxCompletions struct {
+	Complete func(string) []string
+}
@@ -21,6 +21,8 @@ type summary struct {
 	width   int
 	height  int
 	usage   jpf.Usage
+	// The usage of each agent in a room.
+	participantUsage []ParticipantUsage
 }
 
 func (summary) Init() tea.Cmd {
@@ -37,6 +39,10 @@ func (m summary) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, nil
 	case UsageMessage:
 		m.usage = msg.Usage
+		m.participantUsage = msg.Participants
+		return m, nil
+	case SwitchAgentMessage:
+		m.summary = msg.Summary
 		return m, nil
 	default:
 		return m, nil
@@ -77,14 +83,45 @@ func (m summary) View() string {
 		ioText,
 	)
 	ioBlock = lipgloss.NewStyle().Width(m.width - 1).AlignHorizontal(lipgloss.Center).Render(ioBlock)
+	participants := ""
+	if len(m.summary.Participants) > 0 {
+		participants = "\n" + m.participantsView() + "\n"
+	}
+	keysText := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("240")).
+		Render("esc: cancel answer or new session\nctrl+e: export, ctrl+o: inspect steps\n/help: commands")
 	content := fmt.Sprintf(
-		"%s\n\n%s\n%s\n%d MCP servers and %d subagents.\n\n%s",
+		"%s\n\n%s\n%s\n%d MCP servers and %d subagents.\n%s\n%s\n\n%s",
 		header,
 		topRow,
 		strings.Join(m.summary.Description, " "),
 		m.summary.NumMCP, m.summary.NumSubAgents,
+		participants,
 		ioBlock,
+		keysText,
 	)
 	content = boxStyle.Render(content)
 	return content
 }
+
+// List the agents in a room with their models and the tokens each has used.
+func (m summary) participantsView() string {
+	nameStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("6"))
+	usageStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("240"))
+	lines := make([]string, len(m.summary.Participants))
+	for i, p := range m.summary.Participants {
+		var usage jpf.Usage
+		for _, u := range m.participantUsage {
+			if u.Name == p.Name {
+				usage = u.Usage
+			}
+		}
+		lines[i] = fmt.Sprintf(
+			"%s ~ %s %s",
+			nameStyle.Render("@"+p.Name),
+			p.ModelName,
+			usageStyle.Render(fmt.Sprintf("%d/%d", usage.InputTokens, usage.OutputTokens)),
+		)
+	}
+	return strings.Join(lines, "\n")
+}
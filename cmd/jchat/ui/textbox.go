@@ -19,6 +19,13 @@ type textBox struct {
 	width        int
 	onComplete   func(string) tea.Msg
 	pointer      int
+	complete     func(string) []string
+	// The completions being cycled through with tab, or nil if tab has not been pressed since the text last changed.
+	completions   []string
+	completionIdx int
+	// The completion shown after the text, which is found when the text changes rather than on every render,
+	// as completing a path reads the directory.
+	hint string
 }
 
 func (textBox) Init() tea.Cmd {
@@ -26,6 +33,15 @@ func (textBox) Init() tea.Cmd {
 }
 
 func (m textBox) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	text := m.text
+	m, cmd := m.update(msg)
+	if _, ok := msg.(SetTextboxCompletions); ok || m.text != text {
+		m.hint = m.completionHint()
+	}
+	return m, cmd
+}
+
+func (m textBox) update(msg tea.Msg) (textBox, tea.Cmd) {
 	switch msg := msg.(type) {
 	case EnableMessage:
 		m.enabled = msg.Enable
@@ -36,11 +52,32 @@ func (m textBox) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case SetTextboxCompleteMessage:
 		m.onComplete = msg.BuildOnComplete
 		return m, nil
+	case SetTextboxCompletions:
+		m.complete = msg.Complete
+		return m, nil
+	case SetTextboxText:
+		m.text = msg.Text
+		m.pointer = len(m.text)
+		m.completions = nil
+		return m, nil
 	case tea.KeyMsg:
 		if !m.enabled {
 			return m, nil
 		}
 		msgString := msg.String()
+		if msgString == "tab" {
+			if m.completions == nil && m.complete != nil {
+				m.completions = m.complete(m.text)
+				m.completionIdx = 0
+			}
+			if len(m.completions) > 0 {
+				m.text = m.completions[m.completionIdx]
+				m.pointer = len(m.text)
+				m.completionIdx = (m.completionIdx + 1) % len(m.completions)
+			}
+			return m, nil
+		}
+		m.completions = nil
 		if msgString == "enter" {
 			if m.text != "" {
 				var cmd tea.Cmd
@@ -95,7 +132,9 @@ func (m textBox) View() string {
 		arrowStyle = arrowStyle.Foreground(lipgloss.Color("5"))
 		finalCharStyle = finalCharStyle.Background(lipgloss.Color("7"))
 		if m.text == "" {
-			promptText = "Talk to me..."
+			promptText = "Talk to me... (/help for commands)"
+		} else if m.completions == nil && m.pointer == len(m.text) {
+			promptText = m.hint
 		}
 	} else {
 		text = m.disabledText
@@ -114,3 +153,19 @@ func (m textBox) View() string {
 
 	return style.Render(fmt.Sprintf("%s %s%s", arrow, text, promptText))
 }
+
+// Get the rest of the first completion of the text, and how many others there are, to show after the text.
+func (m textBox) completionHint() string {
+	if m.complete == nil {
+		return ""
+	}
+	completions := m.complete(m.text)
+	if len(completions) == 0 {
+		return ""
+	}
+	hint := strings.TrimPrefix(completions[0], m.text)
+	if len(completions) > 1 {
+		hint += fmt.Sprintf("  (+%d more, tab to cycle)", len(completions)-1)
+	}
+	return hint
+}
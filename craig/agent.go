@@ -4,7 +4,10 @@ package craig
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/JoshPattman/agent"
 )
@@ -33,7 +36,9 @@ type agentParams struct {
 	taskPrefix         string
 	finalAnswerMessage string
 	tools              []agent.Tool
+	toolProviders      []agent.ToolProvider
 	scenarios          map[string]agent.Scenario
+	contextDocuments   map[string]string
 }
 
 type NewOpt func(*agentParams)
@@ -50,6 +55,14 @@ func WithTools(tools ...agent.Tool) NewOpt {
 	}
 }
 
+// Add providers whose tools may change over time.
+// The current tools of each provider are fetched before every step, so the agent always sees the latest tools.
+func WithToolProviders(providers ...agent.ToolProvider) NewOpt {
+	return func(a *agentParams) {
+		a.toolProviders = append(a.toolProviders, providers...)
+	}
+}
+
 func WithTaskPrefix(prefix string) NewOpt {
 	return func(a *agentParams) {
 		a.taskPrefix = prefix
@@ -74,7 +87,19 @@ func WithScenarios(scenarios map[string]agent.Scenario) NewOpt {
 	}
 }
 
+// Add documents to the system prompt as background information for the agent, keyed by document name.
+func WithContextDocuments(docs map[string]string) NewOpt {
+	return func(ap *agentParams) {
+		if ap.contextDocuments == nil {
+			ap.contextDocuments = make(map[string]string)
+		}
+		maps.Copy(ap.contextDocuments, docs)
+	}
+}
+
 type combineReActAgent struct {
+	// Held while answering, so that only one query is answered at a time and the history is not changed during an answer.
+	lock            sync.Mutex
 	history         []executedTask
 	params          agentParams
 	modelBuilder    agent.AgentModelBuilder
@@ -85,11 +110,25 @@ type combineReActAgent struct {
 }
 
 func (a *combineReActAgent) Answer(query string) (string, error) {
-	reactStepper, answerStepper := a.buildSteppers()
+	return a.AnswerContext(context.Background(), query)
+}
+
+// AnswerContext implements agent.ContextAgent.
+// If the answer is cancelled, the steps taken so far are remembered as a cancelled task.
+func (a *combineReActAgent) AnswerContext(ctx context.Context, query string) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 	state := newTaskState(query, a.history)
 	// Do reasoning and acting loop
 	for {
-		newState, ok, err := a.stepTaskState(reactStepper, state)
+		tools := a.currentTools()
+		newState, ok, err := a.stepTaskState(ctx, a.buildReActStepper(tools), tools, state)
+		if ctx.Err() != nil {
+			if err == nil {
+				state = newState
+			}
+			return "", a.cancelTask(ctx, state)
+		}
 		if err != nil {
 			return "", err
 		}
@@ -99,7 +138,10 @@ func (a *combineReActAgent) Answer(query string) (string, error) {
 		}
 	}
 	// Finalise output
-	finalResponse, _, err := answerStepper.Call(context.Background(), state)
+	finalResponse, _, err := a.buildAnswerStepper(a.currentTools()).Call(ctx, state)
+	if err != nil && ctx.Err() != nil {
+		return "", a.cancelTask(ctx, state)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -111,28 +153,90 @@ func (a *combineReActAgent) Answer(query string) (string, error) {
 	return finalResponse, nil
 }
 
-func (a *combineReActAgent) buildSteppers() (reActStepper, responseStepper) {
-	rs := newReActStepper(
+// Remember the active task as cancelled with the steps taken so far, returning the error to answer with.
+func (a *combineReActAgent) cancelTask(ctx context.Context, state executingState) error {
+	a.history = append(a.history, executedTask{
+		Task:      state.Active.Task,
+		Steps:     state.Active.Steps,
+		Cancelled: true,
+	})
+	return fmt.Errorf("task was cancelled: %w", ctx.Err())
+}
+
+// History implements agent.StatefulAgent.
+func (a *combineReActAgent) History() []agent.CompletedTask {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	history := make([]agent.CompletedTask, len(a.history))
+	for i, task := range a.history {
+		steps := make([]agent.Step, len(task.Steps))
+		for j, step := range task.Steps {
+			steps[j] = agent.Step(step)
+		}
+		history[i] = agent.CompletedTask{
+			Task:      task.Task,
+			Steps:     steps,
+			Response:  task.Response,
+			Cancelled: task.Cancelled,
+		}
+	}
+	return history
+}
+
+// SetHistory implements agent.StatefulAgent.
+func (a *combineReActAgent) SetHistory(history []agent.CompletedTask) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.history = make([]executedTask, len(history))
+	for i, task := range history {
+		steps := make([]reActStep, len(task.Steps))
+		for j, step := range task.Steps {
+			steps[j] = reActStep(step)
+		}
+		a.history[i] = executedTask{
+			Task:      task.Task,
+			Steps:     steps,
+			Response:  task.Response,
+			Cancelled: task.Cancelled,
+		}
+	}
+}
+
+// Get the fixed tools, followed by the current tools of each provider.
+func (a *combineReActAgent) currentTools() []agent.Tool {
+	tools := slices.Clone(a.params.tools)
+	for _, p := range a.params.toolProviders {
+		tools = append(tools, p.Tools()...)
+	}
+	return tools
+}
+
+func (a *combineReActAgent) buildReActStepper(tools []agent.Tool) reActStepper {
+	return newReActStepper(
 		a.params.personality,
 		a.modelBuilder,
-		a.params.tools,
+		tools,
 		a.params.systemPrompt,
 		a.params.taskPrefix,
 		a.params.finalAnswerMessage,
 		a.params.scenarios,
+		a.params.contextDocuments,
 	)
-	as := newAnswerStepper(
+}
+
+func (a *combineReActAgent) buildAnswerStepper(tools []agent.Tool) responseStepper {
+	return newAnswerStepper(
 		a.params.personality,
 		a.modelBuilder,
-		a.params.tools,
+		tools,
 		a.params.systemPrompt,
 		a.params.taskPrefix,
 		a.params.finalAnswerMessage,
 		a.params.scenarios,
+		a.params.contextDocuments,
 		a.onStreamBegin,
 		a.onStreamChunk,
 	)
-	return rs, as
 }
 
 func (a *combineReActAgent) SetOnReActInitCallback(callback func(reasoning string, actions []agent.Action)) {
@@ -150,15 +254,15 @@ func (a *combineReActAgent) SetOnStreamAnswerChunkCallback(callback func(string)
 	a.onStreamChunk = callback
 }
 
-func (a *combineReActAgent) stepTaskState(stepper reActStepper, state executingState) (executingState, bool, error) {
-	resp, _, err := stepper.Call(context.Background(), state)
+func (a *combineReActAgent) stepTaskState(ctx context.Context, stepper reActStepper, tools []agent.Tool, state executingState) (executingState, bool, error) {
+	resp, _, err := stepper.Call(ctx, state)
 	if err != nil {
 		return executingState{}, false, err
 	}
 	if a.onReActInit != nil {
 		a.onReActInit(resp.Reasoning, resp.Actions)
 	}
-	actionObservations := a.observeActions(resp.Actions)
+	actionObservations := observeActions(ctx, tools, resp.Actions)
 	step := reActStep{
 		Reasoning:          resp.Reasoning,
 		ActionObservations: actionObservations,
@@ -174,28 +278,29 @@ func (a *combineReActAgent) stepTaskState(stepper reActStepper, state executingS
 	}
 }
 
-func (a *combineReActAgent) observeActions(actions []agent.Action) []agent.ActionObservation {
+func observeActions(ctx context.Context, tools []agent.Tool, actions []agent.Action) []agent.ActionObservation {
 	actionObservations := make([]agent.ActionObservation, len(actions))
 	wg := &sync.WaitGroup{}
 	wg.Add(len(actions))
 	for i, action := range actions {
 		go func(i int, action agent.Action) {
 			defer wg.Done()
+			start := time.Now()
 			var tool agent.Tool
-			for _, t := range a.params.tools {
+			for _, t := range tools {
 				if t.Name() == action.Name {
 					tool = t
 					break
 				}
 			}
-			var response string
+			var response agent.ToolResult
 			if tool == nil {
-				response = "error: there were no tools available with that name."
+				response.Text = "error: there were no tools available with that name."
 			} else {
 				args := convertActionArgsToMap(action.Args)
-				resp, err := tool.Call(args)
+				resp, err := agent.CallToolContext(ctx, tool, args)
 				if err != nil {
-					response = fmt.Sprintf("error: %s", err.Error())
+					response.Text = fmt.Sprintf("error: %s", err.Error())
 				} else {
 					response = resp
 				}
@@ -203,8 +308,11 @@ func (a *combineReActAgent) observeActions(actions []agent.Action) []agent.Actio
 			actionObservations[i] = agent.ActionObservation{
 				Action: action,
 				Observation: agent.Observation{
-					Observed: response,
+					Observed:  response.Text,
+					Images:    response.Images,
+					Resources: response.Resources,
 				},
+				Duration: time.Since(start),
 			}
 		}(i, action)
 	}
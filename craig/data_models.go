@@ -16,10 +16,18 @@ type reActStep struct {
 	ActionObservations []agent.ActionObservation `json:"action_observations"`
 }
 
+// An observation as it is shown to the model.
+// Images and resources are referred to by attachment descriptions rather than included inline.
+type encodedObservation struct {
+	Observed    string   `json:"observed"`
+	Attachments []string `json:"attachments,omitempty"`
+}
+
 type executedTask struct {
-	Task     string      `json:"task"`
-	Steps    []reActStep `json:"steps"`
-	Response string      `json:"response"`
+	Task      string      `json:"task"`
+	Steps     []reActStep `json:"steps"`
+	Response  string      `json:"response"`
+	Cancelled bool        `json:"cancelled,omitempty"`
 }
 
 type executingTask struct {
@@ -37,8 +45,14 @@ type systemPromptScenario struct {
 	agent.Scenario
 }
 
+type systemPromptContextDocument struct {
+	Name    string
+	Content string
+}
+
 type systemPromptData struct {
-	Personality string
-	Tools       []agent.Tool
-	Scenarios   []systemPromptScenario
+	Personality      string
+	Tools            []agent.Tool
+	Scenarios        []systemPromptScenario
+	ContextDocuments []systemPromptContextDocument
 }
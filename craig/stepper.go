@@ -18,6 +18,9 @@ var defaultSystemPrompt string
 var defaultReActModePrefix = "You are now in reason-action mode. Your next task / query to respond to is as follows:\n"
 var defaultAnswerModeContent = "You are now in final answer mode, create your final answer."
 
+// Shown after the steps of a task that the user cancelled before it was answered.
+var taskCancelledMessage = "The user cancelled this task before you answered it. Do not continue it unless you are asked to."
+
 func newReActStepper(
 	personality string,
 	modelBuilder agent.AgentModelBuilder,
@@ -26,6 +29,7 @@ func newReActStepper(
 	taskPrefix string,
 	answerModeContent string,
 	scenarios map[string]agent.Scenario,
+	contextDocuments map[string]string,
 ) reActStepper {
 	return jpf.NewOneShotMapFunc(
 		&stateHistoryMessageEncoder{
@@ -36,6 +40,8 @@ func newReActStepper(
 			reActState,
 			tools,
 			scenarios,
+			contextDocuments,
+			agent.ModelBuilderSupportsImages(modelBuilder),
 		},
 		jpf.NewJsonResponseDecoder[executingState, reActResponse](), //jpf.NewValidatingResponseDecoder(, func(resp reActResponse) error { return fmt.Errorf("%v", resp) }),
 		modelBuilder.BuildAgentModel(reActResponse{}, nil, nil),
@@ -50,6 +56,7 @@ func newAnswerStepper(
 	taskPrefix string,
 	answerModeContent string,
 	scenarios map[string]agent.Scenario,
+	contextDocuments map[string]string,
 	onInitFinalStream func(),
 	onChunkFinalStream func(string),
 ) responseStepper {
@@ -62,6 +69,8 @@ func newAnswerStepper(
 			answerState,
 			tools,
 			scenarios,
+			contextDocuments,
+			agent.ModelBuilderSupportsImages(modelBuilder),
 		},
 		jpf.NewRawStringResponseDecoder[executingState](),
 		modelBuilder.BuildAgentModel(nil, onInitFinalStream, onChunkFinalStream),
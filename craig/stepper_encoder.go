@@ -1,8 +1,15 @@
 package craig
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"slices"
+	"strings"
 
 	"github.com/JoshPattman/agent"
 	"github.com/JoshPattman/jpf"
@@ -20,6 +27,8 @@ const (
 // (however we parsed them and threw away the raw text),
 // BUT they will be perfectly formatted, encoragin the LLM to do the same in the future.
 // Thi can optionally add a message to the end which sets the agent into final answer mode.
+// Images returned by tools are attached to the observation message if the model supports images,
+// otherwise they are replaced by a short text description.
 type stateHistoryMessageEncoder struct {
 	personality            string
 	systemPrompt           string
@@ -28,6 +37,8 @@ type stateHistoryMessageEncoder struct {
 	state                  agentState
 	tools                  []agent.Tool
 	scenarios              map[string]agent.Scenario
+	contextDocuments       map[string]string
+	imagesSupported        bool
 }
 
 func (enc *stateHistoryMessageEncoder) BuildInputMessages(state executingState) ([]jpf.Message, error) {
@@ -42,6 +53,10 @@ func (enc *stateHistoryMessageEncoder) BuildInputMessages(state executingState)
 	for _, group := range state.History {
 		messages = append(messages, enc.makeBeginTaskMessage(group.Task))
 		messages = append(messages, enc.makeMessagesForReActSteps(group.Steps)...)
+		if group.Cancelled {
+			messages = append(messages, enc.makeTaskCancelledMessage())
+			continue
+		}
 		messages = append(messages, enc.makeAnswerTaskMessage())
 		messages = append(messages, enc.makeTaskAnsweredMessage(group.Response))
 	}
@@ -71,10 +86,21 @@ func (enc *stateHistoryMessageEncoder) makeSysMessage() (jpf.Message, error) {
 			return 0
 		}
 	})
+	docs := make([]systemPromptContextDocument, 0)
+	for k, v := range enc.contextDocuments {
+		docs = append(docs, systemPromptContextDocument{
+			Name:    k,
+			Content: v,
+		})
+	}
+	slices.SortFunc(docs, func(docA, docB systemPromptContextDocument) int {
+		return strings.Compare(docA.Name, docB.Name)
+	})
 	sysPrompt, err := formatTemplate(enc.systemPrompt, systemPromptData{
-		Personality: enc.personality,
-		Tools:       enc.tools,
-		Scenarios:   scens,
+		Personality:      enc.personality,
+		Tools:            enc.tools,
+		Scenarios:        scens,
+		ContextDocuments: docs,
 	})
 	if err != nil {
 		return jpf.Message{}, err
@@ -97,6 +123,12 @@ func (enc *stateHistoryMessageEncoder) makeAnswerTaskMessage() jpf.Message {
 		Content: enc.finalAnswerModeMessage,
 	}
 }
+func (enc *stateHistoryMessageEncoder) makeTaskCancelledMessage() jpf.Message {
+	return jpf.Message{
+		Role:    jpf.UserRole,
+		Content: taskCancelledMessage,
+	}
+}
 func (enc *stateHistoryMessageEncoder) makeTaskAnsweredMessage(answer string) jpf.Message {
 	resp := answerResponse{
 		Response: answer,
@@ -119,11 +151,13 @@ func (enc *stateHistoryMessageEncoder) makeMessagesForReActSteps(steps []reActSt
 			},
 		)
 		if len(item.ActionObservations) > 0 {
+			content, images := enc.formatStepForUserMessage(item)
 			messages = append(
 				messages,
 				jpf.Message{
 					Role:    jpf.UserRole,
-					Content: formatStepForUserMessage(item),
+					Content: content,
+					Images:  images,
 				},
 			)
 		}
@@ -142,11 +176,30 @@ func formatStepForAIMessage(item reActStep) string {
 	return string(bs)
 }
 
-func formatStepForUserMessage(item reActStep) string {
-	var resps []agent.Observation
+// Format the observations of a step, returning the images that should be attached alongside them.
+func (enc *stateHistoryMessageEncoder) formatStepForUserMessage(item reActStep) (string, []jpf.ImageAttachment) {
+	var resps []encodedObservation
+	var images []jpf.ImageAttachment
 	for _, ao := range item.ActionObservations {
-		resps = append(resps, ao.Observation)
+		resp := encodedObservation{
+			Observed: ao.Observation.Observed,
+		}
+		for _, img := range ao.Observation.Images {
+			if enc.imagesSupported {
+				decoded, _, err := image.Decode(bytes.NewReader(img.Data))
+				if err == nil {
+					images = append(images, jpf.ImageAttachment{Source: decoded})
+					resp.Attachments = append(resp.Attachments, fmt.Sprintf("image %d attached to this message", len(images)))
+					continue
+				}
+			}
+			resp.Attachments = append(resp.Attachments, agent.DescribeImage(img)+" (cannot be shown to you)")
+		}
+		for _, res := range ao.Observation.Resources {
+			resp.Attachments = append(resp.Attachments, agent.DescribeResourceReference(res))
+		}
+		resps = append(resps, resp)
 	}
 	bs, _ := json.Marshal(resps)
-	return string(bs)
+	return string(bs), images
 }
@@ -1,5 +1,10 @@
 package agent
 
+import (
+	"context"
+	"time"
+)
+
 // A function which can be described to and called by an agent.
 type Tool interface {
 	// The name of the tool to be used by the agent.
@@ -10,6 +15,47 @@ type Tool interface {
 	Call(map[string]any) (string, error)
 }
 
+// Provides a set of tools which may change over time, such as the tools of a remote server.
+type ToolProvider interface {
+	// Get the tools that are currently available.
+	Tools() []Tool
+}
+
+// A tool which can respond with more than just text, such as images or references to resources.
+type RichTool interface {
+	Tool
+	// Call the tool, providing the full result or an error if the tool call failed.
+	CallRich(map[string]any) (ToolResult, error)
+}
+
+// A tool whose calls can be stopped early, such as when the task using it is cancelled.
+type ContextTool interface {
+	Tool
+	// Call the tool, giving up as soon as possible once the context is cancelled.
+	CallContext(ctx context.Context, args map[string]any) (ToolResult, error)
+}
+
+// The full result of a tool call.
+type ToolResult struct {
+	Text      string
+	Images    []Image
+	Resources []ResourceReference
+}
+
+// An image, such as a screenshot, in an encoded format (e.g. png).
+type Image struct {
+	MIMEType string `json:"mime_type"`
+	Data     []byte `json:"data"`
+}
+
+// A reference to a resource that was not included in full.
+type ResourceReference struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name,omitempty"`
+	MIMEType    string `json:"mime_type,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
 type Action struct {
 	Name string      `json:"name"`
 	Args []ActionArg `json:"args"`
@@ -20,12 +66,31 @@ type ActionArg struct {
 }
 
 type Observation struct {
-	Observed string `json:"observed"`
+	Observed  string              `json:"observed"`
+	Images    []Image             `json:"images,omitempty"`
+	Resources []ResourceReference `json:"resources,omitempty"`
 }
 
 type ActionObservation struct {
 	Action      Action      `json:"action"`
 	Observation Observation `json:"observation"`
+	// How long the tool took to be called, or zero if this was not measured.
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// A step of reasoning and acting that an agent took while completing a task.
+type Step struct {
+	Reasoning          string              `json:"reasoning"`
+	ActionObservations []ActionObservation `json:"action_observations"`
+}
+
+// A task that an agent has completed, including the steps it took and its final response.
+type CompletedTask struct {
+	Task     string `json:"task"`
+	Steps    []Step `json:"steps"`
+	Response string `json:"response"`
+	// The task was cancelled before it was answered, so the steps are those taken before it was cancelled and there is no response.
+	Cancelled bool `json:"cancelled,omitempty"`
 }
 
 type Scenario struct {
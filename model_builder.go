@@ -7,3 +7,17 @@ type AgentModelBuilder interface {
 	// Create a model with a structured output schema for the object provided.
 	BuildAgentModel(responseType any, onInitFinalStream func(), onDataFinalStream func(string)) jpf.Model
 }
+
+// A model builder which can report whether its models accept images attached to messages.
+// Model builders that do not implement this are assumed to be text-only.
+type ImageModelBuilder interface {
+	AgentModelBuilder
+	// Returns true if the models created by this builder can view attached images.
+	SupportsImages() bool
+}
+
+// Returns true if the model builder creates models that can view attached images.
+func ModelBuilderSupportsImages(builder AgentModelBuilder) bool {
+	imb, ok := builder.(ImageModelBuilder)
+	return ok && imb.SupportsImages()
+}
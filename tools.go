@@ -17,6 +17,95 @@ import (
 	"github.com/mitchellh/mapstructure"
 )
 
+// Call the tool, using the full result if the tool is a RichTool, or wrapping the text result otherwise.
+func CallTool(tool Tool, args map[string]any) (ToolResult, error) {
+	if rt, ok := tool.(RichTool); ok {
+		return rt.CallRich(args)
+	}
+	text, err := tool.Call(args)
+	if err != nil {
+		return ToolResult{}, err
+	}
+	return ToolResult{Text: text}, nil
+}
+
+// Call the tool, stopping it once the context is cancelled if it is a ContextTool.
+// Other tools cannot be stopped, so once the context is cancelled the call is abandoned and its result ignored.
+// If the context is already cancelled, the tool is not called at all.
+func CallToolContext(ctx context.Context, tool Tool, args map[string]any) (ToolResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ToolResult{}, err
+	}
+	if ct, ok := tool.(ContextTool); ok {
+		return ct.CallContext(ctx, args)
+	}
+	type callResult struct {
+		result ToolResult
+		err    error
+	}
+	done := make(chan callResult, 1)
+	go func() {
+		result, err := CallTool(tool, args)
+		done <- callResult{result, err}
+	}()
+	select {
+	case res := <-done:
+		return res.result, res.err
+	case <-ctx.Done():
+		return ToolResult{}, ctx.Err()
+	}
+}
+
+// Get the text of the result, with a short description of each image and resource appended,
+// for use where only text can be shown.
+func (r ToolResult) TextWithFallback() string {
+	parts := make([]string, 0)
+	if r.Text != "" {
+		parts = append(parts, r.Text)
+	}
+	for _, img := range r.Images {
+		parts = append(parts, DescribeImage(img))
+	}
+	for _, res := range r.Resources {
+		parts = append(parts, DescribeResourceReference(res))
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// Describe an image in text, without its content.
+func DescribeImage(img Image) string {
+	return fmt.Sprintf("[image: %s, %s]", img.MIMEType, formatByteSize(len(img.Data)))
+}
+
+// Describe a resource reference in text.
+func DescribeResourceReference(res ResourceReference) string {
+	details := make([]string, 0)
+	if res.Name != "" {
+		details = append(details, res.Name)
+	}
+	if res.MIMEType != "" {
+		details = append(details, res.MIMEType)
+	}
+	if res.Description != "" {
+		details = append(details, res.Description)
+	}
+	if len(details) == 0 {
+		return fmt.Sprintf("[resource: %s]", res.URI)
+	}
+	return fmt.Sprintf("[resource: %s (%s)]", res.URI, strings.Join(details, ", "))
+}
+
+func formatByteSize(n int) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1fKB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
+
 func MapFuncTool[T any](mf jpf.MapFunc[T, string], name string, description []string) Tool {
 	return &mapFuncTool[T]{
 		mf:   mf,
@@ -33,13 +122,22 @@ type mapFuncTool[T any] struct {
 
 // Call implements Tool.
 func (m *mapFuncTool[T]) Call(args map[string]any) (string, error) {
+	res, err := m.CallContext(context.Background(), args)
+	return res.Text, err
+}
+
+// CallContext implements ContextTool.
+func (m *mapFuncTool[T]) CallContext(ctx context.Context, args map[string]any) (ToolResult, error) {
 	var typedArgs T
 	err := mapstructure.Decode(args, &typedArgs)
 	if err != nil {
-		return "", err
+		return ToolResult{}, err
+	}
+	result, _, err := m.mf.Call(ctx, typedArgs)
+	if err != nil {
+		return ToolResult{}, err
 	}
-	result, _, err := m.mf.Call(context.Background(), typedArgs)
-	return result, err
+	return ToolResult{Text: result}, nil
 }
 
 // Description implements Tool.
@@ -81,6 +179,33 @@ func (f *functionalTool) Name() string {
 	return f.name
 }
 
+// Create a tool from a function which stops once its context is cancelled.
+func FunctionalContextTool(do func(context.Context, map[string]any) (string, error), name string, description []string) Tool {
+	return &functionalContextTool{
+		functionalTool: functionalTool{name: name, desc: description},
+		do:             do,
+	}
+}
+
+type functionalContextTool struct {
+	functionalTool
+	do func(context.Context, map[string]any) (string, error)
+}
+
+// Call implements Tool.
+func (f *functionalContextTool) Call(args map[string]any) (string, error) {
+	return f.do(context.Background(), args)
+}
+
+// CallContext implements ContextTool.
+func (f *functionalContextTool) CallContext(ctx context.Context, args map[string]any) (ToolResult, error) {
+	text, err := f.do(ctx, args)
+	if err != nil {
+		return ToolResult{}, err
+	}
+	return ToolResult{Text: text}, nil
+}
+
 func AgentAsTool(buildAgent func() Agent, name string, description []string) Tool {
 	return &agentAsTool{buildAgent, name, description}
 }
@@ -93,12 +218,22 @@ type agentAsTool struct {
 
 // Call implements Tool.
 func (a *agentAsTool) Call(args map[string]any) (string, error) {
+	res, err := a.CallContext(context.Background(), args)
+	return res.Text, err
+}
+
+// CallContext implements ContextTool.
+func (a *agentAsTool) CallContext(ctx context.Context, args map[string]any) (ToolResult, error) {
 	buf := bytes.NewBuffer(nil)
 	err := json.NewEncoder(buf).Encode(args)
 	if err != nil {
-		return "", err
+		return ToolResult{}, err
+	}
+	answer, err := AnswerWithContext(ctx, a.buildAgent(), buf.String())
+	if err != nil {
+		return ToolResult{}, err
 	}
-	return a.buildAgent().Answer(buf.String())
+	return ToolResult{Text: answer}, nil
 }
 
 // Description implements Tool.
@@ -273,25 +408,30 @@ func (t *newAgentQuickQuestionTool) Description() []string {
 }
 
 func (t *newAgentQuickQuestionTool) Call(args map[string]any) (string, error) {
+	res, err := t.CallContext(context.Background(), args)
+	return res.Text, err
+}
+
+func (t *newAgentQuickQuestionTool) CallContext(ctx context.Context, args map[string]any) (ToolResult, error) {
 	queryRaw, ok := args["query"]
 	if !ok {
-		return "", fmt.Errorf("missing required argument: query")
+		return ToolResult{}, fmt.Errorf("missing required argument: query")
 	}
 	query, ok := queryRaw.(string)
 	if !ok {
-		return "", fmt.Errorf("query must be a string")
+		return ToolResult{}, fmt.Errorf("query must be a string")
 	}
 
 	// Build a fresh agent
 	agent := t.buildAgent()
 
 	// Ask the query and return the result
-	answer, err := agent.Answer(query)
+	answer, err := AnswerWithContext(ctx, agent, query)
 	if err != nil {
-		return "", err
+		return ToolResult{}, err
 	}
 
-	return answer, nil
+	return ToolResult{Text: answer}, nil
 }
 
 func NewScenarioRetrieverTool(scenarios map[string]Scenario) Tool {
@@ -460,8 +600,8 @@ func (t *readFileTool) Description() []string {
 }
 
 func NewExecuteCommandTool() Tool {
-	return FunctionalTool(
-		func(m map[string]any) (string, error) {
+	return FunctionalContextTool(
+		func(ctx context.Context, m map[string]any) (string, error) {
 			argsAny, ok := m["args"]
 			if !ok {
 				return "", errors.New("must specify 'args'")
@@ -488,7 +628,7 @@ func NewExecuteCommandTool() Tool {
 			if !ok {
 				return "", errors.New("must specify 'workdir' as a string (or not specify)")
 			}
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+			ctx, cancel := context.WithTimeout(ctx, time.Second*20)
 			defer cancel()
 			cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 			cmd.Dir = workDir
@@ -511,8 +651,8 @@ func NewExecuteCommandTool() Tool {
 }
 
 func NewCustomExecuteCommandTool(name string, description []string, commandPath string, commandArgs ...string) Tool {
-	return FunctionalTool(
-		func(m map[string]any) (string, error) {
+	return FunctionalContextTool(
+		func(ctx context.Context, m map[string]any) (string, error) {
 			workDirAny, ok := m["workdir"]
 			if !ok {
 				workDirAny = "."
@@ -525,7 +665,7 @@ func NewCustomExecuteCommandTool(name string, description []string, commandPath
 			for k, v := range m {
 				envVars[k] = fmt.Sprint(v)
 			}
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+			ctx, cancel := context.WithTimeout(ctx, time.Second*20)
 			defer cancel()
 			cmd := exec.CommandContext(ctx, commandPath, commandArgs...)
 			cmd.Dir = workDir